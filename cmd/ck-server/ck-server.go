@@ -161,6 +161,14 @@ func main() {
 		log.Fatalf("unable to initialise server state: %v", err)
 	}
 
+	if raw.SelfTest {
+		err = sta.SelfTest()
+		if err != nil {
+			log.Fatalf("handshake reply self test failed: %v", err)
+		}
+		log.Info("handshake reply self test passed")
+	}
+
 	listen := func(bindAddr net.Addr) {
 		listener, err := net.Listen("tcp", bindAddr.String())
 		log.Infof("Listening on %v", bindAddr)
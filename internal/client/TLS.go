@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/hmac"
 	"encoding/binary"
 	"github.com/cbeuw/Cloak/internal/common"
 	log "github.com/sirupsen/logrus"
@@ -73,14 +74,15 @@ func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 	log.Trace("client hello sent successfully")
 	tls.TLSConn = common.NewTLSConn(rawConn)
 
-	buf := make([]byte, 1024)
+	// the records of the server's encrypted flight may be as long as a real Certificate message
+	buf := make([]byte, appDataMaxLength)
 	log.Trace("waiting for ServerHello")
-	_, err = tls.Read(buf)
+	n, err := tls.Read(buf)
 	if err != nil {
 		return
 	}
 
-	encrypted := append(buf[6:38], buf[84:116]...)
+	encrypted := append(buf[6:38], serverHelloKeyExchange(buf, n)...)
 	nonce := encrypted[0:12]
 	ciphertextWithTag := encrypted[12:60]
 	sessionKeySlice, err := common.AESGCMDecrypt(nonce, sharedSecret[:], ciphertextWithTag)
@@ -89,8 +91,19 @@ func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 	}
 	copy(sessionKey[:], sessionKeySlice)
 
-	for i := 0; i < 2; i++ {
-		// ChangeCipherSpec and EncryptedCert (in the format of application data)
+	extra, deferred := deferredFlightRecords(encrypted[60:64], sessionKey[:])
+	if deferred {
+		// the server finishes its handshake only once it has what a TLS 1.2 client sends after ServerHelloDone
+		_, err = rawConn.Write(composeClientFlight())
+		if err != nil {
+			return
+		}
+	} else {
+		extra = extraFlightRecords(encrypted[60:64], sessionKey[:])
+	}
+	records := 2 + extra
+	for i := 0; i < records; i++ {
+		// ChangeCipherSpec and EncryptedCert (in the format of application data), which may be in several records
 		_, err = tls.Read(buf)
 		if err != nil {
 			return
@@ -99,3 +112,62 @@ func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 	return sessionKey, nil
 
 }
+
+// serverHelloKeyExchange is where in buf, with a ServerHello of length n read into it, the server put the 32 bytes
+// after its random that the client reads. In a TLS 1.3 ServerHello they're the start of the key exchange of the
+// key_share, its first extension after a 32 byte session id. A TLS 1.2 ServerHello has no key_share, so they're its
+// session id
+func serverHelloKeyExchange(buf []byte, n int) []byte {
+	if n >= 116 && buf[76] == 0x00 && buf[77] == 0x33 {
+		return buf[84:116]
+	}
+	return buf[39:71]
+}
+
+// extraFlightRecords finds out how many more ApplicationData records the server's encrypted flight has than the
+// usual one. tag is the last 4 bytes of the key_share in ServerHello, which are random if there are none
+func extraFlightRecords(tag []byte, sessionKey []byte) int {
+	for extra := 1; extra <= common.MaxExtraFlightRecords; extra++ {
+		if hmac.Equal(tag, common.FlightRecordsTag(sessionKey, extra)) {
+			return extra
+		}
+	}
+	return 0
+}
+
+// deferredFlightRecords finds out if tag is a DeferredFlightRecordsTag, and if so how many more ApplicationData
+// records than the usual one the server's encrypted flight has
+func deferredFlightRecords(tag []byte, sessionKey []byte) (extra int, deferred bool) {
+	for extra := 0; extra <= common.MaxExtraFlightRecords; extra++ {
+		if hmac.Equal(tag, common.DeferredFlightRecordsTag(sessionKey, extra)) {
+			return extra, true
+		}
+	}
+	return 0, false
+}
+
+const (
+	// x25519PublicKeyLength is the length of the ECDH public key in ClientKeyExchange
+	x25519PublicKeyLength = 32
+	// encryptedFinishedLength is the length of an AES-GCM encrypted TLS 1.2 Finished: an 8 byte explicit nonce, the
+	// handshake header, 12 bytes of verify_data and the tag
+	encryptedFinishedLength = 8 + 4 + 12 + 16
+)
+
+// composeClientFlight composes the ClientKeyExchange, ChangeCipherSpec and Finished records a TLS 1.2 client sends
+// after ServerHelloDone. The server doesn't look into them, so the key and Finished are random
+func composeClientFlight() []byte {
+	clientKeyExchange := make([]byte, 4+1+x25519PublicKeyLength)
+	clientKeyExchange[0] = 0x10
+	clientKeyExchange[3] = 1 + x25519PublicKeyLength
+	clientKeyExchange[4] = x25519PublicKeyLength
+	common.CryptoRandRead(clientKeyExchange[5:])
+	finished := make([]byte, encryptedFinishedLength)
+	common.CryptoRandRead(finished)
+
+	var flight []byte
+	flight = append(flight, common.AddRecordLayer(clientKeyExchange, common.Handshake, common.VersionTLS13)...)
+	flight = append(flight, common.AddRecordLayer([]byte{0x01}, common.ChangeCipherSpec, common.VersionTLS13)...)
+	flight = append(flight, common.AddRecordLayer(finished, common.Handshake, common.VersionTLS13)...)
+	return flight
+}
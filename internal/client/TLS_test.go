@@ -2,7 +2,9 @@ package client
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"github.com/cbeuw/Cloak/internal/common"
 	"testing"
 )
 
@@ -41,3 +43,84 @@ func TestMakeServerName(t *testing.T) {
 		}
 	}
 }
+
+func TestExtraFlightRecords(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	for _, extra := range []int{1, 3, common.MaxExtraFlightRecords} {
+		if got := extraFlightRecords(common.FlightRecordsTag(sessionKey, extra), sessionKey); got != extra {
+			t.Errorf("expecting %v extra records, got %v", extra, got)
+		}
+	}
+	// a server that sends the usual single record leaves random bytes here
+	if got := extraFlightRecords([]byte{0x12, 0x34, 0x56, 0x78}, sessionKey); got != 0 {
+		t.Errorf("expecting no extra records, got %v", got)
+	}
+}
+
+func TestDeferredFlightRecords(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	for _, extra := range []int{0, 3, common.MaxExtraFlightRecords} {
+		if got, deferred := deferredFlightRecords(common.DeferredFlightRecordsTag(sessionKey, extra), sessionKey); !deferred || got != extra {
+			t.Errorf("expecting %v deferred extra records, got %v, %v", extra, got, deferred)
+		}
+	}
+	if _, deferred := deferredFlightRecords(common.FlightRecordsTag(sessionKey, 3), sessionKey); deferred {
+		t.Error("FlightRecordsTag taken as deferred")
+	}
+}
+
+func TestComposeClientFlight(t *testing.T) {
+	flight := composeClientFlight()
+	var types []byte
+	for len(flight) > 0 {
+		if len(flight) < 5 {
+			t.Fatalf("incomplete record header %x", flight)
+		}
+		length := int(binary.BigEndian.Uint16(flight[3:5]))
+		if !bytes.Equal(flight[1:3], []byte{0x03, 0x03}) || len(flight) < 5+length {
+			t.Fatalf("malformed record %x", flight)
+		}
+		if flight[0] == common.Handshake && len(types) == 0 {
+			// ClientKeyExchange
+			body := flight[5 : 5+length]
+			if body[0] != 0x10 || int(body[3]) != length-4 || int(body[4]) != length-5 {
+				t.Errorf("malformed ClientKeyExchange %x", body)
+			}
+		}
+		types = append(types, flight[0])
+		flight = flight[5+length:]
+	}
+	if !bytes.Equal(types, []byte{common.Handshake, common.ChangeCipherSpec, common.Handshake}) {
+		t.Errorf("expecting ClientKeyExchange, ChangeCipherSpec and Finished, got record types %v", types)
+	}
+}
+
+func TestServerHelloKeyExchange(t *testing.T) {
+	keyExchange := make([]byte, 32)
+	common.CryptoRandRead(keyExchange)
+
+	// handshake header 4, version 2, random 32, session id 1 + 32, cipher suite 2, compression method 1
+	tls13 := make([]byte, 4+2+32+1+32+2+1)
+	tls13 = append(tls13, 0x00, 0x2e)                         // extensions length
+	tls13 = append(tls13, 0x00, 0x33, 0x00, 0x24, 0x00, 0x1d) // key_share of x25519
+	tls13 = append(tls13, 0x00, 0x20)
+	tls13 = append(tls13, keyExchange...)
+	tls13 = append(tls13, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04)
+	buf := make([]byte, 1024)
+	copy(buf, tls13)
+	if got := serverHelloKeyExchange(buf, len(tls13)); !bytes.Equal(got, keyExchange) {
+		t.Errorf("expecting the key exchange of the TLS 1.3 key_share %x, got %x", keyExchange, got)
+	}
+
+	tls12 := make([]byte, 4+2+32+1)
+	tls12[38] = 32
+	tls12 = append(tls12, keyExchange...)
+	tls12 = append(tls12, 0xc0, 0x2f, 0x00)
+	buf = make([]byte, 1024)
+	copy(buf, tls12)
+	if got := serverHelloKeyExchange(buf, len(tls12)); !bytes.Equal(got, keyExchange) {
+		t.Errorf("expecting the TLS 1.2 session id %x, got %x", keyExchange, got)
+	}
+}
@@ -7,7 +7,8 @@ import (
 )
 
 const (
-	UNORDERED_FLAG = 0x01 // 0000 0001
+	UNORDERED_FLAG   = 0x01 // 0000 0001
+	COMPRESSION_FLAG = 0x02 // 0000 0010
 )
 
 type authenticationPayload struct {
@@ -39,6 +40,9 @@ func makeAuthenticationPayload(authInfo AuthInfo) (ret authenticationPayload, sh
 	if authInfo.Unordered {
 		plaintext[41] |= UNORDERED_FLAG
 	}
+	if authInfo.Compression {
+		plaintext[41] |= COMPRESSION_FLAG
+	}
 
 	copy(sharedSecret[:], ecdh.GenerateSharedSecret(ephPv, authInfo.ServerPubKey))
 	ciphertextWithTag, _ := common.AESGCMEncrypt(ret.randPubKey[:12], sharedSecret[:], plaintext)
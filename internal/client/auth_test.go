@@ -2,7 +2,9 @@ package client
 
 import (
 	"bytes"
+	"crypto/rand"
 	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
 	"github.com/cbeuw/Cloak/internal/multiplex"
 	"testing"
 	"time"
@@ -73,3 +75,36 @@ func TestMakeAuthenticationPayload(t *testing.T) {
 		}()
 	}
 }
+
+func TestMakeAuthenticationPayload_Flags(t *testing.T) {
+	pv, pub, _ := ecdh.GenerateKey(rand.Reader)
+	for _, c := range []struct {
+		unordered   bool
+		compression bool
+		expFlag     byte
+	}{
+		{false, false, 0x00},
+		{true, false, UNORDERED_FLAG},
+		{false, true, COMPRESSION_FLAG},
+		{true, true, UNORDERED_FLAG | COMPRESSION_FLAG},
+	} {
+		authInfo := AuthInfo{
+			UID:          make([]byte, 16),
+			ProxyMethod:  "shadowsocks",
+			Unordered:    c.unordered,
+			Compression:  c.compression,
+			ServerPubKey: pub,
+			WorldState:   common.RealWorldState,
+		}
+		payload, _ := makeAuthenticationPayload(authInfo)
+		ephPub, _ := ecdh.Unmarshal(payload.randPubKey[:])
+		sharedSecret := ecdh.GenerateSharedSecret(pv, ephPub)
+		plaintext, err := common.AESGCMDecrypt(payload.randPubKey[:12], sharedSecret, payload.ciphertextWithTag[:])
+		if err != nil {
+			t.Fatalf("failed to decrypt payload: %v", err)
+		}
+		if plaintext[41] != c.expFlag {
+			t.Errorf("expecting flag %08b, got %08b", c.expFlag, plaintext[41])
+		}
+	}
+}
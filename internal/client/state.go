@@ -58,6 +58,7 @@ type AuthInfo struct {
 	ProxyMethod      string
 	EncryptionMethod byte
 	Unordered        bool
+	Compression      bool // not in RawConfig until streams can be compressed
 	ServerPubKey     crypto.PublicKey
 	MockDomain       string
 	WorldState       common.WorldState
@@ -3,7 +3,9 @@ package common
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"io"
 	"time"
@@ -48,6 +50,30 @@ func AESGCMDecrypt(nonce []byte, key []byte, ciphertext []byte) ([]byte, error)
 	return plain, nil
 }
 
+// MaxExtraFlightRecords is the most ApplicationData records a server may send in its handshake reply beyond the first
+const MaxExtraFlightRecords = 15
+
+// FlightRecordsTag is put by the server in place of the last 4 random bytes of the key_share in its ServerHello to
+// tell the client that the handshake reply has extra more ApplicationData records. Only those with the session key
+// can tell it apart from random bytes
+func FlightRecordsTag(sessionKey []byte, extra int) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("flight records"))
+	mac.Write([]byte{byte(extra)})
+	return mac.Sum(nil)[:4]
+}
+
+// DeferredFlightRecordsTag is put by the server in place of FlightRecordsTag to tell the client that the handshake
+// reply has extra more ApplicationData records, and that the server waits for the client's second flight of a TLS 1.2
+// handshake before it sends its ChangeCipherSpec. Unlike FlightRecordsTag, it's sent even if there are no extra
+// records
+func DeferredFlightRecordsTag(sessionKey []byte, extra int) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("deferred flight records"))
+	mac.Write([]byte{byte(extra)})
+	return mac.Sum(nil)[:4]
+}
+
 func CryptoRandRead(buf []byte) {
 	RandRead(rand.Reader, buf)
 }
@@ -14,8 +14,9 @@ const (
 
 	recordLayerLength = 5
 
-	Handshake       = 22
-	ApplicationData = 23
+	ChangeCipherSpec = 20
+	Handshake        = 22
+	ApplicationData  = 23
 
 	initialWriteBufSize = 14336
 )
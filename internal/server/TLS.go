@@ -7,61 +7,138 @@ import (
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/ecdh"
 	"io"
-	"math/rand"
 	"net"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const appDataMaxLength = 16401
 
-type TLS struct{}
+const (
+	replyWriteTimeout       = 10 * time.Second
+	replyWriteRetryInterval = 10 * time.Millisecond
+)
+
+type TLS struct {
+	// ParseOptions is how strictly ClientHellos are parsed. DefaultParseOptions is used if it's nil
+	ParseOptions *ParseOptions
+}
 
 var ErrBadClientHello = errors.New("non (or malformed) ClientHello")
 
+// ErrNoKeyShare is returned when a ClientHello carries no key_share extension, or one without an x25519 entry.
+// A Cloak client always sends an x25519 key_share, so such a ClientHello cannot be from Cloak. Whichever TLS versions
+// it supports, it's relayed to the redirection server as it is, which sends a TLS 1.3 client HelloRetryRequest and
+// answers a TLS 1.2 one with a TLS 1.2 ServerHello as it would for any other client. Cloak doesn't send a
+// HelloRetryRequest of its own for it
+var ErrNoKeyShare = errors.New("no x25519 key_share in ClientHello")
+
+var ErrClientGone = errors.New("client has gone away")
+
+var ErrReplyWriteTimeout = errors.New("timed out writing handshake reply")
+
+// ErrNoExtensions is returned when a ClientHello has no extensions. These are sent by TLS 1.0-era clients and
+// scanners, and can't be from a Cloak client
+var ErrNoExtensions = errors.New("no extensions in ClientHello")
+
 func (TLS) String() string { return "TLS" }
 
-func (TLS) processFirstPacket(clientHello []byte, privateKey crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
-	ch, err := parseClientHello(clientHello)
+// parseOptions are ParseOptions, or DefaultParseOptions if it's nil
+func (t TLS) parseOptions() ParseOptions {
+	if t.ParseOptions != nil {
+		return *t.ParseOptions
+	}
+	return DefaultParseOptions
+}
+
+func (t TLS) processFirstPacket(clientHello []byte, privateKey crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+	opts := t.parseOptions()
+	start := time.Now()
+	ch, err := parseClientHello(clientHello, opts)
+	parseDuration := time.Since(start)
+	if errors.Is(err, ErrHandshakeBudget) {
+		log.Debug(err)
+		err = ErrHandshakeBudget
+		return
+	}
 	if err != nil {
 		log.Debug(err)
 		err = ErrBadClientHello
 		return
 	}
 
-	fragments, err = TLS{}.unmarshalClientHello(ch, privateKey)
+	if len(ch.extensions) == 0 {
+		log.Debug("ClientHello without extensions, likely a probe")
+		err = ErrNoExtensions
+		return
+	}
+
+	fragments, err = t.unmarshalClientHello(ch, privateKey)
+	if errors.Is(err, ErrSmallOrderKeyShare) {
+		log.Debug(err)
+		err = ErrSmallOrderKeyShare
+		return
+	}
+	if errors.Is(err, ErrTooManyKeyShares) {
+		log.Debug(err)
+		err = ErrTooManyKeyShares
+		return
+	}
+	if errors.Is(err, ErrNoKeyShare) {
+		log.Debug(err)
+		return
+	}
 	if err != nil {
 		err = fmt.Errorf("failed to unmarshal ClientHello into authFragments: %v", err)
 		return
 	}
 
-	respond = TLS{}.makeResponder(ch.sessionId, fragments.sharedSecret)
+	// the key exchange is the costliest part, so it's checked for after it too
+	if opts.pastDeadline() {
+		err = ErrHandshakeBudget
+		return
+	}
+
+	fragments.clientHello = ch
+	fragments.parseDuration = parseDuration
+	respond = TLS{}.makeResponder(ch, fragments.sharedSecret)
 
 	return
 }
 
-func (TLS) makeResponder(clientHelloSessionId []byte, sharedSecret [32]byte) Responder {
-	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
-		// the cert length needs to be the same for all handshakes belonging to the same session
-		// we can use sessionKey as a seed here to ensure consistency
-		possibleCertLengths := []int{42, 27, 68, 59, 36, 44, 46}
-		rand.Seed(int64(sessionKey[0]))
-		cert := make([]byte, possibleCertLengths[rand.Intn(len(possibleCertLengths))])
-		common.RandRead(randSource, cert)
-
-		var nonce [12]byte
-		common.RandRead(randSource, nonce[:])
-		encryptedSessionKey, err := common.AESGCMEncrypt(nonce[:], sharedSecret[:], sessionKey[:])
+func (TLS) makeResponder(ch *ClientHello, sharedSecret [32]byte) Responder {
+	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader, composer ReplyComposer) (preparedConn net.Conn, err error) {
+		reply, err := composer.ComposeReply(ch, sharedSecret[:], sessionKey[:])
 		if err != nil {
+			err = fmt.Errorf("failed to compose TLS reply: %w", err)
+			originalConn.Close()
 			return
 		}
-		var encryptedSessionKeyArr [48]byte
-		copy(encryptedSessionKeyArr[:], encryptedSessionKey)
-
-		reply := composeReply(clientHelloSessionId, nonce, encryptedSessionKeyArr, cert)
-		_, err = originalConn.Write(reply)
+		if awaiter, ok := composer.(clientFinishedAwaiter); ok && awaiter.awaitsClientFinished() {
+			var first []byte
+			first, reply, err = splitAfterHandshakes(reply)
+			if err != nil {
+				err = fmt.Errorf("failed to compose TLS reply: %w", err)
+				originalConn.Close()
+				return
+			}
+			err = writeReply(originalConn, first)
+			if err != nil {
+				err = fmt.Errorf("failed to write TLS reply: %w", err)
+				originalConn.Close()
+				return
+			}
+			err = readClientFlight(originalConn)
+			if err != nil {
+				err = fmt.Errorf("failed to read client's second flight: %w", err)
+				originalConn.Close()
+				return
+			}
+		}
+		err = writeReply(originalConn, reply)
 		if err != nil {
-			err = fmt.Errorf("failed to write TLS reply: %v", err)
+			err = fmt.Errorf("failed to write TLS reply: %w", err)
 			originalConn.Close()
 			return
 		}
@@ -71,7 +148,40 @@ func (TLS) makeResponder(clientHelloSessionId []byte, sharedSecret [32]byte) Res
 	return respond
 }
 
-func (TLS) unmarshalClientHello(ch *ClientHello, staticPv crypto.PrivateKey) (fragments authFragments, err error) {
+// writeReply writes the whole of reply to conn. A client given only part of the reply can't proceed, so short
+// writes and temporary errors are retried until replyWriteTimeout has passed. If the client has gone away,
+// ErrClientGone is returned. A Write blocked by a client that doesn't read is only given up on if conn has a write
+// deadline, which the dispatcher sets, in which case ErrReplyWriteTimeout is returned as soon as it has passed
+func writeReply(conn net.Conn, reply []byte) error {
+	deadline := time.Now().Add(replyWriteTimeout)
+	for len(reply) > 0 {
+		n, err := conn.Write(reply)
+		reply = reply[n:]
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			if !ok || !netErr.Temporary() {
+				return fmt.Errorf("%w: %v", ErrClientGone, err)
+			}
+			// past the write deadline, every retry fails the same way
+			if netErr.Timeout() {
+				return fmt.Errorf("%w with %v bytes unwritten: %v", ErrReplyWriteTimeout, len(reply), err)
+			}
+			time.Sleep(replyWriteRetryInterval)
+		}
+		if len(reply) > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("%w with %v bytes unwritten, last error: %v", ErrReplyWriteTimeout, len(reply), err)
+		}
+	}
+	return nil
+}
+
+func (t TLS) unmarshalClientHello(ch *ClientHello, staticPv crypto.PrivateKey) (fragments authFragments, err error) {
+	keyShareExt, ok := ch.extensions[[2]byte{0x00, 0x33}]
+	if !ok || len(keyShareExt) == 0 {
+		err = ErrNoKeyShare
+		return
+	}
+
 	copy(fragments.randPubKey[:], ch.random)
 	ephPub, ok := ecdh.Unmarshal(fragments.randPubKey[:])
 	if !ok {
@@ -81,16 +191,26 @@ func (TLS) unmarshalClientHello(ch *ClientHello, staticPv crypto.PrivateKey) (fr
 
 	copy(fragments.sharedSecret[:], ecdh.GenerateSharedSecret(staticPv, ephPub))
 	var keyShare []byte
-	keyShare, err = parseKeyShare(ch.extensions[[2]byte{0x00, 0x33}])
+	keyShare, err = parseKeyShare(keyShareExt, t.parseOptions())
 	if err != nil {
 		return
 	}
 
-	ctxTag := append(ch.sessionId, keyShare...)
+	// sessionId shares its backing array with the rest of the ClientHello, so it mustn't be appended to in place
+	ctxTag := append(append([]byte{}, ch.sessionId...), keyShare...)
 	if len(ctxTag) != 64 {
 		err = fmt.Errorf("%v: %v", ErrCiphertextLength, len(ctxTag))
 		return
 	}
 	copy(fragments.ciphertextWithTag[:], ctxTag)
+
+	if alpnExt, ok := ch.extensions[[2]byte{0x00, 0x10}]; ok {
+		fragments.offeredALPN, err = parseALPN(alpnExt)
+		if err != nil {
+			// ALPN isn't part of authentication, so a bad one only means that none will be selected
+			log.Debug(err)
+			err = nil
+		}
+	}
 	return
 }
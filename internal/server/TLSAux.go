@@ -2,14 +2,22 @@ package server
 
 import (
 	"bytes"
+	"crypto/elliptic"
+	"crypto/md5"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // ClientHello contains every field in a ClientHello message
 type ClientHello struct {
+	recordVersion         []byte
 	handshakeType         byte
 	length                int
 	clientVersion         []byte
@@ -22,12 +30,71 @@ type ClientHello struct {
 	compressionMethods    []byte
 	extensionsLen         int
 	extensions            map[[2]byte][]byte
+	// extensionOrder is the types of the extensions in the order they appear in the ClientHello
+	extensionOrder [][2]byte
 }
 
+// maxSessionIdLength is the maximum length of legacy_session_id specified in RFC 8446
+const maxSessionIdLength = 32
+
 var u16 = binary.BigEndian.Uint16
 var u32 = binary.BigEndian.Uint32
 
-func parseExtensions(input []byte) (ret map[[2]byte][]byte, err error) {
+// DefaultMaxExtensions is the most extensions parsed in a ClientHello if it isn't configured. Browsers send around 20
+const DefaultMaxExtensions = 100
+
+// DefaultMaxKeyShares is the most key_share entries looked through if it isn't configured. Browsers send two or three
+const DefaultMaxKeyShares = 16
+
+var ErrTooManyExtensions = errors.New("too many extensions in ClientHello")
+var ErrTooManyKeyShares = errors.New("too many key_share entries in ClientHello")
+var ErrDuplicateExtension = errors.New("duplicate extension in ClientHello")
+var ErrExtensionsLength = errors.New("extensions length doesn't match the rest of ClientHello")
+var ErrCipherSuitesLength = errors.New("cipher suites length isn't a positive multiple of 2")
+
+// ErrHandshakeBudget is returned when a ClientHello takes longer than its ParseOptions.Deadline allows
+var ErrHandshakeBudget = errors.New("ClientHello took too long to handle")
+
+// ParseOptions controls how strictly a ClientHello is parsed. Anything they rule out makes the ClientHello malformed
+type ParseOptions struct {
+	// MaxExtensions is the most extensions parsed
+	MaxExtensions int
+	// MaxKeyShares, if positive, is the most entries looked through for the x25519 one in the key_share extension
+	MaxKeyShares int
+	// RejectDuplicateExtensions rules out two extensions of the same type, which RFC 8446 forbids. Otherwise the
+	// last of them is kept
+	RejectDuplicateExtensions bool
+	// StrictExtensionsLength rules out an extensions length field which doesn't match the length of the extensions
+	// that follow it. Otherwise the field is ignored
+	StrictExtensionsLength bool
+	// RejectSmallOrderKeyShares rules out an x25519 key_share which is one of the points of small order. A careful
+	// TLS server rejects these, as they force the shared secret to one of a few known values
+	RejectSmallOrderKeyShares bool
+	// Deadline, if not zero, is when a ClientHello still being parsed is given up on. It's checked after every
+	// extension against Now, or time.Now if Now is nil
+	Deadline time.Time
+	Now      func() time.Time
+}
+
+// pastDeadline checks if Deadline is set and has passed
+func (opts ParseOptions) pastDeadline() bool {
+	if opts.Deadline.IsZero() {
+		return false
+	}
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	return !now().Before(opts.Deadline)
+}
+
+// DefaultParseOptions are as lenient as the parser has always been, other than the limits on extensions and key_share
+// entries
+var DefaultParseOptions = ParseOptions{MaxExtensions: DefaultMaxExtensions, MaxKeyShares: DefaultMaxKeyShares}
+
+// parseExtensions returns the data of each extension by its type, as well as the types in the order they appear.
+// It stops with ErrTooManyExtensions once there are more than opts.MaxExtensions
+func parseExtensions(input []byte, opts ParseOptions) (ret map[[2]byte][]byte, order [][2]byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New("Malformed Extensions")
@@ -37,6 +104,9 @@ func parseExtensions(input []byte) (ret map[[2]byte][]byte, err error) {
 	totalLen := len(input)
 	ret = make(map[[2]byte][]byte)
 	for pointer < totalLen {
+		if len(order) == opts.MaxExtensions {
+			return nil, nil, fmt.Errorf("%w: more than %v", ErrTooManyExtensions, opts.MaxExtensions)
+		}
 		var typ [2]byte
 		copy(typ[:], input[pointer:pointer+2])
 		pointer += 2
@@ -44,12 +114,59 @@ func parseExtensions(input []byte) (ret map[[2]byte][]byte, err error) {
 		pointer += 2
 		data := input[pointer : pointer+length]
 		pointer += length
+		if _, dup := ret[typ]; dup && opts.RejectDuplicateExtensions {
+			return nil, nil, fmt.Errorf("%w: %x", ErrDuplicateExtension, typ)
+		}
 		ret[typ] = data
+		order = append(order, typ)
+		if opts.pastDeadline() {
+			return nil, nil, fmt.Errorf("%w: gave up after %v extensions", ErrHandshakeBudget, len(order))
+		}
 	}
-	return ret, err
+	return ret, order, err
 }
 
-func parseKeyShare(input []byte) (ret []byte, err error) {
+// ErrSmallOrderKeyShare is returned by parseKeyShare for an x25519 key_share of small order if
+// ParseOptions.RejectSmallOrderKeyShares is set
+var ErrSmallOrderKeyShare = errors.New("x25519 key_share is a point of small order")
+
+// x25519SmallOrderPoints are the encodings of the points of small order on Curve25519, which any multiple of is one
+// of the same few points. The top bit is ignored in X25519, so it's left out of these and of what's compared to them
+var x25519SmallOrderPoints = [][32]byte{
+	// 0
+	{},
+	// 1
+	{0x01},
+	// points of order 8
+	{0xe0, 0xeb, 0x7a, 0x7c, 0x3b, 0x41, 0xb8, 0xae, 0x16, 0x56, 0xe3, 0xfa, 0xf1, 0x9f, 0xc4, 0x6a,
+		0xda, 0x09, 0x8d, 0xeb, 0x9c, 0x32, 0xb1, 0xfd, 0x86, 0x62, 0x05, 0x16, 0x5f, 0x49, 0xb8, 0x00},
+	{0x5f, 0x9c, 0x95, 0xbc, 0xa3, 0x50, 0x8c, 0x24, 0xb1, 0xd0, 0xb1, 0x55, 0x9c, 0x83, 0xef, 0x5b,
+		0x04, 0x44, 0x5c, 0xc4, 0x58, 0x1c, 0x8e, 0x86, 0xd8, 0x22, 0x4e, 0xdd, 0xd0, 0x9f, 0x11, 0x57},
+	// p-1, p and p+1, which are -1, 0 and 1
+	{0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	{0xed, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	{0xee, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+}
+
+// isSmallOrderX25519 checks if a 32 byte x25519 public key is one of x25519SmallOrderPoints
+func isSmallOrderX25519(key []byte) bool {
+	var masked [32]byte
+	copy(masked[:], key)
+	masked[31] &= 0x7f
+	for _, point := range x25519SmallOrderPoints {
+		if masked == point {
+			return true
+		}
+	}
+	return false
+}
+
+// parseKeyShare returns the key exchange of the x25519 entry of a key_share extension. It stops with
+// ErrTooManyKeyShares if that isn't among the first opts.MaxKeyShares entries
+func parseKeyShare(input []byte, opts ParseOptions) (ret []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New("malformed key_share")
@@ -58,7 +175,10 @@ func parseKeyShare(input []byte) (ret []byte, err error) {
 	totalLen := int(u16(input[0:2]))
 	// 2 bytes "client key share length"
 	pointer := 2
-	for pointer < totalLen {
+	for entries := 0; pointer < totalLen; entries++ {
+		if opts.MaxKeyShares > 0 && entries == opts.MaxKeyShares {
+			return nil, fmt.Errorf("%w: no x25519 in the first %v", ErrTooManyKeyShares, opts.MaxKeyShares)
+		}
 		if bytes.Equal([]byte{0x00, 0x1d}, input[pointer:pointer+2]) {
 			// skip "key exchange length"
 			pointer += 2
@@ -67,7 +187,11 @@ func parseKeyShare(input []byte) (ret []byte, err error) {
 			if length != 32 {
 				return nil, fmt.Errorf("key share length should be 32, instead of %v", length)
 			}
-			return input[pointer : pointer+length], nil
+			ret = input[pointer : pointer+length]
+			if opts.RejectSmallOrderKeyShares && isSmallOrderX25519(ret) {
+				return nil, fmt.Errorf("%w: %x", ErrSmallOrderKeyShare, ret)
+			}
+			return ret, nil
 		}
 		pointer += 2
 		length := int(u16(input[pointer : pointer+2]))
@@ -75,7 +199,175 @@ func parseKeyShare(input []byte) (ret []byte, err error) {
 		_ = input[pointer : pointer+length]
 		pointer += length
 	}
-	return nil, errors.New("x25519 does not exist")
+	return nil, ErrNoKeyShare
+}
+
+// parseALPN returns the protocol names in an application_layer_protocol_negotiation extension
+func parseALPN(input []byte) (ret []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed application_layer_protocol_negotiation")
+		}
+	}()
+	totalLen := int(u16(input[0:2]))
+	pointer := 2
+	for pointer < totalLen+2 {
+		length := int(input[pointer])
+		pointer += 1
+		ret = append(ret, string(input[pointer:pointer+length]))
+		pointer += length
+	}
+	return
+}
+
+// serverName returns the host_name in the ClientHello's server_name extension, or an empty string if it has none
+func (ch *ClientHello) serverName() (name string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed server_name")
+		}
+	}()
+	sni, ok := ch.extensions[[2]byte{0x00, 0x00}]
+	if !ok || len(sni) == 0 {
+		return "", nil
+	}
+	listLen := int(u16(sni[0:2]))
+	pointer := 2
+	for pointer < listLen+2 {
+		nameType := sni[pointer]
+		pointer += 1
+		length := int(u16(sni[pointer : pointer+2]))
+		pointer += 2
+		if nameType == 0x00 {
+			return string(sni[pointer : pointer+length]), nil
+		}
+		pointer += length
+	}
+	return "", nil
+}
+
+// plausibleVersions checks if the record layer version and the client version are a combination real clients send.
+// TLS 1.3 and most TLS 1.2 clients send a record layer version of TLS 1.0 for compatibility and a client version of
+// TLS 1.2. The record layer version is never higher than the client version
+func (ch *ClientHello) plausibleVersions() bool {
+	if len(ch.recordVersion) != 2 || len(ch.clientVersion) != 2 {
+		return false
+	}
+	if ch.recordVersion[0] != 0x03 || ch.clientVersion[0] != 0x03 {
+		return false
+	}
+	recordMinor, clientMinor := ch.recordVersion[1], ch.clientVersion[1]
+	return recordMinor >= 0x01 && clientMinor <= 0x03 && recordMinor <= clientMinor
+}
+
+// offersSessionTicket checks if the ClientHello has a session_ticket extension, which it does if it supports TLS 1.2
+// session tickets, regardless of whether it has a ticket to resume with
+func (ch *ClientHello) offersSessionTicket() bool {
+	_, ok := ch.extensions[[2]byte{0x00, 0x23}]
+	return ok
+}
+
+// offeredALPN returns the protocols in the ClientHello's ALPN extension, or nil if it has none or a malformed one
+func (ch *ClientHello) offeredALPN() []string {
+	alpnExt, ok := ch.extensions[[2]byte{0x00, 0x10}]
+	if !ok {
+		return nil
+	}
+	protocols, err := parseALPN(alpnExt)
+	if err != nil {
+		return nil
+	}
+	return protocols
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, which is the MD5 hash in hex of its client version, cipher
+// suites, extension types, supported groups and elliptic curve point formats, with GREASE values left out.
+// Malformed supported_groups or ec_point_formats extensions are treated as empty
+func (ch *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(ch.ja3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ch *ClientHello) ja3String() string {
+	joinU16s := func(data []byte) string {
+		var values []string
+		for i := 0; i+1 < len(data); i += 2 {
+			if isGREASE(data[i : i+2]) {
+				continue
+			}
+			values = append(values, strconv.Itoa(int(u16(data[i:i+2]))))
+		}
+		return strings.Join(values, "-")
+	}
+
+	var extensionTypes []byte
+	for _, typ := range ch.extensionOrder {
+		extensionTypes = append(extensionTypes, typ[:]...)
+	}
+	var groups []byte
+	if supportedGroups := ch.extensions[[2]byte{0x00, 0x0a}]; innerLengthMatches(supportedGroups, 2) {
+		groups = supportedGroups[2:]
+	}
+	var pointFormats []string
+	if formats := ch.extensions[[2]byte{0x00, 0x0b}]; innerLengthMatches(formats, 1) {
+		for _, f := range formats[1:] {
+			pointFormats = append(pointFormats, strconv.Itoa(int(f)))
+		}
+	}
+
+	version := 0
+	if len(ch.clientVersion) == 2 {
+		version = int(u16(ch.clientVersion))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(version),
+		joinU16s(ch.cipherSuites),
+		joinU16s(extensionTypes),
+		joinU16s(groups),
+		strings.Join(pointFormats, "-"),
+	}, ",")
+}
+
+// requestsSCT checks if the ClientHello has a signed_certificate_timestamp extension, asking for the server's SCTs
+func (ch *ClientHello) requestsSCT() bool {
+	_, ok := ch.extensions[[2]byte{0x00, 0x12}]
+	return ok
+}
+
+// CertCompressionAlgs returns the certificate compression algorithms in the ClientHello's compress_certificate
+// extension, such as 2 for brotli, in the client's order of preference. It's nil if there's no such extension or it's
+// malformed
+func (ch *ClientHello) CertCompressionAlgs() []uint16 {
+	ext := ch.extensions[[2]byte{0x00, 0x1b}]
+	if !innerLengthMatches(ext, 1) || len(ext) < 3 || len(ext)%2 != 1 {
+		return nil
+	}
+	var algs []uint16
+	for i := 1; i < len(ext); i += 2 {
+		algs = append(algs, u16(ext[i:i+2]))
+	}
+	return algs
+}
+
+// delegatedCredentialSchemes returns the signature schemes in the ClientHello's delegated_credential extension, which
+// a delegated credential from the server must be signed with one of. It's nil if there's no such extension or it's
+// malformed
+func (ch *ClientHello) delegatedCredentialSchemes() []uint16 {
+	ext := ch.extensions[[2]byte{0x00, 0x22}]
+	if !innerLengthMatches(ext, 2) || len(ext) < 4 || len(ext)%2 != 0 {
+		return nil
+	}
+	var schemes []uint16
+	for i := 2; i < len(ext); i += 2 {
+		schemes = append(schemes, u16(ext[i:i+2]))
+	}
+	return schemes
+}
+
+// SupportsDelegatedCreds checks if the ClientHello has a well-formed delegated_credential extension, offering to
+// accept a delegated credential from the server
+func (ch *ClientHello) SupportsDelegatedCreds() bool {
+	return ch.delegatedCredentialSchemes() != nil
 }
 
 // addRecordLayer adds record layer to data
@@ -92,20 +384,39 @@ func addRecordLayer(input []byte, typ []byte, ver []byte) []byte {
 
 // parseClientHello parses everything on top of the TLS layer
 // (including the record layer) into ClientHello type
-func parseClientHello(data []byte) (ret *ClientHello, err error) {
+func parseClientHello(data []byte, opts ParseOptions) (ret *ClientHello, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New("Malformed ClientHello")
 		}
 	}()
 
-	if !bytes.Equal(data[0:3], []byte{0x16, 0x03, 0x01}) {
-		return ret, errors.New("wrong TLS1.3 handshake magic bytes")
+	// the record header, and the handshake header after it, are needed before any length can be worked out
+	if len(data) < 5 {
+		return ret, fmt.Errorf("%w: %v bytes is shorter than a record header", ErrBadClientHello, len(data))
 	}
+	if data[0] != 0x16 || data[1] != 0x03 {
+		return ret, errors.New("wrong TLS handshake magic bytes")
+	}
+	recordVersion := data[1:3]
 
 	peeled := make([]byte, len(data)-5)
 	copy(peeled, data[5:])
+	// a ClientHello fragmented over several records is put back together
+	if payloads, _, complete := handshakeFragments(data); complete && len(payloads) > 1 {
+		peeled = bytes.Join(payloads, nil)
+	}
+	if len(peeled) < 4 {
+		return ret, fmt.Errorf("%w: %v bytes after the record header is shorter than a handshake header", ErrBadClientHello, len(peeled))
+	}
 	pointer := 0
+	// need checks that n more bytes follow pointer
+	need := func(n int, field string) error {
+		if n < 0 || n > len(peeled)-pointer {
+			return fmt.Errorf("%w: %v of %v bytes, but %v bytes follow", ErrBadClientHello, field, n, len(peeled)-pointer)
+		}
+		return nil
+	}
 	// Handshake Type
 	handshakeType := peeled[pointer]
 	if handshakeType != 0x01 {
@@ -118,32 +429,60 @@ func parseClientHello(data []byte) (ret *ClientHello, err error) {
 	if length != len(peeled[pointer:]) {
 		return ret, errors.New("Hello length doesn't match")
 	}
-	// Client Version
+	// Client Version, Random and the length of Session ID
+	if err = need(2+32+1, "client version and random"); err != nil {
+		return
+	}
 	clientVersion := peeled[pointer : pointer+2]
 	pointer += 2
-	// Random
 	random := peeled[pointer : pointer+32]
 	pointer += 32
 	// Session ID
 	sessionIdLen := int(peeled[pointer])
+	if sessionIdLen > maxSessionIdLength {
+		return ret, fmt.Errorf("session id length %v is over %v", sessionIdLen, maxSessionIdLength)
+	}
 	pointer += 1
+	if err = need(sessionIdLen+2, "session id and cipher suites length"); err != nil {
+		return
+	}
 	sessionId := peeled[pointer : pointer+sessionIdLen]
 	pointer += sessionIdLen
 	// Cipher Suites
 	cipherSuitesLen := int(u16(peeled[pointer : pointer+2]))
 	pointer += 2
+	// each cipher suite is 2 bytes, and every real TLS stack offers at least one
+	if cipherSuitesLen == 0 || cipherSuitesLen%2 != 0 {
+		return ret, fmt.Errorf("%w: %v", ErrCipherSuitesLength, cipherSuitesLen)
+	}
+	if err = need(cipherSuitesLen+1, "cipher suites and compression methods length"); err != nil {
+		return
+	}
 	cipherSuites := peeled[pointer : pointer+cipherSuitesLen]
 	pointer += cipherSuitesLen
 	// Compression Methods
 	compressionMethodsLen := int(peeled[pointer])
 	pointer += 1
+	if err = need(compressionMethodsLen, "compression methods"); err != nil {
+		return
+	}
 	compressionMethods := peeled[pointer : pointer+compressionMethodsLen]
 	pointer += compressionMethodsLen
-	// Extensions
-	extensionsLen := int(u16(peeled[pointer : pointer+2]))
-	pointer += 2
-	extensions, err := parseExtensions(peeled[pointer:])
+	// Extensions, which can be left out altogether
+	var extensionsLen int
+	if pointer < len(peeled) {
+		if err = need(2, "extensions length"); err != nil {
+			return
+		}
+		extensionsLen = int(u16(peeled[pointer : pointer+2]))
+		pointer += 2
+		if opts.StrictExtensionsLength && extensionsLen != len(peeled)-pointer {
+			return ret, fmt.Errorf("%w: %v, but %v bytes follow", ErrExtensionsLength, extensionsLen, len(peeled)-pointer)
+		}
+	}
+	extensions, extensionOrder, err := parseExtensions(peeled[pointer:], opts)
 	ret = &ClientHello{
+		recordVersion,
 		handshakeType,
 		length,
 		clientVersion,
@@ -156,46 +495,557 @@ func parseClientHello(data []byte) (ret *ClientHello, err error) {
 		compressionMethods,
 		extensionsLen,
 		extensions,
+		extensionOrder,
 	}
 	return
 }
 
-func composeServerHello(sessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte) []byte {
-	var serverHello [11][]byte
-	serverHello[0] = []byte{0x02}                                             // handshake type
-	serverHello[1] = []byte{0x00, 0x00, 0x76}                                 // length 77
-	serverHello[2] = []byte{0x03, 0x03}                                       // server version
-	serverHello[3] = append(nonce[0:12], encryptedSessionKeyWithTag[0:20]...) // random 32 bytes
-	serverHello[4] = []byte{0x20}                                             // session id length 32
-	serverHello[5] = sessionId                                                // session id
-	serverHello[6] = []byte{0xc0, 0x30}                                       // cipher suite TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
-	serverHello[7] = []byte{0x00}                                             // compression method null
-	serverHello[8] = []byte{0x00, 0x2e}                                       // extensions length 46
-
-	keyShare := []byte{0x00, 0x33, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}
-	keyExchange := make([]byte, 32)
-	copy(keyExchange, encryptedSessionKeyWithTag[20:48])
-	common.CryptoRandRead(keyExchange[28:32])
-	serverHello[9] = append(keyShare, keyExchange...)
-
-	serverHello[10] = []byte{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04} // supported versions
-	var ret []byte
-	for _, s := range serverHello {
-		ret = append(ret, s...)
+// handshakeFragments returns the payloads of the Handshake records at the start of data which carry its first
+// handshake message, as a client or middlebox may fragment it over several, and how many bytes of data those records
+// take up. The message is complete if the payloads add up to at least the length in its header
+func handshakeFragments(data []byte) (payloads [][]byte, recordsLength int, complete bool) {
+	var message []byte
+	for len(data)-recordsLength >= 5 && data[recordsLength] == 0x16 {
+		length := int(u16(data[recordsLength+3 : recordsLength+5]))
+		// an empty fragment isn't allowed, and one that isn't all there can't be used yet
+		if length == 0 || recordsLength+5+length > len(data) {
+			break
+		}
+		payload := data[recordsLength+5 : recordsLength+5+length]
+		payloads = append(payloads, payload)
+		recordsLength += 5 + length
+		if len(message) < handshakeHeader {
+			message = append(message, payload...)
+		}
+		if len(message) >= handshakeHeader {
+			messageLength := handshakeHeader + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+			if recordsLength-5*len(payloads) >= messageLength {
+				return payloads, recordsLength, true
+			}
+		}
 	}
-	return ret
+	return payloads, recordsLength, false
+}
+
+var ErrIncompleteRecord = errors.New("incomplete TLS record")
+
+// splitRecords partitions data into TLS records, each with its record layer header, by their length fields. If data
+// ends with an incomplete record, the complete records before it are returned along with ErrIncompleteRecord
+func splitRecords(data []byte) (records [][]byte, err error) {
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return records, ErrIncompleteRecord
+		}
+		length := 5 + int(u16(data[3:5]))
+		if length > len(data) {
+			return records, ErrIncompleteRecord
+		}
+		records = append(records, data[:length])
+		data = data[length:]
+	}
+	return records, nil
 }
 
-// composeReply composes the ServerHello, ChangeCipherSpec and an ApplicationData messages
-// together with their respective record layers into one byte slice.
-func composeReply(clientHelloSessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte, cert []byte) []byte {
+// x25519Group is the named group of x25519, which Cloak clients always send a key_share of
+var x25519Group = [2]byte{0x00, 0x1d}
+
+// secp256r1Group is the named group of P-256
+var secp256r1Group = [2]byte{0x00, 0x17}
+
+// keyExchangeLengths is the length of the key exchange of the named groups a handshake reply can be given in. The
+// first 32 bytes of the key exchange carry what the client reads from the reply. That of x25519 and x448 is random
+// bytes with no structure, and that of secp256r1 is made a point on the curve by completeP256Point
+var keyExchangeLengths = map[[2]byte]int{
+	x25519Group:    32,
+	{0x00, 0x1e}:   56, // x448
+	secp256r1Group: 65, // uncompressed point
+}
+
+var ErrNoP256Point = errors.New("unable to make a P-256 point")
+
+// completeP256Point makes point, an uncompressed P-256 point of 0x04 followed by the x and y coordinates, one that is
+// on the curve. Only the last byte of x and the whole of y are changed, so the bytes the client reads are left as
+// they are. The last byte of x is tried from its value onwards until there is a y for it, which is the case for
+// about half of all x
+func completeP256Point(point []byte) error {
+	if len(point) != 65 || point[0] != 0x04 {
+		return fmt.Errorf("%w: %x isn't an uncompressed point", ErrNoP256Point, point)
+	}
+	params := elliptic.P256().Params()
+	three := big.NewInt(3)
+	x := new(big.Int)
+	ySquared := new(big.Int)
+	y := new(big.Int)
+	for i := 0; i < 256; i++ {
+		x.SetBytes(point[1:33])
+		if x.Cmp(params.P) < 0 {
+			// y² = x³ - 3x + b
+			ySquared.Exp(x, three, params.P)
+			ySquared.Sub(ySquared, new(big.Int).Mul(three, x))
+			ySquared.Add(ySquared, params.B)
+			ySquared.Mod(ySquared, params.P)
+			if y.ModSqrt(ySquared, params.P) != nil {
+				yBytes := y.Bytes()
+				for j := range point[33:] {
+					point[33+j] = 0
+				}
+				copy(point[65-len(yBytes):], yBytes)
+				return nil
+			}
+		}
+		point[32]++
+	}
+	return fmt.Errorf("%w: no y for any x starting with %x", ErrNoP256Point, point[1:32])
+}
+
+// serverHelloFields is what varies between the ServerHellos of the handshake replies
+type serverHelloFields struct {
+	// sessionId is usually that of the ClientHello, and so part of the buffer it was read into
+	sessionId                  []byte
+	nonce                      [12]byte
+	encryptedSessionKeyWithTag [48]byte
+	// keyShareGroup is the named group of the key_share, one of keyExchangeLengths
+	keyShareGroup [2]byte
+	// keyShareTail is the 29th to 32nd bytes of the key exchange, or random if it's nil
+	keyShareTail []byte
+	// sessionTicket adds an empty session_ticket extension to say that a NewSessionTicket will follow
+	sessionTicket bool
+	// sctList, if not nil, is sent in a signed_certificate_timestamp extension
+	sctList []byte
+	// tls12Extensions are the extensions of a TLS 1.2 ServerHello answering those of the ClientHello, from
+	// tls12ReplyExtensions
+	tls12Extensions []byte
+}
+
+// composeServerHello composes a ServerHello carrying the nonce and encryptedSessionKeyWithTag in its random and
+// key_share. The client reads them at fixed offsets, so they must stay where they are however the extensions vary.
+// The rest of the key exchange is read from randSource, and an error is returned rather than a ServerHello with
+// predictable bytes in it if that fails. The ServerHello is built in a slice of its own with everything in fields
+// copied into it, so the buffer the ClientHello was read into can be reused as soon as this returns. A profile with
+// TLS12ServerHello gets a ServerHello from composeServerHello12 instead
+func composeServerHello(fields serverHelloFields, profile ServerProfile, randSource io.Reader) ([]byte, error) {
+	if profile.TLS12ServerHello {
+		return composeServerHello12(fields, profile, randSource)
+	}
+	keyExchange := make([]byte, keyExchangeLengths[fields.keyShareGroup])
+	_, err := io.ReadFull(randSource, keyExchange)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get random bytes for key_share: %w", err)
+	}
+	copy(keyExchange, fields.encryptedSessionKeyWithTag[20:48])
+	if fields.keyShareTail != nil {
+		copy(keyExchange[28:32], fields.keyShareTail)
+	}
+	if fields.keyShareGroup == secp256r1Group {
+		err = completeP256Point(keyExchange)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var extensions []byte
+	// key share
+	extensions = append(extensions, 0x00, 0x33, byte((len(keyExchange)+4)>>8), byte(len(keyExchange)+4))
+	extensions = append(extensions, fields.keyShareGroup[:]...)
+	extensions = append(extensions, byte(len(keyExchange)>>8), byte(len(keyExchange)))
+	extensions = append(extensions, keyExchange...)
+	// supported versions
+	extensions = append(extensions, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04)
+	if fields.sessionTicket {
+		// empty session ticket
+		extensions = append(extensions, 0x00, 0x23, 0x00, 0x00)
+	}
+	if fields.sctList != nil {
+		extensions = append(extensions, 0x00, 0x12, byte(len(fields.sctList)>>8), byte(len(fields.sctList)))
+		extensions = append(extensions, fields.sctList...)
+	}
+
+	var body []byte
+	body = append(body, 0x03, 0x03)                                                             // server version
+	body = append(body, append(fields.nonce[:], fields.encryptedSessionKeyWithTag[0:20]...)...) // random 32 bytes
+	body = append(body, byte(len(fields.sessionId)))                                            // session id length
+	body = append(body, fields.sessionId...)                                                    // session id
+	body = append(body, byte(profile.CipherSuite>>8), byte(profile.CipherSuite))                // cipher suite
+	body = append(body, 0x00)                                                                   // compression method null
+	body = append(body, byte(len(extensions)>>8), byte(len(extensions)))                        // extensions length
+	body = append(body, extensions...)
+
+	return append([]byte{0x02, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...), nil
+}
+
+// tls12ReplyExtensions are the extensions a TLS 1.2 server answers in its ServerHello when the client offers them, with
+// the body it answers each with
+var tls12ReplyExtensions = []struct {
+	typ  [2]byte
+	body []byte
+}{
+	{[2]byte{0xff, 0x01}, []byte{0x00}},       // renegotiation_info, empty in an initial handshake
+	{[2]byte{0x00, 0x0b}, []byte{0x01, 0x00}}, // ec_point_formats, uncompressed only
+	{[2]byte{0x00, 0x17}, nil},                // extended_master_secret
+}
+
+// tls12Extensions are the extensions of tls12ReplyExtensions ch offers, as they are in a ServerHello. A client may
+// also ask for renegotiation_info with TLS_EMPTY_RENEGOTIATION_INFO_SCSV in its cipher suites
+func (ch *ClientHello) tls12Extensions() []byte {
+	var extensions []byte
+	for _, ext := range tls12ReplyExtensions {
+		_, ok := ch.extensions[ext.typ]
+		if ext.typ == [2]byte{0xff, 0x01} {
+			for i := 0; i+1 < len(ch.cipherSuites); i += 2 {
+				ok = ok || u16(ch.cipherSuites[i:i+2]) == 0x00ff
+			}
+		}
+		if ok {
+			extensions = append(extensions, ext.typ[0], ext.typ[1], byte(len(ext.body)>>8), byte(len(ext.body)))
+			extensions = append(extensions, ext.body...)
+		}
+	}
+	return extensions
+}
+
+// composeServerHello12 composes a TLS 1.2 ServerHello carrying the nonce and the first 20 bytes of
+// encryptedSessionKeyWithTag in its random, and the rest of it followed by keyShareTail in its 32 byte session id, which
+// a TLS 1.2 server makes up for a new session anyway. There's no key_share or supported_versions, and the extensions
+// block is left out altogether when there are no extensions, as TLS 1.2 allows
+func composeServerHello12(fields serverHelloFields, profile ServerProfile, randSource io.Reader) ([]byte, error) {
+	sessionId := make([]byte, freshSessionIdLength)
+	copy(sessionId, fields.encryptedSessionKeyWithTag[20:48])
+	if fields.keyShareTail != nil {
+		copy(sessionId[28:32], fields.keyShareTail)
+	} else {
+		_, err := io.ReadFull(randSource, sessionId[28:32])
+		if err != nil {
+			return nil, fmt.Errorf("failed to get random bytes for session id: %w", err)
+		}
+	}
+
+	extensions := append([]byte{}, fields.tls12Extensions...)
+	if fields.sessionTicket {
+		// empty session ticket
+		extensions = append(extensions, 0x00, 0x23, 0x00, 0x00)
+	}
+	if fields.sctList != nil {
+		extensions = append(extensions, 0x00, 0x12, byte(len(fields.sctList)>>8), byte(len(fields.sctList)))
+		extensions = append(extensions, fields.sctList...)
+	}
+
+	var body []byte
+	body = append(body, 0x03, 0x03)                                                             // server version
+	body = append(body, append(fields.nonce[:], fields.encryptedSessionKeyWithTag[0:20]...)...) // random 32 bytes
+	body = append(body, byte(len(sessionId)))                                                   // session id length
+	body = append(body, sessionId...)                                                           // session id
+	body = append(body, byte(profile.CipherSuite>>8), byte(profile.CipherSuite))                // cipher suite
+	body = append(body, 0x00)                                                                   // compression method null
+	if len(extensions) > 0 {
+		body = append(body, byte(len(extensions)>>8), byte(len(extensions))) // extensions length
+		body = append(body, extensions...)
+	}
+
+	return append([]byte{0x02, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...), nil
+}
+
+const (
+	// sessionTicketLifetime is the ticket_lifetime_hint in seconds of a NewSessionTicket
+	sessionTicketLifetime = 7200
+	// sessionTicketLength is the length of the ticket in a NewSessionTicket, which is about that of tickets
+	// issued by common TLS 1.2 servers
+	sessionTicketLength = 192
+)
+
+// composeNewSessionTicket composes a TLS 1.2 NewSessionTicket handshake message with a random ticket
+func composeNewSessionTicket(randSource io.Reader) ([]byte, error) {
+	ticket := make([]byte, sessionTicketLength)
+	_, err := io.ReadFull(randSource, ticket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get random bytes for session ticket: %w", err)
+	}
+
+	body := make([]byte, 6)
+	binary.BigEndian.PutUint32(body[0:4], sessionTicketLifetime)
+	binary.BigEndian.PutUint16(body[4:6], uint16(len(ticket)))
+	body = append(body, ticket...)
+	return append([]byte{0x04, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...), nil
+}
+
+var ErrTLS12Flight = errors.New("invalid TLS 1.2 flight")
+
+// minCertificateLength is the length of the header of a DER SEQUENCE with a 2 byte length, which a certificate of a
+// TLS12Flight starts with
+const minCertificateLength = 4
+
+// compose12Flight composes the Certificate, ServerKeyExchange and ServerHelloDone handshake messages of a TLS 1.2
+// server in the shape of flight. Each certificate is a DER SEQUENCE of random bytes, and ServerKeyExchange has a
+// random point in keyShareGroup, the group of the key_share in the ServerHello, with a random signature
+func compose12Flight(flight TLS12Flight, keyShareGroup [2]byte, randSource io.Reader) ([][]byte, error) {
+	var chain []byte
+	for _, length := range flight.CertificateLengths {
+		if length < minCertificateLength || length > 0xffff {
+			return nil, fmt.Errorf("%w: certificate length %v", ErrTLS12Flight, length)
+		}
+		cert := make([]byte, length)
+		_, err := io.ReadFull(randSource, cert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get random bytes for certificate: %w", err)
+		}
+		cert[0], cert[1] = 0x30, 0x82
+		binary.BigEndian.PutUint16(cert[2:4], uint16(length-minCertificateLength))
+		chain = append(chain, byte(length>>16), byte(length>>8), byte(length))
+		chain = append(chain, cert...)
+	}
+	certificate := append([]byte{byte(len(chain) >> 16), byte(len(chain) >> 8), byte(len(chain))}, chain...)
+
+	if flight.SignatureLength <= 0 || flight.SignatureLength > 0xffff {
+		return nil, fmt.Errorf("%w: signature length %v", ErrTLS12Flight, flight.SignatureLength)
+	}
+	// the point and then the signature
+	random := make([]byte, keyExchangeLengths[keyShareGroup]+flight.SignatureLength)
+	_, err := io.ReadFull(randSource, random)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get random bytes for ServerKeyExchange: %w", err)
+	}
+	point, signature := random[:keyExchangeLengths[keyShareGroup]], random[keyExchangeLengths[keyShareGroup]:]
+	if keyShareGroup == secp256r1Group {
+		point[0] = 0x04
+		err = completeP256Point(point)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var keyExchange []byte
+	keyExchange = append(keyExchange, 0x03)                // curve type named_curve
+	keyExchange = append(keyExchange, keyShareGroup[:]...) // named curve
+	keyExchange = append(keyExchange, byte(len(point)))
+	keyExchange = append(keyExchange, point...)
+	keyExchange = append(keyExchange, byte(flight.SignatureAlgorithm>>8), byte(flight.SignatureAlgorithm))
+	keyExchange = append(keyExchange, byte(len(signature)>>8), byte(len(signature)))
+	keyExchange = append(keyExchange, signature...)
+
+	messages := [][]byte{
+		handshakeMessage(0x0b, certificate),
+		handshakeMessage(0x0c, keyExchange),
+		handshakeMessage(0x0e, nil), // ServerHelloDone
+	}
+	for _, message := range messages {
+		// each message is sent in a record of its own
+		if len(message) > maxTLSRecordLength {
+			return nil, fmt.Errorf("%w: handshake message of length %v is too long for a record", ErrTLS12Flight, len(message))
+		}
+	}
+	return messages, nil
+}
+
+// handshakeMessage puts the handshake header of msgType on body
+func handshakeMessage(msgType byte, body []byte) []byte {
+	return append([]byte{msgType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+const (
+	// sctCount is the number of SCTs sent, which is what most certificates have
+	sctCount = 2
+	// maxSCTAge is how long ago an SCT may have been issued
+	maxSCTAge = 365 * 24 * time.Hour
+)
+
+// composeSCTList composes a SignedCertificateTimestampList of sctCount SCTs from random logs, issued at random times
+// in the year before now, each with an ECDSA signature of random bytes
+func composeSCTList(randSource io.Reader, now time.Time) ([]byte, error) {
+	var list []byte
+	for i := 0; i < sctCount; i++ {
+		// 3 bytes for the signature length and the age, then the log id and the longest signature
+		random := make([]byte, 3+32+72)
+		_, err := io.ReadFull(randSource, random)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get random bytes for SCT: %w", err)
+		}
+		// a DER encoded ECDSA P-256 signature is 70 to 72 bytes long
+		signatureLength := 70 + int(random[0])%3
+		age := maxSCTAge / (1 << 16) * time.Duration(u16(random[1:3]))
+
+		var sct []byte
+		sct = append(sct, 0x00)            // version v1
+		sct = append(sct, random[3:35]...) // log id
+		timestamp := make([]byte, 8)
+		binary.BigEndian.PutUint64(timestamp, uint64(now.Add(-age).UnixNano()/int64(time.Millisecond)))
+		sct = append(sct, timestamp...)
+		sct = append(sct, 0x00, 0x00) // no extensions
+		sct = append(sct, 0x04, 0x03) // SHA-256 and ECDSA
+		signature := random[35 : 35+signatureLength]
+		sct = append(sct, byte(len(signature)>>8), byte(len(signature)))
+		sct = append(sct, signature...)
+
+		list = append(list, byte(len(sct)>>8), byte(len(sct)))
+		list = append(list, sct...)
+	}
+	return append([]byte{byte(len(list) >> 8), byte(len(list))}, list...), nil
+}
+
+// helloRetryRequestRandom is the random of a HelloRetryRequest, which is SHA-256 of "HelloRetryRequest"
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// composeHelloRetryRequest composes a HelloRetryRequest asking the client to send a key_share of group.
+// A HelloRetryRequest is a ServerHello with a fixed random, and its key_share extension only has the selected group.
+// cipherSuite must be a TLS 1.3 cipher suite
+func composeHelloRetryRequest(sessionId []byte, cipherSuite uint16, group [2]byte) []byte {
+	extensions := []byte{
+		0x00, 0x2b, 0x00, 0x02, 0x03, 0x04, // supported versions
+		0x00, 0x33, 0x00, 0x02, group[0], group[1], // key share with only the selected group
+	}
+
+	var body []byte
+	body = append(body, 0x03, 0x03) // server version
+	body = append(body, helloRetryRequestRandom...)
+	body = append(body, byte(len(sessionId)))
+	body = append(body, sessionId...)
+	body = append(body, byte(cipherSuite>>8), byte(cipherSuite))
+	body = append(body, 0x00) // compression method null
+	body = append(body, byte(len(extensions)>>8), byte(len(extensions)))
+	body = append(body, extensions...)
+
+	ret := []byte{0x02, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(ret, body...)
+}
+
+// composeReply composes the ServerHello, ChangeCipherSpec if changeCipherSpec is set, and the encrypted flight, each
+// of whose records has one of flight as its payload. Each of handshakes, such as the messages of a TLS12Flight or a
+// NewSessionTicket, is sent in a Handshake record of its own between the ServerHello and ChangeCipherSpec, as a TLS
+// 1.2 server does
+func composeReply(fields serverHelloFields, handshakes [][]byte, changeCipherSpec bool, flight [][]byte, profile ServerProfile, randSource io.Reader) ([]byte, error) {
 	TLS12 := []byte{0x03, 0x03}
-	sh := composeServerHello(clientHelloSessionId, nonce, encryptedSessionKeyWithTag)
-	shBytes := addRecordLayer(sh, []byte{0x16}, TLS12)
-	ccsBytes := addRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
+	sh, err := composeServerHello(fields, profile, randSource)
+	if err != nil {
+		return nil, err
+	}
 
-	encryptedCertBytes := addRecordLayer(cert, []byte{0x17}, TLS12)
-	ret := append(shBytes, ccsBytes...)
-	ret = append(ret, encryptedCertBytes...)
-	return ret
+	ret := addRecordLayer(sh, []byte{0x16}, TLS12)
+	for _, handshake := range handshakes {
+		ret = append(ret, addRecordLayer(handshake, []byte{0x16}, TLS12)...)
+	}
+	if changeCipherSpec {
+		ret = append(ret, addRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)...)
+	}
+	for _, record := range flight {
+		ret = append(ret, addRecordLayer(record, []byte{0x17}, TLS12)...)
+	}
+	return ret, nil
+}
+
+// ECHKind is the kind of encrypted_client_hello extension a ClientHello carries
+type ECHKind int
+
+const (
+	ECHNone ECHKind = iota
+	// ECHGrease is a well-formed outer encrypted_client_hello whose config_id is not one we know of. A real
+	// ECH-aware server treats it the same way as a GREASE placeholder
+	ECHGrease
+	// ECHReal is a well-formed outer encrypted_client_hello whose config_id is one we know of
+	ECHReal
+)
+
+var ErrMalformedECH = errors.New("malformed encrypted_client_hello")
+
+// ECHType finds out what kind of encrypted_client_hello extension the ClientHello has. GREASE and real ECH are
+// designed to be indistinguishable on the wire, so the only way to tell them apart is whether the config_id is
+// one of knownConfigIds, the ids of the ECHConfigs published by the server we mimic
+func (ch *ClientHello) ECHType(knownConfigIds []byte) (kind ECHKind, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			kind, err = ECHNone, ErrMalformedECH
+		}
+	}()
+
+	ech, ok := ch.extensions[[2]byte{0xfe, 0x0d}]
+	if !ok {
+		return ECHNone, nil
+	}
+	const (
+		outer = 0x00
+		inner = 0x01
+	)
+	switch ech[0] {
+	case outer:
+		// 1 byte type, 2 bytes kdf id, 2 bytes aead id
+		pointer := 5
+		configId := ech[pointer]
+		pointer += 1
+		encLen := int(u16(ech[pointer : pointer+2]))
+		pointer += 2
+		_ = ech[pointer : pointer+encLen]
+		pointer += encLen
+		payloadLen := int(u16(ech[pointer : pointer+2]))
+		pointer += 2
+		if payloadLen == 0 || pointer+payloadLen != len(ech) {
+			return ECHNone, ErrMalformedECH
+		}
+		if bytes.IndexByte(knownConfigIds, configId) != -1 {
+			return ECHReal, nil
+		}
+		return ECHGrease, nil
+	case inner:
+		// the inner variant is only ever sent inside the encrypted ClientHelloInner
+		return ECHNone, fmt.Errorf("%w: inner encrypted_client_hello in the outer ClientHello", ErrMalformedECH)
+	default:
+		return ECHNone, ErrMalformedECH
+	}
+}
+
+// PSKIdentity is an entry in the identities of a pre_shared_key extension
+type PSKIdentity struct {
+	Identity            []byte
+	ObfuscatedTicketAge uint32
+}
+
+var ErrMalformedPSK = errors.New("malformed pre_shared_key")
+
+// PSKIdentities parses the identities in the ClientHello's pre_shared_key extension, or returns nil if there isn't
+// one. The extension ends with the binders, one for each identity, which are checked to fill it exactly
+func (ch *ClientHello) PSKIdentities() (identities []PSKIdentity, err error) {
+	psk, ok := ch.extensions[[2]byte{0x00, 0x29}]
+	if !ok {
+		return nil, nil
+	}
+	if len(psk) < 2 {
+		return nil, ErrMalformedPSK
+	}
+	identitiesLen := int(u16(psk[0:2]))
+	if identitiesLen < 7 || identitiesLen > len(psk)-2 {
+		return nil, ErrMalformedPSK
+	}
+	list := psk[2 : 2+identitiesLen]
+	for len(list) > 0 {
+		if len(list) < 2 {
+			return nil, ErrMalformedPSK
+		}
+		length := int(u16(list[0:2]))
+		// identity and obfuscated_ticket_age of 4 bytes
+		if length == 0 || length+4 > len(list)-2 {
+			return nil, ErrMalformedPSK
+		}
+		identities = append(identities, PSKIdentity{
+			Identity:            list[2 : 2+length],
+			ObfuscatedTicketAge: u32(list[2+length : 2+length+4]),
+		})
+		list = list[2+length+4:]
+	}
+
+	binders := psk[2+identitiesLen:]
+	if len(binders) < 2 || int(u16(binders[0:2])) != len(binders)-2 {
+		return nil, ErrMalformedPSK
+	}
+	binders = binders[2:]
+	var binderCount int
+	for len(binders) > 0 {
+		length := int(binders[0])
+		if length < 32 || length > len(binders)-1 {
+			return nil, ErrMalformedPSK
+		}
+		binders = binders[1+length:]
+		binderCount++
+	}
+	if binderCount != len(identities) {
+		return nil, fmt.Errorf("%w: %v identities but %v binders", ErrMalformedPSK, len(identities), binderCount)
+	}
+	return identities, nil
 }
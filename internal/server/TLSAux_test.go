@@ -2,14 +2,25 @@ package server
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseClientHello(t *testing.T) {
 	t.Run("good Cloak ClientHello", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc03034986187cfaf4c55866a0d9b68f82505fd694a3f0fbf21ca3dcf260baad91d75e20c10e2d2c66f4f9366296678550ed769aa0c41cae7e5f480f59bd929b747ee48d0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00208d7d5a544a72e67adb1bacde46aa147b086f714c073f8335688dc13b2a032986001700414e06fb9a27480a93159f3d6273afebb4d307c4a734d7107d883b6edacb58f7d289a95ad8aaedef1b5f76fe09267a14e6bee2b6db4506b43cf0a410a4645105f79f002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		ch, err := parseClientHello(chBytes)
+		ch, err := parseClientHello(chBytes, DefaultParseOptions)
 		if err != nil {
 			t.Errorf("Expecting no error, got %v", err)
 			return
@@ -21,7 +32,7 @@ func TestParseClientHello(t *testing.T) {
 	})
 	t.Run("Malformed ClientHello", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc03034986187cfaf4c55866a0d9b68f82505fd694a3f0fb2f21ca3dcf260baad91d75e20c10e2d2c66f4f9366296678550ed769aa0c41cae7e5f480f59bd929b747ee48d0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00208d7d5a544a72e67adb1bacde46aa147b086f714c073f8335688dc13b2a032986001700414e06fb9a27480a93159f3d6273afebb4d307c4a734d7107d883b6edacb58f7d289a95ad8aaedef1b5f76fe09267a14e6bee2b6db4506b43cf0a410a4645105f79f002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		_, err := parseClientHello(chBytes)
+		_, err := parseClientHello(chBytes, DefaultParseOptions)
 		if err == nil {
 			t.Error("expecting Malformed ClientHello, got no error")
 			return
@@ -29,7 +40,7 @@ func TestParseClientHello(t *testing.T) {
 	})
 	t.Run("not Handshake", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("ff03010200010001fc03034986187cfaf4c55866a0d9b68f82505fd694a3f0fbf21ca3dcf260baad91d75e20c10e2d2c66f4f9366296678550ed769aa0c41cae7e5f480f59bd929b747ee48d0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00208d7d5a544a72e67adb1bacde46aa147b086f714c073f8335688dc13b2a032986001700414e06fb9a27480a93159f3d6273afebb4d307c4a734d7107d883b6edacb58f7d289a95ad8aaedef1b5f76fe09267a14e6bee2b6db4506b43cf0a410a4645105f79f002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		_, err := parseClientHello(chBytes)
+		_, err := parseClientHello(chBytes, DefaultParseOptions)
 		if err == nil {
 			t.Error("not a tls handshake, got no error")
 			return
@@ -37,18 +48,992 @@ func TestParseClientHello(t *testing.T) {
 	})
 	t.Run("wrong TLS record layer version", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("16ff010200010001fc03034986187cfaf4c55866a0d9b68f82505fd694a3f0fbf21ca3dcf260baad91d75e20c10e2d2c66f4f9366296678550ed769aa0c41cae7e5f480f59bd929b747ee48d0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00208d7d5a544a72e67adb1bacde46aa147b086f714c073f8335688dc13b2a032986001700414e06fb9a27480a93159f3d6273afebb4d307c4a734d7107d883b6edacb58f7d289a95ad8aaedef1b5f76fe09267a14e6bee2b6db4506b43cf0a410a4645105f79f002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		_, err := parseClientHello(chBytes)
+		_, err := parseClientHello(chBytes, DefaultParseOptions)
 		if err == nil {
 			t.Error("wrong version, got no error")
 			return
 		}
 	})
+	t.Run("32 byte session id", func(t *testing.T) {
+		tch := newTestClientHello()
+		tch.sessionId = make([]byte, 32)
+		_, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+		if err != nil {
+			t.Errorf("expecting no error, got %v", err)
+		}
+	})
+	t.Run("33 byte session id", func(t *testing.T) {
+		tch := newTestClientHello()
+		tch.sessionId = make([]byte, 33)
+		_, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+		if err == nil {
+			t.Error("session id over 32 bytes, got no error")
+		}
+	})
+	t.Run("255 byte session id", func(t *testing.T) {
+		tch := newTestClientHello()
+		tch.sessionId = make([]byte, 255)
+		_, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+		if err == nil {
+			t.Error("session id over 32 bytes, got no error")
+		}
+	})
 	t.Run("TLS 1.2", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("16030300bd010000b903035d5741ed86719917a932db1dc59a22c7166bf90f5bd693564341d091ffbac5db00002ac02cc02bc030c02f009f009ec024c023c028c027c00ac009c014c013009d009c003d003c0035002f000a0100006600000022002000001d6e61762e736d61727473637265656e2e6d6963726f736f66742e636f6d000500050100000000000a00080006001d00170018000b00020100000d001400120401050102010403050302030202060106030023000000170000ff01000100")
-		_, err := parseClientHello(chBytes)
-		if err == nil {
-			t.Error("wrong version, got no error")
+		ch, err := parseClientHello(chBytes, DefaultParseOptions)
+		if err != nil {
+			t.Errorf("failed to parse TLS 1.2 ClientHello: %v", err)
 			return
 		}
+		if !bytes.Equal(ch.recordVersion, []byte{0x03, 0x03}) {
+			t.Errorf("wrong record version %x", ch.recordVersion)
+		}
+		pv, _, _ := ecdh.GenerateKey(rand.Reader)
+		_, _, err = TLS{}.processFirstPacket(chBytes, pv)
+		if err == nil {
+			t.Error("TLS 1.2 ClientHello can't be from a Cloak client, got no error")
+		}
+	})
+}
+
+type testExtension struct {
+	typ  [2]byte
+	data []byte
+}
+
+// testClientHello is used to compose ClientHellos with particular fields for testing
+type testClientHello struct {
+	clientVersion      []byte
+	random             []byte
+	sessionId          []byte
+	cipherSuites       []byte
+	compressionMethods []byte
+	extensions         []testExtension
+}
+
+func newTestClientHello() testClientHello {
+	random := make([]byte, 32)
+	sessionId := make([]byte, 32)
+	common.CryptoRandRead(random)
+	common.CryptoRandRead(sessionId)
+	keyShare := make([]byte, 32)
+	common.CryptoRandRead(keyShare)
+	return testClientHello{
+		clientVersion:      []byte{0x03, 0x03},
+		random:             random,
+		sessionId:          sessionId,
+		cipherSuites:       []byte{0x13, 0x01, 0x13, 0x02, 0x13, 0x03, 0xc0, 0x2b, 0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30},
+		compressionMethods: []byte{0x00},
+		extensions: []testExtension{
+			{[2]byte{0x00, 0x00}, append([]byte{0x00, 0x0e, 0x00, 0x00, 0x0b}, "example.com"...)},
+			{[2]byte{0x00, 0x0a}, []byte{0x00, 0x04, 0x00, 0x1d, 0x00, 0x17}},
+			{[2]byte{0x00, 0x33}, append([]byte{0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}, keyShare...)},
+			{[2]byte{0x00, 0x2b}, []byte{0x04, 0x03, 0x04, 0x03, 0x03}},
+		},
+	}
+}
+
+func (tch testClientHello) withoutExtension(typ [2]byte) testClientHello {
+	var exts []testExtension
+	for _, ext := range tch.extensions {
+		if ext.typ != typ {
+			exts = append(exts, ext)
+		}
+	}
+	tch.extensions = exts
+	return tch
+}
+
+func (tch testClientHello) withExtension(typ [2]byte, data []byte) testClientHello {
+	tch = tch.withoutExtension(typ)
+	tch.extensions = append(tch.extensions, testExtension{typ, data})
+	return tch
+}
+
+// marshal composes the ClientHello together with its record layer
+func (tch testClientHello) marshal() []byte {
+	var exts []byte
+	for _, ext := range tch.extensions {
+		exts = append(exts, ext.typ[:]...)
+		exts = append(exts, byte(len(ext.data)>>8), byte(len(ext.data)))
+		exts = append(exts, ext.data...)
+	}
+
+	var body []byte
+	body = append(body, tch.clientVersion...)
+	body = append(body, tch.random...)
+	body = append(body, byte(len(tch.sessionId)))
+	body = append(body, tch.sessionId...)
+	body = append(body, byte(len(tch.cipherSuites)>>8), byte(len(tch.cipherSuites)))
+	body = append(body, tch.cipherSuites...)
+	body = append(body, byte(len(tch.compressionMethods)))
+	body = append(body, tch.compressionMethods...)
+	body = append(body, byte(len(exts)>>8), byte(len(exts)))
+	body = append(body, exts...)
+
+	hs := append([]byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	return addRecordLayer(hs, []byte{0x16}, []byte{0x03, 0x01})
+}
+
+func TestClientHelloWithoutKeyShare(t *testing.T) {
+	pv, _, _ := ecdh.GenerateKey(rand.Reader)
+
+	t.Run("TLS 1.3 without key_share", func(t *testing.T) {
+		chBytes := newTestClientHello().withoutExtension([2]byte{0x00, 0x33}).marshal()
+		_, _, err := TLS{}.processFirstPacket(chBytes, pv)
+		if !errors.Is(err, ErrNoKeyShare) {
+			t.Errorf("expecting %v, got %v", ErrNoKeyShare, err)
+		}
+	})
+
+	t.Run("TLS 1.3 with empty key_share", func(t *testing.T) {
+		chBytes := newTestClientHello().withExtension([2]byte{0x00, 0x33}, []byte{0x00, 0x00}).marshal()
+		_, _, err := TLS{}.processFirstPacket(chBytes, pv)
+		if !errors.Is(err, ErrNoKeyShare) {
+			t.Errorf("expecting %v, got %v", ErrNoKeyShare, err)
+		}
+	})
+
+	t.Run("TLS 1.3 with key_share without x25519", func(t *testing.T) {
+		p256 := make([]byte, 65)
+		keyShare := append([]byte{0x00, 0x45, 0x00, 0x17, 0x00, 0x41}, p256...)
+		chBytes := newTestClientHello().withExtension([2]byte{0x00, 0x33}, keyShare).marshal()
+		_, _, err := TLS{}.processFirstPacket(chBytes, pv)
+		if !errors.Is(err, ErrNoKeyShare) {
+			t.Errorf("expecting %v, got %v", ErrNoKeyShare, err)
+		}
+	})
+
+	t.Run("TLS 1.2 without key_share", func(t *testing.T) {
+		chBytes := newTestClientHello().
+			withoutExtension([2]byte{0x00, 0x33}).
+			withoutExtension([2]byte{0x00, 0x2b}).marshal()
+		_, _, err := TLS{}.processFirstPacket(chBytes, pv)
+		if !errors.Is(err, ErrNoKeyShare) {
+			t.Errorf("expecting %v, got %v", ErrNoKeyShare, err)
+		}
+	})
+}
+
+// chromeClientHello is a ClientHello captured from Chrome
+const chromeClientHello = "1603010200010001fc0303eae4c204a867390a758fcff3afa5803cac3e07011cf0c9f3befc1267445aabee20fc398df698113617f8161cbcb89534efa892088a6c5e49246534e05f790ea36f00220a0a130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a010001910a0a000000000014001200000f63646e2e62697a69626c652e636f6d00170000ff01000100000a000a0008caca001d00170018000b00020100002300000010000e000c02683208687474702f312e31000500050100000000000d00140012040308040401050308050501080606010201001200000033002b0029caca000100001d00204c8f1563fb70c261bc0c32c1b568b8d02fab25f4094711e7868b1712751dc754002d00020101002b000b0a2a2a0304030303020301001b00030200026a6a000100001500c9000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
+
+// extensionsOf returns the raw extensions block of a ClientHello with record layer
+func extensionsOf(chBytes []byte) []byte {
+	pointer := 5 + 4 + 2 + 32
+	pointer += 1 + int(chBytes[pointer])
+	pointer += 2 + int(u16(chBytes[pointer:pointer+2]))
+	pointer += 1 + int(chBytes[pointer])
+	return chBytes[pointer+2:]
+}
+
+func TestParseExtensions_MaxExtensions(t *testing.T) {
+	many := newTestClientHello()
+	for i := 0; i < 200; i++ {
+		many.extensions = append(many.extensions, testExtension{[2]byte{0xee, byte(i)}, nil})
+	}
+	manyBytes := many.marshal()
+
+	t.Run("extensions past the limit aren't parsed", func(t *testing.T) {
+		ret, order, err := parseExtensions(extensionsOf(manyBytes), ParseOptions{MaxExtensions: 10})
+		if !errors.Is(err, ErrTooManyExtensions) {
+			t.Errorf("expecting ErrTooManyExtensions, got %v", err)
+		}
+		if ret != nil || order != nil {
+			t.Errorf("expecting nothing to be returned, got %v extensions", len(order))
+		}
+		_, err = parseClientHello(manyBytes, DefaultParseOptions)
+		if !errors.Is(err, ErrTooManyExtensions) {
+			t.Errorf("expecting ErrTooManyExtensions by default, got %v", err)
+		}
+	})
+	t.Run("exactly at the limit", func(t *testing.T) {
+		exts := extensionsOf(manyBytes)
+		_, order, err := parseExtensions(exts, ParseOptions{MaxExtensions: len(many.extensions)})
+		if err != nil {
+			t.Errorf("expecting no error, got %v", err)
+		}
+		if len(order) != len(many.extensions) {
+			t.Errorf("expecting %v extensions, got %v", len(many.extensions), len(order))
+		}
+	})
+	t.Run("transport treats it as malformed", func(t *testing.T) {
+		_, _, err := TLS{}.processFirstPacket(manyBytes, nil)
+		if err != ErrBadClientHello {
+			t.Errorf("expecting ErrBadClientHello, got %v", err)
+		}
+		chBytes, _ := hex.DecodeString(chromeClientHello)
+		_, _, err = TLS{ParseOptions: &ParseOptions{MaxExtensions: 10}}.processFirstPacket(chBytes, nil)
+		if err != ErrBadClientHello {
+			t.Errorf("expecting ErrBadClientHello with a configured limit, got %v", err)
+		}
+	})
+}
+
+func TestParseClientHello_Deadline(t *testing.T) {
+	start := time.Unix(1000, 0)
+	// tickingClock moves on by a millisecond every time it's read
+	tickingClock := func() func() time.Time {
+		now := start
+		return func() time.Time {
+			now = now.Add(time.Millisecond)
+			return now
+		}
+	}
+
+	pathological := newTestClientHello()
+	for i := 0; i < 300; i++ {
+		pathological.extensions = append(pathological.extensions, testExtension{[2]byte{0xee, byte(i)}, nil})
+	}
+	pathologicalBytes := pathological.marshal()
+	normalBytes := newTestClientHello().marshal()
+	budget := func() ParseOptions {
+		return ParseOptions{MaxExtensions: 1000, Deadline: start.Add(100 * time.Millisecond), Now: tickingClock()}
+	}
+
+	t.Run("pathological", func(t *testing.T) {
+		_, err := parseClientHello(pathologicalBytes, budget())
+		if !errors.Is(err, ErrHandshakeBudget) {
+			t.Errorf("expecting ErrHandshakeBudget, got %v", err)
+		}
+		opts := budget()
+		_, _, err = TLS{ParseOptions: &opts}.processFirstPacket(pathologicalBytes, nil)
+		if err != ErrHandshakeBudget {
+			t.Errorf("expecting ErrHandshakeBudget from the transport, got %v", err)
+		}
+		_, err = parseClientHello(pathologicalBytes, ParseOptions{MaxExtensions: 1000})
+		if err != nil {
+			t.Errorf("expecting no error without a deadline, got %v", err)
+		}
+	})
+	t.Run("normal", func(t *testing.T) {
+		_, err := parseClientHello(normalBytes, budget())
+		if err != nil {
+			t.Errorf("expecting no error, got %v", err)
+		}
+	})
+}
+
+func TestParseClientHello_Strictness(t *testing.T) {
+	strict := DefaultParseOptions
+	strict.RejectDuplicateExtensions = true
+	strict.StrictExtensionsLength = true
+
+	duplicate := newTestClientHello()
+	duplicate.extensions = append(duplicate.extensions, testExtension{[2]byte{0x00, 0x0a}, []byte{0x00, 0x02, 0x00, 0x1d}})
+	// a ClientHello whose extensions length field is one short of the extensions that follow
+	wrongLength := newTestClientHello().marshal()
+	extsLenPos := len(wrongLength) - len(extensionsOf(wrongLength)) - 2
+	binary.BigEndian.PutUint16(wrongLength[extsLenPos:], u16(wrongLength[extsLenPos:])-1)
+	// and one whose extensions length field claims more than there is left of it
+	pastEnd := newTestClientHello().marshal()
+	binary.BigEndian.PutUint16(pastEnd[extsLenPos:], u16(pastEnd[extsLenPos:])+7)
+
+	for _, c := range []struct {
+		name      string
+		hello     []byte
+		strictErr error
+	}{
+		{"duplicate extension", duplicate.marshal(), ErrDuplicateExtension},
+		{"wrong extensions length", wrongLength, ErrExtensionsLength},
+		{"extensions length past the end", pastEnd, ErrExtensionsLength},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ch, err := parseClientHello(c.hello, DefaultParseOptions)
+			if err != nil {
+				t.Errorf("expecting a lenient parse to succeed, got %v", err)
+			} else if len(ch.extensions) == 0 {
+				t.Error("expecting extensions from a lenient parse")
+			}
+			_, err = parseClientHello(c.hello, strict)
+			if !errors.Is(err, c.strictErr) {
+				t.Errorf("expecting %v from a strict parse, got %v", c.strictErr, err)
+			}
+			// which the transport takes for a malformed ClientHello
+			_, _, err = TLS{ParseOptions: &strict}.processFirstPacket(c.hello, nil)
+			if err != ErrBadClientHello || !isMalformedHello(err) {
+				t.Errorf("expecting ErrBadClientHello from the transport, got %v", err)
+			}
+		})
+	}
+	t.Run("well formed", func(t *testing.T) {
+		chBytes, _ := hex.DecodeString(chromeClientHello)
+		strictCh, err := parseClientHello(chBytes, strict)
+		if err != nil {
+			t.Fatalf("expecting a strict parse to succeed, got %v", err)
+		}
+		lenientCh, _ := parseClientHello(chBytes, DefaultParseOptions)
+		if !reflect.DeepEqual(strictCh, lenientCh) {
+			t.Error("strict and lenient parses are different")
+		}
+	})
+	t.Run("options from State", func(t *testing.T) {
+		sta := &State{MaxExtensions: 10, RejectDuplicateExtensions: true}
+		opts := sta.parseOptions()
+		if !reflect.DeepEqual(opts, ParseOptions{MaxExtensions: 10, MaxKeyShares: DefaultMaxKeyShares, RejectDuplicateExtensions: true}) {
+			t.Errorf("wrong options %+v", opts)
+		}
+		sta = &State{MaxKeyShares: 4}
+		if opts := sta.parseOptions(); opts.MaxKeyShares != 4 {
+			t.Errorf("expecting MaxKeyShares 4, got %v", opts.MaxKeyShares)
+		}
+		sta = &State{}
+		if !reflect.DeepEqual(sta.parseOptions(), DefaultParseOptions) {
+			t.Errorf("expecting DefaultParseOptions, got %+v", sta.parseOptions())
+		}
+	})
+}
+
+func TestParseClientHello_Short(t *testing.T) {
+	// a handshake whose length is consistent, but whose session id is longer than what follows
+	truncated := []byte{0x01, 0x00, 0x00, 0x2d, 0x03, 0x03}
+	truncated = append(truncated, make([]byte, 32)...)
+	truncated = append(truncated, 0x20)
+	truncated = append(truncated, make([]byte, 10)...)
+	truncated = addRecordLayer(truncated, []byte{0x16}, []byte{0x03, 0x01})
+
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"4 bytes", []byte{0x16, 0x03, 0x01, 0x02}},
+		{"record header only", []byte{0x16, 0x03, 0x01, 0x00, 0x00}},
+		{"truncated session id", truncated},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseClientHello(c.data, DefaultParseOptions)
+			if !errors.Is(err, ErrBadClientHello) {
+				t.Errorf("expecting ErrBadClientHello, got %v", err)
+			}
+			_, _, err = TLS{}.processFirstPacket(c.data, nil)
+			if err != ErrBadClientHello {
+				t.Errorf("expecting ErrBadClientHello from the transport, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseClientHello_Overrun(t *testing.T) {
+	// hello puts fields after the client version and random in a ClientHello whose handshake and record lengths match
+	// them, however the length fields in them lie
+	hello := func(fields ...[]byte) []byte {
+		body := append([]byte{0x03, 0x03}, make([]byte, 32)...)
+		for _, field := range fields {
+			body = append(body, field...)
+		}
+		hs := append([]byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+		return addRecordLayer(hs, []byte{0x16}, []byte{0x03, 0x01})
+	}
+	noSessionId := []byte{0x00}
+	oneSuite := []byte{0x00, 0x02, 0x13, 0x01}
+	for _, c := range []struct {
+		name  string
+		hello []byte
+		field string
+	}{
+		{"session id", hello([]byte{0x20}, make([]byte, 16)), "session id"},
+		{"no cipher suites length", hello([]byte{0x20}, make([]byte, 32)), "cipher suites length"},
+		{"cipher suites", hello(noSessionId, []byte{0x00, 0x10, 0x13, 0x01, 0x13, 0x02}), "cipher suites"},
+		{"no compression methods length", hello(noSessionId, oneSuite), "compression methods length"},
+		{"compression methods", hello(noSessionId, oneSuite, []byte{0x05, 0x00}), "compression methods"},
+		{"extensions length", hello(noSessionId, oneSuite, []byte{0x01, 0x00, 0x00}), "extensions length"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseClientHello(c.hello, DefaultParseOptions)
+			// the error from a recovered panic isn't ErrBadClientHello
+			if !errors.Is(err, ErrBadClientHello) {
+				t.Fatalf("expecting ErrBadClientHello, got %v", err)
+			}
+			if !strings.Contains(err.Error(), c.field) {
+				t.Errorf("expecting an error about the %v, got %v", c.field, err)
+			}
+		})
+	}
+	t.Run("well formed", func(t *testing.T) {
+		_, err := parseClientHello(hello(noSessionId, oneSuite, []byte{0x01, 0x00}), DefaultParseOptions)
+		if err != nil {
+			t.Errorf("expecting a ClientHello without extensions to parse, got %v", err)
+		}
+	})
+}
+
+func TestParseClientHello_CipherSuitesLength(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		cipherSuites []byte
+	}{
+		{"odd", []byte{0x13, 0x01, 0x13}},
+		{"one byte", []byte{0x13}},
+		{"empty", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tch := newTestClientHello()
+			tch.cipherSuites = c.cipherSuites
+			_, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+			if !errors.Is(err, ErrCipherSuitesLength) {
+				t.Errorf("expecting ErrCipherSuitesLength, got %v", err)
+			}
+			_, _, err = TLS{}.processFirstPacket(tch.marshal(), nil)
+			if err != ErrBadClientHello {
+				t.Errorf("expecting ErrBadClientHello from the transport, got %v", err)
+			}
+		})
+	}
+
+	tch := newTestClientHello()
+	tch.cipherSuites = []byte{0x13, 0x01}
+	_, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+	assert.NoError(t, err)
+}
+
+func TestClientHello_ECHType(t *testing.T) {
+	echExtType := [2]byte{0xfe, 0x0d}
+	// outer, HKDF-SHA256, AES-128-GCM, config_id 0x2a, 32 bytes enc, 144 bytes payload
+	outerECH, _ := hex.DecodeString("00000100012a0020" +
+		"5e1bd8d9c908b2fb0b7dd501670f1340654b8c88b12f8e3cc9e5bd6f0a9e8e9d" + "0090")
+	outerECH = append(outerECH, make([]byte, 144)...)
+
+	parse := func(t *testing.T, tch testClientHello) *ClientHello {
+		ch, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+		if err != nil {
+			t.Fatalf("failed to parse ClientHello: %v", err)
+		}
+		return ch
+	}
+
+	t.Run("none", func(t *testing.T) {
+		kind, err := parse(t, newTestClientHello()).ECHType(nil)
+		if err != nil || kind != ECHNone {
+			t.Errorf("expecting ECHNone and no error, got %v and %v", kind, err)
+		}
+	})
+
+	t.Run("GREASE", func(t *testing.T) {
+		ch := parse(t, newTestClientHello().withExtension(echExtType, outerECH))
+		kind, err := ch.ECHType([]byte{0x01, 0x02})
+		if err != nil || kind != ECHGrease {
+			t.Errorf("expecting ECHGrease and no error, got %v and %v", kind, err)
+		}
+	})
+
+	t.Run("real", func(t *testing.T) {
+		ch := parse(t, newTestClientHello().withExtension(echExtType, outerECH))
+		kind, err := ch.ECHType([]byte{0x01, 0x2a})
+		if err != nil || kind != ECHReal {
+			t.Errorf("expecting ECHReal and no error, got %v and %v", kind, err)
+		}
+	})
+
+	t.Run("inner", func(t *testing.T) {
+		ch := parse(t, newTestClientHello().withExtension(echExtType, []byte{0x01}))
+		_, err := ch.ECHType(nil)
+		if !errors.Is(err, ErrMalformedECH) {
+			t.Errorf("expecting %v, got %v", ErrMalformedECH, err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		ch := parse(t, newTestClientHello().withExtension(echExtType, outerECH[:len(outerECH)-1]))
+		_, err := ch.ECHType(nil)
+		if !errors.Is(err, ErrMalformedECH) {
+			t.Errorf("expecting %v, got %v", ErrMalformedECH, err)
+		}
+	})
+
+	t.Run("chrome", func(t *testing.T) {
+		chBytes, _ := hex.DecodeString(chromeClientHello)
+		ch, _ := parseClientHello(chBytes, DefaultParseOptions)
+		kind, err := ch.ECHType(nil)
+		if err != nil || kind != ECHNone {
+			t.Errorf("expecting ECHNone and no error, got %v and %v", kind, err)
+		}
+	})
+}
+
+func TestComposeHelloRetryRequest(t *testing.T) {
+	sessionId := make([]byte, 32)
+	common.CryptoRandRead(sessionId)
+	x25519 := [2]byte{0x00, 0x1d}
+	hrr := composeHelloRetryRequest(sessionId, 0x1301, x25519)
+
+	if hrr[0] != 0x02 {
+		t.Errorf("HelloRetryRequest must have the handshake type of ServerHello, got %v", hrr[0])
+	}
+	if length := int(u32(append([]byte{0x00}, hrr[1:4]...))); length != len(hrr)-4 {
+		t.Errorf("wrong handshake length: declared %v, actually %v", length, len(hrr)-4)
+	}
+
+	hrrRandom := sha256.Sum256([]byte("HelloRetryRequest"))
+	if !bytes.Equal(hrr[6:38], hrrRandom[:]) {
+		t.Errorf("expecting random %x, got %x", hrrRandom, hrr[6:38])
+	}
+	if int(hrr[38]) != len(sessionId) || !bytes.Equal(hrr[39:71], sessionId) {
+		t.Error("session id is not echoed")
+	}
+	if !bytes.Equal(hrr[71:73], []byte{0x13, 0x01}) {
+		t.Errorf("wrong cipher suite %x", hrr[71:73])
+	}
+
+	extensions, _, err := parseExtensions(hrr[76:], DefaultParseOptions)
+	if err != nil {
+		t.Fatalf("failed to parse extensions: %v", err)
+	}
+	if int(u16(hrr[74:76])) != len(hrr[76:]) {
+		t.Error("wrong extensions length")
+	}
+	if !bytes.Equal(extensions[[2]byte{0x00, 0x33}], x25519[:]) {
+		t.Errorf("key_share should only contain the group, got %x", extensions[[2]byte{0x00, 0x33}])
+	}
+	if !bytes.Equal(extensions[[2]byte{0x00, 0x2b}], []byte{0x03, 0x04}) {
+		t.Errorf("wrong supported_versions %x", extensions[[2]byte{0x00, 0x2b}])
+	}
+}
+
+func TestParseALPN(t *testing.T) {
+	t.Run("h2 and http/1.1", func(t *testing.T) {
+		ext, _ := hex.DecodeString("000c02683208687474702f312e31")
+		protos, err := parseALPN(ext)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(protos) != 2 || protos[0] != "h2" || protos[1] != "http/1.1" {
+			t.Errorf("wrong protocols: %v", protos)
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		ext, _ := hex.DecodeString("000c026832086874")
+		_, err := parseALPN(ext)
+		if err == nil {
+			t.Error("expecting error")
+		}
+	})
+}
+
+// chromeResumptionClientHello is a ClientHello from Chrome with a pre_shared_key extension resuming a previous session
+const chromeResumptionClientHello = "1603010246010002420303794ae79c6db7a31e67e2ce91b8afcb82995ae79ad1d0dc885f933e4193bf95cd208abd7a70f3b82cc31c02f1c2b94ba74d5222a66695a5cf92a366421d7f5eb9530022fafa130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a010001d75a5a00000000001e001c0000196c68332e676f6f676c6575736572636f6e74656e742e636f6d00170000ff01000100000a000a0008baba001d00170018000b00020100002300000010000e000c02683208687474702f312e31000500050100000000000d00140012040308040401050308050501080606010201001200000033002b0029baba000100001d002074bfe93336c364b43cf0879d997b2e11dc97068b86fc90174e0f2bcea1d4ed1c002d00020101002b000b0ababa0304030303020301001b00030200029a9a0001000029010500e000da00d1f6c0918f865390ae3ca33c77f61a1974cb4533456071b214ec018d17dc22845f2f72cf1dba48f9cdc0758803002dda9b964fad5522e82442af7cbbe242241e39233386f2383bce3ced8e16b1ae3f0ef52a706f58e1e6a1bca0cd3b3a2a4c4cb738770b01b56bf3e73c472bf4fb238cab510aa78f8427a3ca99f741aa433f548be460705f43a3abe878cec6ee3158c129406910b93e798e8a7aaffc2e7ff7b8fd872778d3687a0beaa1452fe7ec418070d537344b64d09f6edd053346ff9c9678eef6b8886882aba81d4be11d9df653de35659f93a22ac39399e3ba400021204e22b73261693967a9216fe4a3b004571c53f316309e76671a18d78931b5b072"
+
+func TestClientHello_PSKIdentities(t *testing.T) {
+	t.Run("captured", func(t *testing.T) {
+		chBytes, _ := hex.DecodeString(chromeResumptionClientHello)
+		ch, err := parseClientHello(chBytes, DefaultParseOptions)
+		if err != nil {
+			t.Fatalf("failed to parse ClientHello: %v", err)
+		}
+		identities, err := ch.PSKIdentities()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(identities) != 1 {
+			t.Fatalf("expecting 1 identity, got %v", len(identities))
+		}
+		if len(identities[0].Identity) != 218 {
+			t.Errorf("expecting identity of length 218, got %v", len(identities[0].Identity))
+		}
+		if !bytes.HasPrefix(identities[0].Identity, []byte{0x00, 0xd1, 0xf6, 0xc0}) {
+			t.Errorf("wrong identity: %x", identities[0].Identity)
+		}
+		if identities[0].ObfuscatedTicketAge != 0x99e3ba40 {
+			t.Errorf("wrong obfuscated_ticket_age: %x", identities[0].ObfuscatedTicketAge)
+		}
+	})
+	t.Run("no pre_shared_key", func(t *testing.T) {
+		ch, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+		identities, err := ch.PSKIdentities()
+		if identities != nil || err != nil {
+			t.Errorf("expecting nil and no error, got %v and %v", identities, err)
+		}
+	})
+	t.Run("binders don't fill the extension", func(t *testing.T) {
+		psk, _ := hex.DecodeString("000a00040102030400000001" + "0021" + "20" + strings.Repeat("00", 32) + "00")
+		ch, _ := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x29}, psk).marshal(), DefaultParseOptions)
+		_, err := ch.PSKIdentities()
+		if !errors.Is(err, ErrMalformedPSK) {
+			t.Errorf("expecting ErrMalformedPSK, got %v", err)
+		}
+	})
+	t.Run("fewer binders than identities", func(t *testing.T) {
+		psk, _ := hex.DecodeString("001400040102030400000001000405060708000000020021" + "20" + strings.Repeat("00", 32))
+		ch, _ := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x29}, psk).marshal(), DefaultParseOptions)
+		_, err := ch.PSKIdentities()
+		if !errors.Is(err, ErrMalformedPSK) {
+			t.Errorf("expecting ErrMalformedPSK, got %v", err)
+		}
+	})
+}
+
+func TestParseClientHello_ExtensionOrder(t *testing.T) {
+	chBytes, _ := hex.DecodeString(chromeResumptionClientHello)
+	ch, err := parseClientHello(chBytes, DefaultParseOptions)
+	if err != nil {
+		t.Fatalf("failed to parse ClientHello: %v", err)
+	}
+	expected := [][2]byte{
+		{0x5a, 0x5a}, {0x00, 0x00}, {0x00, 0x17}, {0xff, 0x01}, {0x00, 0x0a}, {0x00, 0x0b}, {0x00, 0x23}, {0x00, 0x10},
+		{0x00, 0x05}, {0x00, 0x0d}, {0x00, 0x12}, {0x00, 0x33}, {0x00, 0x2d}, {0x00, 0x2b}, {0x00, 0x1b}, {0x9a, 0x9a},
+		{0x00, 0x29},
+	}
+	if len(ch.extensionOrder) != len(expected) {
+		t.Fatalf("expecting %v extensions, got %v", len(expected), len(ch.extensionOrder))
+	}
+	for i := range expected {
+		if ch.extensionOrder[i] != expected[i] {
+			t.Errorf("extension %v: expecting %x, got %x", i, expected[i], ch.extensionOrder[i])
+		}
+	}
+	for _, typ := range ch.extensionOrder {
+		if _, ok := ch.extensions[typ]; !ok {
+			t.Errorf("extension %x is ordered but not in the map", typ)
+		}
+	}
+}
+
+func TestClientHello_ServerName(t *testing.T) {
+	ch, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	name, err := ch.serverName()
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", name)
+
+	ch, _ = parseClientHello(newTestClientHello().withoutExtension([2]byte{0x00, 0x00}).marshal(), DefaultParseOptions)
+	name, err = ch.serverName()
+	assert.NoError(t, err)
+	assert.Empty(t, name)
+
+	ch, _ = parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x00}, []byte{0x00, 0x0e, 0x00, 0x00, 0x0b, 'a'}).marshal(), DefaultParseOptions)
+	_, err = ch.serverName()
+	assert.Error(t, err)
+}
+
+func TestClientHello_CertCompressionAlgs(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		ext  []byte
+		algs []uint16
+	}{
+		{"brotli", []byte{0x02, 0x00, 0x02}, []uint16{2}},
+		{"zlib and zstd", []byte{0x04, 0x00, 0x01, 0x00, 0x03}, []uint16{1, 3}},
+		{"empty list", []byte{0x00}, nil},
+		{"wrong length", []byte{0x04, 0x00, 0x02}, nil},
+		{"odd length", []byte{0x03, 0x00, 0x02, 0x00}, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ch, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x1b}, c.ext).marshal(), DefaultParseOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, c.algs, ch.CertCompressionAlgs())
+		})
+	}
+	ch, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	assert.Nil(t, ch.CertCompressionAlgs())
+
+	// Chrome offers brotli
+	chromeBytes, _ := hex.DecodeString(chromeClientHello)
+	chrome, _ := parseClientHello(chromeBytes, DefaultParseOptions)
+	assert.Equal(t, []uint16{2}, chrome.CertCompressionAlgs())
+}
+
+func TestClientHello_SupportsDelegatedCreds(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		ext     []byte
+		schemes []uint16
+	}{
+		{"ecdsa", []byte{0x00, 0x02, 0x04, 0x03}, []uint16{0x0403}},
+		{"ecdsa and ed25519", []byte{0x00, 0x04, 0x04, 0x03, 0x08, 0x07}, []uint16{0x0403, 0x0807}},
+		{"empty list", []byte{0x00, 0x00}, nil},
+		{"wrong length", []byte{0x00, 0x04, 0x04, 0x03}, nil},
+		{"odd length", []byte{0x00, 0x03, 0x04, 0x03, 0x08}, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ch, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x22}, c.ext).marshal(), DefaultParseOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, c.schemes, ch.delegatedCredentialSchemes())
+			assert.Equal(t, c.schemes != nil, ch.SupportsDelegatedCreds())
+		})
+	}
+	ch, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	assert.False(t, ch.SupportsDelegatedCreds())
+}
+
+func BenchmarkParseClientHello(b *testing.B) {
+	for _, c := range []struct {
+		name  string
+		hello string
+	}{
+		{"cloak", cloakClientHello},
+		{"chrome", chromeClientHello},
+		{"chrome resumption", chromeResumptionClientHello},
+	} {
+		chBytes, _ := hex.DecodeString(c.hello)
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				parseClientHello(chBytes, DefaultParseOptions)
+			}
+		})
+	}
+}
+
+func BenchmarkParseKeyShare(b *testing.B) {
+	chBytes, _ := hex.DecodeString(cloakClientHello)
+	ch, err := parseClientHello(chBytes, DefaultParseOptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keyShare := ch.extensions[[2]byte{0x00, 0x33}]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseKeyShare(keyShare, DefaultParseOptions)
+	}
+}
+
+func BenchmarkComposeServerHello(b *testing.B) {
+	chBytes, _ := hex.DecodeString(cloakClientHello)
+	ch, err := parseClientHello(chBytes, DefaultParseOptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	fields := serverHelloFields{sessionId: ch.sessionId, keyShareGroup: x25519Group}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		composeServerHello(fields, DefaultServerProfile, rand.Reader)
+	}
+}
+
+func BenchmarkComposeReply(b *testing.B) {
+	chBytes, _ := hex.DecodeString(cloakClientHello)
+	ch, err := parseClientHello(chBytes, DefaultParseOptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	fields := serverHelloFields{sessionId: ch.sessionId, keyShareGroup: x25519Group}
+	cert := make([]byte, DefaultServerProfile.encryptedFlightLength(possibleCertLengths[0]))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		composeReply(fields, nil, true, [][]byte{cert}, DefaultServerProfile, rand.Reader)
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	hello, _ := hex.DecodeString(cloakClientHello)
+	ccs := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+
+	t.Run("two coalesced records", func(t *testing.T) {
+		records, err := splitRecords(append(append([]byte{}, hello...), ccs...))
+		assert.NoError(t, err)
+		if assert.Len(t, records, 2) {
+			assert.Equal(t, hello, records[0])
+			assert.Equal(t, ccs, records[1])
+		}
+		ch, err := parseClientHello(records[0], DefaultParseOptions)
+		assert.NoError(t, err)
+		assert.NotNil(t, ch)
+	})
+	t.Run("incomplete header", func(t *testing.T) {
+		records, err := splitRecords(append(append([]byte{}, hello...), ccs[:3]...))
+		assert.Equal(t, ErrIncompleteRecord, err)
+		assert.Len(t, records, 1)
+	})
+	t.Run("incomplete payload", func(t *testing.T) {
+		records, err := splitRecords(hello[:100])
+		assert.Equal(t, ErrIncompleteRecord, err)
+		assert.Empty(t, records)
+	})
+}
+
+// fragmentRecord splits the payload of record at each of offsets into Handshake records of its own
+func fragmentRecord(record []byte, offsets ...int) []byte {
+	var ret []byte
+	payload := record[5:]
+	start := 0
+	for _, end := range append(offsets, len(payload)) {
+		ret = append(ret, record[0], record[1], record[2], byte((end-start)>>8), byte(end-start))
+		ret = append(ret, payload[start:end]...)
+		start = end
+	}
+	return ret
+}
+
+func TestParseClientHello_Fragmented(t *testing.T) {
+	hello, _ := hex.DecodeString(cloakClientHello)
+	whole, err := parseClientHello(hello, DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offsets := range [][]int{{2}, {200}, {100, 300}} {
+		fragmented := fragmentRecord(hello, offsets...)
+		payloads, recordsLength, complete := handshakeFragments(fragmented)
+		assert.Len(t, payloads, len(offsets)+1)
+		assert.Equal(t, len(fragmented), recordsLength)
+		assert.True(t, complete)
+
+		ch, err := parseClientHello(fragmented, DefaultParseOptions)
+		if assert.NoError(t, err, "split at %v", offsets) {
+			assert.Equal(t, whole.random, ch.random)
+			assert.Equal(t, whole.sessionId, ch.sessionId)
+			assert.Equal(t, whole.extensions, ch.extensions)
+		}
+	}
+
+	t.Run("missing the last fragment", func(t *testing.T) {
+		fragmented := fragmentRecord(hello, 200)
+		_, recordsLength, complete := handshakeFragments(fragmented[:205])
+		assert.Equal(t, 205, recordsLength)
+		assert.False(t, complete)
+		_, err := parseClientHello(fragmented[:205], DefaultParseOptions)
+		assert.Error(t, err)
+	})
+	t.Run("followed by another record", func(t *testing.T) {
+		fragmented := fragmentRecord(hello, 200)
+		ccs := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+		_, recordsLength, complete := handshakeFragments(append(append([]byte{}, fragmented...), ccs...))
+		assert.Equal(t, len(fragmented), recordsLength)
+		assert.True(t, complete)
 	})
 }
+
+func TestClientHelloWithoutExtensions(t *testing.T) {
+	pv, _, _ := ecdh.GenerateKey(rand.Reader)
+	tch := newTestClientHello()
+	tch.extensions = nil
+	withEmptyExtensions := tch.marshal()
+	// a ClientHello can leave out the length of the extensions as well
+	withoutExtensionsLength := append([]byte{}, withEmptyExtensions[:len(withEmptyExtensions)-2]...)
+	withoutExtensionsLength[4] -= 2
+	withoutExtensionsLength[8] -= 2
+
+	for name, chBytes := range map[string][]byte{
+		"empty extensions":          withEmptyExtensions,
+		"without extensions length": withoutExtensionsLength,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ch, err := parseClientHello(chBytes, DefaultParseOptions)
+			if err != nil {
+				t.Fatalf("failed to parse ClientHello: %v", err)
+			}
+			assert.Empty(t, ch.extensions)
+			_, _, err = TLS{}.processFirstPacket(chBytes, pv)
+			assert.Equal(t, ErrNoExtensions, err)
+		})
+	}
+}
+
+func TestClientHello_PlausibleVersions(t *testing.T) {
+	for _, c := range []struct {
+		recordVersion []byte
+		clientVersion []byte
+		plausible     bool
+	}{
+		{[]byte{0x03, 0x01}, []byte{0x03, 0x03}, true},
+		{[]byte{0x03, 0x03}, []byte{0x03, 0x03}, true},
+		{[]byte{0x03, 0x01}, []byte{0x03, 0x01}, true},
+		{[]byte{0x03, 0x03}, []byte{0x03, 0x01}, false},
+		{[]byte{0x03, 0x01}, []byte{0x03, 0x04}, false},
+		{[]byte{0x03, 0x00}, []byte{0x03, 0x03}, false},
+		{[]byte{0x03, 0x01}, []byte{0x7f, 0x1c}, false},
+	} {
+		tch := newTestClientHello()
+		tch.clientVersion = c.clientVersion
+		chBytes := tch.marshal()
+		copy(chBytes[1:3], c.recordVersion)
+		ch, err := parseClientHello(chBytes, DefaultParseOptions)
+		if err != nil {
+			t.Errorf("failed to parse ClientHello: %v", err)
+			continue
+		}
+		if ch.plausibleVersions() != c.plausible {
+			t.Errorf("record version %x and client version %x: expecting plausible %v", c.recordVersion, c.clientVersion, c.plausible)
+		}
+		sta := &State{}
+		if err := sta.checkClientHello(ch); c.plausible == errors.Is(err, ErrImplausibleVersions) {
+			t.Errorf("record version %x and client version %x: got %v from checkClientHello", c.recordVersion, c.clientVersion, err)
+		}
+	}
+}
+
+func TestClientHello_JA3(t *testing.T) {
+	chBytes, _ := hex.DecodeString(chromeClientHello)
+	ch, err := parseClientHello(chBytes, DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// GREASE values are left out of cipher suites, extensions and supported groups
+	assert.Equal(t, "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53-10,"+
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-21,29-23-24,0", ch.ja3String())
+	assert.Equal(t, "66918128f1b9b03303d77c6f2eefd128", ch.JA3())
+}
+
+func TestParseKeyShare_SmallOrder(t *testing.T) {
+	keyShareOf := func(key []byte) []byte {
+		return append([]byte{0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}, key...)
+	}
+	strict := DefaultParseOptions
+	strict.RejectSmallOrderKeyShares = true
+
+	scalar := make([]byte, 32)
+	common.CryptoRandRead(scalar)
+	for _, point := range x25519SmallOrderPoints {
+		// X25519 refuses to give the all zero shared secret of a point of small order
+		_, err := curve25519.X25519(scalar, point[:])
+		assert.Error(t, err, "%x isn't of small order", point)
+
+		for _, key := range [][]byte{point[:], append(append([]byte{}, point[:31]...), point[31]|0x80)} {
+			_, err = parseKeyShare(keyShareOf(key), strict)
+			assert.True(t, errors.Is(err, ErrSmallOrderKeyShare), "%x not rejected: %v", key, err)
+			ret, err := parseKeyShare(keyShareOf(key), DefaultParseOptions)
+			assert.NoError(t, err, "small order points are only rejected if asked to")
+			assert.Equal(t, key, ret)
+		}
+	}
+
+	key := make([]byte, 32)
+	common.CryptoRandRead(key)
+	ret, err := parseKeyShare(keyShareOf(key), strict)
+	assert.NoError(t, err)
+	assert.Equal(t, key, ret)
+
+	tch := newTestClientHello()
+	tch.extensions[2] = testExtension{[2]byte{0x00, 0x33}, keyShareOf(x25519SmallOrderPoints[2][:])}
+	_, _, err = TLS{ParseOptions: &strict}.processFirstPacket(tch.marshal(), testStaticPv)
+	assert.Equal(t, ErrSmallOrderKeyShare, err)
+	assert.True(t, isMalformedHello(err))
+}
+
+func TestParseKeyShare_MaxKeyShares(t *testing.T) {
+	key := make([]byte, 32)
+	common.CryptoRandRead(key)
+	// keyShareOf puts the x25519 entry of key after n entries of another group
+	keyShareOf := func(n int) []byte {
+		var entries []byte
+		for i := 0; i < n; i++ {
+			entries = append(entries, 0x00, 0x17, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04)
+		}
+		entries = append(append(entries, 0x00, 0x1d, 0x00, 0x20), key...)
+		return append([]byte{byte(len(entries) >> 8), byte(len(entries))}, entries...)
+	}
+
+	ret, err := parseKeyShare(keyShareOf(1), DefaultParseOptions)
+	assert.NoError(t, err, "a two-entry key_share is rejected")
+	assert.Equal(t, key, ret)
+
+	_, err = parseKeyShare(keyShareOf(300), DefaultParseOptions)
+	assert.True(t, errors.Is(err, ErrTooManyKeyShares), "got %v", err)
+
+	capped := DefaultParseOptions
+	capped.MaxKeyShares = 4
+	ret, err = parseKeyShare(keyShareOf(3), capped)
+	assert.NoError(t, err, "x25519 as the last entry allowed is rejected")
+	assert.Equal(t, key, ret)
+	_, err = parseKeyShare(keyShareOf(4), capped)
+	assert.True(t, errors.Is(err, ErrTooManyKeyShares), "got %v", err)
+
+	tch := newTestClientHello()
+	tch.extensions[2] = testExtension{[2]byte{0x00, 0x33}, keyShareOf(300)}
+	_, _, err = TLS{}.processFirstPacket(tch.marshal(), testStaticPv)
+	assert.Equal(t, ErrTooManyKeyShares, err)
+	assert.True(t, isMalformedHello(err))
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTLSResponder_EncryptedFlightLength(t *testing.T) {
+	sessionId := make([]byte, 32)
+	var sharedSecret, sessionKey [32]byte
+	rand.Read(sharedSecret[:])
+
+	isPossibleCertLength := func(l int) bool {
+		for _, possible := range possibleCertLengths {
+			if l == possible {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, c := range []struct {
+		name        string
+		cipherSuite uint16
+		hashLen     int
+	}{
+		{"TLS_AES_256_GCM_SHA384", 0x1302, 48},
+		{"TLS_AES_128_GCM_SHA256", 0x1301, 32},
+		{"TLS_CHACHA20_POLY1305_SHA256", 0x1303, 32},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			profile := ServerProfile{CipherSuite: c.cipherSuite}
+			for i := 0; i < 10; i++ {
+				rand.Read(sessionKey[:])
+				local, remote := connutil.AsyncPipe()
+				respond := TLS{}.makeResponder(minimalClientHello(sessionId), sharedSecret)
+				go respond(remote, sessionKey, rand.Reader, TLSReplyComposer{Profile: profile, Rand: rand.Reader})
+				records, err := readServerReply(local)
+				if err != nil {
+					t.Fatalf("failed to read reply: %v", err)
+				}
+
+				sh := records[0]
+				if sh[5+71] != byte(c.cipherSuite>>8) || sh[5+72] != byte(c.cipherSuite) {
+					t.Errorf("wrong cipher suite in ServerHello: %x", sh[5+71:5+73])
+				}
+
+				flightLen := len(records[2]) - 5
+				certLen := flightLen - (handshakeHeader + c.hashLen) - innerContentType - aeadTagLength
+				if !isPossibleCertLength(certLen) {
+					t.Errorf("encrypted flight length %v is inconsistent with a %v byte Finished", flightLen, c.hashLen)
+				}
+				local.Close()
+			}
+		})
+	}
+}
+
+// chunkedConn writes at most chunkSize bytes in each call to Write, optionally failing some calls with err
+type chunkedConn struct {
+	net.Conn
+	chunkSize int
+	// failures is the number of calls to Write that still have to fail with err
+	failures int
+	err      error
+}
+
+func (c *chunkedConn) Write(b []byte) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, c.err
+	}
+	if len(b) > c.chunkSize {
+		b = b[:c.chunkSize]
+	}
+	return c.Conn.Write(b)
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestTLSResponder_PartialWrites(t *testing.T) {
+	sessionId := make([]byte, 32)
+	var sharedSecret, sessionKey [32]byte
+	rand.Read(sharedSecret[:])
+	rand.Read(sessionKey[:])
+
+	respondOver := func(conn net.Conn) <-chan error {
+		respondErr := make(chan error, 1)
+		respond := TLS{}.makeResponder(minimalClientHello(sessionId), sharedSecret)
+		go func() {
+			_, err := respond(conn, sessionKey, rand.Reader, TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader})
+			respondErr <- err
+		}()
+		return respondErr
+	}
+
+	t.Run("small chunks", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		respondErr := respondOver(&chunkedConn{Conn: remote, chunkSize: 7})
+		_, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+		assert.NoError(t, <-respondErr)
+		local.Close()
+	})
+
+	t.Run("temporary errors", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		respondErr := respondOver(&chunkedConn{Conn: remote, chunkSize: 50, failures: 3, err: temporaryError{}})
+		_, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+		assert.NoError(t, <-respondErr)
+		local.Close()
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		respondErr := respondOver(&chunkedConn{Conn: remote, chunkSize: 50, failures: 1, err: io.ErrClosedPipe})
+		err := <-respondErr
+		if !errors.Is(err, ErrClientGone) {
+			t.Errorf("expecting ErrClientGone, got %v", err)
+		}
+		local.Close()
+	})
+}
+
+func TestWriteReply_Stalled(t *testing.T) {
+	// the client stops taking the reply after its first few bytes
+	local, remote := connutil.AsyncPipe()
+	defer local.Close()
+	conn := newThrottledConn(remote, throttleOptions{StallWrites: true, StallWritesAfter: 10})
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	written := make(chan error, 1)
+	go func() { written <- writeReply(conn, make([]byte, 1000)) }()
+	select {
+	case err := <-written:
+		assert.True(t, errors.Is(err, ErrReplyWriteTimeout), "got %v", err)
+	case <-time.After(replyWriteTimeout):
+		t.Fatal("writeReply blocks past the write deadline")
+	}
+}
+
+func TestDispatchConnection_ReplyWriteTimeout(t *testing.T) {
+	sta, _, _ := makeDispatchTestState(t)
+	sta.ReplyWriteTimeout = 100 * time.Millisecond
+
+	first, _ := hex.DecodeString(cloakClientHello)
+	local, remote := connutil.AsyncPipe()
+	defer local.Close()
+	dispatched := make(chan struct{})
+	go func() {
+		dispatchConnection(newThrottledConn(remote, throttleOptions{StallWrites: true}), sta)
+		close(dispatched)
+	}()
+	local.Write(first)
+
+	// the client never reads its reply
+	select {
+	case <-dispatched:
+	case <-time.After(replyWriteTimeout):
+		t.Fatal("dispatchConnection is held up by a client not reading its reply")
+	}
+	local.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := local.Read(make([]byte, 1))
+	assert.Equal(t, io.ErrClosedPipe, err, "connection isn't closed")
+}
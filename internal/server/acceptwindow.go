@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrOutsideAcceptWindow = errors.New("handshake outside of accept windows")
+
+// AcceptWindow is a time of day range in UTC during which Cloak handshakes are accepted. Start and End are the
+// time since midnight. If End is before Start, the window goes past midnight
+type AcceptWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// contains checks if the time of day of t is within the window, including Start but not End
+func (w AcceptWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	if w.Start <= w.End {
+		return sinceMidnight >= w.Start && sinceMidnight < w.End
+	}
+	return sinceMidnight >= w.Start || sinceMidnight < w.End
+}
+
+// parseAcceptWindow parses a window in the form of "HH:MM-HH:MM"
+func parseAcceptWindow(window string) (AcceptWindow, error) {
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return AcceptWindow{}, fmt.Errorf("invalid accept window %v", window)
+	}
+	var ret [2]time.Duration
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return AcceptWindow{}, fmt.Errorf("invalid accept window %v: %v", window, err)
+		}
+		ret[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return AcceptWindow{Start: ret[0], End: ret[1]}, nil
+}
+
+// acceptingHandshakes checks if Cloak handshakes are accepted at this time. They always are if there are no
+// AcceptWindows
+func (sta *State) acceptingHandshakes() bool {
+	if len(sta.AcceptWindows) == 0 {
+		return true
+	}
+	now := sta.WorldState.Now()
+	for _, w := range sta.AcceptWindows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/hex"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseAcceptWindow(t *testing.T) {
+	w, err := parseAcceptWindow("08:30-17:00")
+	assert.NoError(t, err)
+	assert.Equal(t, AcceptWindow{Start: 8*time.Hour + 30*time.Minute, End: 17 * time.Hour}, w)
+
+	for _, bad := range []string{"", "08:30", "8-17", "08:30-25:00", "08:30-17:00-18:00"} {
+		_, err := parseAcceptWindow(bad)
+		assert.Error(t, err, "%q should fail", bad)
+	}
+}
+
+func TestAcceptWindow_Contains(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2020, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+	day := AcceptWindow{Start: 8 * time.Hour, End: 17 * time.Hour}
+	assert.True(t, day.contains(at(8, 0)))
+	assert.True(t, day.contains(at(16, 59)))
+	assert.False(t, day.contains(at(17, 0)))
+	assert.False(t, day.contains(at(3, 0)))
+
+	night := AcceptWindow{Start: 22 * time.Hour, End: 2 * time.Hour}
+	assert.True(t, night.contains(at(23, 0)))
+	assert.True(t, night.contains(at(1, 59)))
+	assert.False(t, night.contains(at(2, 0)))
+	assert.False(t, night.contains(at(12, 0)))
+
+	// times are compared in UTC
+	assert.True(t, day.contains(at(9, 0).In(time.FixedZone("UTC-10", -10*60*60))))
+}
+
+func TestState_AcceptingHandshakes(t *testing.T) {
+	// cloakClientHelloTime is 23:42:46 UTC
+	cases := []struct {
+		windows   []AcceptWindow
+		accepting bool
+	}{
+		{nil, true},
+		{[]AcceptWindow{{Start: 23 * time.Hour, End: 24 * time.Hour}}, true},
+		{[]AcceptWindow{{Start: 22 * time.Hour, End: 6 * time.Hour}}, true},
+		{[]AcceptWindow{{Start: 8 * time.Hour, End: 17 * time.Hour}}, false},
+		{[]AcceptWindow{{Start: 8 * time.Hour, End: 17 * time.Hour}, {Start: 23 * time.Hour, End: 23*time.Hour + 50*time.Minute}}, true},
+	}
+	for _, c := range cases {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.AcceptWindows = c.windows
+		assert.Equal(t, c.accepting, sta.acceptingHandshakes(), "windows %v", c.windows)
+	}
+}
+
+func TestDispatchConnection_AcceptWindows(t *testing.T) {
+	t.Run("in window", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.AcceptWindows = []AcceptWindow{{Start: 23 * time.Hour, End: 24 * time.Hour}}
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		records, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		assert.Equal(t, byte(0x16), records[0][0])
+		local.Close()
+	})
+
+	t.Run("out of window", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.AcceptWindows = []AcceptWindow{{Start: 8 * time.Hour, End: 17 * time.Hour}}
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(first))
+		_, err = io.ReadFull(redirConn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, first, buf)
+		assert.False(t, sta.Panel.isActive(cloakClientHelloUID), "a session is made out of window")
+		local.Close()
+		redirConn.Close()
+	})
+}
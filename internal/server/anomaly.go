@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+)
+
+// Flags returned by ClientHello.AnomalyFlags
+const (
+	// AnomalyExtensionsLength is when the declared length of the extensions block isn't the sum of the extensions
+	AnomalyExtensionsLength = "extensions_length_mismatch"
+	// AnomalyDuplicateExtension is when an extension type appears more than once
+	AnomalyDuplicateExtension = "duplicate_extension"
+	// AnomalyOddCipherSuitesLength is when the cipher suites don't divide into two byte values. parseClientHello
+	// rejects such ClientHellos with ErrCipherSuitesLength
+	AnomalyOddCipherSuitesLength = "odd_cipher_suites_length"
+	// AnomalyNoCipherSuites is when no cipher suite is offered at all, which parseClientHello also rejects
+	AnomalyNoCipherSuites = "no_cipher_suites"
+	// AnomalyCompressionMethods is when the compression methods are anything other than null alone
+	AnomalyCompressionMethods = "unusual_compression_methods"
+	// AnomalySessionIdLength is when legacy_session_id is neither empty nor 32 bytes, which browsers never send
+	AnomalySessionIdLength = "unusual_session_id_length"
+	// AnomalyInnerLength is when the length prefix inside a well known extension doesn't match the extension's length
+	AnomalyInnerLength = "extension_inner_length_mismatch"
+	// AnomalyHugePadding is when the padding extension is longer than any browser pads
+	AnomalyHugePadding = "huge_padding"
+	// AnomalyNonZeroPadding is when the padding extension isn't all zeros, as RFC 7685 requires
+	AnomalyNonZeroPadding = "nonzero_padding"
+)
+
+// maxPlausiblePadding is the longest padding extension we expect. Browsers pad ClientHellos to 512 bytes, so their
+// padding never gets close to this
+const maxPlausiblePadding = 512
+
+// innerLengthPrefixes is the width of the length prefix at the start of some well known extensions, which is
+// followed by exactly that many bytes
+var innerLengthPrefixes = map[[2]byte]int{
+	{0x00, 0x00}: 2, // server_name
+	{0x00, 0x0a}: 2, // supported_groups
+	{0x00, 0x0b}: 1, // ec_point_formats
+	{0x00, 0x0d}: 2, // signature_algorithms
+	{0x00, 0x10}: 2, // application_layer_protocol_negotiation
+	{0x00, 0x2b}: 1, // supported_versions
+	{0x00, 0x2d}: 1, // psk_key_exchange_modes
+	{0x00, 0x33}: 2, // key_share
+}
+
+// AnomalyFlags checks the length fields of the ClientHello against each other and against what they describe, and
+// flags values that are self-consistent but no real browser would produce. A ClientHello that has parsed
+// successfully can still be handcrafted, and these flags are hints of that. It returns nil if nothing is amiss
+func (ch *ClientHello) AnomalyFlags() (flags []string) {
+	if ch.cipherSuitesLen == 0 {
+		flags = append(flags, AnomalyNoCipherSuites)
+	}
+	if ch.cipherSuitesLen%2 != 0 {
+		flags = append(flags, AnomalyOddCipherSuitesLength)
+	}
+	if !bytes.Equal(ch.compressionMethods, []byte{0x00}) {
+		flags = append(flags, AnomalyCompressionMethods)
+	}
+	if ch.sessionIdLen != 0 && ch.sessionIdLen != 32 {
+		flags = append(flags, AnomalySessionIdLength)
+	}
+
+	if len(ch.extensionOrder) != len(ch.extensions) {
+		// the extensions map only keeps the last of the duplicates, so the lengths can't be added up
+		flags = append(flags, AnomalyDuplicateExtension)
+	} else {
+		var sum int
+		for _, typ := range ch.extensionOrder {
+			sum += 4 + len(ch.extensions[typ])
+		}
+		if sum != ch.extensionsLen {
+			flags = append(flags, AnomalyExtensionsLength)
+		}
+	}
+
+	for typ, prefixLen := range innerLengthPrefixes {
+		data, ok := ch.extensions[typ]
+		if !ok {
+			continue
+		}
+		if !innerLengthMatches(data, prefixLen) {
+			flags = append(flags, AnomalyInnerLength)
+			break
+		}
+	}
+
+	if padding, ok := ch.extensions[[2]byte{0x00, 0x15}]; ok {
+		if len(padding) > maxPlausiblePadding {
+			flags = append(flags, AnomalyHugePadding)
+		}
+		for _, b := range padding {
+			if b != 0x00 {
+				flags = append(flags, AnomalyNonZeroPadding)
+				break
+			}
+		}
+	}
+	return
+}
+
+// innerLengthMatches checks if data starts with a big endian length of prefixLen bytes which covers the rest of data
+func innerLengthMatches(data []byte, prefixLen int) bool {
+	if len(data) < prefixLen {
+		return false
+	}
+	var length int
+	for _, b := range data[:prefixLen] {
+		length = length<<8 | int(b)
+	}
+	return length == len(data)-prefixLen
+}
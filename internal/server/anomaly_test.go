@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAnomalyFlags(t *testing.T) {
+	parse := func(t *testing.T, chBytes []byte) *ClientHello {
+		ch, err := parseClientHello(chBytes, DefaultParseOptions)
+		if err != nil {
+			t.Fatalf("failed to parse ClientHello: %v", err)
+		}
+		return ch
+	}
+
+	t.Run("real ClientHellos", func(t *testing.T) {
+		for _, hello := range []string{chromeClientHello, chromeResumptionClientHello, cloakClientHello} {
+			chBytes, _ := hex.DecodeString(hello)
+			assert.Empty(t, parse(t, chBytes).AnomalyFlags())
+		}
+	})
+	t.Run("test ClientHello", func(t *testing.T) {
+		assert.Empty(t, parse(t, newTestClientHello().marshal()).AnomalyFlags())
+	})
+	t.Run("extensions length", func(t *testing.T) {
+		chBytes := newTestClientHello().marshal()
+		ch := parse(t, chBytes)
+		// the extensions length sits right before the first extension, server_name
+		extensionsLenOffset := len(chBytes) - ch.extensionsLen - 2
+		chBytes[extensionsLenOffset+1] -= 1
+		assert.Equal(t, []string{AnomalyExtensionsLength}, parse(t, chBytes).AnomalyFlags())
+	})
+	t.Run("duplicate extension", func(t *testing.T) {
+		tch := newTestClientHello()
+		tch.extensions = append(tch.extensions, testExtension{[2]byte{0x00, 0x17}, nil}, testExtension{[2]byte{0x00, 0x17}, nil})
+		assert.Equal(t, []string{AnomalyDuplicateExtension}, parse(t, tch.marshal()).AnomalyFlags())
+	})
+	t.Run("cipher suites", func(t *testing.T) {
+		// the parser rules these out, so they can only be flagged on a ClientHello that didn't come from it
+		ch := parse(t, newTestClientHello().marshal())
+		ch.cipherSuites = []byte{0x13, 0x01, 0x13}
+		ch.cipherSuitesLen = 3
+		assert.Equal(t, []string{AnomalyOddCipherSuitesLength}, ch.AnomalyFlags())
+
+		ch.cipherSuites = nil
+		ch.cipherSuitesLen = 0
+		assert.Equal(t, []string{AnomalyNoCipherSuites}, ch.AnomalyFlags())
+	})
+	t.Run("compression methods", func(t *testing.T) {
+		tch := newTestClientHello()
+		tch.compressionMethods = []byte{0x01, 0x00}
+		assert.Equal(t, []string{AnomalyCompressionMethods}, parse(t, tch.marshal()).AnomalyFlags())
+	})
+	t.Run("session id length", func(t *testing.T) {
+		tch := newTestClientHello()
+		tch.sessionId = tch.sessionId[:16]
+		assert.Equal(t, []string{AnomalySessionIdLength}, parse(t, tch.marshal()).AnomalyFlags())
+
+		tch.sessionId = nil
+		assert.Empty(t, parse(t, tch.marshal()).AnomalyFlags())
+	})
+	t.Run("inner length", func(t *testing.T) {
+		tch := newTestClientHello().withExtension([2]byte{0x00, 0x0a}, []byte{0x00, 0x06, 0x00, 0x1d, 0x00, 0x17})
+		assert.Equal(t, []string{AnomalyInnerLength}, parse(t, tch.marshal()).AnomalyFlags())
+	})
+	t.Run("padding", func(t *testing.T) {
+		tch := newTestClientHello().withExtension([2]byte{0x00, 0x15}, make([]byte, 200))
+		assert.Empty(t, parse(t, tch.marshal()).AnomalyFlags())
+
+		tch = tch.withExtension([2]byte{0x00, 0x15}, make([]byte, 4000))
+		assert.Equal(t, []string{AnomalyHugePadding}, parse(t, tch.marshal()).AnomalyFlags())
+
+		padding := make([]byte, 200)
+		padding[100] = 0x01
+		tch = tch.withExtension([2]byte{0x00, 0x15}, padding)
+		assert.Equal(t, []string{AnomalyNonZeroPadding}, parse(t, tch.marshal()).AnomalyFlags())
+	})
+	t.Run("several", func(t *testing.T) {
+		tch := newTestClientHello().withExtension([2]byte{0x00, 0x15}, make([]byte, 4000))
+		tch.compressionMethods = []byte{0x01}
+		tch.sessionId = tch.sessionId[:8]
+		assert.Equal(t, []string{AnomalyCompressionMethods, AnomalySessionIdLength, AnomalyHugePadding}, parse(t, tch.marshal()).AnomalyFlags())
+	})
+}
@@ -16,24 +16,49 @@ type ClientInfo struct {
 	SessionId        uint32
 	ProxyMethod      string
 	EncryptionMethod byte
-	Unordered        bool
-	Transport        Transport
+	// Unordered is whether the client wants its session to carry UDP, which it says with UNORDERED_FLAG. Frames of an
+	// unordered session are delivered to its streams as they arrive, one datagram each
+	Unordered   bool
+	Compression bool
+	Transport   Transport
+	// ALPN is the application layer protocol selected from those offered by the client, or empty if none was
+	ALPN string
+	// HandshakeLength is how many bytes at the start of the first packet are the handshake of Transport
+	HandshakeLength int
+	// EarlyData is what the client has sent after the handshake, either in the first packet or right after it if
+	// State.ReadAhead is set, exactly as it was received. It may end in the middle of a TLS record. It belongs to the
+	// session, which reads it before anything else from the connection and decrypts it as the start of the first
+	// Cloak frame
+	EarlyData []byte
+	// ParseDuration is how long the first packet took to be parsed, before anything in it was decrypted
+	ParseDuration time.Duration
 }
 
 type authFragments struct {
-	sharedSecret      [32]byte
-	randPubKey        [32]byte
+	sharedSecret [32]byte
+	randPubKey   [32]byte
+	// ciphertextWithTag is the client's fields sealed with AES-GCM, followed by the tag. Over TLS it's the
+	// session_id then the x25519 key_share, so a session_id that isn't the client's own fails the tag and can't be
+	// forged, and one that is replayed comes with a random already used
 	ciphertextWithTag [64]byte
+	offeredALPN       []string
+	// clientHello is the parsed ClientHello if the transport is TLS
+	clientHello *ClientHello
+	// parseDuration is how long the first packet took to be parsed
+	parseDuration time.Duration
 }
 
+// Flags of the byte after the session id in the authenticated data of a client
 const (
-	UNORDERED_FLAG = 0x01 // 0000 0001
+	UNORDERED_FLAG   = 0x01 // 0000 0001
+	COMPRESSION_FLAG = 0x02 // 0000 0010
 )
 
 var ErrTimestampOutOfWindow = errors.New("timestamp is outside of the accepting window")
 
-// decryptClientInfo checks if a the authFragments are valid. It doesn't check if the UID is authorised
-func decryptClientInfo(fragments authFragments, serverTime time.Time) (info ClientInfo, err error) {
+// decryptClientInfo checks if a the authFragments are valid, with a timestamp within tolerance of serverTime. It
+// doesn't check if the UID is authorised
+func decryptClientInfo(fragments authFragments, serverTime time.Time, tolerance time.Duration) (info ClientInfo, err error) {
 	var plaintext []byte
 	plaintext, err = common.AESGCMDecrypt(fragments.randPubKey[0:12], fragments.sharedSecret[:], fragments.ciphertextWithTag[:])
 	if err != nil {
@@ -46,12 +71,13 @@ func decryptClientInfo(fragments authFragments, serverTime time.Time) (info Clie
 		ProxyMethod:      string(bytes.Trim(plaintext[16:28], "\x00")),
 		EncryptionMethod: plaintext[28],
 		Unordered:        plaintext[41]&UNORDERED_FLAG != 0,
+		Compression:      plaintext[41]&COMPRESSION_FLAG != 0,
 	}
 
 	timestamp := int64(binary.BigEndian.Uint64(plaintext[29:37]))
 	clientTime := time.Unix(timestamp, 0)
-	if !(clientTime.After(serverTime.Add(-timestampTolerance)) && clientTime.Before(serverTime.Add(timestampTolerance))) {
-		err = fmt.Errorf("%v: received timestamp %v", ErrTimestampOutOfWindow, timestamp)
+	if !(clientTime.After(serverTime.Add(-tolerance)) && clientTime.Before(serverTime.Add(tolerance))) {
+		err = fmt.Errorf("%w: received timestamp %v", ErrTimestampOutOfWindow, timestamp)
 		return
 	}
 	info.SessionId = binary.BigEndian.Uint32(plaintext[37:41])
@@ -67,26 +93,101 @@ var ErrBadDecryption = errors.New("decryption/authentication faliure")
 // is authorised. It also returns a finisher callback function to be called when the caller wishes to proceed with
 // the handshake
 func AuthFirstPacket(firstPacket []byte, transport Transport, sta *State) (info ClientInfo, finisher Responder, err error) {
-	fragments, finisher, err := transport.processFirstPacket(firstPacket, sta.StaticPv)
+	// outside of the accept windows, every connection is treated as if there were no Cloak server
+	if !sta.acceptingHandshakes() {
+		err = ErrOutsideAcceptWindow
+		return
+	}
+	// nor is a ClientHello for a name not enabled for Cloak looked into any further
+	if !sta.cloakServerNameEnabled(firstPacket, transport) {
+		err = ErrServerNameNotEnabled
+		return
+	}
+
+	handshakeLen := handshakeLength(firstPacket, transport)
+	fragments, finisher, err := transport.processFirstPacket(firstPacket[:handshakeLen], sta.StaticPv)
 	if err != nil {
 		return
 	}
 
-	if sta.registerRandom(fragments.randPubKey) {
+	if fragments.clientHello != nil {
+		err = sta.checkClientHello(fragments.clientHello)
+		if err != nil {
+			return
+		}
+	}
+
+	replayed := sta.registerRandom(fragments.randPubKey)
+	// a replay is only decrypted to find out which UID it claims to be from
+	if replayed && sta.RandomIndex == nil {
 		err = ErrReplay
 		return
 	}
 
-	info, err = decryptClientInfo(fragments, sta.WorldState.Now().UTC())
+	info, err = decryptClientInfo(fragments, sta.WorldState.Now().UTC(), sta.clockSkewTolerance())
 	if err != nil {
+		if replayed {
+			err = ErrReplay
+			return
+		}
 		log.Debug(err)
 		err = fmt.Errorf("%w: %v", ErrBadDecryption, err)
 		return
 	}
+	err = sta.checkRandomReuse(fragments.randPubKey, info.UID, replayed)
+	if err != nil {
+		return
+	}
+	if replayed {
+		err = ErrReplay
+		return
+	}
+	// the proxy method asked for may be gone from ProxyBook if it's overridden
+	err = sta.applyUIDPolicy(&info)
+	if err != nil {
+		return
+	}
 	if _, ok := sta.ProxyBook[info.ProxyMethod]; !ok {
 		err = ErrBadProxyMethod
 		return
 	}
 	info.Transport = transport
+	info.ALPN = sta.serverProfile(info.UID).selectALPN(fragments.offeredALPN)
+	info.HandshakeLength = handshakeLen
+	info.ParseDuration = fragments.parseDuration
+	if handshakeLen < len(firstPacket) {
+		info.EarlyData = append([]byte{}, firstPacket[handshakeLen:]...)
+	}
 	return
 }
+
+// handshakeLength is how many bytes at the start of firstPacket are the handshake of transport: the records carrying
+// the ClientHello for TLS, or the HTTP request up to its blank line for WebSocket. Anything after them was sent by the client without
+// waiting for the handshake reply
+func handshakeLength(firstPacket []byte, transport Transport) int {
+	switch transport.(type) {
+	case TLS:
+		if len(firstPacket) < 5 {
+			return len(firstPacket)
+		}
+		if _, length, complete := handshakeFragments(firstPacket); complete && length < len(firstPacket) {
+			return length
+		}
+		if length := 5 + int(u16(firstPacket[3:5])); length < len(firstPacket) {
+			return length
+		}
+	case WebSocket:
+		if i := bytes.Index(firstPacket, []byte("\r\n\r\n")); i != -1 {
+			return i + 4
+		}
+	}
+	return len(firstPacket)
+}
+
+// authFirstPacket checks the first packet with Authenticate if it's set, or AuthFirstPacket otherwise
+func (sta *State) authFirstPacket(firstPacket []byte, transport Transport) (ClientInfo, Responder, error) {
+	if sta.Authenticate != nil {
+		return sta.Authenticate(firstPacket, transport, sta)
+	}
+	return AuthFirstPacket(firstPacket, transport, sta)
+}
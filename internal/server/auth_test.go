@@ -1,11 +1,16 @@
 package server
 
 import (
+	"bytes"
 	"crypto"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/ecdh"
+	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,7 +22,7 @@ func TestDecryptClientInfo(t *testing.T) {
 
 	t.Run("correct time", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		ch, _ := parseClientHello(chBytes)
+		ch, _ := parseClientHello(chBytes, DefaultParseOptions)
 		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
@@ -25,7 +30,7 @@ func TestDecryptClientInfo(t *testing.T) {
 		}
 
 		nineSixSix := time.Unix(1565998966, 0)
-		cinfo, err := decryptClientInfo(ai, nineSixSix)
+		cinfo, err := decryptClientInfo(ai, nineSixSix, timestampTolerance)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
@@ -36,7 +41,7 @@ func TestDecryptClientInfo(t *testing.T) {
 	})
 	t.Run("roughly correct time", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		ch, _ := parseClientHello(chBytes)
+		ch, _ := parseClientHello(chBytes, DefaultParseOptions)
 		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
@@ -44,13 +49,13 @@ func TestDecryptClientInfo(t *testing.T) {
 		}
 
 		nineSixSixP50 := time.Unix(1565998966, 0).Add(50)
-		_, err = decryptClientInfo(ai, nineSixSixP50)
+		_, err = decryptClientInfo(ai, nineSixSixP50, timestampTolerance)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
 		}
 		nineSixSixM50 := time.Unix(1565998966, 0).Add(-50)
-		_, err = decryptClientInfo(ai, nineSixSixM50)
+		_, err = decryptClientInfo(ai, nineSixSixM50, timestampTolerance)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
@@ -59,7 +64,7 @@ func TestDecryptClientInfo(t *testing.T) {
 	})
 	t.Run("over interval", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		ch, _ := parseClientHello(chBytes)
+		ch, _ := parseClientHello(chBytes, DefaultParseOptions)
 		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
@@ -67,7 +72,7 @@ func TestDecryptClientInfo(t *testing.T) {
 		}
 
 		nineSixSixOver := time.Unix(1565998966, 0).Add(timestampTolerance + 10)
-		_, err = decryptClientInfo(ai, nineSixSixOver)
+		_, err = decryptClientInfo(ai, nineSixSixOver, timestampTolerance)
 		if err == nil {
 			t.Errorf("expecting %v, got %v", ErrTimestampOutOfWindow, err)
 			return
@@ -75,7 +80,7 @@ func TestDecryptClientInfo(t *testing.T) {
 	})
 	t.Run("under interval", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		ch, _ := parseClientHello(chBytes)
+		ch, _ := parseClientHello(chBytes, DefaultParseOptions)
 		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
@@ -83,7 +88,7 @@ func TestDecryptClientInfo(t *testing.T) {
 		}
 
 		nineSixSixUnder := time.Unix(1565998966, 0).Add(-(timestampTolerance + 10))
-		_, err = decryptClientInfo(ai, nineSixSixUnder)
+		_, err = decryptClientInfo(ai, nineSixSixUnder, timestampTolerance)
 		if err == nil {
 			t.Errorf("expecting %v, got %v", ErrTimestampOutOfWindow, err)
 			return
@@ -91,7 +96,7 @@ func TestDecryptClientInfo(t *testing.T) {
 	})
 	t.Run("not cloak psk", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010246010002420303794ae79c6db7a31e67e2ce91b8afcb82995ae79ad1d0dc885f933e4193bf95cd208abd7a70f3b82cc31c02f1c2b94ba74d5222a66695a5cf92a366421d7f5eb9530022fafa130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a010001d75a5a00000000001e001c0000196c68332e676f6f676c6575736572636f6e74656e742e636f6d00170000ff01000100000a000a0008baba001d00170018000b00020100002300000010000e000c02683208687474702f312e31000500050100000000000d00140012040308040401050308050501080606010201001200000033002b0029baba000100001d002074bfe93336c364b43cf0879d997b2e11dc97068b86fc90174e0f2bcea1d4ed1c002d00020101002b000b0ababa0304030303020301001b00030200029a9a0001000029010500e000da00d1f6c0918f865390ae3ca33c77f61a1974cb4533456071b214ec018d17dc22845f2f72cf1dba48f9cdc0758803002dda9b964fad5522e82442af7cbbe242241e39233386f2383bce3ced8e16b1ae3f0ef52a706f58e1e6a1bca0cd3b3a2a4c4cb738770b01b56bf3e73c472bf4fb238cab510aa78f8427a3ca99f741aa433f548be460705f43a3abe878cec6ee3158c129406910b93e798e8a7aaffc2e7ff7b8fd872778d3687a0beaa1452fe7ec418070d537344b64d09f6edd053346ff9c9678eef6b8886882aba81d4be11d9df653de35659f93a22ac39399e3ba400021204e22b73261693967a9216fe4a3b004571c53f316309e76671a18d78931b5b072")
-		ch, _ := parseClientHello(chBytes)
+		ch, _ := parseClientHello(chBytes, DefaultParseOptions)
 		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
@@ -99,7 +104,7 @@ func TestDecryptClientInfo(t *testing.T) {
 		}
 
 		fiveOSix := time.Unix(1565999506, 0)
-		cinfo, err := decryptClientInfo(ai, fiveOSix)
+		cinfo, err := decryptClientInfo(ai, fiveOSix, timestampTolerance)
 		if err == nil {
 			t.Errorf("not a cloak, got nil error and cinfo %v", cinfo)
 			return
@@ -107,7 +112,7 @@ func TestDecryptClientInfo(t *testing.T) {
 	})
 	t.Run("not cloak no psk", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303eae4c204a867390a758fcff3afa5803cac3e07011cf0c9f3befc1267445aabee20fc398df698113617f8161cbcb89534efa892088a6c5e49246534e05f790ea36f00220a0a130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a010001910a0a000000000014001200000f63646e2e62697a69626c652e636f6d00170000ff01000100000a000a0008caca001d00170018000b00020100002300000010000e000c02683208687474702f312e31000500050100000000000d00140012040308040401050308050501080606010201001200000033002b0029caca000100001d00204c8f1563fb70c261bc0c32c1b568b8d02fab25f4094711e7868b1712751dc754002d00020101002b000b0a2a2a0304030303020301001b00030200026a6a000100001500c9000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-		ch, _ := parseClientHello(chBytes)
+		ch, _ := parseClientHello(chBytes, DefaultParseOptions)
 		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
@@ -115,7 +120,7 @@ func TestDecryptClientInfo(t *testing.T) {
 		}
 
 		sixOneFive := time.Unix(1565999615, 0)
-		cinfo, err := decryptClientInfo(ai, sixOneFive)
+		cinfo, err := decryptClientInfo(ai, sixOneFive, timestampTolerance)
 		if err == nil {
 			t.Errorf("not a cloak, got nil error and cinfo %v", cinfo)
 			return
@@ -152,6 +157,51 @@ func TestAuthFirstPacket(t *testing.T) {
 			return
 		}
 	})
+	t.Run("TLS fragmented", func(t *testing.T) {
+		sta := getNewState()
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		fragmented := fragmentRecord(chBytes, 100, 300)
+		extra := []byte{0x17, 0x03, 0x03, 0x00, 0x05, 0x01, 0x02, 0x03, 0x04, 0x05}
+		info, _, err := AuthFirstPacket(append(append([]byte{}, fragmented...), extra...), TLS{}, sta)
+		if err != nil {
+			t.Errorf("failed to get client info: %v", err)
+			return
+		}
+		if info.HandshakeLength != len(fragmented) {
+			t.Errorf("expecting handshake length %v, got %v", len(fragmented), info.HandshakeLength)
+		}
+		if !bytes.Equal(info.EarlyData, extra) {
+			t.Errorf("expecting early data %x, got %x", extra, info.EarlyData)
+		}
+	})
+	t.Run("TLS with data after ClientHello", func(t *testing.T) {
+		sta := getNewState()
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		extra := []byte{0x17, 0x03, 0x03, 0x00, 0x05, 0x01, 0x02, 0x03, 0x04, 0x05}
+		info, _, err := AuthFirstPacket(append(append([]byte{}, chBytes...), extra...), TLS{}, sta)
+		if err != nil {
+			t.Errorf("failed to get client info: %v", err)
+			return
+		}
+		if info.HandshakeLength != len(chBytes) {
+			t.Errorf("expecting handshake length %v, got %v", len(chBytes), info.HandshakeLength)
+		}
+		if !bytes.Equal(info.EarlyData, extra) {
+			t.Errorf("expecting early data %x, got %x", extra, info.EarlyData)
+		}
+	})
+	t.Run("TLS with nothing after ClientHello", func(t *testing.T) {
+		sta := getNewState()
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		info, _, err := AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != nil {
+			t.Errorf("failed to get client info: %v", err)
+			return
+		}
+		if info.HandshakeLength != len(chBytes) || info.EarlyData != nil {
+			t.Errorf("expecting handshake length %v and no early data, got %v and %x", len(chBytes), info.HandshakeLength, info.EarlyData)
+		}
+	})
 	t.Run("TLS correct but replay", func(t *testing.T) {
 		sta := getNewState()
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
@@ -166,6 +216,147 @@ func TestAuthFirstPacket(t *testing.T) {
 			return
 		}
 	})
+	t.Run("TLS replay by the same UID with RandomIndex", func(t *testing.T) {
+		sta := getNewState()
+		sta.RandomIndex = MakeRandomIndex(time.Hour, 16)
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		_, _, err := AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != nil {
+			t.Errorf("failed to prepare for the first time: %v", err)
+			return
+		}
+		_, _, err = AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != ErrReplay {
+			t.Errorf("failed to return ErrReplay, got %v instead", err)
+		}
+	})
+	t.Run("TLS random of another UID", func(t *testing.T) {
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		ch, _ := parseClientHello(chBytes, DefaultParseOptions)
+		var random [32]byte
+		copy(random[:], ch.random)
+		otherUID := make([]byte, 16)
+
+		sta := getNewState()
+		sta.RandomIndex = MakeRandomIndex(time.Hour, 16)
+		sta.RandomIndex.Use(random, otherUID, sta.WorldState.Now())
+		// only logged
+		_, _, err := AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != nil {
+			t.Errorf("failed to get client info: %v", err)
+			return
+		}
+		_, _, err = AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != ErrCrossUIDReplay || !errors.Is(err, ErrReplay) {
+			t.Errorf("failed to return ErrCrossUIDReplay for a replay, got %v instead", err)
+			return
+		}
+
+		sta = getNewState()
+		sta.RandomIndex = MakeRandomIndex(time.Hour, 16)
+		sta.RejectCrossUIDReplays = true
+		sta.RandomIndex.Use(random, otherUID, sta.WorldState.Now())
+		_, _, err = AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != ErrCrossUIDReplay {
+			t.Errorf("failed to return ErrCrossUIDReplay, got %v instead", err)
+		}
+	})
+	t.Run("TLS ALPN selected by server preference", func(t *testing.T) {
+		sta := getNewState()
+		// the ClientHello offers h2 and http/1.1, in that order
+		sta.Profile = &ServerProfile{CipherSuite: DefaultServerProfile.CipherSuite, ALPN: []string{"http/1.1", "h2"}}
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		info, _, err := AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != nil {
+			t.Errorf("failed to get client info: %v", err)
+			return
+		}
+		if info.ALPN != "http/1.1" {
+			t.Errorf("expecting ALPN http/1.1, got %q", info.ALPN)
+		}
+	})
+	t.Run("TLS ALPN selected by client preference", func(t *testing.T) {
+		sta := getNewState()
+		sta.Profile = &ServerProfile{CipherSuite: DefaultServerProfile.CipherSuite, ALPN: []string{"http/1.1", "h2"}, ALPNPreference: ALPNClientPreference}
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		info, _, err := AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != nil {
+			t.Errorf("failed to get client info: %v", err)
+			return
+		}
+		if info.ALPN != "h2" {
+			t.Errorf("expecting ALPN h2, got %q", info.ALPN)
+		}
+	})
+	t.Run("TLS ALPN none in common", func(t *testing.T) {
+		sta := getNewState()
+		sta.Profile = &ServerProfile{CipherSuite: DefaultServerProfile.CipherSuite, ALPN: []string{"h3"}}
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		info, _, err := AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != nil {
+			t.Errorf("failed to get client info: %v", err)
+			return
+		}
+		if info.ALPN != "" {
+			t.Errorf("expecting no ALPN, got %q", info.ALPN)
+		}
+	})
+	t.Run("TLS with forged session_id", func(t *testing.T) {
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		// the session_id follows the record and handshake headers, the version, the random and its length
+		for _, offset := range []int{0, 17, 31} {
+			sta := getNewState()
+			forged := append([]byte{}, chBytes...)
+			forged[5+4+2+32+1+offset] ^= 0x01
+			_, _, err := AuthFirstPacket(forged, TLS{}, sta)
+			if !errors.Is(err, ErrBadDecryption) {
+				t.Errorf("expecting ErrBadDecryption with byte %v of session_id changed, got %v", offset, err)
+			}
+			if fallbackReason(err) != FallbackNotCloak {
+				t.Errorf("expecting a forged session_id to be relayed as not from a Cloak client, got %v", fallbackReason(err))
+			}
+		}
+	})
+	t.Run("TLS without session_id", func(t *testing.T) {
+		sta := getNewState()
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		sessionIdStart := 5 + 4 + 2 + 32 + 1
+		short := append(append([]byte{}, chBytes[:sessionIdStart]...), chBytes[sessionIdStart+32:]...)
+		short[sessionIdStart-1] = 0
+		binary.BigEndian.PutUint16(short[3:5], uint16(len(short)-5))
+		short[6], short[7], short[8] = 0, byte((len(short)-9)>>8), byte(len(short)-9)
+		_, _, err := AuthFirstPacket(short, TLS{}, sta)
+		if err == nil || !strings.Contains(err.Error(), ErrCiphertextLength.Error()) {
+			t.Errorf("expecting ErrCiphertextLength, got %v", err)
+		}
+		if fallbackReason(err) != FallbackNotCloak {
+			t.Errorf("expecting a missing session_id to be relayed as not from a Cloak client, got %v", fallbackReason(err))
+		}
+	})
+	t.Run("TLS within ClockSkewTolerance", func(t *testing.T) {
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		for _, skew := range []time.Duration{10*time.Minute - time.Second, -(10*time.Minute - time.Second)} {
+			sta := getNewState()
+			sta.ClockSkewTolerance = 10 * time.Minute
+			sta.WorldState = common.WorldOfTime(cloakClientHelloTime.Add(skew))
+			_, _, err := AuthFirstPacket(chBytes, TLS{}, sta)
+			if err != nil {
+				t.Errorf("failed to get client info with a clock skew of %v: %v", skew, err)
+			}
+		}
+	})
+	t.Run("TLS outside ClockSkewTolerance", func(t *testing.T) {
+		chBytes, _ := hex.DecodeString(cloakClientHello)
+		for _, skew := range []time.Duration{10*time.Minute + time.Second, -(10*time.Minute + time.Second)} {
+			sta := getNewState()
+			sta.ClockSkewTolerance = 10 * time.Minute
+			sta.WorldState = common.WorldOfTime(cloakClientHelloTime.Add(skew))
+			_, _, err := AuthFirstPacket(chBytes, TLS{}, sta)
+			if !errors.Is(err, ErrBadDecryption) || !strings.Contains(err.Error(), ErrTimestampOutOfWindow.Error()) {
+				t.Errorf("expecting ErrTimestampOutOfWindow with a clock skew of %v, got %v", skew, err)
+			}
+		}
+	})
 	t.Run("Websocket correct", func(t *testing.T) {
 		sta, _ := InitState(RawConfig{}, common.WorldOfTime(time.Unix(1584358419, 0)))
 		sta.StaticPv = p.(crypto.PrivateKey)
@@ -193,3 +384,84 @@ Upgrade: websocket
 	})
 
 }
+
+// makeTestAuthFragments encrypts the authentication data in the format of a Cloak client
+func makeTestAuthFragments(UID []byte, proxyMethod string, encryptionMethod byte, timestamp time.Time, sessionId uint32, flag byte) (fragments authFragments) {
+	plaintext := make([]byte, 48)
+	copy(plaintext, UID)
+	copy(plaintext[16:28], proxyMethod)
+	plaintext[28] = encryptionMethod
+	binary.BigEndian.PutUint64(plaintext[29:37], uint64(timestamp.Unix()))
+	binary.BigEndian.PutUint32(plaintext[37:41], sessionId)
+	plaintext[41] = flag
+
+	common.CryptoRandRead(fragments.randPubKey[:])
+	common.CryptoRandRead(fragments.sharedSecret[:])
+	ciphertextWithTag, _ := common.AESGCMEncrypt(fragments.randPubKey[:12], fragments.sharedSecret[:], plaintext)
+	copy(fragments.ciphertextWithTag[:], ciphertextWithTag)
+	return
+}
+
+func TestDecryptClientInfo_Flags(t *testing.T) {
+	UID := make([]byte, 16)
+	now := time.Unix(1565998966, 0)
+	for _, c := range []struct {
+		name        string
+		flag        byte
+		unordered   bool
+		compression bool
+	}{
+		{"none", 0x00, false, false},
+		{"unordered", UNORDERED_FLAG, true, false},
+		{"compression", COMPRESSION_FLAG, false, true},
+		{"both", UNORDERED_FLAG | COMPRESSION_FLAG, true, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fragments := makeTestAuthFragments(UID, "shadowsocks", 0x00, now, 1, c.flag)
+			info, err := decryptClientInfo(fragments, now, timestampTolerance)
+			if err != nil {
+				t.Fatalf("expecting no error, got %v", err)
+			}
+			if info.Unordered != c.unordered {
+				t.Errorf("expecting Unordered %v, got %v", c.unordered, info.Unordered)
+			}
+			if info.Compression != c.compression {
+				t.Errorf("expecting Compression %v, got %v", c.compression, info.Compression)
+			}
+		})
+	}
+}
+
+// discardConn is an in-memory net.Conn that discards whatever is written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (discardConn) Close() error                { return nil }
+
+// BenchmarkAuthFirstPacket measures the whole handshake from the ClientHello of a Cloak client to the reply
+func BenchmarkAuthFirstPacket(b *testing.B) {
+	sta, _ := InitState(RawConfig{}, common.WorldOfTime(cloakClientHelloTime))
+	sta.StaticPv = testStaticPv
+	sta.ProxyBook["shadowsocks"] = nil
+	chBytes, _ := hex.DecodeString(cloakClientHello)
+	var random [32]byte
+	// record layer 5, handshake header 4, client version 2
+	copy(random[:], chBytes[11:43])
+	var sessionKey [32]byte
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// or else every ClientHello after the first is a replay
+		delete(sta.UsedRandom, random)
+		_, finisher, err := AuthFirstPacket(chBytes, TLS{}, sta)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = finisher(discardConn{}, sessionKey, sta.WorldState.Rand, sta.replyComposer(nil))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
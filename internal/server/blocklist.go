@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Blocklist decides which source IPs have their connections closed before anything is read from them. FloodTracker
+// is one, and MemoryBlocklist holds a fixed list
+type Blocklist interface {
+	Blocked(ip string, now time.Time) bool
+}
+
+// MemoryBlocklist blocks IPs until a time of their own, and networks for good
+type MemoryBlocklist struct {
+	mutex    sync.RWMutex
+	ips      map[string]time.Time
+	networks []*net.IPNet
+}
+
+func MakeMemoryBlocklist() *MemoryBlocklist {
+	return &MemoryBlocklist{ips: make(map[string]time.Time)}
+}
+
+// ParseMemoryBlocklist makes a MemoryBlocklist of entries, each an IP address or a network in CIDR notation
+func ParseMemoryBlocklist(entries []string) (*MemoryBlocklist, error) {
+	b := MakeMemoryBlocklist()
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			b.Block(ip.String(), time.Time{})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%v in blocklist is neither an IP address nor a network", entry)
+		}
+		b.BlockNetwork(network)
+	}
+	return b, nil
+}
+
+// Block blocks ip until until, or for good if until is zero
+func (b *MemoryBlocklist) Block(ip string, until time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.ips[ip] = until
+}
+
+func (b *MemoryBlocklist) Unblock(ip string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.ips, ip)
+}
+
+func (b *MemoryBlocklist) BlockNetwork(network *net.IPNet) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.networks = append(b.networks, network)
+}
+
+// Blocked checks if ip is blocked at now. An IP whose block has passed is forgotten
+func (b *MemoryBlocklist) Blocked(ip string, now time.Time) bool {
+	b.mutex.RLock()
+	until, ok := b.ips[ip]
+	networks := b.networks
+	b.mutex.RUnlock()
+	if ok {
+		if until.IsZero() || now.Before(until) {
+			return true
+		}
+		b.mutex.Lock()
+		if b.ips[ip] == until {
+			delete(b.ips, ip)
+		}
+		b.mutex.Unlock()
+	}
+	if len(networks) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceBlocked checks if the source of conn is blocked by FloodTracker or Blocklist, in which case nothing should
+// be read from conn
+func (sta *State) sourceBlocked(conn net.Conn) bool {
+	if sta.FloodTracker == nil && sta.Blocklist == nil {
+		return false
+	}
+	ip, now := sourceIP(conn), sta.WorldState.Now()
+	if sta.FloodTracker != nil && sta.FloodTracker.Blocked(ip, now) {
+		sta.emitSecurityEvent(SecurityEventFlooding, conn, nil, "")
+		return true
+	}
+	if sta.Blocklist != nil && sta.Blocklist.Blocked(ip, now) {
+		sta.emitSecurityEvent(SecurityEventBlocklisted, conn, nil, "")
+		return true
+	}
+	return false
+}
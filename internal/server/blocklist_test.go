@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBlocklist(t *testing.T) {
+	start := time.Unix(1000, 0)
+	t.Run("IPs", func(t *testing.T) {
+		b := MakeMemoryBlocklist()
+		b.Block("1.2.3.4", time.Time{})
+		b.Block("5.6.7.8", start.Add(time.Minute))
+		assert.True(t, b.Blocked("1.2.3.4", start.Add(time.Hour)))
+		assert.True(t, b.Blocked("5.6.7.8", start))
+		assert.False(t, b.Blocked("5.6.7.8", start.Add(time.Minute)), "blocked past until")
+		assert.False(t, b.Blocked("9.9.9.9", start))
+		b.Unblock("1.2.3.4")
+		assert.False(t, b.Blocked("1.2.3.4", start))
+	})
+	t.Run("parsed", func(t *testing.T) {
+		b, err := ParseMemoryBlocklist([]string{"1.2.3.4", "10.0.0.0/8", "2001:db8::/32"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, b.Blocked("1.2.3.4", start))
+		assert.True(t, b.Blocked("10.20.30.40", start))
+		assert.True(t, b.Blocked("2001:db8::1", start))
+		assert.False(t, b.Blocked("11.0.0.1", start))
+		assert.False(t, b.Blocked("pipe", start))
+
+		_, err = ParseMemoryBlocklist([]string{"1.2.3"})
+		assert.Error(t, err)
+	})
+}
+
+// readCountingConn counts the reads from it, and comes from addr
+type readCountingConn struct {
+	net.Conn
+	addr  net.Addr
+	reads int32
+}
+
+func (c *readCountingConn) Read(b []byte) (int, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+func (c *readCountingConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestDispatchConnection_Blocklist(t *testing.T) {
+	sta, _, _ := makeDispatchTestState(t)
+	blocklist := MakeMemoryBlocklist()
+	blocklist.Block("203.0.113.7", time.Time{})
+	sta.Blocklist = blocklist
+
+	local, remote := connutil.AsyncPipe()
+	conn := &readCountingConn{Conn: remote, addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}}
+	done := make(chan struct{})
+	go func() {
+		dispatchConnection(conn, sta)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("connection from a blocked IP isn't dropped straight away")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&conn.reads), "read from a blocked IP")
+	_, err := local.Read(make([]byte, 1))
+	assert.Error(t, err, "connection from a blocked IP isn't closed")
+
+	// anyone else is dispatched as usual
+	local, remote = connutil.AsyncPipe()
+	conn = &readCountingConn{Conn: remote, addr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 51234}}
+	go dispatchConnection(conn, sta)
+	cloakBytes, _ := hex.DecodeString(cloakClientHello)
+	local.Write(cloakBytes)
+	records, err := readServerReply(local)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, records)
+	local.Close()
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBreakerWindow   = time.Minute
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// BreakerState is the state of the circuit of a proxy server
+type BreakerState int
+
+const (
+	// BreakerClosed relays streams to the proxy server as normal
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails streams straight away without connecting to the proxy server, until Cooldown has passed
+	BreakerOpen
+	// BreakerHalfOpen lets a single stream through to try the proxy server again. The circuit closes if it can be
+	// connected to, and opens again otherwise
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops relaying streams to a proxy server, by address, once Threshold consecutive connections to it
+// have failed within Window. Each upstream in ProxyUpstreams has a circuit of its own. A circuit is then open for
+// Cooldown, during which streams go to another upstream of the ring, or to a fallback in ProxyFallbacks if there is
+// one, or are closed straight away
+type CircuitBreaker struct {
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+
+	mutex    sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state BreakerState
+	// failures is the number of consecutive failures since firstFailure
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	// trying is whether the one stream let through while half-open is still connecting
+	trying bool
+}
+
+func MakeCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Window:    window,
+		Cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+func (b *CircuitBreaker) circuit(upstream string) *circuit {
+	c, ok := b.circuits[upstream]
+	if !ok {
+		c = &circuit{}
+		b.circuits[upstream] = c
+	}
+	return c
+}
+
+func (b *CircuitBreaker) transition(upstream string, c *circuit, state BreakerState) {
+	if c.state != state {
+		log.WithField("upstream", upstream).Infof("proxy server circuit %v", state)
+	}
+	c.state = state
+}
+
+// State returns the state of the circuit of upstream, an address as given by net.Addr.String, at now. An open circuit
+// whose Cooldown has passed is half-open
+func (b *CircuitBreaker) State(upstream string, now time.Time) BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c, ok := b.circuits[upstream]
+	if !ok {
+		return BreakerClosed
+	}
+	if c.state == BreakerOpen && !now.Before(c.openedAt.Add(b.Cooldown)) {
+		return BreakerHalfOpen
+	}
+	return c.state
+}
+
+// Blocked checks if a stream to upstream would be failed at now, which is while its circuit is open, or half-open
+// with another stream already trying the proxy server
+func (b *CircuitBreaker) Blocked(upstream string, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c, ok := b.circuits[upstream]
+	if !ok {
+		return false
+	}
+	switch c.state {
+	case BreakerOpen:
+		return now.Before(c.openedAt.Add(b.Cooldown))
+	case BreakerHalfOpen:
+		return c.trying
+	}
+	return false
+}
+
+// Allow checks if a stream may connect to the proxy server at upstream at now. If it may, Succeeded or Failed
+// must be called with how that went
+func (b *CircuitBreaker) Allow(upstream string, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := b.circuit(upstream)
+	switch c.state {
+	case BreakerOpen:
+		if now.Before(c.openedAt.Add(b.Cooldown)) {
+			return false
+		}
+		b.transition(upstream, c, BreakerHalfOpen)
+		c.trying = true
+		return true
+	case BreakerHalfOpen:
+		if c.trying {
+			return false
+		}
+		c.trying = true
+		return true
+	}
+	return true
+}
+
+// Succeeded records that the proxy server at upstream has been connected to, which closes its circuit
+func (b *CircuitBreaker) Succeeded(upstream string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := b.circuit(upstream)
+	c.failures = 0
+	c.trying = false
+	b.transition(upstream, c, BreakerClosed)
+}
+
+// Failed records that the proxy server at upstream couldn't be connected to at now
+func (b *CircuitBreaker) Failed(upstream string, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := b.circuit(upstream)
+	switch c.state {
+	case BreakerHalfOpen:
+		c.trying = false
+		c.openedAt = now
+		b.transition(upstream, c, BreakerOpen)
+		return
+	case BreakerOpen:
+		return
+	}
+	if c.failures == 0 || now.Sub(c.firstFailure) > b.Window {
+		c.failures = 0
+		c.firstFailure = now
+	}
+	c.failures++
+	if c.failures >= b.Threshold {
+		c.failures = 0
+		c.openedAt = now
+		b.transition(upstream, c, BreakerOpen)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	b := MakeCircuitBreaker(3, time.Minute, 30*time.Second)
+
+	t.Run("closed to open", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			assert.True(t, b.Allow("ss", now))
+			b.Failed("ss", now)
+		}
+		assert.Equal(t, BreakerClosed, b.State("ss", now))
+		assert.True(t, b.Allow("ss", now))
+		b.Failed("ss", now)
+		assert.Equal(t, BreakerOpen, b.State("ss", now))
+		assert.True(t, b.Blocked("ss", now))
+		assert.False(t, b.Allow("ss", now.Add(29*time.Second)), "streams are failed during the cooldown")
+	})
+
+	t.Run("open to half-open to open", func(t *testing.T) {
+		later := now.Add(30 * time.Second)
+		assert.Equal(t, BreakerHalfOpen, b.State("ss", later))
+		assert.False(t, b.Blocked("ss", later))
+		assert.True(t, b.Allow("ss", later))
+		assert.True(t, b.Blocked("ss", later), "only one stream tries the proxy server")
+		assert.False(t, b.Allow("ss", later))
+		b.Failed("ss", later)
+		assert.Equal(t, BreakerOpen, b.State("ss", later))
+		now = later
+	})
+
+	t.Run("half-open to closed", func(t *testing.T) {
+		later := now.Add(30 * time.Second)
+		assert.True(t, b.Allow("ss", later))
+		b.Succeeded("ss")
+		assert.Equal(t, BreakerClosed, b.State("ss", later))
+		assert.True(t, b.Allow("ss", later))
+		assert.True(t, b.Allow("ss", later))
+	})
+
+	t.Run("failures outside the window", func(t *testing.T) {
+		b.Failed("ss", now)
+		b.Failed("ss", now)
+		b.Failed("ss", now.Add(2*time.Minute))
+		assert.Equal(t, BreakerClosed, b.State("ss", now.Add(2*time.Minute)))
+	})
+
+	t.Run("success resets the count", func(t *testing.T) {
+		b.Failed("vpn", now)
+		b.Failed("vpn", now)
+		b.Succeeded("vpn")
+		b.Failed("vpn", now)
+		assert.Equal(t, BreakerClosed, b.State("vpn", now))
+		assert.Equal(t, BreakerClosed, b.State("unknown", now))
+	})
+}
+
+func TestState_ResolveProxyMethod_Breaker(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	sta := &State{
+		ProxyBook:      testProxyBook("up", "down"),
+		ProxyFallbacks: map[string]string{"down": "up"},
+		ProxyBreaker:   MakeCircuitBreaker(1, time.Minute, 30*time.Second),
+		WorldState:     common.WorldState{Now: func() time.Time { return now }},
+	}
+	sta.ProxyBreaker.Failed(sta.ProxyBook["down"].String(), now)
+	assert.Equal(t, "up", sta.resolveProxyMethod("down", nil), "streams go to the fallback while the circuit is open")
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, "down", sta.resolveProxyMethod("down", nil), "the proxy server is tried again once the cooldown has passed")
+}
+
+func TestState_ProxyBreaker_Upstreams(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	failing := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8388}
+	healthy := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8389}
+	ring := MakeHashRing([]net.Addr{failing, healthy})
+	sta := &State{
+		ProxyBook:      map[string]net.Addr{"shadowsocks": failing},
+		ProxyUpstreams: map[string]*HashRing{"shadowsocks": ring},
+		ProxyBreaker:   MakeCircuitBreaker(1, time.Minute, 30*time.Second),
+		WorldState:     common.WorldState{Now: func() time.Time { return now }},
+	}
+	var failingUID, healthyUID []byte
+	for failingUID == nil || healthyUID == nil {
+		UID := make([]byte, 16)
+		common.CryptoRandRead(UID)
+		if ring.Get(UID) == failing {
+			failingUID = UID
+		} else {
+			healthyUID = UID
+		}
+	}
+
+	assert.Equal(t, failing, sta.proxyAddr("shadowsocks", failingUID))
+	sta.ProxyBreaker.Failed(failing.String(), now)
+	assert.Equal(t, BreakerOpen, sta.ProxyBreaker.State(failing.String(), now))
+	assert.Equal(t, BreakerClosed, sta.ProxyBreaker.State(healthy.String(), now),
+		"a failing upstream doesn't open the circuit of another")
+
+	for _, UID := range [][]byte{healthyUID, failingUID} {
+		assert.Equal(t, "shadowsocks", sta.resolveProxyMethod("shadowsocks", UID))
+		assert.Equal(t, healthy, sta.proxyAddr("shadowsocks", UID), "an upstream with an open circuit is passed over")
+		assert.True(t, sta.ProxyBreaker.Allow(healthy.String(), now))
+		sta.ProxyBreaker.Succeeded(healthy.String())
+	}
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, failing, sta.proxyAddr("shadowsocks", failingUID),
+		"the failing upstream is tried again once the cooldown has passed")
+	assert.Equal(t, healthy, sta.proxyAddr("shadowsocks", healthyUID))
+}
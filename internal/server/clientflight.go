@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// clientFlightTimeout is how long the second flight of a client is waited for when the profile has
+	// AwaitClientFinished
+	clientFlightTimeout = 10 * time.Second
+	// maxClientFlightRecords is the most records a client's second flight may have. A TLS 1.2 client sends at most
+	// Certificate, ClientKeyExchange, CertificateVerify, ChangeCipherSpec and Finished
+	maxClientFlightRecords = 5
+)
+
+var ErrClientFlight = errors.New("unexpected second flight from client")
+
+// clientFinishedAwaiter tells whether a ReplyComposer's reply is to be written in two parts, with the client's second
+// flight read in between. A ReplyComposer without this method is written all at once
+type clientFinishedAwaiter interface {
+	awaitsClientFinished() bool
+}
+
+func (c TLSReplyComposer) awaitsClientFinished() bool {
+	return c.Profile.AwaitClientFinished
+}
+
+// splitAfterHandshakes splits reply into its Handshake records up to the first of any other type, which is
+// ChangeCipherSpec or the encrypted flight, and the rest
+func splitAfterHandshakes(reply []byte) (first, rest []byte, err error) {
+	records, err := splitRecords(reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset := 0
+	for _, record := range records {
+		if record[0] != 0x16 {
+			return reply[:offset], reply[offset:], nil
+		}
+		offset += len(record)
+	}
+	return nil, nil, fmt.Errorf("%w: no ChangeCipherSpec or encrypted flight", ErrMalformedReply)
+}
+
+// readClientFlight reads the second flight of a TLS 1.2 client, which is handshake messages such as
+// ClientKeyExchange, then ChangeCipherSpec and its encrypted Finished. What's in them isn't looked into
+func readClientFlight(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(clientFlightTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	changedCipherSpec := false
+	header := make([]byte, 5)
+	for i := 0; i < maxClientFlightRecords; i++ {
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			return fmt.Errorf("failed to read record header: %w", err)
+		}
+		length := int(u16(header[3:5]))
+		if length == 0 || length > maxTLSRecordLength {
+			return fmt.Errorf("%w: record length %v", ErrClientFlight, length)
+		}
+		_, err = io.ReadFull(conn, make([]byte, length))
+		if err != nil {
+			return fmt.Errorf("failed to read record payload: %w", err)
+		}
+		switch {
+		case header[0] == 0x14 && !changedCipherSpec:
+			changedCipherSpec = true
+		case header[0] == 0x16 && changedCipherSpec:
+			// Finished
+			return nil
+		case header[0] == 0x16:
+		default:
+			return fmt.Errorf("%w: record type %#x", ErrClientFlight, header[0])
+		}
+	}
+	return fmt.Errorf("%w: more than %v records", ErrClientFlight, maxClientFlightRecords)
+}
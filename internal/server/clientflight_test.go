@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSResponder_AwaitClientFinished(t *testing.T) {
+	var sharedSecret, sessionKey [32]byte
+	common.CryptoRandRead(sharedSecret[:])
+	common.CryptoRandRead(sessionKey[:])
+	sessionId := make([]byte, 32)
+	common.CryptoRandRead(sessionId)
+	ch := minimalClientHello(sessionId)
+	profile := ServerProfile{
+		CipherSuite:         0x1302,
+		TLS12Flight:         &TLS12Flight{CertificateLengths: []int{1300}, SignatureAlgorithm: 0x0804, SignatureLength: 256},
+		AwaitClientFinished: true,
+	}
+	composer := TLSReplyComposer{Profile: profile, Rand: rand.Reader}
+
+	respond := func(serverSide net.Conn) chan error {
+		respondErr := make(chan error, 1)
+		go func() {
+			_, err := TLS{}.makeResponder(ch, sharedSecret)(serverSide, sessionKey, rand.Reader, composer)
+			respondErr <- err
+		}()
+		return respondErr
+	}
+
+	t.Run("reply finished after client's flight", func(t *testing.T) {
+		serverSide, clientSide := net.Pipe()
+		defer clientSide.Close()
+		respondErr := respond(serverSide)
+
+		clientSide.SetReadDeadline(time.Now().Add(time.Second))
+		sh, err := readRecord(clientSide, 0x16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, checkServerHello(sh, sessionId, profile))
+		// the client reads the tag at the same offset as the encrypted session key
+		assert.Equal(t, common.DeferredFlightRecordsTag(sessionKey[:], 3), sh[112:116])
+		for _, msgType := range []byte{0x0b, 0x0c, 0x0e} {
+			message, err := readRecord(clientSide, 0x16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, msgType, message[0])
+		}
+
+		// nothing more until the client has sent its flight
+		clientSide.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err = clientSide.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("expecting a timeout, got %v", err)
+		}
+
+		go clientSide.Write(minimalClientFlight())
+		clientSide.SetReadDeadline(time.Now().Add(time.Second))
+		ccs, err := readRecord(clientSide, 0x14)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x01}, ccs)
+		_, err = readRecord(clientSide, 0x17)
+		assert.NoError(t, err)
+		assert.NoError(t, <-respondErr)
+	})
+
+	t.Run("unexpected client flight", func(t *testing.T) {
+		serverSide, clientSide := net.Pipe()
+		defer clientSide.Close()
+		respondErr := respond(serverSide)
+		go func() {
+			// the client goes straight to ApplicationData
+			clientSide.Write(addRecordLayer(make([]byte, 40), []byte{0x17}, []byte{0x03, 0x03}))
+		}()
+		clientSide.SetReadDeadline(time.Now().Add(time.Second))
+		for i := 0; i < 4; i++ {
+			_, err := readRecord(clientSide, 0x16)
+			assert.NoError(t, err)
+		}
+		err := <-respondErr
+		assert.True(t, errors.Is(err, ErrClientFlight), "got %v", err)
+	})
+
+	t.Run("self test", func(t *testing.T) {
+		assert.NoError(t, selfTest(profile))
+	})
+}
+
+func TestSplitAfterHandshakes(t *testing.T) {
+	TLS12 := []byte{0x03, 0x03}
+	sh := addRecordLayer([]byte{0x02, 0x00}, []byte{0x16}, TLS12)
+	rest := append(addRecordLayer([]byte{0x01}, []byte{0x14}, TLS12), addRecordLayer([]byte{0x00}, []byte{0x17}, TLS12)...)
+	first, second, err := splitAfterHandshakes(append(append([]byte{}, sh...), rest...))
+	assert.NoError(t, err)
+	assert.Equal(t, sh, first)
+	assert.Equal(t, rest, second)
+
+	_, _, err = splitAfterHandshakes(sh)
+	assert.True(t, errors.Is(err, ErrMalformedReply))
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrServerNameNotEnabled = errors.New("server name not enabled for Cloak")
+
+// parseCloakServerNames makes the set of CloakServerNames from names, which are matched without regard to case
+func parseCloakServerNames(names []string) map[string]struct{} {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[strings.ToLower(name)] = struct{}{}
+	}
+	return set
+}
+
+// cloakServerNameEnabled checks if the ClientHello in firstPacket is for one of CloakServerNames, and so may be from a
+// Cloak client. Every first packet is if there are no CloakServerNames. A ClientHello with no server_name, or one
+// that can't be parsed, isn't. The WebSocket transport carries no server_name, so its first packets always are
+func (sta *State) cloakServerNameEnabled(firstPacket []byte, transport Transport) bool {
+	if len(sta.CloakServerNames) == 0 {
+		return true
+	}
+	if _, ok := transport.(TLS); !ok {
+		return true
+	}
+	ch, err := parseClientHello(firstPacket, DefaultParseOptions)
+	if err != nil {
+		return false
+	}
+	name, err := ch.serverName()
+	if err != nil || name == "" {
+		return false
+	}
+	_, ok := sta.CloakServerNames[strings.ToLower(name)]
+	return ok
+}
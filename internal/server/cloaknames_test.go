@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloakServerNameEnabled(t *testing.T) {
+	cloakHello, _ := hex.DecodeString(cloakClientHello)
+	sta := &State{}
+	assert.True(t, sta.cloakServerNameEnabled(cloakHello, TLS{}), "everything is enabled without CloakServerNames")
+
+	sta.CloakServerNames = parseCloakServerNames([]string{"example.com", "WWW.Bing.com"})
+	assert.True(t, sta.cloakServerNameEnabled(cloakHello, TLS{}))
+	assert.True(t, sta.cloakServerNameEnabled(newTestClientHello().marshal(), TLS{}))
+	assert.False(t, sta.cloakServerNameEnabled(newTestClientHello().withExtension([2]byte{0x00, 0x00}, append([]byte{0x00, 0x0e, 0x00, 0x00, 0x0b}, "example.org"...)).marshal(), TLS{}))
+	assert.False(t, sta.cloakServerNameEnabled(newTestClientHello().withoutExtension([2]byte{0x00, 0x00}).marshal(), TLS{}), "a ClientHello without server_name is enabled")
+	assert.False(t, sta.cloakServerNameEnabled([]byte{0x16, 0x03, 0x01, 0x00, 0x01, 0x01}, TLS{}))
+	assert.True(t, sta.cloakServerNameEnabled([]byte("GET / HTTP/1.1\r\n\r\n"), WebSocket{}))
+}
+
+func TestDispatchConnection_CloakServerNames(t *testing.T) {
+	first, _ := hex.DecodeString(cloakClientHello)
+
+	t.Run("matching", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.CloakServerNames = parseCloakServerNames([]string{"www.bing.com"})
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		records, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		assert.Equal(t, byte(0x16), records[0][0])
+	})
+
+	t.Run("not matching", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.CloakServerNames = parseCloakServerNames([]string{"www.example.com"})
+		reasons := make(chan FallbackReason, 1)
+		sta.OnFallback = func(_ net.Conn, reason FallbackReason) { reasons <- reason }
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer redirConn.Close()
+		buf := make([]byte, len(first))
+		_, err = io.ReadFull(redirConn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, first, buf)
+		assert.Equal(t, FallbackNotCloak, <-reasons)
+		assert.False(t, sta.Panel.isActive(cloakClientHelloUID), "a session is made for a name not enabled")
+	})
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplyComposer composes the reply to the ClientHello of a Cloak client, which completes the handshake and gives
+// the client sessionKey encrypted with sharedSecret
+type ReplyComposer interface {
+	ComposeReply(ch *ClientHello, sharedSecret, sessionKey []byte) ([]byte, error)
+}
+
+// ErrKeyLength is returned by ComposeReply when sharedSecret or sessionKey isn't 32 bytes long
+var ErrKeyLength = errors.New("shared secret and session key must be 32 bytes long")
+
+const keyLength = 32
+
+// the cert length needs to be the same for all handshakes belonging to the same session
+var possibleCertLengths = []int{42, 27, 68, 59, 36, 44, 46}
+
+// TLSReplyComposer composes the ServerHello, ChangeCipherSpec and encrypted flight of the TLS server in Profile.
+// It's used unless State.ReplyComposer is set
+type TLSReplyComposer struct {
+	Profile ServerProfile
+	Rand    io.Reader
+	// FillerRand, if not nil, is read instead of Rand for the bytes that only have to look random: the encrypted
+	// flight, NewSessionTicket and SCTs. Rand is still read for nonces, the random and the session id
+	FillerRand io.Reader
+	// Now is the time the reply is composed at. time.Now is used if it's nil
+	Now func() time.Time
+	// PreferredKeyShareGroups are the named groups the key_share in ServerHello may be in, most preferred first.
+	// x25519 is used if it's empty
+	PreferredKeyShareGroups [][2]byte
+}
+
+// DefaultPreferredKeyShareGroups answers every Cloak client with x25519
+var DefaultPreferredKeyShareGroups = [][2]byte{x25519Group}
+
+// ErrKeyShareGroupNotOffered is returned by ComposeReply when none of the groups a reply can be given in has been
+// sent a key_share of by the client. A ServerHello with a key_share the client has no key for would give us away
+var ErrKeyShareGroupNotOffered = errors.New("no key_share of a group the reply can be given in")
+
+// selectKeyShareGroup picks the first of preferred which the client has sent a key_share of and which a handshake
+// reply can be given in. A Cloak client always sends x25519, which is picked if none of preferred is
+func selectKeyShareGroup(ch *ClientHello, preferred [][2]byte) ([2]byte, error) {
+	offered, err := ch.keyShareGroups()
+	if err != nil {
+		return [2]byte{}, fmt.Errorf("%w: %v", ErrKeyShareGroupNotOffered, err)
+	}
+	isOffered := func(group [2]byte) bool {
+		for _, o := range offered {
+			if o == u16(group[:]) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, group := range preferred {
+		if _, ok := keyExchangeLengths[group]; ok && isOffered(group) {
+			return group, nil
+		}
+	}
+	if !isOffered(x25519Group) {
+		return [2]byte{}, fmt.Errorf("%w: client sent key_shares of %x, preferred %x", ErrKeyShareGroupNotOffered, offered, preferred)
+	}
+	return x25519Group, nil
+}
+
+func (c TLSReplyComposer) ComposeReply(ch *ClientHello, sharedSecret, sessionKey []byte) ([]byte, error) {
+	// the session key is always encrypted into the same 48 bytes of the ServerHello, so anything but a 32 byte key
+	// would give the client a corrupt one
+	if len(sharedSecret) != keyLength || len(sessionKey) != keyLength {
+		return nil, fmt.Errorf("%w: got %v and %v", ErrKeyLength, len(sharedSecret), len(sessionKey))
+	}
+	profile := c.Profile
+	cipherSuite, err := profile.negotiateCipherSuite(ch)
+	if err != nil {
+		return nil, err
+	}
+	profile.CipherSuite = cipherSuite
+	filler := c.Rand
+	if c.FillerRand != nil {
+		filler = c.FillerRand
+	}
+	// we can use sessionKey as a seed here to ensure the cert length is consistent within a session
+	rand.Seed(int64(sessionKey[0]))
+	certLength := possibleCertLengths[rand.Intn(len(possibleCertLengths))]
+	// the whole session key seeds the draw from a histogram, which would be skewed by having only 256 seeds
+	sessionRand := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sessionKey[:8]))))
+	certLength, err = profile.sampleCertLength(sessionRand, certLength)
+	if err != nil {
+		return nil, err
+	}
+	exts, dropped := profile.replyExtensions(ch)
+	if len(dropped) > 0 {
+		log.WithField("extensions", dropped).Debug("leaving out extensions of the server profile not offered by the client")
+	}
+	// a compressed certificate makes for a shorter flight
+	if exts.certCompression {
+		profile.FlightLengths = profile.CertCompression.FlightLengths
+	}
+	// and a delegated credential makes for a longer one
+	if exts.delegatedCredential {
+		profile, certLength = profile.withDelegatedCredential(certLength)
+	}
+	// the encrypted flight ends with a Finished message whose length depends on the hash of the cipher suite
+	recordLengths := profile.flightRecordLengths(certLength)
+	// an h2 server starts the connection with its SETTINGS straight after the handshake
+	if profile.H2Settings && exts.alpn == "h2" {
+		recordLengths = append(recordLengths, profile.h2SettingsRecordLength())
+	}
+	// and one that supports h3 advertises it for the origin the client wants
+	if origin := profile.altSvcOrigin(ch); profile.AltSvc != "" && exts.alpn == "h2" && origin != "" {
+		recordLengths = append(recordLengths, profile.altSvcRecordLength(origin))
+	}
+	if len(recordLengths) > common.MaxExtraFlightRecords {
+		return nil, fmt.Errorf("%v encrypted flight records, which is more than a client can take", len(recordLengths))
+	}
+	flight := make([][]byte, len(recordLengths))
+	for i, length := range recordLengths {
+		if length > maxTLSRecordLength {
+			return nil, fmt.Errorf("encrypted flight record length %v is too long", length)
+		}
+		flight[i] = make([]byte, length)
+		_, err = io.ReadFull(filler, flight[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to get random bytes for encrypted flight: %w", err)
+		}
+	}
+	keyShareGroup, err := selectKeyShareGroup(ch, c.PreferredKeyShareGroups)
+	if err != nil {
+		return nil, err
+	}
+	var handshakes [][]byte
+	if profile.TLS12Flight != nil {
+		handshakes, err = compose12Flight(*profile.TLS12Flight, keyShareGroup, filler)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if exts.sessionTicket {
+		newSessionTicket, err := composeNewSessionTicket(filler)
+		if err != nil {
+			return nil, err
+		}
+		handshakes = append(handshakes, newSessionTicket)
+	}
+	// the client reads the usual single record unless told otherwise
+	extraRecords := len(flight) - 1 + len(handshakes)
+	if extraRecords > common.MaxExtraFlightRecords {
+		return nil, fmt.Errorf("%v extra records in the handshake reply, which is more than a client can take", extraRecords)
+	}
+	var keyShareTail []byte
+	if profile.AwaitClientFinished {
+		keyShareTail = common.DeferredFlightRecordsTag(sessionKey, extraRecords)
+	} else if extraRecords > 0 {
+		keyShareTail = common.FlightRecordsTag(sessionKey, extraRecords)
+	}
+
+	sessionId := ch.sessionId
+	if profile.SessionIdPolicy == SessionIdFresh {
+		sessionId = make([]byte, freshSessionIdLength)
+		_, err = io.ReadFull(c.Rand, sessionId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get random bytes for session id: %w", err)
+		}
+	}
+
+	nonce, encryptedSessionKeyArr, err := c.encryptSessionKey(sharedSecret, sessionKey, keyShareGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := serverHelloFields{
+		sessionId:                  sessionId,
+		nonce:                      nonce,
+		encryptedSessionKeyWithTag: encryptedSessionKeyArr,
+		keyShareGroup:              keyShareGroup,
+		keyShareTail:               keyShareTail,
+		sessionTicket:              exts.sessionTicket,
+	}
+	if profile.TLS12ServerHello {
+		fields.tls12Extensions = ch.tls12Extensions()
+	}
+	if exts.sct {
+		now := time.Now
+		if c.Now != nil {
+			now = c.Now
+		}
+		fields.sctList, err = composeSCTList(filler, now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	// a client sending an empty session id isn't in middlebox compatibility mode, so a TLS 1.3 server doesn't send it
+	// the dummy ChangeCipherSpec. A Cloak client always sends a session id
+	changeCipherSpec := len(ch.sessionId) > 0
+	return composeReply(fields, handshakes, changeCipherSpec, flight, profile, c.Rand)
+}
+
+// maxNonceAttempts is the most nonces tried for the encrypted session key to fit in a key exchange. One in 256 fits
+// a secp256r1 one, so running out of attempts is all but impossible
+const maxNonceAttempts = 4096
+
+// encryptSessionKey encrypts sessionKey with sharedSecret and a random nonce. The 21st byte of the encrypted session
+// key is the first of the key exchange, which for secp256r1 must be 0x04 as that of an uncompressed point, so nonces
+// are tried until it is. To anyone without sharedSecret the nonce chosen looks as random as any other
+func (c TLSReplyComposer) encryptSessionKey(sharedSecret, sessionKey []byte, keyShareGroup [2]byte) (nonce [12]byte, encrypted [48]byte, err error) {
+	for i := 0; i < maxNonceAttempts; i++ {
+		_, err = io.ReadFull(c.Rand, nonce[:])
+		if err != nil {
+			err = fmt.Errorf("failed to get random bytes for nonce: %w", err)
+			return
+		}
+		var ciphertext []byte
+		ciphertext, err = common.AESGCMEncrypt(nonce[:], sharedSecret, sessionKey)
+		if err != nil {
+			return
+		}
+		copy(encrypted[:], ciphertext)
+		if keyShareGroup != secp256r1Group || encrypted[20] == 0x04 {
+			return
+		}
+	}
+	err = fmt.Errorf("%w: no nonce found for the encrypted session key", ErrNoP256Point)
+	return
+}
+
+// replyComposer returns the ReplyComposer for the handshake reply to the user
+func (sta *State) replyComposer(UID []byte) ReplyComposer {
+	if sta.ReplyComposer != nil {
+		return sta.ReplyComposer
+	}
+	return TLSReplyComposer{
+		Profile:                 sta.serverProfile(UID),
+		Rand:                    sta.WorldState.Rand,
+		FillerRand:              sta.FillerRand,
+		Now:                     sta.WorldState.Now,
+		PreferredKeyShareGroups: sta.PreferredKeyShareGroups,
+	}
+}
@@ -0,0 +1,1101 @@
+package server
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+)
+
+// stubComposer replies with the session id of the ClientHello followed by the session key in plain
+type stubComposer struct{}
+
+func (stubComposer) ComposeReply(ch *ClientHello, sharedSecret, sessionKey []byte) ([]byte, error) {
+	return append(append([]byte{}, ch.sessionId...), sessionKey...), nil
+}
+
+func TestReplyComposer(t *testing.T) {
+	t.Run("stub", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.ReplyComposer = stubComposer{}
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		ch, _ := parseClientHello(first, DefaultParseOptions)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		reply := make([]byte, 64)
+		_, err := io.ReadFull(local, reply)
+		assert.NoError(t, err)
+		assert.Equal(t, ch.sessionId, reply[:32])
+
+		user, err := sta.Panel.GetBypassUser(cloakClientHelloUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sesh, existing, err := user.GetSession(3710878841, mux.SessionConfig{})
+		assert.NoError(t, err)
+		assert.True(t, existing, "composer isn't called for a new session")
+		assert.Equal(t, sesh.SessionKey[:], reply[32:])
+		local.Close()
+	})
+
+	t.Run("TLS by default", func(t *testing.T) {
+		sta := &State{Profile: &ServerProfile{CipherSuite: 0x1301}}
+		composer, ok := sta.replyComposer(nil).(TLSReplyComposer)
+		if assert.True(t, ok) {
+			assert.Equal(t, uint16(0x1301), composer.Profile.CipherSuite)
+		}
+	})
+
+	t.Run("TLS reply", func(t *testing.T) {
+		sessionId := bytes.Repeat([]byte{0x01}, 32)
+		composer := TLSReplyComposer{Profile: DefaultServerProfile, Rand: bytes.NewReader(make([]byte, 1000))}
+		reply, err := composer.ComposeReply(minimalClientHello(sessionId), make([]byte, 32), make([]byte, 32))
+		assert.NoError(t, err)
+		assert.NoError(t, checkServerReply(bytes.NewReader(reply), sessionId, DefaultServerProfile))
+	})
+}
+
+func TestTLSReplyComposer_FlightLengths(t *testing.T) {
+	chBytes, _ := hex.DecodeString(cloakClientHello)
+	ch, _ := parseClientHello(chBytes, DefaultParseOptions)
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	// EncryptedExtensions, Certificate and CertificateVerify of a TLS 1.3 server with an RSA certificate
+	profile := ServerProfile{CipherSuite: 0x1301, FlightLengths: []int{40, 2600, 264}}
+	reply, err := TLSReplyComposer{Profile: profile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := splitRecords(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ServerHello, ChangeCipherSpec, then EncryptedExtensions, Certificate, CertificateVerify and Finished
+	if !assert.Len(t, records, 6) {
+		return
+	}
+	var lengths []int
+	for _, record := range records[2:] {
+		assert.Equal(t, byte(0x17), record[0])
+		lengths = append(lengths, len(record)-5)
+	}
+	assert.Equal(t, []int{40 + 17, 2600 + 17, 264 + 17, 36 + 17}, lengths)
+	assert.True(t, lengths[0] < 100, "EncryptedExtensions should be small")
+	assert.True(t, lengths[1] > 1000, "Certificate should be large")
+
+	// the client is told about the 3 extra records in the last bytes of key_share
+	keyShareTail := records[0][len(records[0])-6-4 : len(records[0])-6]
+	assert.Equal(t, common.FlightRecordsTag(sessionKey, 3), keyShareTail)
+	assert.NoError(t, checkServerReply(bytes.NewReader(reply), ch.sessionId, profile))
+
+	t.Run("single record by default", func(t *testing.T) {
+		reply, err := TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, _ := splitRecords(reply)
+		assert.Len(t, records, 3)
+	})
+	t.Run("too many records", func(t *testing.T) {
+		profile := ServerProfile{FlightLengths: make([]int, common.MaxExtraFlightRecords+1)}
+		_, err := TLSReplyComposer{Profile: profile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+		assert.Error(t, err)
+	})
+}
+
+func TestTLSReplyComposer_KeyLength(t *testing.T) {
+	ch, err := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, 32)
+	common.CryptoRandRead(key)
+	composer := TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader}
+
+	for _, c := range []struct {
+		name                     string
+		sharedSecret, sessionKey []byte
+	}{
+		{"short session key", key, key[:16]},
+		{"empty session key", key, nil},
+		{"long session key", key, append(key, 0x00)},
+		{"short shared secret", key[:16], key},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			reply, err := composer.ComposeReply(ch, c.sharedSecret, c.sessionKey)
+			assert.True(t, errors.Is(err, ErrKeyLength), "got %v", err)
+			assert.Nil(t, reply)
+		})
+	}
+	_, err = composer.ComposeReply(ch, key, key)
+	assert.NoError(t, err)
+}
+
+func TestTLSReplyComposer_SessionTickets(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	cloakBytes, _ := hex.DecodeString(cloakClientHello)
+	withTicket, _ := parseClientHello(cloakBytes, DefaultParseOptions)
+	withoutTicket, err := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, withTicket.offersSessionTicket())
+	assert.False(t, withoutTicket.offersSessionTicket())
+
+	ticketProfile := ServerProfile{CipherSuite: 0x1302, SessionTickets: true}
+	compose := func(t *testing.T, ch *ClientHello, profile ServerProfile) [][]byte {
+		reply, err := TLSReplyComposer{Profile: profile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := splitRecords(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, checkServerHello(records[0][5:], ch.sessionId, profile))
+		return records
+	}
+	sessionTicketExtension := []byte{0x00, 0x23, 0x00, 0x00}
+
+	t.Run("client offers session_ticket", func(t *testing.T) {
+		records := compose(t, withTicket, ticketProfile)
+		// ServerHello, NewSessionTicket, ChangeCipherSpec and the encrypted flight
+		if !assert.Len(t, records, 4) {
+			return
+		}
+		assert.True(t, bytes.HasSuffix(records[0], sessionTicketExtension))
+		assert.Equal(t, []byte{0x16, 0x03, 0x03}, records[1][:3])
+		nst := records[1][5:]
+		assert.Equal(t, byte(0x04), nst[0], "not a NewSessionTicket")
+		assert.Equal(t, 4+4+2+sessionTicketLength, len(nst))
+		assert.Equal(t, byte(0x14), records[2][0])
+		assert.Equal(t, byte(0x17), records[3][0])
+
+		keyShareTail := records[0][len(records[0])-4-6-4 : len(records[0])-4-6]
+		assert.Equal(t, common.FlightRecordsTag(sessionKey, 1), keyShareTail)
+	})
+	t.Run("client doesn't offer session_ticket", func(t *testing.T) {
+		records := compose(t, withoutTicket, ticketProfile)
+		assert.Len(t, records, 3)
+		assert.False(t, bytes.HasSuffix(records[0], sessionTicketExtension))
+	})
+	t.Run("server doesn't issue tickets", func(t *testing.T) {
+		records := compose(t, withTicket, DefaultServerProfile)
+		assert.Len(t, records, 3)
+		assert.False(t, bytes.HasSuffix(records[0], sessionTicketExtension))
+	})
+}
+
+func TestTLSReplyComposer_PreferredKeyShareGroups(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	x448 := [2]byte{0x00, 0x1e}
+	x25519Key := make([]byte, 32)
+	x448Key := make([]byte, 56)
+	keyShare := []byte{0x00, 0x5e, 0x00, 0x1d, 0x00, 0x20}
+	keyShare = append(keyShare, x25519Key...)
+	keyShare = append(keyShare, 0x00, 0x1e, 0x00, 0x38)
+	keyShare = append(keyShare, x448Key...)
+	bothGroups, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x33}, keyShare).marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519Only, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+
+	// emittedKeyShare returns the key_share extension data of the ServerHello
+	emittedKeyShare := func(t *testing.T, ch *ClientHello, preferred [][2]byte) []byte {
+		composer := TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader, PreferredKeyShareGroups: preferred}
+		reply, err := composer.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, _ := splitRecords(reply)
+		assert.NoError(t, checkServerHello(records[0][5:], ch.sessionId, DefaultServerProfile))
+		// record header 5, handshake header 4, version 2, random 32, session id 1+32, cipher suite 2, compression 1,
+		// extensions length 2, key_share type and length 4
+		return records[0][5+4+2+32+1+32+2+1+2+4:]
+	}
+
+	t.Run("default", func(t *testing.T) {
+		assert.Equal(t, x25519Group[:], emittedKeyShare(t, bothGroups, nil)[0:2])
+		assert.Equal(t, x25519Group[:], emittedKeyShare(t, bothGroups, DefaultPreferredKeyShareGroups)[0:2])
+	})
+	t.Run("different group preferred", func(t *testing.T) {
+		emitted := emittedKeyShare(t, bothGroups, [][2]byte{x448, x25519Group})
+		assert.Equal(t, x448[:], emitted[0:2])
+		assert.Equal(t, []byte{0x00, 0x38}, emitted[2:4])
+	})
+	t.Run("preferred group not offered", func(t *testing.T) {
+		assert.Equal(t, x25519Group[:], emittedKeyShare(t, x25519Only, [][2]byte{x448, x25519Group})[0:2])
+	})
+	t.Run("preferred group can't be answered", func(t *testing.T) {
+		secp384r1 := [2]byte{0x00, 0x18}
+		assert.Equal(t, x25519Group[:], emittedKeyShare(t, bothGroups, [][2]byte{secp384r1})[0:2])
+	})
+	t.Run("no preferred group or x25519 offered", func(t *testing.T) {
+		secp256r1Share := []byte{0x00, 0x45, 0x00, 0x17, 0x00, 0x41}
+		secp256r1Share = append(secp256r1Share, make([]byte, 65)...)
+		secp256r1Only, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x33}, secp256r1Share).marshal(), DefaultParseOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, preferred := range [][][2]byte{nil, {x448}, {{0x00, 0x18}}} {
+			composer := TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader, PreferredKeyShareGroups: preferred}
+			_, err := composer.ComposeReply(secp256r1Only, sharedSecret, sessionKey)
+			assert.True(t, errors.Is(err, ErrKeyShareGroupNotOffered), "preferred %x, got %v", preferred, err)
+		}
+	})
+	t.Run("encrypted session key stays where the client reads it", func(t *testing.T) {
+		for _, preferred := range [][][2]byte{{x25519Group}, {x448}} {
+			composer := TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader, PreferredKeyShareGroups: preferred}
+			reply, _ := composer.ComposeReply(bothGroups, sharedSecret, sessionKey)
+			// the client strips the record header and reads the nonce and encrypted session key at these offsets
+			encrypted := append(append([]byte{}, reply[5+6:5+38]...), reply[5+84:5+116]...)
+			decrypted, err := common.AESGCMDecrypt(encrypted[0:12], sharedSecret, encrypted[12:60])
+			assert.NoError(t, err, "group %x", preferred[0])
+			assert.Equal(t, sessionKey, decrypted)
+		}
+	})
+}
+
+func TestTLSReplyComposer_P256(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	_, clientX, clientY, _ := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	keyShare := []byte{0x00, 0x69, 0x00, 0x1d, 0x00, 0x20}
+	keyShare = append(keyShare, make([]byte, 32)...)
+	keyShare = append(keyShare, 0x00, 0x17, 0x00, 0x41)
+	keyShare = append(keyShare, elliptic.Marshal(elliptic.P256(), clientX, clientY)...)
+	ch, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x33}, keyShare).marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with and without extra flight records, which change the last bytes the client reads
+	for _, profile := range []ServerProfile{DefaultServerProfile, {CipherSuite: 0x1301, FlightLengths: []int{40, 2600, 264}}} {
+		for i := 0; i < 20; i++ {
+			composer := TLSReplyComposer{Profile: profile, Rand: rand.Reader, PreferredKeyShareGroups: [][2]byte{secp256r1Group}}
+			reply, err := composer.ComposeReply(ch, sharedSecret, sessionKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, _ := splitRecords(reply)
+			assert.NoError(t, checkServerHello(records[0][5:], ch.sessionId, profile))
+			// record header 5, handshake header 4, version 2, random 32, session id 1+32, cipher suite 2, compression 1,
+			// extensions length 2, key_share type and length 4
+			emitted := records[0][5+4+2+32+1+32+2+1+2+4:]
+			assert.Equal(t, []byte{0x00, 0x17, 0x00, 0x41}, emitted[0:4])
+			x, y := elliptic.Unmarshal(elliptic.P256(), emitted[4:4+65])
+			if !assert.NotNil(t, x, "key exchange %x isn't a point on the curve", emitted[4:4+65]) {
+				return
+			}
+			assert.True(t, elliptic.P256().IsOnCurve(x, y))
+
+			encrypted := append(append([]byte{}, reply[5+6:5+38]...), reply[5+84:5+116]...)
+			decrypted, err := common.AESGCMDecrypt(encrypted[0:12], sharedSecret, encrypted[12:60])
+			assert.NoError(t, err)
+			assert.Equal(t, sessionKey, decrypted)
+		}
+	}
+}
+
+func TestCompleteP256Point(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		point := make([]byte, 65)
+		common.CryptoRandRead(point)
+		point[0] = 0x04
+		original := append([]byte{}, point...)
+		err := completeP256Point(point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, original[:32], point[:32], "bytes read by the client changed")
+		x, y := elliptic.Unmarshal(elliptic.P256(), point)
+		if assert.NotNil(t, x) {
+			assert.True(t, elliptic.P256().IsOnCurve(x, y))
+		}
+	}
+	assert.True(t, errors.Is(completeP256Point(make([]byte, 65)), ErrNoP256Point))
+}
+
+func TestTLSReplyComposer_SCTs(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	withSCT, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x12}, nil).marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutSCT, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	assert.True(t, withSCT.requestsSCT())
+	assert.False(t, withoutSCT.requestsSCT())
+
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	sctProfile := ServerProfile{CipherSuite: 0x1302, SCTs: true}
+	// emittedSCTs returns the signed_certificate_timestamp extension data of the ServerHello, or nil if there is none
+	emittedSCTs := func(t *testing.T, ch *ClientHello, profile ServerProfile) []byte {
+		composer := TLSReplyComposer{Profile: profile, Rand: rand.Reader, Now: func() time.Time { return now }}
+		reply, err := composer.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, _ := splitRecords(reply)
+		if !assert.Len(t, records, 3) {
+			t.FailNow()
+		}
+		sh := records[0][5:]
+		assert.NoError(t, checkServerHello(sh, ch.sessionId, profile))
+		// handshake header 4, version 2, random 32, session id 1+32, cipher suite 2, compression 1, extensions length 2
+		extensions := sh[4+2+32+1+32+2+1+2:]
+		for len(extensions) >= 4 {
+			length := int(u16(extensions[2:4]))
+			if bytes.Equal(extensions[0:2], []byte{0x00, 0x12}) {
+				return extensions[4 : 4+length]
+			}
+			extensions = extensions[4+length:]
+		}
+		return nil
+	}
+
+	t.Run("client requests SCTs", func(t *testing.T) {
+		list := emittedSCTs(t, withSCT, sctProfile)
+		if !assert.NotNil(t, list) {
+			return
+		}
+		assert.True(t, len(list) > 200 && len(list) < 300, "SCT list of %v bytes", len(list))
+		assert.Equal(t, len(list)-2, int(u16(list[0:2])))
+
+		scts := list[2:]
+		var count int
+		for len(scts) > 0 {
+			if !assert.True(t, len(scts) >= 2) {
+				return
+			}
+			length := int(u16(scts[0:2]))
+			if !assert.True(t, length <= len(scts)-2) {
+				return
+			}
+			sct := scts[2 : 2+length]
+			scts = scts[2+length:]
+			count++
+
+			assert.Equal(t, byte(0x00), sct[0], "not a v1 SCT")
+			timestamp := time.Unix(0, int64(binary.BigEndian.Uint64(sct[33:41]))*int64(time.Millisecond))
+			assert.False(t, timestamp.After(now))
+			assert.True(t, timestamp.After(now.Add(-maxSCTAge)))
+			assert.Equal(t, []byte{0x00, 0x00}, sct[41:43], "SCT extensions")
+			assert.Equal(t, []byte{0x04, 0x03}, sct[43:45], "SCT signature algorithm")
+			assert.Equal(t, len(sct)-47, int(u16(sct[45:47])), "SCT signature length")
+		}
+		assert.Equal(t, sctCount, count)
+	})
+	t.Run("client doesn't request SCTs", func(t *testing.T) {
+		assert.Nil(t, emittedSCTs(t, withoutSCT, sctProfile))
+	})
+	t.Run("server doesn't send SCTs", func(t *testing.T) {
+		assert.Nil(t, emittedSCTs(t, withSCT, DefaultServerProfile))
+	})
+}
+
+func TestTLSReplyComposer_H2Settings(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	alpn := append([]byte{0x00, 0x0c, 0x02}, "h2"...)
+	alpn = append(append(alpn, 0x08), "http/1.1"...)
+	withALPN, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x10}, alpn).marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutALPN, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	h2Profile := ServerProfile{CipherSuite: 0x1301, ALPN: []string{"h2", "http/1.1"}, H2Settings: true}
+
+	compose := func(t *testing.T, ch *ClientHello, profile ServerProfile) [][]byte {
+		composer := TLSReplyComposer{Profile: profile, Rand: rand.Reader}
+		reply, err := composer.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := splitRecords(reply)
+		assert.NoError(t, err)
+		return records
+	}
+
+	t.Run("h2 selected", func(t *testing.T) {
+		records := compose(t, withALPN, h2Profile)
+		if !assert.Len(t, records, 4) {
+			return
+		}
+		settings := records[3]
+		assert.Equal(t, byte(0x17), settings[0])
+		assert.Equal(t, len(h2SettingsFrame)+innerContentType+aeadTagLength, len(settings)-5)
+		// the client is told to read one record more than the flight. Record header 5, handshake header 4, version 2,
+		// random 32, session id 1+32, cipher suite 2, compression 1, extensions length 2, key_share type and length 4,
+		// group and key exchange length 4
+		keyExchange := records[0][5+4+2+32+1+32+2+1+2+4+4:]
+		assert.Equal(t, common.FlightRecordsTag(sessionKey, 1), keyExchange[28:32])
+	})
+	t.Run("another protocol selected", func(t *testing.T) {
+		profile := h2Profile
+		profile.ALPN = []string{"http/1.1", "h2"}
+		assert.Len(t, compose(t, withALPN, profile), 3)
+	})
+	t.Run("no ALPN offered", func(t *testing.T) {
+		assert.Len(t, compose(t, withoutALPN, h2Profile), 3)
+	})
+	t.Run("server doesn't send SETTINGS", func(t *testing.T) {
+		profile := h2Profile
+		profile.H2Settings = false
+		assert.Len(t, compose(t, withALPN, profile), 3)
+	})
+}
+
+func TestTLSReplyComposer_RecordSizeHistogram(t *testing.T) {
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+	sessionId := bytes.Repeat([]byte{0x01}, 32)
+	ch := minimalClientHello(sessionId)
+
+	profile := ServerProfile{
+		CipherSuite:         0x1301,
+		RecordSizeHistogram: []RecordSizeBin{{Length: 1200, Count: 50}, {Length: 1500, Count: 30}, {Length: 900, Count: 20}, {Length: 700}},
+	}
+	composer := TLSReplyComposer{Profile: profile, Rand: rand.Reader}
+	flightLength := func(t *testing.T, sessionKey []byte) int {
+		reply, err := composer.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := splitRecords(reply)
+		if err != nil || !assert.Len(t, records, 3) {
+			t.FailNow()
+		}
+		return len(records[2]) - 5
+	}
+
+	t.Run("distribution", func(t *testing.T) {
+		const samples = 5000
+		counts := make(map[int]int)
+		sessionKey := make([]byte, 32)
+		for i := 0; i < samples; i++ {
+			common.CryptoRandRead(sessionKey)
+			counts[flightLength(t, sessionKey)]++
+		}
+		assert.Len(t, counts, 3, "lengths outside the histogram: %v", counts)
+		for _, bin := range profile.RecordSizeHistogram[:3] {
+			proportion := float64(counts[bin.Length]) / samples
+			expected := float64(bin.Count) / 100
+			assert.True(t, proportion > expected-0.03 && proportion < expected+0.03,
+				"length %v drawn %.3f of the time, expecting %.2f", bin.Length, proportion, expected)
+		}
+	})
+	t.Run("same within a session", func(t *testing.T) {
+		sessionKey := make([]byte, 32)
+		common.CryptoRandRead(sessionKey)
+		length := flightLength(t, sessionKey)
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, length, flightLength(t, sessionKey))
+		}
+	})
+	t.Run("self test", func(t *testing.T) {
+		reply, err := composer.ComposeReply(ch, sharedSecret, make([]byte, 32))
+		assert.NoError(t, err)
+		assert.NoError(t, checkServerReply(bytes.NewReader(reply), sessionId, profile))
+	})
+	t.Run("too short for Finished", func(t *testing.T) {
+		profile := ServerProfile{CipherSuite: 0x1301, RecordSizeHistogram: []RecordSizeBin{{Length: 40, Count: 1}}}
+		_, err := TLSReplyComposer{Profile: profile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, make([]byte, 32))
+		assert.True(t, errors.Is(err, ErrRecordSizeHistogram), "got %v", err)
+	})
+}
+
+func TestTLSReplyComposer_CertCompression(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	offering := func(ext []byte) *ClientHello {
+		ch, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x1b}, ext).marshal(), DefaultParseOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ch
+	}
+	brotli := offering([]byte{0x02, 0x00, 0x02})
+	zlib := offering([]byte{0x02, 0x00, 0x01})
+	none, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+
+	profile := ServerProfile{
+		CipherSuite:     0x1301,
+		FlightLengths:   []int{40, 2600, 264},
+		CertCompression: &CertCompression{Algorithms: []uint16{2}, FlightLengths: []int{40, 1900, 264}},
+	}
+	certificateLength := func(t *testing.T, ch *ClientHello) int {
+		reply, err := TLSReplyComposer{Profile: profile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := splitRecords(reply)
+		assert.NoError(t, err)
+		if !assert.Len(t, records, 6) {
+			t.FailNow()
+		}
+		return len(records[3]) - 5 - innerContentType - aeadTagLength
+	}
+
+	t.Run("client offers a supported algorithm", func(t *testing.T) {
+		assert.Equal(t, 1900, certificateLength(t, brotli))
+	})
+	t.Run("client offers another algorithm", func(t *testing.T) {
+		assert.Equal(t, 2600, certificateLength(t, zlib))
+	})
+	t.Run("client doesn't offer compress_certificate", func(t *testing.T) {
+		assert.Equal(t, 2600, certificateLength(t, none))
+	})
+}
+
+func TestTLSReplyComposer_DelegatedCredential(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	offering, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x22}, []byte{0x00, 0x02, 0x04, 0x03}).marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+
+	dc := &DelegatedCredential{SignatureScheme: 0x0403}
+	profile := ServerProfile{
+		CipherSuite:         0x1301,
+		FlightLengths:       []int{40, 2600, 264},
+		DelegatedCredential: dc,
+	}
+	certificateLength := func(t *testing.T, ch *ClientHello) int {
+		reply, err := TLSReplyComposer{Profile: profile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := splitRecords(reply)
+		assert.NoError(t, err)
+		if !assert.Len(t, records, 6) {
+			t.FailNow()
+		}
+		return len(records[3]) - 5 - innerContentType - aeadTagLength
+	}
+
+	t.Run("client accepts delegated credentials", func(t *testing.T) {
+		assert.Equal(t, 2600+dc.extensionLength(), certificateLength(t, offering))
+	})
+	t.Run("client doesn't offer delegated_credential", func(t *testing.T) {
+		assert.Equal(t, 2600, certificateLength(t, none))
+	})
+	t.Run("profile without a delegated credential", func(t *testing.T) {
+		profile.DelegatedCredential = nil
+		defer func() { profile.DelegatedCredential = dc }()
+		assert.Equal(t, 2600, certificateLength(t, offering))
+	})
+}
+
+func TestTLSReplyComposer_AltSvc(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	alpn := append([]byte{0x00, 0x03, 0x02}, "h2"...)
+	withALPN, err := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x10}, alpn).marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3Profile := ServerProfile{CipherSuite: 0x1301, ALPN: []string{"h2"}, H2Settings: true, AltSvc: `h3=":443"; ma=86400`}
+
+	compose := func(t *testing.T, profile ServerProfile) [][]byte {
+		composer := TLSReplyComposer{Profile: profile, Rand: rand.Reader}
+		reply, err := composer.ComposeReply(withALPN, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := splitRecords(reply)
+		assert.NoError(t, err)
+		return records
+	}
+
+	t.Run("h2 selected", func(t *testing.T) {
+		records := compose(t, h3Profile)
+		if !assert.Len(t, records, 5) {
+			return
+		}
+		altSvc := records[4]
+		assert.Equal(t, byte(0x17), altSvc[0])
+		frame := h2AltSvcFrame("https://example.com", h3Profile.AltSvc)
+		assert.Equal(t, len(frame)+innerContentType+aeadTagLength, len(altSvc)-5)
+		keyExchange := records[0][5+4+2+32+1+32+2+1+2+4+4:]
+		assert.Equal(t, common.FlightRecordsTag(sessionKey, 2), keyExchange[28:32])
+	})
+	t.Run("no Alt-Svc", func(t *testing.T) {
+		profile := h3Profile
+		profile.AltSvc = ""
+		assert.Len(t, compose(t, profile), 4)
+	})
+}
+
+func TestH2AltSvcFrame(t *testing.T) {
+	frame := h2AltSvcFrame("https://example.com", `h3=":443"; ma=86400`)
+	payload := append([]byte{0x00, 0x13}, `https://example.com`+`h3=":443"; ma=86400`...)
+	assert.Equal(t, []byte{0x00, 0x00, byte(len(payload)), 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00}, frame[:9])
+	assert.Equal(t, payload, frame[9:])
+}
+
+func TestServerProfile_AltSvcOrigin(t *testing.T) {
+	withSNI, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	withoutSNI := minimalClientHello(make([]byte, 32))
+
+	assert.Equal(t, "https://example.com", ServerProfile{ServerNames: []string{"example.org"}}.altSvcOrigin(withSNI))
+	assert.Equal(t, "https://example.org", ServerProfile{ServerNames: []string{"example.org"}}.altSvcOrigin(withoutSNI))
+	assert.Equal(t, "", ServerProfile{}.altSvcOrigin(withoutSNI))
+}
+
+func TestTLSReplyComposer_SessionIdPolicy(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+	ch, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+
+	// emittedSessionId returns the session id of the ServerHello after checking its structure
+	emittedSessionId := func(t *testing.T, ch *ClientHello, profile ServerProfile) []byte {
+		composer := TLSReplyComposer{Profile: profile, Rand: rand.Reader}
+		reply, err := composer.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, checkServerReply(bytes.NewReader(reply), ch.sessionId, profile))
+		records, _ := splitRecords(reply)
+		// record header 5, handshake header 4, version 2, random 32
+		sh := records[0][5+4+2+32:]
+		sessionIdLen := int(sh[0])
+		if !assert.True(t, sessionIdLen < len(sh)) {
+			t.FailNow()
+		}
+
+		// the client reads the encrypted session key at the same offsets regardless
+		encrypted := append(append([]byte{}, reply[5+6:5+38]...), reply[5+84:5+116]...)
+		decrypted, err := common.AESGCMDecrypt(encrypted[0:12], sharedSecret, encrypted[12:60])
+		assert.NoError(t, err)
+		assert.Equal(t, sessionKey, decrypted)
+		return sh[1 : 1+sessionIdLen]
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		assert.Equal(t, ch.sessionId, emittedSessionId(t, ch, DefaultServerProfile))
+	})
+	t.Run("fresh", func(t *testing.T) {
+		profile := ServerProfile{CipherSuite: 0x1302, SessionIdPolicy: SessionIdFresh}
+		first := emittedSessionId(t, ch, profile)
+		assert.Len(t, first, freshSessionIdLength)
+		assert.NotEqual(t, ch.sessionId, first)
+		assert.NotEqual(t, first, emittedSessionId(t, ch, profile))
+	})
+}
+
+func TestTLSReplyComposer_SessionIdNotAliased(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+	buf := newTestClientHello().marshal()
+	ch, err := parseClientHello(buf, DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := append([]byte{}, ch.sessionId...)
+
+	reply, err := TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	composed := append([]byte{}, reply...)
+	// as if the buffer were taken for the next ClientHello
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	assert.Equal(t, composed, reply)
+	assert.NoError(t, checkServerReply(bytes.NewReader(reply), sessionId, DefaultServerProfile))
+}
+
+var errRandFailed = errors.New("random source failed")
+
+// failingRand gives remaining random bytes and then fails
+type failingRand struct {
+	remaining int
+}
+
+func (r *failingRand) Read(p []byte) (int, error) {
+	if r.remaining >= len(p) {
+		r.remaining -= len(p)
+		return rand.Read(p)
+	}
+	n, _ := rand.Read(p[:r.remaining])
+	r.remaining = 0
+	return n, errRandFailed
+}
+
+func TestTLSReplyComposer_RandFailure(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+	withSCT, _ := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x12}, nil).marshal(), DefaultParseOptions)
+	profile := ServerProfile{CipherSuite: 0x1302, SCTs: true}
+
+	t.Run("ServerHello", func(t *testing.T) {
+		sh, err := composeServerHello(serverHelloFields{keyShareGroup: x25519Group}, profile, &failingRand{remaining: 16})
+		assert.True(t, errors.Is(err, errRandFailed), "got %v", err)
+		assert.Nil(t, sh)
+	})
+	t.Run("any of the reply", func(t *testing.T) {
+		// the random source fails after every number of bytes until the reply needs no more
+		for n := 0; ; n++ {
+			composer := TLSReplyComposer{Profile: profile, Rand: &failingRand{remaining: n}}
+			reply, err := composer.ComposeReply(withSCT, sharedSecret, sessionKey)
+			if err == nil {
+				assert.True(t, n > 32, "a reply composed from only %v random bytes", n)
+				return
+			}
+			if !assert.True(t, errors.Is(err, errRandFailed), "got %v after %v bytes", err, n) {
+				return
+			}
+			assert.Nil(t, reply)
+		}
+	})
+	t.Run("handshake aborted", func(t *testing.T) {
+		var sharedSecretArr, sessionKeyArr [32]byte
+		copy(sharedSecretArr[:], sharedSecret)
+		copy(sessionKeyArr[:], sessionKey)
+		local, remote := net.Pipe()
+		respond := TLS{}.makeResponder(withSCT, sharedSecretArr)
+		respondErr := make(chan error, 1)
+		go func() {
+			_, err := respond(remote, sessionKeyArr, rand.Reader, TLSReplyComposer{Profile: profile, Rand: &failingRand{}})
+			respondErr <- err
+		}()
+		n, err := local.Read(make([]byte, 1))
+		assert.Equal(t, 0, n, "part of a reply sent")
+		assert.Equal(t, io.EOF, err)
+		assert.True(t, errors.Is(<-respondErr, errRandFailed))
+	})
+}
+
+func TestTLSReplyComposer_CipherSuite(t *testing.T) {
+	sessionId := make([]byte, 32)
+	common.CryptoRandRead(sessionId)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+
+	for _, c := range []struct {
+		name     string
+		profile  uint16
+		offered  []byte
+		selected uint16
+	}{
+		{"TLS 1.3 suite offered", 0x1303, []byte{0x13, 0x01, 0x13, 0x02, 0x13, 0x03}, 0x1303},
+		{"TLS 1.2 suite swapped for its TLS 1.3 equivalent", 0xc030, []byte{0x13, 0x01, 0x13, 0x02, 0xc0, 0x30}, 0x1302},
+		{"suite not offered", 0x1302, []byte{0x13, 0x03, 0x13, 0x01, 0xc0, 0x2c}, 0x1303},
+		{"unknown suite", 0x00ff, []byte{0xc0, 0x2b, 0x13, 0x01}, 0x1301},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ch := minimalClientHello(sessionId)
+			ch.cipherSuites = c.offered
+			composer := TLSReplyComposer{Profile: ServerProfile{CipherSuite: c.profile}, Rand: rand.Reader}
+			reply, err := composer.ComposeReply(ch, sharedSecret, sessionKey)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NoError(t, checkServerReply(bytes.NewReader(reply), sessionId, ServerProfile{CipherSuite: c.selected}))
+		})
+	}
+
+	t.Run("no TLS 1.3 suite offered", func(t *testing.T) {
+		ch := minimalClientHello(sessionId)
+		ch.cipherSuites = []byte{0xc0, 0x2b, 0xc0, 0x30}
+		composer := TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader}
+		_, err := composer.ComposeReply(ch, sharedSecret, sessionKey)
+		assert.True(t, errors.Is(err, ErrNoCipherSuite), "got %v", err)
+	})
+}
+
+func TestTLSReplyComposer_TLS12Flight(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+	ch, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	flight := &TLS12Flight{CertificateLengths: []int{1300, 1100}, SignatureAlgorithm: 0x0804, SignatureLength: 256}
+	profile := ServerProfile{CipherSuite: 0x1302, TLS12Flight: flight}
+
+	reply, err := TLSReplyComposer{Profile: profile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, checkServerReply(bytes.NewReader(reply), ch.sessionId, profile))
+	records, err := splitRecords(reply)
+	assert.NoError(t, err)
+	var types []byte
+	for _, record := range records {
+		types = append(types, record[0])
+	}
+	assert.Equal(t, []byte{0x16, 0x16, 0x16, 0x16, 0x14, 0x17}, types)
+
+	// the client is told to read the three extra records
+	assert.Equal(t, common.FlightRecordsTag(sessionKey, 3), reply[5+112:5+116])
+
+	certificate := records[1][5:]
+	assert.Equal(t, byte(0x0b), certificate[0])
+	chain := certificate[4+3:]
+	var certLengths []int
+	for len(chain) > 0 {
+		length := int(chain[0])<<16 | int(chain[1])<<8 | int(chain[2])
+		cert := chain[3 : 3+length]
+		assert.Equal(t, []byte{0x30, 0x82}, cert[0:2])
+		assert.Equal(t, length-4, int(binary.BigEndian.Uint16(cert[2:4])))
+		certLengths = append(certLengths, length)
+		chain = chain[3+length:]
+	}
+	assert.Equal(t, flight.CertificateLengths, certLengths)
+
+	keyExchange := records[2][5:]
+	assert.Equal(t, byte(0x0c), keyExchange[0])
+	assert.Equal(t, []byte{0x03, 0x00, 0x1d, 32}, keyExchange[4:8])
+	signature := keyExchange[8+32:]
+	assert.Equal(t, []byte{0x08, 0x04, 0x01, 0x00}, signature[0:4])
+	assert.Len(t, signature[4:], 256)
+
+	assert.Equal(t, []byte{0x0e, 0x00, 0x00, 0x00}, records[3][5:])
+
+	t.Run("secp256r1", func(t *testing.T) {
+		messages, err := compose12Flight(*flight, secp256r1Group, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyExchange := messages[1]
+		assert.Equal(t, []byte{0x03, 0x00, 0x17, 65}, keyExchange[4:8])
+		x, y := elliptic.Unmarshal(elliptic.P256(), keyExchange[8:8+65])
+		if assert.NotNil(t, x) {
+			assert.True(t, elliptic.P256().IsOnCurve(x, y))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := compose12Flight(TLS12Flight{CertificateLengths: []int{3}, SignatureLength: 256}, x25519Group, rand.Reader)
+		assert.True(t, errors.Is(err, ErrTLS12Flight))
+		_, err = compose12Flight(TLS12Flight{CertificateLengths: []int{1300}}, x25519Group, rand.Reader)
+		assert.True(t, errors.Is(err, ErrTLS12Flight))
+		_, err = compose12Flight(TLS12Flight{CertificateLengths: []int{10000, 10000}, SignatureLength: 256}, x25519Group, rand.Reader)
+		assert.True(t, errors.Is(err, ErrTLS12Flight))
+	})
+}
+
+func TestTLSReplyComposer_TLS12ServerHello(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+	flight := &TLS12Flight{CertificateLengths: []int{1300, 1100}, SignatureAlgorithm: 0x0804, SignatureLength: 256}
+	profile := ServerProfile{CipherSuite: 0xc02f, TLS12Flight: flight, TLS12ServerHello: true}
+
+	// serverHello composes the reply to ch and returns the body of its ServerHello after checking the reply
+	serverHello := func(t *testing.T, ch *ClientHello, profile ServerProfile) []byte {
+		reply, err := TLSReplyComposer{Profile: profile, Rand: rand.Reader}.ComposeReply(ch, sharedSecret, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		negotiated := profile
+		negotiated.CipherSuite, _ = profile.negotiateCipherSuite(ch)
+		assert.NoError(t, checkServerReply(bytes.NewReader(reply), ch.sessionId, negotiated))
+		records, _ := splitRecords(reply)
+		sh := records[0][5:]
+
+		// the client reads the rest of the encrypted session key and the tag from the session id
+		encrypted := append(append([]byte{}, sh[6:38]...), sh[39:71]...)
+		decrypted, err := common.AESGCMDecrypt(encrypted[0:12], sharedSecret, encrypted[12:60])
+		assert.NoError(t, err)
+		assert.Equal(t, sessionKey, decrypted)
+		assert.Equal(t, common.FlightRecordsTag(sessionKey, 3), encrypted[60:64])
+		return sh[4:]
+	}
+
+	t.Run("with TLS 1.2 extensions", func(t *testing.T) {
+		tch := newTestClientHello().
+			withExtension([2]byte{0xff, 0x01}, []byte{0x00}).
+			withExtension([2]byte{0x00, 0x0b}, []byte{0x01, 0x00}).
+			withExtension([2]byte{0x00, 0x17}, nil)
+		ch, _ := parseClientHello(tch.marshal(), DefaultParseOptions)
+		body := serverHello(t, ch, profile)
+
+		assert.Equal(t, []byte{0x03, 0x03}, body[0:2])
+		assert.Equal(t, byte(freshSessionIdLength), body[34])
+		assert.NotEqual(t, ch.sessionId, body[35:67])
+		assert.Equal(t, []byte{0xc0, 0x2f}, body[67:69])
+		// the single compression method, then the extensions block
+		assert.Equal(t, byte(0x00), body[69])
+		extensions := []byte{
+			0xff, 0x01, 0x00, 0x01, 0x00, // renegotiation_info
+			0x00, 0x0b, 0x00, 0x02, 0x01, 0x00, // ec_point_formats
+			0x00, 0x17, 0x00, 0x00, // extended_master_secret
+		}
+		assert.Equal(t, append([]byte{0x00, byte(len(extensions))}, extensions...), body[70:])
+	})
+
+	t.Run("without extensions", func(t *testing.T) {
+		sessionId := make([]byte, 32)
+		common.CryptoRandRead(sessionId)
+		body := serverHello(t, minimalClientHello(sessionId), ServerProfile{CipherSuite: 0xc030, TLS12Flight: flight, TLS12ServerHello: true})
+		assert.Equal(t, []byte{0xc0, 0x30}, body[67:69])
+		assert.Len(t, body, 70, "the extensions block is left out")
+	})
+
+	t.Run("renegotiation SCSV", func(t *testing.T) {
+		ch := minimalClientHello(nil)
+		ch.cipherSuites = append(ch.cipherSuites, 0x00, 0xff)
+		assert.Equal(t, []byte{0xff, 0x01, 0x00, 0x01, 0x00}, ch.tls12Extensions())
+	})
+
+	t.Run("cipher suite", func(t *testing.T) {
+		ch := minimalClientHello(nil)
+		suite, err := ServerProfile{CipherSuite: 0xc02c, TLS12ServerHello: true}.negotiateCipherSuite(ch)
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(0xc02c), suite)
+		// a TLS 1.3 suite in the profile gives way to the first TLS 1.2 one offered
+		suite, err = ServerProfile{CipherSuite: 0x1302, TLS12ServerHello: true}.negotiateCipherSuite(ch)
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(0xc02b), suite)
+
+		ch.cipherSuites = []byte{0x13, 0x01, 0x13, 0x02}
+		_, err = ServerProfile{CipherSuite: 0xc02f, TLS12ServerHello: true}.negotiateCipherSuite(ch)
+		assert.True(t, errors.Is(err, ErrNoTLS12CipherSuite), "got %v", err)
+	})
+
+	t.Run("self test", func(t *testing.T) {
+		assert.NoError(t, selfTest(profile))
+		awaiting := profile
+		awaiting.AwaitClientFinished = true
+		assert.NoError(t, selfTest(awaiting))
+	})
+}
+
+func TestTLSReplyComposer_CompatibilityMode(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	common.CryptoRandRead(sessionKey)
+	sharedSecret := make([]byte, 32)
+	common.CryptoRandRead(sharedSecret)
+
+	// reply composes the reply to a ClientHello with sessionId, checks it as a client reading it off the connection
+	// would, and returns the types of its records
+	reply := func(t *testing.T, sessionId []byte) []byte {
+		serverSide, clientSide := net.Pipe()
+		defer clientSide.Close()
+		var sharedSecretArr, sessionKeyArr [32]byte
+		copy(sharedSecretArr[:], sharedSecret)
+		copy(sessionKeyArr[:], sessionKey)
+		composer := TLSReplyComposer{Profile: DefaultServerProfile, Rand: rand.Reader}
+		respond := TLS{}.makeResponder(minimalClientHello(sessionId), sharedSecretArr)
+		replyRead := make(chan []byte, 1)
+		go func() {
+			reply, _ := ioutil.ReadAll(clientSide)
+			replyRead <- reply
+		}()
+		_, err := respond(serverSide, sessionKeyArr, rand.Reader, composer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverSide.Close()
+		reply := <-replyRead
+		assert.NoError(t, checkServerReply(bytes.NewReader(reply), sessionId, DefaultServerProfile))
+		// the session id is echoed however long it is
+		assert.Equal(t, byte(len(sessionId)), reply[5+4+2+32])
+		records, err := splitRecords(reply)
+		assert.NoError(t, err)
+		var types []byte
+		for _, record := range records {
+			types = append(types, record[0])
+		}
+		return types
+	}
+
+	t.Run("session id", func(t *testing.T) {
+		sessionId := make([]byte, 32)
+		common.CryptoRandRead(sessionId)
+		assert.Equal(t, []byte{0x16, 0x14, 0x17}, reply(t, sessionId))
+	})
+	t.Run("empty session id", func(t *testing.T) {
+		assert.Equal(t, []byte{0x16, 0x17}, reply(t, nil))
+	})
+
+	t.Run("dispatched", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		reply, err := readServerReply(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local.Close()
+		assert.Equal(t, byte(0x14), reply[1][0])
+
+		// without the session id, which carries half of what the client sends encrypted, a ClientHello can't be
+		// from a Cloak client
+		withoutSessionId := append(append([]byte{}, first[:5+4+2+32]...), 0x00)
+		withoutSessionId = append(withoutSessionId, first[5+4+2+32+1+32:]...)
+		binary.BigEndian.PutUint16(withoutSessionId[3:5], uint16(len(withoutSessionId)-5))
+		withoutSessionId[6] = 0
+		binary.BigEndian.PutUint16(withoutSessionId[7:9], uint16(len(withoutSessionId)-5-4))
+		local, remote = connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(withoutSessionId)
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirConn.Close()
+		local.Close()
+	})
+}
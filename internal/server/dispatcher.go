@@ -56,6 +56,9 @@ func connReadLine(conn net.Conn, buf []byte) (int, error) {
 
 var ErrUnrecognisedProtocol = errors.New("unrecognised protocol")
 
+// readFirstPacket reads the first packet into buf, and works out its transport. For TLS, it reads exactly the records
+// carrying the ClientHello, usually the first one, so anything the client has sent after it, even in the same TCP
+// segment, is left in conn. A ClientHello fragmented over more than buf can hold is an io.ErrShortBuffer
 func readFirstPacket(conn net.Conn, buf []byte, timeout time.Duration) (int, Transport, bool, error) {
 	conn.SetReadDeadline(time.Now().Add(timeout))
 	defer conn.SetReadDeadline(time.Time{})
@@ -94,6 +97,41 @@ func readFirstPacket(conn net.Conn, buf []byte, timeout time.Duration) (int, Tra
 			conn.Close()
 			return bufOffset, transport, false, err
 		}
+
+		// a ClientHello fragmented over several records is read until it's all there
+		for dataLength > 0 && buf[5] == 0x01 {
+			if _, _, complete := handshakeFragments(buf[:bufOffset]); complete {
+				break
+			}
+			if bufOffset+recordLayerLength > len(buf) {
+				return bufOffset, transport, true, io.ErrShortBuffer
+			}
+			i, err = io.ReadFull(conn, buf[bufOffset:bufOffset+recordLayerLength])
+			bufOffset += i
+			if err != nil {
+				err = fmt.Errorf("read error after connection is established: %v", err)
+				conn.Close()
+				return bufOffset, transport, false, err
+			}
+			header := buf[bufOffset-recordLayerLength : bufOffset]
+			if header[0] != 0x16 {
+				break
+			}
+			dataLength = int(binary.BigEndian.Uint16(header[3:5]))
+			if dataLength == 0 {
+				break
+			}
+			if bufOffset+dataLength > len(buf) {
+				return bufOffset, transport, true, io.ErrShortBuffer
+			}
+			i, err = io.ReadFull(conn, buf[bufOffset:bufOffset+dataLength])
+			bufOffset += i
+			if err != nil {
+				err = fmt.Errorf("read error after connection is established: %v", err)
+				conn.Close()
+				return bufOffset, transport, false, err
+			}
+		}
 	case 0x47:
 		transport = WebSocket{}
 
@@ -123,12 +161,47 @@ func readFirstPacket(conn net.Conn, buf []byte, timeout time.Duration) (int, Tra
 
 func dispatchConnection(conn net.Conn, sta *State) {
 	var err error
+	if sta.sourceBlocked(conn) {
+		conn.Close()
+		return
+	}
 	buf := make([]byte, 1500)
 
 	i, transport, redirOnErr, err := readFirstPacket(conn, buf, 15*time.Second)
 	data := buf[:i]
+	if _, ok := transport.(TLS); ok {
+		opts := sta.parseOptions()
+		if sta.HandshakeBudget > 0 {
+			opts.Deadline = sta.WorldState.Now().Add(sta.HandshakeBudget)
+			opts.Now = sta.WorldState.Now
+		}
+		transport = TLS{ParseOptions: &opts}
+	}
+	if _, ok := transport.(TLS); ok && err == nil && sta.AlwaysHelloRetryRequest {
+		data, err = sta.retryHello(conn, data, buf)
+		if err != nil {
+			log.WithField("remoteAddr", conn.RemoteAddr()).Warn(err)
+			conn.Close()
+			return
+		}
+	}
+	var earlyData []byte
+	if err == nil && sta.ReadAhead > 0 {
+		earlyData = readAhead(conn, sta.ReadAhead)
+	}
 
-	goWeb := func() {
+	goWeb := func(reason FallbackReason) {
+		sta.observeFallback(conn, reason)
+		if _, ok := transport.(TLS); ok && sta.answerServerNameMismatch(conn, data) {
+			return
+		}
+		if sta.ConfigureFallbackConn != nil {
+			sta.ConfigureFallbackConn(conn)
+		}
+		if sta.MaintenancePage != nil {
+			go sta.MaintenancePage.serve(conn, transport, append(data, earlyData...))
+			return
+		}
 		redirPort := sta.RedirPort
 		if redirPort == "" {
 			_, redirPort, _ = net.SplitHostPort(conn.LocalAddr().String())
@@ -136,11 +209,14 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		webConn, err := sta.RedirDialer.Dial("tcp", net.JoinHostPort(sta.RedirHost.String(), redirPort))
 		if err != nil {
 			log.Errorf("Making connection to redirection server: %v", err)
+			sta.closeFallbackConn(conn)
 			return
 		}
-		_, err = webConn.Write(data)
+		_, err = webConn.Write(append(data, earlyData...))
 		if err != nil {
 			log.Error("Failed to send first packet to redirection server", err)
+			webConn.Close()
+			sta.closeFallbackConn(conn)
 			return
 		}
 		go common.Copy(webConn, conn)
@@ -150,15 +226,27 @@ func dispatchConnection(conn net.Conn, sta *State) {
 	if err != nil {
 		log.WithField("remoteAddr", conn.RemoteAddr()).
 			Warnf("error reading first packet: %v", err)
+		sta.recordFailedHandshake(conn, data, err)
+		sta.countMalformedHello(conn)
 		if redirOnErr {
-			goWeb()
+			if sta.tarpitProbe(conn, transport, data, err) {
+				return
+			}
+			goWeb(FallbackBadHello)
 		} else {
-			conn.Close()
+			sta.closeFallbackConn(conn)
 		}
 		return
 	}
 
-	ci, finishHandshake, err := AuthFirstPacket(data, transport, sta)
+	if _, ok := transport.(TLS); ok && sta.classifyProbe(conn, data, func() { goWeb(FallbackProbe) }) {
+		return
+	}
+
+	authStart := time.Now()
+	ci, finishHandshake, err := sta.authFirstPacket(data, transport)
+	authDuration := time.Since(authStart)
+	sta.emitHandshakeEvent(conn, data, ci, err)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"remoteAddr":       conn.RemoteAddr(),
@@ -167,16 +255,68 @@ func dispatchConnection(conn net.Conn, sta *State) {
 			"proxyMethod":      ci.ProxyMethod,
 			"encryptionMethod": ci.EncryptionMethod,
 		}).Warn(err)
-		goWeb()
+		sta.recordFailedHandshake(conn, data, err)
+		if isMalformedHello(err) {
+			sta.countMalformedHello(conn)
+		}
+		if errors.Is(err, ErrReplay) {
+			sta.emitSecurityEvent(SecurityEventReplay, conn, ci.UID, err.Error())
+		}
+		if sta.tarpitProbe(conn, transport, data, err) {
+			return
+		}
+		goWeb(fallbackReason(err))
 		return
 	}
+	// an Authenticate that doesn't set ParseDuration has all of it timed as authentication
+	sta.observePhase(PhaseParse, ci.ParseDuration)
+	sta.observePhase(PhaseAuth, authDuration-ci.ParseDuration)
+	ci.EarlyData = append(ci.EarlyData, earlyData...)
+	if _, ok := transport.(TLS); ok && len(ci.EarlyData) > 0 {
+		records, err := splitRecords(ci.EarlyData)
+		var types []byte
+		for _, record := range records {
+			types = append(types, record[0])
+		}
+		log.WithFields(log.Fields{
+			"remoteAddr":  conn.RemoteAddr(),
+			"recordTypes": fmt.Sprintf("%x", types),
+			"incomplete":  err != nil,
+		}).Debugf("%v records after ClientHello", len(records))
+	}
+	clientConn := conn
+	if len(ci.EarlyData) > 0 {
+		clientConn = &earlyDataConn{Conn: conn, earlyData: ci.EarlyData}
+	}
+	if _, ok := transport.(TLS); ok {
+		clientConn = &compatCCSConn{Conn: clientConn}
+	}
+	var replyRecorder *replyRecordingConn
+	if sta.sampleReply() {
+		replyRecorder = &replyRecordingConn{Conn: clientConn, recording: true}
+		clientConn = replyRecorder
+	}
+	// finish sends the handshake reply with sessionKey in it
+	finish := func(sessionKey [32]byte) (net.Conn, error) {
+		replyStart := time.Now()
+		clientConn.SetWriteDeadline(replyStart.Add(sta.replyTimeout()))
+		preparedConn, err := finishHandshake(clientConn, sessionKey, sta.WorldState.Rand, sta.replyComposer(ci.UID))
+		if err != nil {
+			return nil, err
+		}
+		clientConn.SetWriteDeadline(time.Time{})
+		sta.observePhase(PhaseReply, time.Since(replyStart))
+		sta.latency.observe(time.Since(authStart), sta.WorldState.Now())
+		sta.reportReply(data, ci.HandshakeLength, replyRecorder)
+		return preparedConn, nil
+	}
 
 	var sessionKey [32]byte
 	common.RandRead(sta.WorldState.Rand, sessionKey[:])
 	obfuscator, err := mux.MakeObfuscator(ci.EncryptionMethod, sessionKey)
 	if err != nil {
 		log.Error(err)
-		goWeb()
+		goWeb(FallbackBadMethod)
 		return
 	}
 
@@ -192,12 +332,13 @@ func dispatchConnection(conn net.Conn, sta *State) {
 	// and normal proxy mode is that sessionID needs == 0 for admin mode
 	if bytes.Equal(ci.UID, sta.AdminUID) && ci.SessionId == 0 {
 		sesh := mux.MakeSession(0, seshConfig)
-		preparedConn, err := finishHandshake(conn, sessionKey, sta.WorldState.Rand)
+		preparedConn, err := finish(sessionKey)
 		if err != nil {
 			log.Error(err)
 			return
 		}
 		log.Trace("finished handshake")
+		sta.configureConn(conn, ci.UID)
 		sesh.AddConnection(preparedConn)
 		//TODO: Router could be nil in cnc mode
 		log.WithField("remoteAddr", preparedConn.RemoteAddr()).Info("New admin session")
@@ -207,6 +348,16 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		return
 	}
 
+	if sta.Draining() && !sta.Panel.hasSession(ci.UID, ci.SessionId) {
+		log.WithFields(log.Fields{
+			"remoteAddr": conn.RemoteAddr(),
+			"UID":        b64(ci.UID),
+			"sessionId":  ci.SessionId,
+		}).Info("draining, refusing new session")
+		goWeb(FallbackDraining)
+		return
+	}
+
 	var user *ActiveUser
 	if sta.IsBypass(ci.UID) {
 		user, err = sta.Panel.GetBypassUser(ci.UID)
@@ -219,7 +370,12 @@ func dispatchConnection(conn net.Conn, sta *State) {
 			"remoteAddr": conn.RemoteAddr(),
 			"error":      err,
 		}).Warn("+1 unauthorised UID")
-		goWeb()
+		sta.recordFailedHandshake(conn, data, err)
+		goWeb(FallbackUnauthorised)
+		return
+	}
+	if !sta.checkUIDIPs(conn, ci.UID) {
+		goWeb(FallbackTooManyIPs)
 		return
 	}
 
@@ -230,19 +386,21 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		return
 	}
 
-	preparedConn, err := finishHandshake(conn, sesh.SessionKey, sta.WorldState.Rand)
+	preparedConn, err := finish(sesh.SessionKey)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 	log.Trace("finished handshake")
+	sta.configureConn(conn, ci.UID)
 	sesh.AddConnection(preparedConn)
 
 	if !existing {
 		// if the session was newly made, we serve connections from the session streams to the proxy server
 		log.WithFields(log.Fields{
-			"UID":       b64(ci.UID),
-			"sessionID": ci.SessionId,
+			"UID":         b64(ci.UID),
+			"sessionID":   ci.SessionId,
+			"compression": ci.Compression,
 		}).Info("New session")
 
 		serveSession(sesh, ci, user, sta)
@@ -266,24 +424,55 @@ func serveSession(sesh *mux.Session, ci ClientInfo, user *ActiveUser, sta *State
 				continue
 			}
 		}
-		proxyAddr := sta.ProxyBook[ci.ProxyMethod]
+		proxyMethod := sta.resolveProxyMethod(ci.ProxyMethod, ci.UID)
+		release, ok := sta.acquireProxyConnection(proxyMethod, ci.UID)
+		if !ok {
+			log.WithFields(log.Fields{
+				"UID":         b64(ci.UID),
+				"proxyMethod": proxyMethod,
+			}).Warn("too many connections to proxy server, closing new stream")
+			newStream.Close()
+			continue
+		}
+		proxyAddr := sta.proxyAddr(proxyMethod, ci.UID)
+		if sta.ProxyBreaker != nil && !sta.ProxyBreaker.Allow(proxyAddr.String(), sta.WorldState.Now()) {
+			release()
+			log.WithFields(log.Fields{
+				"UID":         b64(ci.UID),
+				"proxyMethod": proxyMethod,
+				"upstream":    proxyAddr.String(),
+			}).Warn("proxy server circuit open, closing new stream")
+			newStream.Close()
+			continue
+		}
 		localConn, err := sta.ProxyDialer.Dial(proxyAddr.Network(), proxyAddr.String())
+		if sta.ProxyBreaker != nil {
+			if err != nil {
+				sta.ProxyBreaker.Failed(proxyAddr.String(), sta.WorldState.Now())
+			} else {
+				sta.ProxyBreaker.Succeeded(proxyAddr.String())
+			}
+		}
 		if err != nil {
-			log.Errorf("Failed to connect to %v: %v", ci.ProxyMethod, err)
+			release()
+			log.Errorf("Failed to connect to %v: %v", proxyMethod, err)
 			user.CloseSession(ci.SessionId, "Failed to connect to proxy server")
 			return err
 		}
-		log.Tracef("%v endpoint has been successfully connected", ci.ProxyMethod)
+		log.Tracef("%v endpoint has been successfully connected", proxyMethod)
 
-		// if stream has nothing to send to proxy server for sta.Timeout period of time, stream will return error
-		newStream.(*mux.Stream).SetWriteToTimeout(sta.Timeout)
+		// if stream has nothing to send to proxy server for the stream timeout of proxyMethod, stream will return error
+		newStream.(*mux.Stream).SetWriteToTimeout(sta.streamTimeout(proxyMethod))
+		// common.Copy closes both localConn and newStream when it returns
 		go func() {
+			defer release()
 			if _, err := common.Copy(localConn, newStream); err != nil {
 				log.Tracef("copying stream to proxy server: %v", err)
 			}
 		}()
 
 		go func() {
+			defer release()
 			if _, err := common.Copy(newStream, localConn); err != nil {
 				log.Tracef("copying proxy server to stream: %v", err)
 			}
@@ -1,15 +1,89 @@
 package server
 
 import (
+	"crypto"
 	"encoding/hex"
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
 	"github.com/cbeuw/connutil"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
+// cloakClientHello is a ClientHello from a Cloak client with cloakClientHelloUID, proxy method shadowsocks and
+// encryption method plain, made at cloakClientHelloTime for the server private key testStaticPv
+const cloakClientHello = "1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
+
+var cloakClientHelloTime = time.Unix(1565998966, 0)
+var cloakClientHelloUID, _ = hex.DecodeString("e679de6e5272ea59e23c97ebf352ee61")
+
+var testStaticPv = func() crypto.PrivateKey {
+	pvBytes, _ := hex.DecodeString("10de5a3c4a4d04efafc3e06d1506363a72bd6d053baef123e6a9a79a0c04b547")
+	p, _ := ecdh.Unmarshal(pvBytes)
+	return p.(crypto.PrivateKey)
+}()
+
+// makeDispatchTestState makes a State in which cloakClientHelloUID is a bypass user. Connections to the proxy and
+// the redirection server can be accepted from the returned listeners
+func makeDispatchTestState(t *testing.T) (sta *State, proxyListener *connutil.PipeListener, redirListener *connutil.PipeListener) {
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	t.Cleanup(func() { os.Remove(tmpDB.Name()) })
+	worldState := common.WorldOfTime(cloakClientHelloTime)
+	manager, err := usermanager.MakeLocalManager(tmpDB.Name(), worldState)
+	if err != nil {
+		t.Fatalf("failed to make local manager: %v", err)
+	}
+
+	var proxyDialer, redirDialer *connutil.PipeDialer
+	proxyDialer, proxyListener = connutil.DialerListener(128)
+	redirDialer, redirListener = connutil.DialerListener(128)
+
+	var arrUID [16]byte
+	copy(arrUID[:], cloakClientHelloUID)
+	sta = &State{
+		ProxyBook:   map[string]net.Addr{"shadowsocks": &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8388}},
+		ProxyDialer: proxyDialer,
+		WorldState:  worldState,
+		Timeout:     300 * time.Second,
+		BypassUID:   map[[16]byte]struct{}{arrUID: {}},
+		StaticPv:    testStaticPv,
+		RedirHost:   &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		RedirDialer: redirDialer,
+		UsedRandom:  map[[32]byte]int64{},
+		Panel:       MakeUserPanel(manager),
+	}
+	return
+}
+
+// readServerReply reads the ServerHello, ChangeCipherSpec and the ApplicationData records sent in reply to a
+// Cloak ClientHello
+func readServerReply(conn net.Conn) ([][]byte, error) {
+	var records [][]byte
+	for i := 0; i < 3; i++ {
+		header := make([]byte, 5)
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			return records, err
+		}
+		record := make([]byte, 5+int(u16(header[3:5])))
+		copy(record, header)
+		_, err = io.ReadFull(conn, record[5:])
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
 type rfpReturnValue struct {
 	n          int
 	transport  Transport
@@ -60,6 +134,42 @@ func TestReadFirstPacket(t *testing.T) {
 
 	})
 
+	t.Run("Good TLS fragmented", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		buf := make([]byte, 1500)
+		retChan := make(chan rfpReturnValue)
+		go rfp(remote, buf, retChan)
+
+		hello, _ := hex.DecodeString(cloakClientHello)
+		first := fragmentRecord(hello, 200)
+		ccs := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+		local.Write(append(append([]byte{}, first...), ccs...))
+
+		ret := <-retChan
+
+		assert.Equal(t, len(first), ret.n, "records after the ClientHello are left in conn")
+		assert.Equal(t, first, buf[:ret.n])
+		assert.IsType(t, TLS{}, ret.transport)
+		assert.NoError(t, ret.err)
+	})
+
+	t.Run("TLS fragmented but buf too small", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		buf := make([]byte, 300)
+		retChan := make(chan rfpReturnValue)
+		go rfp(remote, buf, retChan)
+
+		hello, _ := hex.DecodeString(cloakClientHello)
+		first := fragmentRecord(hello, 200)
+		local.Write(first)
+
+		ret := <-retChan
+
+		assert.Equal(t, io.ErrShortBuffer, ret.err)
+		assert.True(t, ret.redirOnErr)
+		assert.Equal(t, first[:ret.n], buf[:ret.n])
+	})
+
 	t.Run("Incomplete timeout", func(t *testing.T) {
 		local, remote := connutil.AsyncPipe()
 		buf := make([]byte, 1500)
@@ -207,4 +317,383 @@ func TestReadFirstPacket(t *testing.T) {
 		assert.IsType(t, WebSocket{}, ret.transport)
 		assert.NoError(t, ret.err)
 	})
+
+	t.Run("Good TLS trickled", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		buf := make([]byte, 1500)
+		retChan := make(chan rfpReturnValue)
+		go rfp(newThrottledConn(remote, throttleOptions{ReadDelay: 5 * time.Millisecond, MaxChunk: 64}), buf, retChan)
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local.Write(first)
+
+		ret := <-retChan
+
+		assert.Equal(t, len(first), ret.n)
+		assert.Equal(t, first, buf[:ret.n])
+		assert.IsType(t, TLS{}, ret.transport)
+		assert.NoError(t, ret.err)
+	})
+
+	t.Run("TLS stalled mid-record", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		buf := make([]byte, 1500)
+		retChan := make(chan rfpReturnValue)
+		go rfp(newThrottledConn(remote, throttleOptions{StallReads: true, StallReadsAfter: 100}), buf, retChan)
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local.Write(first)
+
+		select {
+		case ret := <-retChan:
+			assert.Equal(t, 100, ret.n)
+			assert.False(t, ret.redirOnErr)
+			assert.Error(t, ret.err)
+		case <-time.After(2 * timeout):
+			assert.Fail(t, "readFirstPacket should have timed out")
+		}
+	})
+}
+
+type chanRecorder chan HandshakeRecord
+
+func (c chanRecorder) Record(r HandshakeRecord) { c <- r }
+
+func TestDispatchConnection_Recorder(t *testing.T) {
+	t.Run("failed handshake is recorded", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		recorder := make(chanRecorder, 1)
+		sta.Recorder = recorder
+
+		// not a Cloak ClientHello
+		first, _ := hex.DecodeString(chromeClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirConn.Close()
+		select {
+		case record := <-recorder:
+			assert.Equal(t, first, record.FirstPacket)
+			assert.Equal(t, cloakClientHelloTime, record.Time)
+			assert.Equal(t, remote.RemoteAddr().String(), record.RemoteAddr)
+			assert.NotEmpty(t, record.Reason)
+		case <-time.After(timeout):
+			t.Error("failed handshake is not recorded")
+		}
+	})
+
+	t.Run("successful handshake is not recorded", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		recorder := make(chanRecorder, 1)
+		sta.Recorder = recorder
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		_, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		local.Close()
+		select {
+		case record := <-recorder:
+			t.Errorf("successful handshake is recorded: %v", record)
+		case <-time.After(timeout):
+		}
+	})
+}
+
+func TestDispatchConnection_Draining(t *testing.T) {
+	t.Run("not draining", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		records, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		assert.Equal(t, byte(0x16), records[0][0])
+		local.Close()
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.SetDraining(true)
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(first))
+		_, err = io.ReadFull(redirConn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, first, buf)
+		assert.False(t, sta.Panel.isActive(cloakClientHelloUID), "draining server made a new session")
+		local.Close()
+		redirConn.Close()
+	})
+}
+
+func TestDispatchConnection_NoKeyShare(t *testing.T) {
+	hellos := map[string][]byte{
+		"TLS 1.3": newTestClientHello().withoutExtension([2]byte{0x00, 0x33}).marshal(),
+		"TLS 1.2": newTestClientHello().
+			withoutExtension([2]byte{0x00, 0x33}).
+			withoutExtension([2]byte{0x00, 0x2b}).marshal(),
+	}
+	for name, first := range hellos {
+		t.Run(name, func(t *testing.T) {
+			sta, _, redirListener := makeDispatchTestState(t)
+			local, remote := connutil.AsyncPipe()
+			go dispatchConnection(remote, sta)
+			local.Write(first)
+
+			redirConn, err := redirListener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(first))
+			_, err = io.ReadFull(redirConn, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, first, buf, "a ClientHello without key_share is left to the redirection server")
+			local.Close()
+			redirConn.Close()
+		})
+	}
+}
+
+func TestDispatchConnection_ConfigureConn(t *testing.T) {
+	t.Run("successful handshake", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		configured := make(chan net.Conn, 2)
+		sta.ConfigureConn = func(conn net.Conn) { configured <- conn }
+		sta.ConfigureFallbackConn = func(conn net.Conn) { t.Error("ConfigureFallbackConn called on successful handshake") }
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		_, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+
+		select {
+		case conn := <-configured:
+			assert.Equal(t, remote, conn)
+		case <-time.After(timeout):
+			t.Fatal("ConfigureConn not called")
+		}
+		select {
+		case <-configured:
+			t.Error("ConfigureConn called more than once")
+		case <-time.After(timeout):
+		}
+		local.Close()
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		configured := make(chan net.Conn, 2)
+		sta.ConfigureConn = func(conn net.Conn) { t.Error("ConfigureConn called on fallback") }
+		sta.ConfigureFallbackConn = func(conn net.Conn) { configured <- conn }
+
+		first, _ := hex.DecodeString(chromeClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case conn := <-configured:
+			assert.Equal(t, remote, conn)
+		case <-time.After(timeout):
+			t.Fatal("ConfigureFallbackConn not called")
+		}
+		assert.Len(t, configured, 0, "ConfigureFallbackConn called more than once")
+		local.Close()
+		redirConn.Close()
+	})
+}
+
+func TestDispatchConnection_NoExtensions(t *testing.T) {
+	sta, _, redirListener := makeDispatchTestState(t)
+	recorder := make(chanRecorder, 1)
+	sta.Recorder = recorder
+
+	tch := newTestClientHello()
+	tch.extensions = nil
+	first := tch.marshal()
+	local, remote := connutil.AsyncPipe()
+	go dispatchConnection(remote, sta)
+	local.Write(first)
+
+	redirConn, err := redirListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(first))
+	_, err = io.ReadFull(redirConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, first, buf)
+
+	select {
+	case record := <-recorder:
+		assert.Contains(t, record.Reason, ErrNoExtensions.Error())
+	case <-time.After(timeout):
+		t.Error("handshake not recorded")
+	}
+	local.Close()
+	redirConn.Close()
+}
+
+func TestDispatchConnection_Authenticate(t *testing.T) {
+	// the stub takes any first packet as being from cloakClientHelloUID, and replies with the session key in plain
+	stubAuth := func(called chan []byte) func([]byte, Transport, *State) (ClientInfo, Responder, error) {
+		return func(firstPacket []byte, transport Transport, sta *State) (ClientInfo, Responder, error) {
+			called <- firstPacket
+			info := ClientInfo{
+				UID:              cloakClientHelloUID,
+				SessionId:        1,
+				ProxyMethod:      "shadowsocks",
+				EncryptionMethod: mux.EncryptionMethodPlain,
+				Transport:        transport,
+			}
+			respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader, composer ReplyComposer) (net.Conn, error) {
+				_, err := originalConn.Write(sessionKey[:])
+				return originalConn, err
+			}
+			return info, respond, nil
+		}
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		called := make(chan []byte, 1)
+		sta.Authenticate = stubAuth(called)
+
+		// not from a Cloak client, so AuthFirstPacket would have rejected it
+		first := newTestClientHello().marshal()
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		defer local.Close()
+
+		select {
+		case packet := <-called:
+			assert.Equal(t, first, packet)
+		case <-time.After(timeout):
+			t.Fatal("Authenticate not called")
+		}
+		sessionKey := make([]byte, 32)
+		_, err := io.ReadFull(local, sessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := sta.Panel.GetBypassUser(cloakClientHelloUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sesh, existing, err := user.GetSession(1, mux.SessionConfig{})
+		assert.NoError(t, err)
+		assert.True(t, existing, "no session made")
+		assert.Equal(t, sesh.SessionKey[:], sessionKey)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.Authenticate = func([]byte, Transport, *State) (ClientInfo, Responder, error) {
+			return ClientInfo{}, nil, ErrBadDecryption
+		}
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		defer local.Close()
+
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer redirConn.Close()
+		buf := make([]byte, len(first))
+		_, err = io.ReadFull(redirConn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, first, buf)
+	})
+}
+
+func TestDispatchConnection_HandshakeBudget(t *testing.T) {
+	sta, _, redirListener := makeDispatchTestState(t)
+	sta.HandshakeBudget = 100 * time.Millisecond
+	sta.MaxExtensions = 1000
+	recorder := make(chanRecorder, 1)
+	sta.Recorder = recorder
+	// the clock moves on by a millisecond every time it's read
+	var clockMutex sync.Mutex
+	now := cloakClientHelloTime
+	sta.WorldState.Now = func() time.Time {
+		clockMutex.Lock()
+		defer clockMutex.Unlock()
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	t.Run("pathological", func(t *testing.T) {
+		pathological := newTestClientHello()
+		for i := 0; i < 300; i++ {
+			pathological.extensions = append(pathological.extensions, testExtension{[2]byte{0xee, byte(i)}, nil})
+		}
+		first := pathological.marshal()
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer redirConn.Close()
+		buf := make([]byte, len(first))
+		_, err = io.ReadFull(redirConn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, first, buf)
+		select {
+		case record := <-recorder:
+			assert.Equal(t, ErrHandshakeBudget.Error(), record.Reason)
+		case <-time.After(timeout):
+			t.Error("handshake not recorded")
+		}
+	})
+	t.Run("normal", func(t *testing.T) {
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		records, err := readServerReply(local)
+		assert.NoError(t, err, "no handshake reply")
+		assert.NotEmpty(t, records)
+	})
 }
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readAheadTimeout is how long we wait for data sent by a client right after its ClientHello
+const readAheadTimeout = 50 * time.Millisecond
+
+// readAhead reads whatever the client has sent right after its first packet, up to max bytes, without waiting
+// for more than readAheadTimeout
+func readAhead(conn net.Conn, max int) []byte {
+	conn.SetReadDeadline(time.Now().Add(readAheadTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, max)
+	n, _ := conn.Read(buf)
+	if n == 0 {
+		return nil
+	}
+	return buf[:n]
+}
+
+// earlyDataConn is a net.Conn whose reads return earlyData before anything else read from Conn. earlyData and
+// what's left in Conn read as one uninterrupted stream, so a record split between them is read whole by
+// io.ReadFull
+type earlyDataConn struct {
+	net.Conn
+	earlyData []byte
+}
+
+func (c *earlyDataConn) Read(buf []byte) (int, error) {
+	if len(c.earlyData) > 0 {
+		n := copy(buf, c.earlyData)
+		c.earlyData = c.earlyData[n:]
+		return n, nil
+	}
+	return c.Conn.Read(buf)
+}
+
+// compatCCSConn is a net.Conn which discards a ChangeCipherSpec record if it's the first thing read from Conn, as a
+// TLS 1.3 client in middlebox compatibility mode may send one right after its ClientHello. Such a record is only
+// handshake noise, and would otherwise be taken as a Cloak frame which fails to be decrypted
+type compatCCSConn struct {
+	net.Conn
+	checked bool
+	pending []byte
+}
+
+func (c *compatCCSConn) Read(buf []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		// a record header, then the content of a ChangeCipherSpec
+		record := make([]byte, 6)
+		n, err := io.ReadFull(c.Conn, record[:5])
+		if n == 5 && record[0] == 0x14 && record[1] == 0x03 && u16(record[3:5]) == 1 {
+			var m int
+			m, err = io.ReadFull(c.Conn, record[5:])
+			n += m
+			if n == 6 && record[5] == 0x01 {
+				log.Trace("discarding middlebox compatibility ChangeCipherSpec")
+				n = 0
+			}
+		}
+		c.pending = record[:n]
+		if n == 0 && err != nil {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(buf, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(buf)
+}
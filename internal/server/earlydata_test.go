@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/hex"
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestReadAhead(t *testing.T) {
+	hello, _ := hex.DecodeString(cloakClientHello)
+	early := []byte{0x17, 0x03, 0x03, 0x00, 0x03, 0x01, 0x02, 0x03}
+
+	t.Run("handshake with data", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		local.Write(append(append([]byte{}, hello...), early...))
+
+		buf := make([]byte, 1500)
+		n, transport, _, err := readFirstPacket(remote, buf, timeout)
+		assert.NoError(t, err)
+		assert.IsType(t, TLS{}, transport)
+		assert.Equal(t, hello, buf[:n])
+		assert.Equal(t, early, readAhead(remote, 1024))
+	})
+
+	t.Run("more than max", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		local.Write(early)
+		assert.Equal(t, early[:4], readAhead(remote, 4))
+	})
+
+	t.Run("handshake only", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		local.Write(hello)
+
+		buf := make([]byte, 1500)
+		_, _, _, err := readFirstPacket(remote, buf, timeout)
+		assert.NoError(t, err)
+		assert.Empty(t, readAhead(remote, 1024))
+	})
+}
+
+func TestEarlyDataConn(t *testing.T) {
+	local, remote := connutil.AsyncPipe()
+	conn := &earlyDataConn{Conn: remote, earlyData: []byte{1, 2, 3, 4, 5}}
+	local.Write([]byte{6, 7})
+
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, buf)
+
+	buf = make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{4, 5, 6, 7}, buf)
+}
+
+func TestDispatchConnection_ReadAhead(t *testing.T) {
+	sta, _, redirListener := makeDispatchTestState(t)
+	sta.ReadAhead = 1024
+
+	hello, _ := hex.DecodeString(chromeClientHello)
+	early := []byte{0x17, 0x03, 0x03, 0x00, 0x03, 0x01, 0x02, 0x03}
+	first := append(append([]byte{}, hello...), early...)
+	local, remote := connutil.AsyncPipe()
+	go dispatchConnection(remote, sta)
+	local.Write(first)
+
+	redirConn, err := redirListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(first))
+	_, err = io.ReadFull(redirConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, first, buf, "redirection server didn't get both the ClientHello and the data after it")
+	local.Close()
+	redirConn.Close()
+}
+
+func TestEarlyData_SharedRead(t *testing.T) {
+	hello, _ := hex.DecodeString(cloakClientHello)
+	firstFrame := common.AddRecordLayer([]byte("first cloak frame"), 0x17, 0x0303)
+	secondFrame := common.AddRecordLayer([]byte("second cloak frame"), 0x17, 0x0303)
+
+	for _, c := range []struct {
+		name      string
+		readAhead int
+	}{
+		{"whole frame in read ahead", 1024},
+		{"frame split by read ahead", 10},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			local, remote := connutil.AsyncPipe()
+			// the ClientHello and the first frame arrive in the same read
+			local.Write(append(append([]byte{}, hello...), firstFrame...))
+
+			buf := make([]byte, 1500)
+			n, _, _, err := readFirstPacket(remote, buf, timeout)
+			assert.NoError(t, err)
+			assert.Equal(t, hello, buf[:n])
+			early := readAhead(remote, c.readAhead)
+			local.Write(secondFrame)
+
+			tlsConn := common.NewTLSConn(&earlyDataConn{Conn: remote, earlyData: early})
+			payload := make([]byte, 100)
+			n, err = tlsConn.Read(payload)
+			assert.NoError(t, err)
+			assert.Equal(t, firstFrame[5:], payload[:n])
+			n, err = tlsConn.Read(payload)
+			assert.NoError(t, err)
+			assert.Equal(t, secondFrame[5:], payload[:n])
+		})
+	}
+}
+
+func TestCompatCCSConn(t *testing.T) {
+	hello, _ := hex.DecodeString(cloakClientHello)
+	ccs := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+	firstFrame := common.AddRecordLayer([]byte("first cloak frame"), 0x17, 0x0303)
+
+	// firstRecord reads the first record through a compatCCSConn from what the client has sent after its ClientHello,
+	// which is written in writes
+	firstRecord := func(t *testing.T, max int, writes ...[]byte) []byte {
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		local.Write(append(append([]byte{}, hello...), writes[0]...))
+		buf := make([]byte, 1500)
+		_, _, _, err := readFirstPacket(remote, buf, timeout)
+		assert.NoError(t, err)
+		early := readAhead(remote, max)
+		for _, w := range writes[1:] {
+			local.Write(w)
+		}
+
+		tlsConn := common.NewTLSConn(&compatCCSConn{Conn: &earlyDataConn{Conn: remote, earlyData: early}})
+		payload := make([]byte, 100)
+		n, err := tlsConn.Read(payload)
+		assert.NoError(t, err)
+		return payload[:n]
+	}
+
+	t.Run("CCS coalesced with the ClientHello", func(t *testing.T) {
+		assert.Equal(t, firstFrame[5:], firstRecord(t, 1024, append(append([]byte{}, ccs...), firstFrame...)))
+	})
+	t.Run("CCS split by read ahead", func(t *testing.T) {
+		assert.Equal(t, firstFrame[5:], firstRecord(t, 3, append(append([]byte{}, ccs...), firstFrame...)))
+	})
+	t.Run("CCS sent on its own", func(t *testing.T) {
+		assert.Equal(t, firstFrame[5:], firstRecord(t, 1024, ccs, firstFrame))
+	})
+	t.Run("no CCS", func(t *testing.T) {
+		assert.Equal(t, firstFrame[5:], firstRecord(t, 1024, firstFrame))
+	})
+	t.Run("only the first record is discarded", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		local.Write(append(append([]byte{}, ccs...), ccs...))
+		tlsConn := common.NewTLSConn(&compatCCSConn{Conn: remote})
+		payload := make([]byte, 100)
+		n, err := tlsConn.Read(payload)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x01}, payload[:n])
+	})
+	t.Run("not a CCS despite its header", func(t *testing.T) {
+		notCCS := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x02}
+		assert.Equal(t, []byte{0x02}, firstRecord(t, 1024, notCCS))
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// HandshakeEvent describes the outcome of the first packet of a connection
+type HandshakeEvent struct {
+	Time     time.Time
+	RemoteIP string
+	// Accepted is whether the first packet is from a Cloak client. If not, Reason is why
+	Accepted bool
+	Reason   string
+	// UID is the UID of the Cloak client, or nil if it isn't from one
+	UID []byte
+	// JA3 is the JA3 fingerprint of the ClientHello, or empty if the first packet isn't one
+	JA3 string
+	// Version is the TLS version negotiated with a Cloak client over TLS, or 0 otherwise
+	Version uint16
+	ALPN    string
+}
+
+// emitHandshakeEvent sends the event of a first packet to HandshakeEvents if it's set. It never blocks: if the
+// channel is full, the event is dropped and counted in DroppedHandshakeEvents
+func (sta *State) emitHandshakeEvent(conn net.Conn, firstPacket []byte, info ClientInfo, err error) {
+	if sta.HandshakeEvents == nil {
+		return
+	}
+	event := HandshakeEvent{
+		Time:     sta.WorldState.Now(),
+		RemoteIP: sourceIP(conn),
+		Accepted: err == nil,
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	} else {
+		event.UID = info.UID
+		event.ALPN = info.ALPN
+		if _, ok := info.Transport.(TLS); ok {
+			// the handshake reply has TLS 1.3 in its supported_versions, unless it's laid out as TLS 1.2 without one
+			event.Version = 0x0304
+			if sta.serverProfile(info.UID).TLS12ServerHello {
+				event.Version = 0x0303
+			}
+		}
+	}
+	if ch, parseErr := parseClientHello(firstPacket, DefaultParseOptions); parseErr == nil {
+		event.JA3 = ch.JA3()
+	}
+
+	select {
+	case sta.HandshakeEvents <- event:
+	default:
+		atomic.AddUint32(&sta.droppedHandshakeEvents, 1)
+	}
+}
+
+// DroppedHandshakeEvents is the number of HandshakeEvents dropped because HandshakeEvents was full
+func (sta *State) DroppedHandshakeEvents() uint32 {
+	return atomic.LoadUint32(&sta.droppedHandshakeEvents)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/hex"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestDispatchConnection_HandshakeEvents(t *testing.T) {
+	sta, _, redirListener := makeDispatchTestState(t)
+	sta.HandshakeEvents = make(chan HandshakeEvent, 4)
+	go func() {
+		for {
+			conn, err := redirListener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	receive := func(t *testing.T) HandshakeEvent {
+		select {
+		case event := <-sta.HandshakeEvents:
+			return event
+		case <-time.After(timeout):
+			t.Fatal("no event emitted")
+		}
+		return HandshakeEvent{}
+	}
+
+	t.Run("Cloak client", func(t *testing.T) {
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		event := receive(t)
+		assert.True(t, event.Accepted)
+		assert.Empty(t, event.Reason)
+		assert.Equal(t, cloakClientHelloUID, event.UID)
+		assert.Equal(t, cloakClientHelloTime, event.Time)
+		assert.Equal(t, sourceIP(remote), event.RemoteIP)
+		assert.Equal(t, uint16(0x0304), event.Version)
+		assert.Len(t, event.JA3, 32)
+		local.Close()
+	})
+
+	t.Run("browser", func(t *testing.T) {
+		first, _ := hex.DecodeString(chromeClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		event := receive(t)
+		assert.False(t, event.Accepted)
+		assert.Contains(t, event.Reason, ErrBadDecryption.Error())
+		assert.Nil(t, event.UID)
+		assert.Equal(t, "66918128f1b9b03303d77c6f2eefd128", event.JA3)
+		assert.Zero(t, event.Version)
+		local.Close()
+	})
+}
+
+func TestEmitHandshakeEvent_TLS12ServerHello(t *testing.T) {
+	sta, _, _ := makeDispatchTestState(t)
+	sta.HandshakeEvents = make(chan HandshakeEvent, 1)
+	sta.Profile = &ServerProfile{CipherSuite: 0xc02f, TLS12ServerHello: true}
+	_, conn := connutil.AsyncPipe()
+	first, _ := hex.DecodeString(cloakClientHello)
+
+	sta.emitHandshakeEvent(conn, first, ClientInfo{UID: cloakClientHelloUID, Transport: TLS{}}, nil)
+	event := <-sta.HandshakeEvents
+	assert.True(t, event.Accepted)
+	assert.Equal(t, uint16(0x0303), event.Version, "a TLS 1.2 ServerHello negotiates TLS 1.2")
+}
+
+func TestEmitHandshakeEvent_Full(t *testing.T) {
+	sta, _, _ := makeDispatchTestState(t)
+	sta.HandshakeEvents = make(chan HandshakeEvent, 2)
+	_, conn := connutil.AsyncPipe()
+	first, _ := hex.DecodeString(chromeClientHello)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			sta.emitHandshakeEvent(conn, first, ClientInfo{}, ErrBadDecryption)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("emitting to a full channel blocks")
+	}
+	assert.Len(t, sta.HandshakeEvents, 2)
+	assert.Equal(t, uint32(3), sta.DroppedHandshakeEvents())
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// FallbackReason is why a connection is relayed to the redirection server instead of being served as a Cloak client
+type FallbackReason int
+
+const (
+	// FallbackBadHello is for a first packet that is malformed, or isn't a ClientHello or an HTTP GET at all
+	FallbackBadHello FallbackReason = iota
+	// FallbackNotCloak is for a well-formed first packet that isn't from a Cloak client
+	FallbackNotCloak
+	// FallbackReplay is for a first packet that has been seen before
+	FallbackReplay
+	// FallbackBadMethod is for a Cloak client asking for a proxy method or encryption method it can't have
+	FallbackBadMethod
+	// FallbackUnauthorised is for a Cloak client whose UID isn't allowed to connect
+	FallbackUnauthorised
+	// FallbackDraining is for a new session of a Cloak client while the server is draining
+	FallbackDraining
+	// FallbackProbe is for a connection that ProbeClassifier takes for a probe
+	FallbackProbe
+	// FallbackTooManyIPs is for a Cloak client whose UID has connected from too many source IPs, if UIDIPAction is
+	// UIDIPDivert
+	FallbackTooManyIPs
+)
+
+func (r FallbackReason) String() string {
+	switch r {
+	case FallbackBadHello:
+		return "bad hello"
+	case FallbackNotCloak:
+		return "not cloak"
+	case FallbackReplay:
+		return "replay"
+	case FallbackBadMethod:
+		return "bad method"
+	case FallbackUnauthorised:
+		return "unauthorised"
+	case FallbackDraining:
+		return "draining"
+	case FallbackProbe:
+		return "probe"
+	case FallbackTooManyIPs:
+		return "too many IPs"
+	default:
+		return "unknown"
+	}
+}
+
+// fallbackReason is the reason for a connection whose first packet failed authentication with err
+func fallbackReason(err error) FallbackReason {
+	switch {
+	case isMalformedHello(err):
+		return FallbackBadHello
+	case errors.Is(err, ErrReplay):
+		return FallbackReplay
+	case errors.Is(err, ErrBadProxyMethod), errors.Is(err, ErrEncryptionMethodNotAllowed):
+		return FallbackBadMethod
+	default:
+		return FallbackNotCloak
+	}
+}
+
+// observeFallback passes the reason for relaying conn to the redirection server to OnFallback, if it's set
+func (sta *State) observeFallback(conn net.Conn, reason FallbackReason) {
+	if sta.OnFallback != nil {
+		sta.OnFallback(conn, reason)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallbackReason(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		reason FallbackReason
+	}{
+		{ErrBadClientHello, FallbackBadHello},
+		{fmt.Errorf("%w: 3 offered", ErrTooFewCipherSuites), FallbackBadHello},
+		{ErrBadDecryption, FallbackNotCloak},
+		{ErrTimestampOutOfWindow, FallbackNotCloak},
+		{ErrCrossUIDReplay, FallbackReplay},
+		{ErrBadProxyMethod, FallbackBadMethod},
+		{fmt.Errorf("%w: client uses 1, plain required", ErrEncryptionMethodNotAllowed), FallbackBadMethod},
+	} {
+		assert.Equal(t, c.reason, fallbackReason(c.err), "%v", c.err)
+	}
+}
+
+func TestDispatchConnection_FallbackReason(t *testing.T) {
+	cloakBytes, _ := hex.DecodeString(cloakClientHello)
+	chromeBytes, _ := hex.DecodeString(chromeClientHello)
+
+	// dispatch sends each of firsts on a connection of its own to sta, of which all but the last are to be answered,
+	// and returns the reason the last falls back
+	dispatch := func(t *testing.T, sta *State, redirListener *connutil.PipeListener, firsts ...[]byte) FallbackReason {
+		reasons := make(chan FallbackReason, len(firsts))
+		sta.OnFallback = func(conn net.Conn, reason FallbackReason) { reasons <- reason }
+		for i, first := range firsts {
+			local, remote := connutil.AsyncPipe()
+			t.Cleanup(func() { local.Close() })
+			go dispatchConnection(remote, sta)
+			local.Write(first)
+			if i < len(firsts)-1 {
+				if _, err := readServerReply(local); err != nil {
+					t.Fatalf("failed to read server reply: %v", err)
+				}
+			}
+		}
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirConn.Close()
+		return <-reasons
+	}
+
+	t.Run("bad hello", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		assert.Equal(t, FallbackBadHello, dispatch(t, sta, redirListener, []byte("SSH-2.0-OpenSSH_8.2\r\n")))
+	})
+	t.Run("not cloak", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		assert.Equal(t, FallbackNotCloak, dispatch(t, sta, redirListener, chromeBytes))
+	})
+	t.Run("forged session_id", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		forged := append([]byte{}, cloakBytes...)
+		forged[5+4+2+32+1] ^= 0x01
+		assert.Equal(t, FallbackNotCloak, dispatch(t, sta, redirListener, forged))
+	})
+	t.Run("replay", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		assert.Equal(t, FallbackReplay, dispatch(t, sta, redirListener, cloakBytes, cloakBytes))
+	})
+	t.Run("unauthorised", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.BypassUID = nil
+		assert.Equal(t, FallbackUnauthorised, dispatch(t, sta, redirListener, cloakBytes))
+	})
+	t.Run("draining", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.SetDraining(true)
+		assert.Equal(t, FallbackDraining, dispatch(t, sta, redirListener, cloakBytes))
+	})
+	t.Run("probe", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.ProbeClassifier = fixedClassifier{decision: ProbeDivert, seen: make(chan *ClientHello, 1)}
+		assert.Equal(t, FallbackProbe, dispatch(t, sta, redirListener, cloakBytes))
+	})
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// fillerReseedLength is the number of bytes read from a filler keystream before it's replaced with a freshly seeded
+// one, well before the 256 GiB a ChaCha20 key and nonce can encrypt
+const fillerReseedLength = 1 << 30
+
+// fillerRandom reads ChaCha20 keystreams seeded from seed. Before Go 1.24, every read from crypto/rand is a getrandom
+// syscall, which is a lot to make for the few kilobytes of encrypted flight of every connection when none of it is
+// secret. Keystreams are kept in a sync.Pool, so concurrent readers each get their own instead of contending over one
+type fillerRandom struct {
+	seed    io.Reader
+	streams sync.Pool
+}
+
+type fillerStream struct {
+	cipher    *chacha20.Cipher
+	remaining int
+}
+
+func makeFillerRandom(seed io.Reader) *fillerRandom {
+	return &fillerRandom{seed: seed}
+}
+
+func (f *fillerRandom) newStream() (*fillerStream, error) {
+	seed := make([]byte, chacha20.KeySize+chacha20.NonceSize)
+	_, err := io.ReadFull(f.seed, seed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seed filler keystream: %w", err)
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(seed[:chacha20.KeySize], seed[chacha20.KeySize:])
+	if err != nil {
+		return nil, err
+	}
+	return &fillerStream{cipher: cipher, remaining: fillerReseedLength}, nil
+}
+
+// Read fills p with keystream. At most fillerReseedLength bytes are read at a time
+func (f *fillerRandom) Read(p []byte) (int, error) {
+	if len(p) > fillerReseedLength {
+		p = p[:fillerReseedLength]
+	}
+	stream, _ := f.streams.Get().(*fillerStream)
+	if stream == nil || stream.remaining < len(p) {
+		var err error
+		stream, err = f.newStream()
+		if err != nil {
+			return 0, err
+		}
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	stream.cipher.XORKeyStream(p, p)
+	stream.remaining -= len(p)
+	f.streams.Put(stream)
+	return len(p), nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFillerRandom(t *testing.T) {
+	t.Run("keystream", func(t *testing.T) {
+		filler := makeFillerRandom(rand.Reader)
+		a := make([]byte, 4096)
+		b := make([]byte, 4096)
+		_, err := io.ReadFull(filler, a)
+		assert.NoError(t, err)
+		_, err = io.ReadFull(filler, b)
+		assert.NoError(t, err)
+		assert.NotEqual(t, make([]byte, 4096), a)
+		assert.NotEqual(t, a, b)
+	})
+
+	t.Run("failed seed", func(t *testing.T) {
+		filler := makeFillerRandom(bytes.NewReader(make([]byte, 10)))
+		_, err := filler.Read(make([]byte, 16))
+		assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "got %v", err)
+	})
+
+	t.Run("reseeded", func(t *testing.T) {
+		seeds := &countingReader{Reader: rand.Reader}
+		filler := makeFillerRandom(seeds)
+		stream, err := filler.newStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.remaining = 10
+		filler.streams.Put(stream)
+		_, err = filler.Read(make([]byte, 16))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, seeds.reads)
+	})
+}
+
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.Reader.Read(p)
+}
+
+func TestTLSReplyComposer_FillerRand(t *testing.T) {
+	sessionId := make([]byte, 32)
+	composer := TLSReplyComposer{
+		Profile:    DefaultServerProfile,
+		Rand:       rand.Reader,
+		FillerRand: bytes.NewReader(bytes.Repeat([]byte{0xaa}, 1000)),
+	}
+	reply, err := composer.ComposeReply(minimalClientHello(sessionId), make([]byte, 32), make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(reply)
+	readRecord(r, 0x16)
+	readRecord(r, 0x14)
+	flight, err := readRecord(r, 0x17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, bytes.Repeat([]byte{0xaa}, len(flight)), flight)
+}
+
+// BenchmarkFillerRandom compares reading the 4 KB filler of an encrypted flight from crypto/rand and from
+// fillerRandom, from as many goroutines as there are CPUs
+func BenchmarkFillerRandom(b *testing.B) {
+	for _, c := range []struct {
+		name   string
+		source io.Reader
+	}{
+		{"crypto/rand", rand.Reader},
+		{"fillerRandom", makeFillerRandom(rand.Reader)},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(4096)
+			b.RunParallel(func(pb *testing.PB) {
+				flight := make([]byte, 4096)
+				for pb.Next() {
+					io.ReadFull(c.source, flight)
+				}
+			})
+		})
+	}
+}
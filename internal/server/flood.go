@@ -0,0 +1,130 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFloodWindow   = time.Minute
+	defaultFloodCooldown = 10 * time.Minute
+	defaultFloodMaxIPs   = 10000
+)
+
+// malformedHelloErrors are the outcomes of a first packet which a browser would never send
+var malformedHelloErrors = append([]error{
+	ErrBadClientHello,
+	ErrBadGET,
+	ErrUnrecognisedProtocol,
+	ErrHandshakeBudget,
+	ErrSmallOrderKeyShare,
+	ErrTooManyKeyShares,
+}, failedCheckErrors...)
+
+// isMalformedHello checks if err, returned by AuthFirstPacket, means that the first packet was malformed rather than
+// simply not from a Cloak client
+func isMalformedHello(err error) bool {
+	for _, malformed := range malformedHelloErrors {
+		if errors.Is(err, malformed) {
+			return true
+		}
+	}
+	return false
+}
+
+// FloodTracker counts the malformed first packets from each source IP. Once an IP has sent Threshold of them within
+// Window, connections from it are dropped for Cooldown. At most MaxIPs are tracked, and the least recently seen is
+// forgotten to make room for a new one
+type FloodTracker struct {
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+	MaxIPs    int
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type floodEntry struct {
+	ip string
+	// failures are the times of the most recent malformed first packets, oldest first, of which there are fewer
+	// than Threshold
+	failures     []time.Time
+	blockedUntil time.Time
+}
+
+func MakeFloodTracker(threshold int, window, cooldown time.Duration, maxIPs int) *FloodTracker {
+	return &FloodTracker{
+		Threshold: threshold,
+		Window:    window,
+		Cooldown:  cooldown,
+		MaxIPs:    maxIPs,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// Blocked checks if connections from ip are being dropped at now
+func (ft *FloodTracker) Blocked(ip string, now time.Time) bool {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	elem, ok := ft.entries[ip]
+	if !ok {
+		return false
+	}
+	return now.Before(elem.Value.(*floodEntry).blockedUntil)
+}
+
+// Failed counts a malformed first packet from ip at now
+func (ft *FloodTracker) Failed(ip string, now time.Time) {
+	ft.mutex.Lock()
+	defer ft.mutex.Unlock()
+	var entry *floodEntry
+	if elem, ok := ft.entries[ip]; ok {
+		ft.lru.MoveToFront(elem)
+		entry = elem.Value.(*floodEntry)
+	} else {
+		if ft.lru.Len() >= ft.MaxIPs {
+			oldest := ft.lru.Back()
+			ft.lru.Remove(oldest)
+			delete(ft.entries, oldest.Value.(*floodEntry).ip)
+		}
+		entry = &floodEntry{ip: ip}
+		ft.entries[ip] = ft.lru.PushFront(entry)
+	}
+
+	// forget the failures that have slid out of the window
+	windowStart := now.Add(-ft.Window)
+	recent := entry.failures[:0]
+	for _, t := range entry.failures {
+		if t.After(windowStart) {
+			recent = append(recent, t)
+		}
+	}
+	entry.failures = append(recent, now)
+	if len(entry.failures) >= ft.Threshold {
+		entry.blockedUntil = now.Add(ft.Cooldown)
+		entry.failures = entry.failures[:0]
+	}
+}
+
+// countMalformedHello counts a malformed first packet from the source of conn if FloodTracker is set
+func (sta *State) countMalformedHello(conn net.Conn) {
+	if sta.FloodTracker != nil {
+		sta.FloodTracker.Failed(sourceIP(conn), sta.WorldState.Now())
+	}
+}
+
+// sourceIP returns the IP address of the other end of conn, or the whole address if it doesn't have a port
+func sourceIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestFloodTracker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	t.Run("threshold and cooldown", func(t *testing.T) {
+		ft := MakeFloodTracker(3, time.Minute, 10*time.Minute, 16)
+		ft.Failed("1.2.3.4", start)
+		ft.Failed("1.2.3.4", start.Add(time.Second))
+		assert.False(t, ft.Blocked("1.2.3.4", start.Add(time.Second)))
+		ft.Failed("1.2.3.4", start.Add(2*time.Second))
+		assert.True(t, ft.Blocked("1.2.3.4", start.Add(2*time.Second)))
+		assert.False(t, ft.Blocked("5.6.7.8", start.Add(2*time.Second)), "another IP is blocked")
+		assert.True(t, ft.Blocked("1.2.3.4", start.Add(5*time.Minute)))
+		assert.False(t, ft.Blocked("1.2.3.4", start.Add(2*time.Second+10*time.Minute)), "blocked past cooldown")
+	})
+	t.Run("sliding window", func(t *testing.T) {
+		ft := MakeFloodTracker(3, time.Minute, 10*time.Minute, 16)
+		ft.Failed("1.2.3.4", start)
+		ft.Failed("1.2.3.4", start.Add(50*time.Second))
+		// the first failure has slid out of the window
+		ft.Failed("1.2.3.4", start.Add(70*time.Second))
+		assert.False(t, ft.Blocked("1.2.3.4", start.Add(70*time.Second)))
+		ft.Failed("1.2.3.4", start.Add(80*time.Second))
+		assert.True(t, ft.Blocked("1.2.3.4", start.Add(80*time.Second)))
+	})
+	t.Run("bounded memory", func(t *testing.T) {
+		ft := MakeFloodTracker(2, time.Minute, 10*time.Minute, 4)
+		ft.Failed("1.2.3.4", start)
+		ft.Failed("1.2.3.4", start)
+		assert.True(t, ft.Blocked("1.2.3.4", start))
+		for i := 0; i < 4; i++ {
+			ft.Failed(fmt.Sprintf("10.0.0.%v", i), start)
+		}
+		assert.Equal(t, 4, ft.lru.Len())
+		assert.Len(t, ft.entries, 4)
+		assert.False(t, ft.Blocked("1.2.3.4", start), "least recently seen IP isn't evicted")
+	})
+}
+
+func TestIsMalformedHello(t *testing.T) {
+	assert.True(t, isMalformedHello(ErrBadClientHello))
+	assert.True(t, isMalformedHello(fmt.Errorf("%w: 2 offered", ErrTooFewCipherSuites)))
+	assert.False(t, isMalformedHello(fmt.Errorf("%w: cipher: message authentication failed", ErrBadDecryption)))
+	assert.False(t, isMalformedHello(ErrReplay))
+	assert.False(t, isMalformedHello(errors.New("something else")))
+}
+
+func TestDispatchConnection_Flood(t *testing.T) {
+	sta, _, redirListener := makeDispatchTestState(t)
+	const threshold = 5
+	sta.FloodTracker = MakeFloodTracker(threshold, time.Minute, 10*time.Minute, 16)
+	go func() {
+		for {
+			conn, err := redirListener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	// every connection from an AsyncPipe has the same remote address
+	malformed := append([]byte{0x16, 0x03, 0x01, 0x00, 0x04}, "junk"...)
+	for i := 0; i < threshold; i++ {
+		local, remote := connutil.AsyncPipe()
+		assert.False(t, sta.FloodTracker.Blocked(sourceIP(remote), sta.WorldState.Now()), "blocked after %v packets", i)
+		done := make(chan struct{})
+		go func() {
+			dispatchConnection(remote, sta)
+			close(done)
+		}()
+		local.Write(malformed)
+		<-done
+		local.Close()
+	}
+
+	local, remote := connutil.AsyncPipe()
+	assert.True(t, sta.FloodTracker.Blocked(sourceIP(remote), sta.WorldState.Now()))
+	done := make(chan struct{})
+	go func() {
+		dispatchConnection(remote, sta)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("connection from a flooding IP isn't dropped straight away")
+	}
+	_, err := local.Read(make([]byte, 1))
+	assert.Error(t, err, "connection from a flooding IP isn't closed")
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hashRingReplicas is the number of points each upstream has on a HashRing. The more there are, the more evenly keys
+// are spread over the upstreams
+const hashRingReplicas = 160
+
+// HashRing picks one of several upstreams of a proxy method by consistent hashing, so that a key always gets the same
+// upstream, and only the keys of an upstream move if it is added or removed
+type HashRing struct {
+	points    []uint64
+	upstreams map[uint64]net.Addr
+	members   []net.Addr
+}
+
+func hashRingPoint(data []byte) uint64 {
+	sum := sha256.Sum256(data)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func MakeHashRing(upstreams []net.Addr) *HashRing {
+	ring := &HashRing{upstreams: make(map[uint64]net.Addr), members: upstreams}
+	for _, upstream := range upstreams {
+		for i := 0; i < hashRingReplicas; i++ {
+			point := hashRingPoint([]byte(upstream.String() + "#" + strconv.Itoa(i)))
+			if _, taken := ring.upstreams[point]; taken {
+				continue
+			}
+			ring.upstreams[point] = upstream
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Get returns the upstream of key, which is the one with the first point on the ring at or after the hash of key
+func (r *HashRing) Get(key []byte) net.Addr {
+	if len(r.points) == 0 {
+		return nil
+	}
+	return r.upstreams[r.points[r.index(key)]]
+}
+
+// GetUsable returns the upstream of key like Get, but passes over the points of upstreams that aren't usable, so the
+// keys of such an upstream go to the next usable one on the ring. If none is usable, it's the upstream Get returns
+func (r *HashRing) GetUsable(key []byte, usable func(net.Addr) bool) net.Addr {
+	if len(r.points) == 0 {
+		return nil
+	}
+	i := r.index(key)
+	unusable := make(map[net.Addr]bool)
+	for n := 0; n < len(r.points) && len(unusable) < len(r.members); n++ {
+		upstream := r.upstreams[r.points[(i+n)%len(r.points)]]
+		if unusable[upstream] {
+			continue
+		}
+		if usable(upstream) {
+			return upstream
+		}
+		unusable[upstream] = true
+	}
+	return r.upstreams[r.points[i]]
+}
+
+// Upstreams returns every upstream on the ring
+func (r *HashRing) Upstreams() []net.Addr {
+	return r.members
+}
+
+// index is that of the first point on the ring at or after the hash of key
+func (r *HashRing) index(key []byte) int {
+	hash := hashRingPoint(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// parseProxyUpstreams makes the HashRing of each proxy method with more upstreams, which are resolved on the network
+// of the proxy method's entry in proxyBook. The address in proxyBook is one of the upstreams
+func parseProxyUpstreams(upstreams map[string][]string, proxyBook map[string]net.Addr) (map[string]*HashRing, error) {
+	rings := make(map[string]*HashRing)
+	for name, addrs := range upstreams {
+		name = strings.ToLower(name)
+		first, ok := proxyBook[name]
+		if !ok {
+			return nil, fmt.Errorf("upstreams given for %v, which isn't in ProxyBook", name)
+		}
+		resolved := []net.Addr{first}
+		for _, addr := range addrs {
+			upstream, err := parseProxyAddr(first.Network(), addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstream of %v: %v", name, err)
+			}
+			resolved = append(resolved, upstream)
+		}
+		rings[name] = MakeHashRing(resolved)
+	}
+	return rings, nil
+}
+
+// proxyAddr is the address of the proxy server the streams of UID are relayed to for proxyMethod. That's one of its
+// ProxyUpstreams picked by UID if it has any, passing over those that are unhealthy or whose circuit is open, or its
+// address in ProxyBook otherwise
+func (sta *State) proxyAddr(proxyMethod string, UID []byte) net.Addr {
+	if ring, ok := sta.ProxyUpstreams[proxyMethod]; ok {
+		if sta.ProxyHealth == nil && sta.ProxyBreaker == nil {
+			return ring.Get(UID)
+		}
+		return ring.GetUsable(UID, sta.usable)
+	}
+	return sta.ProxyBook[proxyMethod]
+}
+
+// proxyUpstreams returns the address of every proxy server streams can be relayed to, which are those in ProxyBook
+// and ProxyUpstreams, each once
+func (sta *State) proxyUpstreams() []net.Addr {
+	var upstreams []net.Addr
+	seen := make(map[string]bool)
+	add := func(addr net.Addr) {
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			upstreams = append(upstreams, addr)
+		}
+	}
+	for _, addr := range sta.ProxyBook {
+		add(addr)
+	}
+	for _, ring := range sta.ProxyUpstreams {
+		for _, addr := range ring.Upstreams() {
+			add(addr)
+		}
+	}
+	return upstreams
+}
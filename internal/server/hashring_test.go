@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRing(t *testing.T) {
+	var upstreams []net.Addr
+	for port := 1; port <= 4; port++ {
+		upstreams = append(upstreams, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	}
+	ring := MakeHashRing(upstreams)
+
+	UIDs := make([][]byte, 10000)
+	counts := make(map[string]int)
+	for i := range UIDs {
+		UIDs[i] = make([]byte, 16)
+		common.CryptoRandRead(UIDs[i])
+		upstream := ring.Get(UIDs[i])
+		assert.Equal(t, upstream, ring.Get(UIDs[i]), "the same UID lands on the same upstream")
+		counts[upstream.String()]++
+	}
+	for _, upstream := range upstreams {
+		count := counts[upstream.String()]
+		assert.True(t, count > 2500*7/10 && count < 2500*13/10, "%v has %v of 10000 UIDs", upstream, count)
+	}
+
+	t.Run("upstream removed", func(t *testing.T) {
+		smaller := MakeHashRing(upstreams[:3])
+		for _, UID := range UIDs {
+			if before := ring.Get(UID); before != upstreams[3] {
+				assert.Equal(t, before, smaller.Get(UID), "only the UIDs of the removed upstream move")
+			} else {
+				assert.NotEqual(t, upstreams[3], smaller.Get(UID))
+			}
+		}
+	})
+
+	t.Run("unusable upstream passed over", func(t *testing.T) {
+		usable := func(upstream net.Addr) bool { return upstream != upstreams[3] }
+		for _, UID := range UIDs[:1000] {
+			if before := ring.Get(UID); before != upstreams[3] {
+				assert.Equal(t, before, ring.GetUsable(UID, usable), "only the UIDs of the unusable upstream move")
+			} else {
+				assert.NotEqual(t, upstreams[3], ring.GetUsable(UID, usable))
+			}
+		}
+		none := func(net.Addr) bool { return false }
+		assert.Equal(t, ring.Get(UIDs[0]), ring.GetUsable(UIDs[0], none), "with nothing usable, Get's upstream is used")
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Nil(t, MakeHashRing(nil).Get([]byte{0x01}))
+	})
+}
+
+func TestParseProxyUpstreams(t *testing.T) {
+	first := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8388}
+	proxyBook := map[string]net.Addr{"shadowsocks": first, "openvpn": &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1194}}
+
+	rings, err := parseProxyUpstreams(map[string][]string{
+		"Shadowsocks": {"127.0.0.1:8389"},
+		"openvpn":     {"127.0.0.1:1195"},
+	}, proxyBook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		UID := make([]byte, 16)
+		common.CryptoRandRead(UID)
+		seen[rings["shadowsocks"].Get(UID).String()] = true
+		assert.Equal(t, "udp", rings["openvpn"].Get(UID).Network())
+	}
+	assert.Equal(t, map[string]bool{"127.0.0.1:8388": true, "127.0.0.1:8389": true}, seen)
+
+	_, err = parseProxyUpstreams(map[string][]string{"tor": {"127.0.0.1:9050"}}, proxyBook)
+	assert.Error(t, err)
+	_, err = parseProxyUpstreams(map[string][]string{"shadowsocks": {"not an address"}}, proxyBook)
+	assert.Error(t, err)
+}
+
+func TestState_ProxyAddr(t *testing.T) {
+	first := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8388}
+	second := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8389}
+	sta := &State{ProxyBook: map[string]net.Addr{"shadowsocks": first}}
+	UID := make([]byte, 16)
+	assert.Equal(t, first, sta.proxyAddr("shadowsocks", UID))
+
+	sta.ProxyUpstreams = map[string]*HashRing{"shadowsocks": MakeHashRing([]net.Addr{second})}
+	assert.Equal(t, second, sta.proxyAddr("shadowsocks", UID))
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultProxyHealthCheckTimeout = 5 * time.Second
+
+var ErrHealthCheckTimeout = errors.New("timed out connecting to proxy server")
+
+// ProxyHealth keeps track of which proxy servers, by address, could be connected to when they were last checked.
+// Those are the proxy servers in ProxyBook and every upstream in ProxyUpstreams. A proxy server that has never been
+// checked is healthy
+type ProxyHealth struct {
+	// Timeout is how long a connection to a proxy server is waited for before it's deemed unhealthy
+	Timeout time.Duration
+
+	mutex     sync.RWMutex
+	unhealthy map[string]bool
+}
+
+func MakeProxyHealth(timeout time.Duration) *ProxyHealth {
+	return &ProxyHealth{
+		Timeout:   timeout,
+		unhealthy: make(map[string]bool),
+	}
+}
+
+// Healthy reports whether the proxy server at upstream, an address as given by net.Addr.String, could be connected
+// to when it was last checked
+func (h *ProxyHealth) Healthy(upstream string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return !h.unhealthy[upstream]
+}
+
+func (h *ProxyHealth) set(upstream string, healthy bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.unhealthy[upstream] == !healthy {
+		return
+	}
+	h.unhealthy[upstream] = !healthy
+	log.WithField("upstream", upstream).Infof("proxy server healthy: %v", healthy)
+}
+
+// Check connects to every proxy server in upstreams with dialer at once, and waits for them all to succeed, fail or
+// time out. Connecting to a UDP address always succeeds, so those are taken as healthy
+func (h *ProxyHealth) Check(upstreams []net.Addr, dialer common.Dialer) {
+	var wg sync.WaitGroup
+	for _, addr := range upstreams {
+		if addr.Network() == "udp" {
+			continue
+		}
+		wg.Add(1)
+		go func(addr net.Addr) {
+			defer wg.Done()
+			err := dialWithTimeout(dialer, addr, h.Timeout)
+			if err != nil {
+				log.WithField("upstream", addr.String()).Debugf("health check failed: %v", err)
+			}
+			h.set(addr.String(), err == nil)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// dialWithTimeout connects to addr and closes the connection straight away. common.Dialer has no timeout of its
+// own, so a connection that arrives after timeout is closed once it does
+func dialWithTimeout(dialer common.Dialer, addr net.Addr, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		conn, err := dialer.Dial(addr.Network(), addr.String())
+		if err == nil {
+			conn.Close()
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return ErrHealthCheckTimeout
+	}
+}
+
+// ProxyHealthChecker checks the proxy servers in ProxyBook and ProxyUpstreams every interval
+func (sta *State) ProxyHealthChecker(interval time.Duration) {
+	for {
+		sta.ProxyHealth.Check(sta.proxyUpstreams(), sta.ProxyDialer)
+		time.Sleep(interval)
+	}
+}
+
+// available checks if the streams of UID can be relayed to its proxy server of proxyMethod. A proxy method with
+// upstreams is only unavailable if none of them is usable
+func (sta *State) available(proxyMethod string, UID []byte) bool {
+	if sta.ProxyHealth == nil && sta.ProxyBreaker == nil {
+		return true
+	}
+	addr := sta.proxyAddr(proxyMethod, UID)
+	return addr != nil && sta.usable(addr)
+}
+
+// usable checks if streams can be relayed to the proxy server at upstream, which is healthy and whose circuit isn't
+// open
+func (sta *State) usable(upstream net.Addr) bool {
+	if sta.ProxyHealth != nil && !sta.ProxyHealth.Healthy(upstream.String()) {
+		return false
+	}
+	return sta.ProxyBreaker == nil || !sta.ProxyBreaker.Blocked(upstream.String(), sta.WorldState.Now())
+}
+
+// resolveProxyMethod returns the proxy method whose proxy server a stream of proxyMethod from UID is relayed to.
+// That's proxyMethod itself unless its proxy server is unavailable and one down its chain of ProxyFallbacks is
+// available. If none is, proxyMethod is used regardless
+func (sta *State) resolveProxyMethod(proxyMethod string, UID []byte) string {
+	if sta.ProxyHealth == nil && sta.ProxyBreaker == nil {
+		return proxyMethod
+	}
+	seen := make(map[string]bool)
+	for method := proxyMethod; !seen[method]; {
+		seen[method] = true
+		if sta.available(method, UID) {
+			if method != proxyMethod {
+				log.WithFields(log.Fields{
+					"proxyMethod": proxyMethod,
+					"fallback":    method,
+				}).Debug("proxy server unavailable, using fallback")
+			}
+			return method
+		}
+		fallback, ok := sta.ProxyFallbacks[method]
+		if !ok {
+			break
+		}
+		method = fallback
+	}
+	return proxyMethod
+}
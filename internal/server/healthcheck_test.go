@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// addrDialer connects to any address other than those in refused, which fail, and those in hanging, which take a
+// second to fail
+type addrDialer struct {
+	refused map[string]bool
+	hanging map[string]bool
+}
+
+func (d addrDialer) Dial(network, address string) (net.Conn, error) {
+	if d.refused[address] {
+		return nil, errors.New("connection refused")
+	}
+	if d.hanging[address] {
+		time.Sleep(time.Second)
+		return nil, errors.New("connection timed out")
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestProxyHealth_Check(t *testing.T) {
+	up := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	down := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	hanging := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3}
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4}
+	upstreams := []net.Addr{up, down, hanging, udp}
+	dialer := addrDialer{
+		refused: map[string]bool{down.String(): true, udp.String(): true},
+		hanging: map[string]bool{hanging.String(): true},
+	}
+
+	health := MakeProxyHealth(50 * time.Millisecond)
+	for _, addr := range upstreams {
+		assert.True(t, health.Healthy(addr.String()), "%v is healthy before it's checked", addr)
+	}
+	health.Check(upstreams, dialer)
+	assert.True(t, health.Healthy(up.String()))
+	assert.False(t, health.Healthy(down.String()))
+	assert.False(t, health.Healthy(hanging.String()))
+	assert.True(t, health.Healthy(udp.String()), "UDP proxy servers aren't checked")
+
+	// the hanging dial of the first check may still be running, so the maps it reads are left alone
+	dialer = addrDialer{
+		refused: map[string]bool{udp.String(): true},
+		hanging: map[string]bool{hanging.String(): true},
+	}
+	health.Check(upstreams, dialer)
+	assert.True(t, health.Healthy(down.String()), "a proxy server is healthy again once it can be connected to")
+}
+
+// testProxyBook gives each of proxyMethods its own local address
+func testProxyBook(proxyMethods ...string) map[string]net.Addr {
+	proxyBook := make(map[string]net.Addr)
+	for i, method := range proxyMethods {
+		proxyBook[method] = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000 + i}
+	}
+	return proxyBook
+}
+
+func TestState_ProxyHealthChecker_Upstreams(t *testing.T) {
+	first := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8388}
+	second := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8389}
+	sta := &State{
+		ProxyBook:      map[string]net.Addr{"shadowsocks": first},
+		ProxyUpstreams: map[string]*HashRing{"shadowsocks": MakeHashRing([]net.Addr{first, second})},
+		ProxyHealth:    MakeProxyHealth(50 * time.Millisecond),
+	}
+	sta.ProxyHealth.Check(sta.proxyUpstreams(), addrDialer{refused: map[string]bool{second.String(): true}})
+	assert.True(t, sta.ProxyHealth.Healthy(first.String()))
+	assert.False(t, sta.ProxyHealth.Healthy(second.String()), "every upstream of a ring is checked")
+
+	for i := 0; i < 100; i++ {
+		UID := make([]byte, 16)
+		common.CryptoRandRead(UID)
+		assert.Equal(t, first, sta.proxyAddr("shadowsocks", UID), "an unhealthy upstream is passed over")
+		assert.Equal(t, "shadowsocks", sta.resolveProxyMethod("shadowsocks", UID),
+			"a proxy method is available while one of its upstreams is healthy")
+	}
+}
+
+func TestState_ResolveProxyMethod(t *testing.T) {
+	sta := &State{
+		ProxyBook: testProxyBook("up", "down", "down2", "loop", "loop2", "alsoup", "nowhere", "nofallback"),
+		ProxyFallbacks: map[string]string{
+			"down":    "up",
+			"down2":   "down",
+			"loop":    "loop2",
+			"loop2":   "loop",
+			"alsoup":  "up",
+			"nowhere": "loop",
+		},
+	}
+	assert.Equal(t, "down", sta.resolveProxyMethod("down", nil), "without ProxyHealth, nothing is unhealthy")
+
+	sta.ProxyHealth = MakeProxyHealth(time.Second)
+	for _, method := range []string{"down", "down2", "loop", "loop2", "nowhere", "nofallback"} {
+		sta.ProxyHealth.set(sta.ProxyBook[method].String(), false)
+	}
+	assert.Equal(t, "up", sta.resolveProxyMethod("down", nil))
+	assert.Equal(t, "up", sta.resolveProxyMethod("down2", nil), "fallbacks are followed down the chain")
+	assert.Equal(t, "alsoup", sta.resolveProxyMethod("alsoup", nil), "a healthy proxy method isn't replaced")
+	assert.Equal(t, "loop", sta.resolveProxyMethod("loop", nil), "a loop with nothing healthy in it ends")
+	assert.Equal(t, "nowhere", sta.resolveProxyMethod("nowhere", nil))
+	assert.Equal(t, "nofallback", sta.resolveProxyMethod("nofallback", nil))
+}
+
+func TestParseProxyFallbacks(t *testing.T) {
+	proxyBook := map[string]net.Addr{"shadowsocks": &net.TCPAddr{}, "openvpn": &net.TCPAddr{}}
+	fallbacks, err := parseProxyFallbacks(map[string]string{"Shadowsocks": "OpenVPN"}, proxyBook)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"shadowsocks": "openvpn"}, fallbacks)
+
+	_, err = parseProxyFallbacks(map[string]string{"shadowsocks": "tor"}, proxyBook)
+	assert.Error(t, err)
+	_, err = parseProxyFallbacks(map[string]string{"tor": "shadowsocks"}, proxyBook)
+	assert.Error(t, err)
+}
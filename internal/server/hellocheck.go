@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var ErrImplausibleVersions = errors.New("implausible combination of record layer and client versions")
+var ErrTooFewCipherSuites = errors.New("too few cipher suites in ClientHello")
+var ErrKeyShareGroupNotAllowed = errors.New("no allowed group in key_share")
+var ErrTooFewExtensions = errors.New("too few extensions in ClientHello")
+var ErrOnlySCSV = errors.New("only signalling cipher suite values in ClientHello")
+
+// isGREASE checks if a two byte codepoint is one of those reserved by RFC 8701
+func isGREASE(v []byte) bool {
+	return v[0] == v[1] && v[0]&0x0f == 0x0a
+}
+
+var (
+	renegoSCSV   = []byte{0x00, 0xff} // TLS_EMPTY_RENEGOTIATION_INFO_SCSV
+	fallbackSCSV = []byte{0x56, 0x00} // TLS_FALLBACK_SCSV
+)
+
+// isSCSV checks if a cipher suite is a signalling cipher suite value rather than a real cipher suite
+func isSCSV(v []byte) bool {
+	return bytes.Equal(v, renegoSCSV) || bytes.Equal(v, fallbackSCSV)
+}
+
+// HasRenegoSCSV checks if the ClientHello signals secure renegotiation with TLS_EMPTY_RENEGOTIATION_INFO_SCSV
+// instead of, or as well as, the renegotiation_info extension
+func (ch *ClientHello) HasRenegoSCSV() bool {
+	for i := 0; i+1 < len(ch.cipherSuites); i += 2 {
+		if bytes.Equal(ch.cipherSuites[i:i+2], renegoSCSV) {
+			return true
+		}
+	}
+	return false
+}
+
+// onlySCSV checks if the ClientHello offers no real cipher suites, but only signalling values and GREASE
+func (ch *ClientHello) onlySCSV() bool {
+	for i := 0; i+1 < len(ch.cipherSuites); i += 2 {
+		suite := ch.cipherSuites[i : i+2]
+		if !isSCSV(suite) && !isGREASE(suite) {
+			return false
+		}
+	}
+	return true
+}
+
+// cipherSuiteCount is the number of cipher suites the ClientHello offers, optionally excluding GREASE values
+func (ch *ClientHello) cipherSuiteCount(countGREASE bool) int {
+	var count int
+	for i := 0; i+1 < len(ch.cipherSuites); i += 2 {
+		if !countGREASE && isGREASE(ch.cipherSuites[i:i+2]) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// keyShareGroups returns the named groups of all the entries in the ClientHello's key_share extension
+func (ch *ClientHello) keyShareGroups() (groups []uint16, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed key_share")
+		}
+	}()
+	input, ok := ch.extensions[[2]byte{0x00, 0x33}]
+	if !ok {
+		return nil, ErrNoKeyShare
+	}
+	totalLen := int(u16(input[0:2]))
+	pointer := 2
+	for pointer < totalLen+2 {
+		groups = append(groups, u16(input[pointer:pointer+2]))
+		pointer += 2
+		length := int(u16(input[pointer : pointer+2]))
+		pointer += 2
+		_ = input[pointer : pointer+length]
+		pointer += length
+	}
+	return
+}
+
+// extensionCount is the number of distinct extension types in the ClientHello, optionally excluding GREASE values
+func (ch *ClientHello) extensionCount(countGREASE bool) int {
+	var count int
+	for typ := range ch.extensions {
+		if !countGREASE && isGREASE(typ[:]) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// checkClientHello performs the optional sanity checks on a ClientHello from a supposed Cloak client. These are
+// cheap filters against scanners and handcrafted probes, whose ClientHellos look unlike a real browser's
+func (sta *State) checkClientHello(ch *ClientHello) error {
+	if !ch.plausibleVersions() {
+		return fmt.Errorf("%w: %x and %x", ErrImplausibleVersions, ch.recordVersion, ch.clientVersion)
+	}
+	if sta.MinCipherSuites > 0 {
+		count := ch.cipherSuiteCount(sta.CountGREASECipherSuites)
+		if count < sta.MinCipherSuites {
+			return fmt.Errorf("%w: %v offered, at least %v wanted", ErrTooFewCipherSuites, count, sta.MinCipherSuites)
+		}
+	}
+	if sta.MinExtensions > 0 {
+		count := ch.extensionCount(sta.CountGREASEExtensions)
+		if count < sta.MinExtensions {
+			return fmt.Errorf("%w: %v offered, at least %v wanted", ErrTooFewExtensions, count, sta.MinExtensions)
+		}
+	}
+	if sta.DivertOnlySCSV && ch.onlySCSV() {
+		return ErrOnlySCSV
+	}
+	if len(sta.KeyShareGroups) > 0 {
+		groups, err := ch.keyShareGroups()
+		if err != nil {
+			return err
+		}
+		if !anyAllowedGroup(groups, sta.KeyShareGroups) {
+			return fmt.Errorf("%w: offered %x", ErrKeyShareGroupNotAllowed, groups)
+		}
+	}
+	return nil
+}
+
+func anyAllowedGroup(offered []uint16, allowed []uint16) bool {
+	for _, o := range offered {
+		for _, a := range allowed {
+			if o == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseOptions are how strictly ClientHellos from supposed Cloak clients are parsed
+func (sta *State) parseOptions() ParseOptions {
+	opts := DefaultParseOptions
+	if sta.MaxExtensions > 0 {
+		opts.MaxExtensions = sta.MaxExtensions
+	}
+	if sta.MaxKeyShares > 0 {
+		opts.MaxKeyShares = sta.MaxKeyShares
+	}
+	opts.RejectDuplicateExtensions = sta.RejectDuplicateExtensions
+	opts.StrictExtensionsLength = sta.StrictExtensionsLength
+	opts.RejectSmallOrderKeyShares = sta.RejectSmallOrderKeyShares
+	return opts
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestCheckClientHello_MinCipherSuites(t *testing.T) {
+	chromeBytes, _ := hex.DecodeString(chromeClientHello)
+	chrome, err := parseClientHello(chromeBytes, DefaultParseOptions)
+	if err != nil {
+		t.Fatalf("failed to parse ClientHello: %v", err)
+	}
+	scannerHello := newTestClientHello()
+	scannerHello.cipherSuites = []byte{0xc0, 0x2f, 0xc0, 0x30}
+	scanner, err := parseClientHello(scannerHello.marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatalf("failed to parse ClientHello: %v", err)
+	}
+	greaseHello := newTestClientHello()
+	greaseHello.cipherSuites = []byte{0x3a, 0x3a, 0xc0, 0x2f, 0xc0, 0x30}
+	grease, err := parseClientHello(greaseHello.marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatalf("failed to parse ClientHello: %v", err)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		sta := &State{}
+		assert.NoError(t, sta.checkClientHello(scanner))
+	})
+	t.Run("browser", func(t *testing.T) {
+		sta := &State{MinCipherSuites: 8}
+		assert.NoError(t, sta.checkClientHello(chrome))
+	})
+	t.Run("scanner", func(t *testing.T) {
+		sta := &State{MinCipherSuites: 8}
+		err := sta.checkClientHello(scanner)
+		if !errors.Is(err, ErrTooFewCipherSuites) {
+			t.Errorf("expecting ErrTooFewCipherSuites, got %v", err)
+		}
+	})
+	t.Run("GREASE not counted", func(t *testing.T) {
+		sta := &State{MinCipherSuites: 3}
+		err := sta.checkClientHello(grease)
+		if !errors.Is(err, ErrTooFewCipherSuites) {
+			t.Errorf("expecting ErrTooFewCipherSuites, got %v", err)
+		}
+	})
+	t.Run("GREASE counted", func(t *testing.T) {
+		sta := &State{MinCipherSuites: 3, CountGREASECipherSuites: true}
+		assert.NoError(t, sta.checkClientHello(grease))
+	})
+}
+
+func TestDispatchConnection_MinCipherSuites(t *testing.T) {
+	// cloakClientHello offers 18 cipher suites
+	sta, _, redirListener := makeDispatchTestState(t)
+	sta.MinCipherSuites = 19
+
+	first, _ := hex.DecodeString(cloakClientHello)
+	local, remote := connutil.AsyncPipe()
+	go dispatchConnection(remote, sta)
+	local.Write(first)
+
+	redirConn, err := redirListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(first))
+	_, err = io.ReadFull(redirConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, first, buf)
+	local.Close()
+	redirConn.Close()
+}
+
+func TestCheckClientHello_KeyShareGroups(t *testing.T) {
+	// newTestClientHello only has an x25519 key_share
+	ch, err := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatalf("failed to parse ClientHello: %v", err)
+	}
+
+	t.Run("not allowed", func(t *testing.T) {
+		sta := &State{KeyShareGroups: []uint16{0x0017, 0x0018}}
+		err := sta.checkClientHello(ch)
+		if !errors.Is(err, ErrKeyShareGroupNotAllowed) {
+			t.Errorf("expecting ErrKeyShareGroupNotAllowed, got %v", err)
+		}
+	})
+	t.Run("allowed", func(t *testing.T) {
+		sta := &State{KeyShareGroups: []uint16{0x0017, 0x001d}}
+		assert.NoError(t, sta.checkClientHello(ch))
+	})
+}
+
+func TestDispatchConnection_KeyShareGroups(t *testing.T) {
+	// cloakClientHello has key_shares of x25519 and secp256r1
+	t.Run("diverted", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.KeyShareGroups = []uint16{0x0018}
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(first))
+		_, err = io.ReadFull(redirConn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, first, buf)
+		local.Close()
+		redirConn.Close()
+	})
+	t.Run("proceeds", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.KeyShareGroups = []uint16{0x0017}
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+
+		records, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		assert.Equal(t, byte(0x16), records[0][0])
+		local.Close()
+	})
+}
+
+func TestClientHello_HasRenegoSCSV(t *testing.T) {
+	withSuites := func(t *testing.T, suites []byte) *ClientHello {
+		tch := newTestClientHello()
+		tch.cipherSuites = suites
+		ch, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+		if err != nil {
+			t.Fatalf("failed to parse ClientHello: %v", err)
+		}
+		return ch
+	}
+
+	t.Run("no SCSV", func(t *testing.T) {
+		ch := withSuites(t, []byte{0x13, 0x01, 0xc0, 0x2f})
+		assert.False(t, ch.HasRenegoSCSV())
+		assert.False(t, ch.onlySCSV())
+	})
+	t.Run("SCSV with real suites", func(t *testing.T) {
+		ch := withSuites(t, []byte{0x13, 0x01, 0xc0, 0x2f, 0x00, 0xff})
+		assert.True(t, ch.HasRenegoSCSV())
+		assert.False(t, ch.onlySCSV())
+		sta := &State{DivertOnlySCSV: true}
+		assert.NoError(t, sta.checkClientHello(ch))
+	})
+	t.Run("SCSV only", func(t *testing.T) {
+		for _, suites := range [][]byte{{0x00, 0xff}, {0x0a, 0x0a, 0x00, 0xff, 0x56, 0x00}} {
+			ch := withSuites(t, suites)
+			assert.True(t, ch.HasRenegoSCSV())
+			assert.True(t, ch.onlySCSV())
+			sta := &State{DivertOnlySCSV: true}
+			err := sta.checkClientHello(ch)
+			if !errors.Is(err, ErrOnlySCSV) {
+				t.Errorf("expecting ErrOnlySCSV for cipher suites %x, got %v", suites, err)
+			}
+			sta = &State{}
+			assert.NoError(t, sta.checkClientHello(ch))
+		}
+	})
+}
+
+func TestCheckClientHello_MinExtensions(t *testing.T) {
+	// chromeClientHello has 17 distinct extensions, 2 of which are GREASE
+	chromeBytes, _ := hex.DecodeString(chromeClientHello)
+	chrome, err := parseClientHello(chromeBytes, DefaultParseOptions)
+	if err != nil {
+		t.Fatalf("failed to parse ClientHello: %v", err)
+	}
+	probe, err := parseClientHello(newTestClientHello().withoutExtension([2]byte{0x00, 0x0a}).marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatalf("failed to parse ClientHello: %v", err)
+	}
+
+	t.Run("browser", func(t *testing.T) {
+		sta := &State{MinExtensions: 8}
+		assert.NoError(t, sta.checkClientHello(chrome))
+	})
+	t.Run("probe", func(t *testing.T) {
+		sta := &State{MinExtensions: 8}
+		err := sta.checkClientHello(probe)
+		if !errors.Is(err, ErrTooFewExtensions) {
+			t.Errorf("expecting ErrTooFewExtensions, got %v", err)
+		}
+	})
+	t.Run("GREASE", func(t *testing.T) {
+		sta := &State{MinExtensions: 16}
+		if !errors.Is(sta.checkClientHello(chrome), ErrTooFewExtensions) {
+			t.Error("GREASE extensions are counted")
+		}
+		sta.CountGREASEExtensions = true
+		assert.NoError(t, sta.checkClientHello(chrome))
+	})
+}
+
+func TestDispatchConnection_MinExtensions(t *testing.T) {
+	// cloakClientHello has 14 extensions
+	sta, _, redirListener := makeDispatchTestState(t)
+	sta.MinExtensions = 15
+
+	first, _ := hex.DecodeString(cloakClientHello)
+	local, remote := connutil.AsyncPipe()
+	go dispatchConnection(remote, sta)
+	local.Write(first)
+
+	redirConn, err := redirListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(first))
+	_, err = io.ReadFull(redirConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, first, buf)
+	local.Close()
+	redirConn.Close()
+}
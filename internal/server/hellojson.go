@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+)
+
+// versionNames are the names of TLS and SSL versions
+var versionNames = map[uint16]string{
+	0x0304: "TLS 1.3",
+	0x0303: "TLS 1.2",
+	0x0302: "TLS 1.1",
+	0x0301: "TLS 1.0",
+	0x0300: "SSL 3.0",
+}
+
+// cipherSuiteNames are the IANA names of the cipher suites browsers offer
+var cipherSuiteNames = map[uint16]string{
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+	0xc02b: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	0xc02f: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	0xc02c: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	0xc030: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	0xcca9: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	0xcca8: "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	0xc009: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	0xc00a: "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	0xc013: "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	0xc014: "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	0x0033: "TLS_DHE_RSA_WITH_AES_128_CBC_SHA",
+	0x0039: "TLS_DHE_RSA_WITH_AES_256_CBC_SHA",
+	0x009c: "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	0x009d: "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	0x002f: "TLS_RSA_WITH_AES_128_CBC_SHA",
+	0x0035: "TLS_RSA_WITH_AES_256_CBC_SHA",
+	0x000a: "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	0x00ff: "TLS_EMPTY_RENEGOTIATION_INFO_SCSV",
+}
+
+// extensionNames are the IANA names of the extensions browsers send
+var extensionNames = map[uint16]string{
+	0x0000: "server_name",
+	0x0005: "status_request",
+	0x000a: "supported_groups",
+	0x000b: "ec_point_formats",
+	0x000d: "signature_algorithms",
+	0x0010: "application_layer_protocol_negotiation",
+	0x0012: "signed_certificate_timestamp",
+	0x0015: "padding",
+	0x0017: "extended_master_secret",
+	0x001b: "compress_certificate",
+	0x001c: "record_size_limit",
+	0x0022: "delegated_credentials",
+	0x0023: "session_ticket",
+	0x0029: "pre_shared_key",
+	0x002b: "supported_versions",
+	0x002d: "psk_key_exchange_modes",
+	0x0033: "key_share",
+	0x4469: "application_settings",
+	0xfe0d: "encrypted_client_hello",
+	0xff01: "renegotiation_info",
+}
+
+// nameOf returns the name of the 2 byte value in names, or its hex if it isn't there. GREASE values are marked so
+func nameOf(value []byte, names map[uint16]string) string {
+	if isGREASE(value) {
+		return "GREASE 0x" + hex.EncodeToString(value)
+	}
+	if name, ok := names[u16(value)]; ok {
+		return name
+	}
+	return "0x" + hex.EncodeToString(value)
+}
+
+type clientHelloJSON struct {
+	RecordVersion      string          `json:"record_version"`
+	ClientVersion      string          `json:"client_version"`
+	SupportedVersions  []string        `json:"supported_versions,omitempty"`
+	Random             string          `json:"random"`
+	SessionId          string          `json:"session_id"`
+	CipherSuites       []string        `json:"cipher_suites"`
+	CompressionMethods string          `json:"compression_methods"`
+	Extensions         []extensionJSON `json:"extensions"`
+	ServerName         string          `json:"server_name,omitempty"`
+	ALPN               []string        `json:"alpn,omitempty"`
+	JA3                string          `json:"ja3"`
+	JA4                string          `json:"ja4"`
+}
+
+type extensionJSON struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// MarshalJSON describes the ClientHello for people to read. Versions, cipher suites and extension types are given by
+// name where they are known, and in hex otherwise. Random, session id and extension data are in hex, and extensions
+// are in the order they appear in the ClientHello
+func (ch *ClientHello) MarshalJSON() ([]byte, error) {
+	j := clientHelloJSON{
+		RecordVersion:      nameOf(ch.recordVersion, versionNames),
+		ClientVersion:      nameOf(ch.clientVersion, versionNames),
+		Random:             hex.EncodeToString(ch.random),
+		SessionId:          hex.EncodeToString(ch.sessionId),
+		CompressionMethods: hex.EncodeToString(ch.compressionMethods),
+		ALPN:               ch.offeredALPN(),
+		JA3:                ch.JA3(),
+		JA4:                ch.JA4(),
+	}
+	if supportedVersions := ch.extensions[[2]byte{0x00, 0x2b}]; innerLengthMatches(supportedVersions, 1) {
+		for i := 1; i+1 < len(supportedVersions); i += 2 {
+			j.SupportedVersions = append(j.SupportedVersions, nameOf(supportedVersions[i:i+2], versionNames))
+		}
+	}
+	j.CipherSuites = []string{}
+	for i := 0; i+1 < len(ch.cipherSuites); i += 2 {
+		j.CipherSuites = append(j.CipherSuites, nameOf(ch.cipherSuites[i:i+2], cipherSuiteNames))
+	}
+	j.Extensions = []extensionJSON{}
+	for _, typ := range ch.extensionOrder {
+		j.Extensions = append(j.Extensions, extensionJSON{
+			Type: nameOf(typ[:], extensionNames),
+			Data: hex.EncodeToString(ch.extensions[typ]),
+		})
+	}
+	// a malformed server_name is still there to be seen in Extensions
+	j.ServerName, _ = ch.serverName()
+	return json.Marshal(j)
+}
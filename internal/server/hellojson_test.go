@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientHello_MarshalJSON(t *testing.T) {
+	chBytes, _ := hex.DecodeString(cloakClientHello)
+	ch, err := parseClientHello(chBytes, DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshalled, err := json.Marshal(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j clientHelloJSON
+	err = json.Unmarshal(marshalled, &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "TLS 1.0", j.RecordVersion)
+	assert.Equal(t, "TLS 1.2", j.ClientVersion)
+	assert.Equal(t, []string{"TLS 1.3", "TLS 1.2", "TLS 1.1", "TLS 1.0"}, j.SupportedVersions)
+	assert.Equal(t, hex.EncodeToString(ch.random), j.Random)
+	assert.Equal(t, hex.EncodeToString(ch.sessionId), j.SessionId)
+	assert.Equal(t, "00", j.CompressionMethods)
+	assert.Equal(t, "www.bing.com", j.ServerName)
+	assert.Equal(t, []string{"h2", "http/1.1"}, j.ALPN)
+	assert.Equal(t, ch.JA3(), j.JA3)
+	assert.Equal(t, ch.JA4(), j.JA4)
+
+	if assert.Len(t, j.CipherSuites, len(ch.cipherSuites)/2) {
+		assert.Equal(t, "TLS_AES_128_GCM_SHA256", j.CipherSuites[0])
+		assert.Equal(t, "TLS_CHACHA20_POLY1305_SHA256", j.CipherSuites[1])
+	}
+	if assert.Len(t, j.Extensions, len(ch.extensionOrder)) {
+		for i, typ := range ch.extensionOrder {
+			data, err := hex.DecodeString(j.Extensions[i].Data)
+			assert.NoError(t, err)
+			assert.Equal(t, ch.extensions[typ], data, "data of extension %v", j.Extensions[i].Type)
+		}
+		assert.Equal(t, "server_name", j.Extensions[0].Type)
+	}
+}
+
+func TestNameOf(t *testing.T) {
+	assert.Equal(t, "TLS_AES_256_GCM_SHA384", nameOf([]byte{0x13, 0x02}, cipherSuiteNames))
+	assert.Equal(t, "0x1337", nameOf([]byte{0x13, 0x37}, cipherSuiteNames))
+	assert.Equal(t, "GREASE 0x2a2a", nameOf([]byte{0x2a, 0x2a}, extensionNames))
+	assert.Equal(t, "key_share", nameOf([]byte{0x00, 0x33}, extensionNames))
+}
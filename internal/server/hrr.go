@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNotRetried = errors.New("client didn't retry its ClientHello after HelloRetryRequest")
+
+// retryHello is for AlwaysHelloRetryRequest. It answers the ClientHello in data with a HelloRetryRequest for
+// x25519, followed by a ChangeCipherSpec as a server in middlebox compatibility mode sends, and reads the ClientHello
+// the client retries with into buf. This is only ever done once per connection. The retried ClientHello is returned,
+// or data itself if it isn't a ClientHello a HelloRetryRequest can be sent to
+func (sta *State) retryHello(conn net.Conn, data []byte, buf []byte) ([]byte, error) {
+	ch, err := parseClientHello(data, sta.parseOptions())
+	if err != nil {
+		return data, nil
+	}
+	cipherSuite, err := sta.serverProfile(nil).negotiateCipherSuite(ch)
+	if err != nil {
+		log.WithField("remoteAddr", conn.RemoteAddr()).Debugf("not sending HelloRetryRequest: %v", err)
+		return data, nil
+	}
+	// ch is in buf, which the retried ClientHello is read into
+	sessionId := append([]byte{}, ch.sessionId...)
+	cipherSuites := append([]byte{}, ch.cipherSuites...)
+
+	hrr := addRecordLayer(composeHelloRetryRequest(sessionId, cipherSuite, x25519Group), []byte{0x16}, []byte{0x03, 0x03})
+	hrr = append(hrr, addRecordLayer([]byte{0x01}, []byte{0x14}, []byte{0x03, 0x03})...)
+	err = writeReply(conn, hrr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send HelloRetryRequest: %w", err)
+	}
+
+	// the client may send a ChangeCipherSpec of its own before retrying
+	i, transport, _, err := readFirstPacket(&compatCCSConn{Conn: conn}, buf, 15*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotRetried, err)
+	}
+	if _, ok := transport.(TLS); !ok {
+		return nil, fmt.Errorf("%w: got something other than a ClientHello", ErrNotRetried)
+	}
+	retried, err := parseClientHello(buf[:i], sta.parseOptions())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotRetried, err)
+	}
+	groups, _ := retried.keyShareGroups()
+	log.WithFields(log.Fields{
+		"remoteAddr":       conn.RemoteAddr(),
+		"keyShareGroups":   groups,
+		"sameSessionId":    bytes.Equal(retried.sessionId, sessionId),
+		"sameCipherSuites": bytes.Equal(retried.cipherSuites, cipherSuites),
+	}).Info("ClientHello retried after HelloRetryRequest")
+	return buf[:i], nil
+}
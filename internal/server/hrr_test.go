@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchConnection_AlwaysHelloRetryRequest(t *testing.T) {
+	first, _ := hex.DecodeString(cloakClientHello)
+	ch, _ := parseClientHello(first, DefaultParseOptions)
+	ccs := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+
+	readHelloRetryRequest := func(t *testing.T, r io.Reader) {
+		hrr, err := readRecord(r, 0x16)
+		if err != nil {
+			t.Fatalf("failed to read HelloRetryRequest: %v", err)
+		}
+		if len(hrr) < 76 {
+			t.Fatalf("HelloRetryRequest is too short: %x", hrr)
+		}
+		assert.Equal(t, byte(0x02), hrr[0])
+		assert.Equal(t, len(hrr)-4, int(u32(append([]byte{0x00}, hrr[1:4]...))), "handshake length")
+		assert.Equal(t, helloRetryRequestRandom, hrr[6:38])
+		assert.Equal(t, ch.sessionId, hrr[39:71])
+		assert.Equal(t, []byte{0x13, 0x02}, hrr[71:73], "cipher suite of the profile")
+		assert.Equal(t, len(hrr)-76, int(u16(hrr[74:76])), "extensions length")
+		extensions, _, err := parseExtensions(hrr[76:], DefaultParseOptions)
+		assert.NoError(t, err)
+		assert.Equal(t, x25519Group[:], extensions[[2]byte{0x00, 0x33}])
+		assert.Equal(t, []byte{0x03, 0x04}, extensions[[2]byte{0x00, 0x2b}])
+
+		record, err := readRecord(r, 0x14)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x01}, record)
+	}
+
+	t.Run("retried", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.AlwaysHelloRetryRequest = true
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		readHelloRetryRequest(t, local)
+
+		local.Write(append(ccs, first...))
+		records, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		// only the first ClientHello is answered with a HelloRetryRequest
+		assert.False(t, bytes.Equal(helloRetryRequestRandom, records[0][5+6:5+38]), "HelloRetryRequest sent twice")
+		assert.NoError(t, checkServerHello(records[0][5:], ch.sessionId, ServerProfile{CipherSuite: 0x1302}))
+		local.Close()
+	})
+
+	t.Run("not retried", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.AlwaysHelloRetryRequest = true
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		readHelloRetryRequest(t, local)
+
+		local.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		_, err := local.Read(make([]byte, 1))
+		assert.Error(t, err, "connection should be closed")
+
+		redirListener.Close()
+		_, err = redirListener.Accept()
+		assert.Error(t, err, "nothing should be relayed to the redirection server")
+	})
+
+	t.Run("off", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		records, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		assert.False(t, bytes.Equal(helloRetryRequestRandom, records[0][5+6:5+38]))
+		local.Close()
+	})
+}
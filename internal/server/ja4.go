@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ja4VersionCodes are the two character codes JA4 uses for TLS and SSL versions
+var ja4VersionCodes = map[uint16]string{
+	0x0304: "13",
+	0x0303: "12",
+	0x0302: "11",
+	0x0301: "10",
+	0x0300: "s3",
+	0x0002: "s2",
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello. Unlike JA3, it sorts cipher suites and extension types before
+// hashing them, so it doesn't change when a client shuffles its extensions. GREASE values are left out. Cloak only
+// receives ClientHellos over TCP, so the fingerprint always starts with t
+func (ch *ClientHello) JA4() string {
+	var extensionTypes []string
+	var sortedExtensionTypes []string
+	for _, typ := range ch.extensionOrder {
+		if isGREASE(typ[:]) {
+			continue
+		}
+		extensionTypes = append(extensionTypes, hex.EncodeToString(typ[:]))
+		// server_name and ALPN are already accounted for in the first part
+		if typ != [2]byte{0x00, 0x00} && typ != [2]byte{0x00, 0x10} {
+			sortedExtensionTypes = append(sortedExtensionTypes, hex.EncodeToString(typ[:]))
+		}
+	}
+	sort.Strings(sortedExtensionTypes)
+	cipherSuites := hexU16s(ch.cipherSuites)
+	sort.Strings(cipherSuites)
+
+	sni := "i"
+	if _, ok := ch.extensions[[2]byte{0x00, 0x00}]; ok {
+		sni = "d"
+	}
+	prefix := fmt.Sprintf("t%v%v%02d%02d%v",
+		ch.ja4Version(), sni, min99(len(cipherSuites)), min99(len(extensionTypes)), ch.ja4ALPN())
+
+	extensions := strings.Join(sortedExtensionTypes, ",")
+	if sigAlgs := ch.signatureAlgorithms(); len(sigAlgs) > 0 {
+		extensions += "_" + strings.Join(sigAlgs, ",")
+	}
+	return prefix + "_" + ja4Hash(strings.Join(cipherSuites, ",")) + "_" + ja4Hash(extensions)
+}
+
+// ja4Version is the JA4 code of the highest version in supported_versions, or the client version if there is no
+// supported_versions extension
+func (ch *ClientHello) ja4Version() string {
+	var highest uint16
+	if supportedVersions := ch.extensions[[2]byte{0x00, 0x2b}]; innerLengthMatches(supportedVersions, 1) {
+		for i := 1; i+1 < len(supportedVersions); i += 2 {
+			if isGREASE(supportedVersions[i : i+2]) {
+				continue
+			}
+			if v := u16(supportedVersions[i : i+2]); v > highest {
+				highest = v
+			}
+		}
+	} else if len(ch.clientVersion) == 2 {
+		highest = u16(ch.clientVersion)
+	}
+	if code, ok := ja4VersionCodes[highest]; ok {
+		return code
+	}
+	return "00"
+}
+
+// ja4ALPN is the first and last characters of the first protocol in the ALPN extension, or 00 if there is none. If
+// either of the characters isn't alphanumeric, the first hex digit of the first byte and the last hex digit of the
+// last byte are used instead
+func (ch *ClientHello) ja4ALPN() string {
+	alpnExt, ok := ch.extensions[[2]byte{0x00, 0x10}]
+	if !ok {
+		return "00"
+	}
+	protocols, err := parseALPN(alpnExt)
+	if err != nil || len(protocols) == 0 || len(protocols[0]) == 0 {
+		return "00"
+	}
+	first, last := protocols[0][0], protocols[0][len(protocols[0])-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	return hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+}
+
+// signatureAlgorithms returns the values in the signature_algorithms extension as hex, in the order they are sent
+func (ch *ClientHello) signatureAlgorithms() []string {
+	sigAlgs := ch.extensions[[2]byte{0x00, 0x0d}]
+	if !innerLengthMatches(sigAlgs, 2) {
+		return nil
+	}
+	return hexU16s(sigAlgs[2:])
+}
+
+// hexU16s returns each of the 2 byte values in data as 4 hex digits, leaving out GREASE values
+func hexU16s(data []byte) []string {
+	var values []string
+	for i := 0; i+1 < len(data); i += 2 {
+		if isGREASE(data[i : i+2]) {
+			continue
+		}
+		values = append(values, hex.EncodeToString(data[i:i+2]))
+	}
+	return values
+}
+
+// ja4Hash is the first 12 hex digits of the SHA-256 of s, or twelve 0s if s is empty
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// chromeJA4ClientHello has the cipher suites, extensions and signature algorithms of the Chrome ClientHello in the
+// JA4 specification, whose JA4 is t13d1516h2_8daaf6152771_e5627efa2ab1. Chrome shuffles its extensions, so their
+// order here is one of many
+func chromeJA4ClientHello() testClientHello {
+	tch := newTestClientHello()
+	tch.cipherSuites = mustDecodeHex("7a7a130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035")
+	tch.extensions = []testExtension{
+		{[2]byte{0x3a, 0x3a}, nil},
+		{[2]byte{0x00, 0x2d}, mustDecodeHex("0101")},
+		{[2]byte{0x00, 0x10}, append(mustDecodeHex("000c02683208"), "http/1.1"...)},
+		{[2]byte{0x00, 0x0d}, mustDecodeHex("001004030804040105030805050108060601")},
+		{[2]byte{0x00, 0x00}, append(mustDecodeHex("000e00000b"), "example.com"...)},
+		{[2]byte{0x00, 0x12}, nil},
+		{[2]byte{0x00, 0x23}, nil},
+		{[2]byte{0x00, 0x0a}, mustDecodeHex("00088a8a001d00170018")},
+		{[2]byte{0x44, 0x69}, mustDecodeHex("0003026832")},
+		{[2]byte{0x00, 0x33}, append(mustDecodeHex("002b00298a8a000100001d0020"), make([]byte, 32)...)},
+		{[2]byte{0x00, 0x05}, mustDecodeHex("0100000000")},
+		{[2]byte{0x00, 0x2b}, mustDecodeHex("06dada03040303")},
+		{[2]byte{0x00, 0x17}, nil},
+		{[2]byte{0x00, 0x1b}, mustDecodeHex("020002")},
+		{[2]byte{0xff, 0x01}, mustDecodeHex("00")},
+		{[2]byte{0x00, 0x0b}, mustDecodeHex("0100")},
+		{[2]byte{0x2a, 0x2a}, mustDecodeHex("00")},
+		{[2]byte{0x00, 0x15}, make([]byte, 200)},
+	}
+	return tch
+}
+
+// firefoxJA4ClientHello has the cipher suites, extensions and signature algorithms of Firefox, whose published JA4
+// is t13d1715h2_5b57614c22b0_3d5424432f57
+func firefoxJA4ClientHello() testClientHello {
+	tch := newTestClientHello()
+	tch.cipherSuites = mustDecodeHex("130113031302c02bc02fcca9cca8c02cc030c00ac009c013c014009c009d002f0035")
+	tch.extensions = []testExtension{
+		{[2]byte{0x00, 0x00}, append(mustDecodeHex("000e00000b"), "example.com"...)},
+		{[2]byte{0x00, 0x17}, nil},
+		{[2]byte{0xff, 0x01}, mustDecodeHex("00")},
+		{[2]byte{0x00, 0x0a}, mustDecodeHex("000e001d00170018001901000101")},
+		{[2]byte{0x00, 0x0b}, mustDecodeHex("0100")},
+		{[2]byte{0x00, 0x23}, nil},
+		{[2]byte{0x00, 0x10}, append(mustDecodeHex("000c02683208"), "http/1.1"...)},
+		{[2]byte{0x00, 0x05}, mustDecodeHex("0100000000")},
+		{[2]byte{0x00, 0x22}, mustDecodeHex("000a0403050306030203")},
+		{[2]byte{0x00, 0x33}, append(mustDecodeHex("00240022001d0020"), make([]byte, 32)...)},
+		{[2]byte{0x00, 0x2b}, mustDecodeHex("0403040303")},
+		{[2]byte{0x00, 0x0d}, mustDecodeHex("001604030503060308040805080604010501060102030201")},
+		{[2]byte{0x00, 0x2d}, mustDecodeHex("0101")},
+		{[2]byte{0x00, 0x1c}, mustDecodeHex("4001")},
+		{[2]byte{0x00, 0x15}, make([]byte, 100)},
+	}
+	return tch
+}
+
+func TestClientHello_JA4(t *testing.T) {
+	ja4 := func(t *testing.T, tch testClientHello) string {
+		ch, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ch.JA4()
+	}
+
+	t.Run("chrome", func(t *testing.T) {
+		assert.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", ja4(t, chromeJA4ClientHello()))
+	})
+	t.Run("chrome with shuffled extensions", func(t *testing.T) {
+		tch := chromeJA4ClientHello()
+		exts := tch.extensions
+		exts[1], exts[9] = exts[9], exts[1]
+		exts[4], exts[14] = exts[14], exts[4]
+		assert.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", ja4(t, tch))
+	})
+	t.Run("firefox", func(t *testing.T) {
+		assert.Equal(t, "t13d1715h2_5b57614c22b0_3d5424432f57", ja4(t, firefoxJA4ClientHello()))
+	})
+	t.Run("no server_name or ALPN", func(t *testing.T) {
+		tch := chromeJA4ClientHello().withoutExtension([2]byte{0x00, 0x00}).withoutExtension([2]byte{0x00, 0x10})
+		assert.Equal(t, "t13i151400_8daaf6152771_e5627efa2ab1", ja4(t, tch))
+	})
+	t.Run("TLS 1.2", func(t *testing.T) {
+		tch := chromeJA4ClientHello().withoutExtension([2]byte{0x00, 0x2b})
+		assert.Equal(t, "t12d1515h2", ja4(t, tch)[:10])
+	})
+	t.Run("ALPN not alphanumeric", func(t *testing.T) {
+		tch := chromeJA4ClientHello().withExtension([2]byte{0x00, 0x10}, mustDecodeHex("000302ab03"))
+		assert.Equal(t, "t13d1516a3", ja4(t, tch)[:10])
+	})
+	t.Run("no extensions", func(t *testing.T) {
+		tch := chromeJA4ClientHello()
+		tch.extensions = nil
+		ch, err := parseClientHello(tch.marshal(), DefaultParseOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the parser rules out a ClientHello without cipher suites
+		ch.cipherSuites = nil
+		assert.Equal(t, "t12i000000_000000000000_000000000000", ch.JA4())
+	})
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyMinBound is the upper bound of the first bucket of a latencyHistogram, into which anything quicker goes
+	latencyMinBound = 10 * time.Microsecond
+	// latencyGrowth is how much longer the upper bound of each bucket is than that of the one before, which is the
+	// most a quantile can be off by
+	latencyGrowth = 1.25
+	// latencyBuckets takes the bounds past a minute, into the last of which anything slower goes
+	latencyBuckets = 72
+	// latencyWindow is how long the handshakes in a LatencySnapshot are counted for
+	latencyWindow = 5 * time.Minute
+)
+
+// LatencySnapshot is how long the handshakes with Cloak clients that succeeded in the last five to ten minutes took,
+// from when the first packet was read to when the reply was sent. The quantiles are the upper bounds of the buckets
+// they fall in, which are at most a quarter longer than the latency itself. They're zero if there's been no handshake
+type LatencySnapshot struct {
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+// latencyHistogram counts latencies in buckets of exponentially growing bounds, so that it takes the same memory
+// however many are counted
+type latencyHistogram [latencyBuckets]uint64
+
+// latencyBound is the upper bound of bucket i
+func latencyBound(i int) time.Duration {
+	return time.Duration(float64(latencyMinBound) * math.Pow(latencyGrowth, float64(i)))
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	if d > latencyMinBound {
+		i = int(math.Ceil(math.Log(float64(d)/float64(latencyMinBound)) / math.Log(latencyGrowth)))
+		// the float arithmetic may land just past the bound it should be under
+		if i > 0 && d <= latencyBound(i-1) {
+			i--
+		}
+		if i >= latencyBuckets {
+			i = latencyBuckets - 1
+		}
+	}
+	h[i]++
+}
+
+// quantile is the upper bound of the bucket the q quantile of count latencies falls in
+func (h *latencyHistogram) quantile(q float64, count uint64) time.Duration {
+	rank := uint64(math.Ceil(q * float64(count)))
+	if rank == 0 {
+		rank = 1
+	}
+	var cumulative uint64
+	for i, n := range h {
+		cumulative += n
+		if cumulative >= rank {
+			return latencyBound(i)
+		}
+	}
+	return latencyBound(latencyBuckets - 1)
+}
+
+// latencyTracker keeps the latencies of the handshakes in the current window and the one before it, so that a
+// snapshot always covers at least one whole window
+type latencyTracker struct {
+	mutex    sync.Mutex
+	current  latencyHistogram
+	previous latencyHistogram
+	started  time.Time
+}
+
+// rotate starts a new window if the current one has ended at now
+func (t *latencyTracker) rotate(now time.Time) {
+	if t.started.IsZero() {
+		t.started = now
+		return
+	}
+	elapsed := now.Sub(t.started)
+	if elapsed < latencyWindow {
+		return
+	}
+	if elapsed < 2*latencyWindow {
+		t.previous = t.current
+	} else {
+		t.previous = latencyHistogram{}
+	}
+	t.current = latencyHistogram{}
+	t.started = now
+}
+
+func (t *latencyTracker) observe(d time.Duration, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rotate(now)
+	t.current.observe(d)
+}
+
+func (t *latencyTracker) snapshot(now time.Time) LatencySnapshot {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rotate(now)
+	var merged latencyHistogram
+	var count uint64
+	for i := range merged {
+		merged[i] = t.current[i] + t.previous[i]
+		count += merged[i]
+	}
+	if count == 0 {
+		return LatencySnapshot{}
+	}
+	return LatencySnapshot{
+		Count: int(count),
+		P50:   merged.quantile(0.5, count),
+		P90:   merged.quantile(0.9, count),
+		P99:   merged.quantile(0.99, count),
+	}
+}
+
+// LatencySnapshot is how long the recent successful handshakes with Cloak clients took
+func (sta *State) LatencySnapshot() LatencySnapshot {
+	return sta.latency.snapshot(sta.WorldState.Now())
+}
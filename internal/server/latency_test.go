@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	for _, d := range []time.Duration{0, latencyMinBound, 11 * time.Microsecond, time.Millisecond, 3 * time.Second, time.Hour} {
+		var h latencyHistogram
+		h.observe(d)
+		bound := h.quantile(0.5, 1)
+		if d <= latencyMinBound {
+			assert.Equal(t, latencyMinBound, bound)
+			continue
+		}
+		if d > latencyBound(latencyBuckets-1) {
+			assert.Equal(t, latencyBound(latencyBuckets-1), bound)
+			continue
+		}
+		assert.True(t, d <= bound, "%v put in a bucket up to %v", d, bound)
+		assert.True(t, float64(bound) <= float64(d)*latencyGrowth, "%v put in a bucket up to %v", d, bound)
+	}
+	assert.True(t, latencyBound(latencyBuckets-1) > time.Minute)
+}
+
+func TestLatencyTracker(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	within := func(t *testing.T, d time.Duration, quantile time.Duration) {
+		assert.True(t, d <= quantile && float64(quantile) <= float64(d)*latencyGrowth, "expecting about %v, got %v", d, quantile)
+	}
+
+	var tracker latencyTracker
+	assert.Equal(t, LatencySnapshot{}, tracker.snapshot(now))
+	for i := 0; i < 90; i++ {
+		tracker.observe(time.Millisecond, now)
+	}
+	for i := 0; i < 9; i++ {
+		tracker.observe(10*time.Millisecond, now)
+	}
+	tracker.observe(100*time.Millisecond, now)
+
+	snapshot := tracker.snapshot(now)
+	assert.Equal(t, 100, snapshot.Count)
+	within(t, time.Millisecond, snapshot.P50)
+	within(t, time.Millisecond, snapshot.P90)
+	within(t, 10*time.Millisecond, snapshot.P99)
+
+	t.Run("rolling window", func(t *testing.T) {
+		later := now.Add(latencyWindow)
+		tracker.observe(time.Second, later)
+		snapshot := tracker.snapshot(later)
+		assert.Equal(t, 101, snapshot.Count, "the last window is forgotten straight away")
+
+		// the first window has been forgotten
+		later = later.Add(latencyWindow)
+		snapshot = tracker.snapshot(later)
+		assert.Equal(t, 1, snapshot.Count)
+		within(t, time.Second, snapshot.P50)
+
+		assert.Equal(t, LatencySnapshot{}, tracker.snapshot(later.Add(2*latencyWindow)))
+	})
+}
+
+func TestDispatchConnection_LatencySnapshot(t *testing.T) {
+	sta, _, _ := makeDispatchTestState(t)
+	const delay = 50 * time.Millisecond
+	first, _ := hex.DecodeString(cloakClientHello)
+	local, remote := connutil.AsyncPipe()
+	defer local.Close()
+	// the reply is held up on its way to the client
+	go dispatchConnection(newThrottledConn(remote, throttleOptions{WriteDelay: delay}), sta)
+	local.Write(first)
+	if _, err := readServerReply(local); err != nil {
+		t.Fatalf("failed to read server reply: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for sta.LatencySnapshot().Count == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	snapshot := sta.LatencySnapshot()
+	assert.Equal(t, 1, snapshot.Count)
+	assert.True(t, snapshot.P50 >= delay, "P50 of %v is quicker than the injected latency", snapshot.P50)
+	assert.Equal(t, snapshot.P50, snapshot.P99)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaintenanceStatus  = http.StatusServiceUnavailable
+	defaultMaintenanceTimeout = 30 * time.Second
+	// maintenanceMaxRequestBody is how much of the body of a request is read before the connection is closed
+	maintenanceMaxRequestBody = 1 << 16
+)
+
+// MaintenancePage answers connections not from a Cloak client itself instead of relaying them to RedirAddr, for a
+// server with no website behind it. A ClientHello is answered with a real TLS handshake, and each HTTP request after
+// it, or one sent in the clear, with the same static response, so that a prober sees a site under maintenance instead
+// of a reset. A first packet which is neither is closed as usual
+type MaintenancePage struct {
+	// TLSConfig has the certificate the TLS handshake is completed with
+	TLSConfig *tls.Config
+	// StatusCode is that of the response, such as 503
+	StatusCode int
+	// ContentType is the Content-Type of Body
+	ContentType string
+	Body        []byte
+	// Timeout is how long each of the TLS handshake and requests may take
+	Timeout time.Duration
+	// Records, if more than one, is how many writes, and so records over TLS, each response is sent in: its header
+	// first, then its body in equal parts, as from a backend that streams it. RecordGap is about how long is waited
+	// before each write after the first, give or take half of it
+	Records   int
+	RecordGap time.Duration
+}
+
+// MakeMaintenancePage makes a MaintenancePage answering with body and statusCode in TLS sessions with cert
+func MakeMaintenancePage(cert tls.Certificate, statusCode int, body []byte) *MaintenancePage {
+	if statusCode == 0 {
+		statusCode = defaultMaintenanceStatus
+	}
+	return &MaintenancePage{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"http/1.1"},
+		},
+		StatusCode:  statusCode,
+		ContentType: http.DetectContentType(body),
+		Body:        body,
+		Timeout:     defaultMaintenanceTimeout,
+	}
+}
+
+// selfSignedCertificate makes a certificate for names, valid for a year from now, for a MaintenancePage when no
+// certificate is given. A prober can tell it isn't signed by a CA, but so it can for many small sites
+func selfSignedCertificate(names []string, now time.Time) (tls.Certificate, error) {
+	if len(names) == 0 {
+		names = []string{"localhost"}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// loadMaintenancePage makes the MaintenancePage of raw, with its certificate or one made for the ServerNames of the
+// server profiles
+func (sta *State) loadMaintenancePage(raw RawConfig) (*MaintenancePage, error) {
+	body, err := ioutil.ReadFile(raw.MaintenancePage)
+	if err != nil {
+		return nil, err
+	}
+	var cert tls.Certificate
+	if raw.MaintenanceCert != "" || raw.MaintenanceKey != "" {
+		cert, err = tls.LoadX509KeyPair(raw.MaintenanceCert, raw.MaintenanceKey)
+	} else {
+		var names []string
+		for _, profile := range sta.serverProfiles() {
+			names = append(names, profile.ServerNames...)
+		}
+		cert, err = selfSignedCertificate(names, sta.WorldState.Now())
+	}
+	if err != nil {
+		return nil, err
+	}
+	page := MakeMaintenancePage(cert, raw.MaintenanceStatus, body)
+	page.Records = raw.MaintenanceRecords
+	page.RecordGap = time.Duration(raw.MaintenanceRecordGap) * time.Millisecond
+	return page, nil
+}
+
+// serve answers conn, from which firstPacket of transport has already been read, and closes it
+func (m *MaintenancePage) serve(conn net.Conn, transport Transport, firstPacket []byte) {
+	conn = &earlyDataConn{Conn: conn, earlyData: firstPacket}
+	switch transport.(type) {
+	case TLS:
+		tlsConn := tls.Server(conn, m.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(m.Timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.WithField("remoteAddr", conn.RemoteAddr()).Debugf("maintenance page TLS handshake failed: %v", err)
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	case WebSocket:
+	default:
+		conn.Close()
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(m.Timeout))
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, io.LimitReader(req.Body, maintenanceMaxRequestBody+1))
+		req.Body.Close()
+		resp := m.response(req)
+		if n > maintenanceMaxRequestBody {
+			resp.Close = true
+		}
+		if err := m.writeResponse(conn, resp); err != nil || resp.Close {
+			return
+		}
+	}
+}
+
+// writeResponse writes resp to conn in Records writes, with RecordGap between them, or in a single write if Records
+// isn't more than one
+func (m *MaintenancePage) writeResponse(conn net.Conn, resp *http.Response) error {
+	var buf bytes.Buffer
+	if err := resp.Write(&buf); err != nil {
+		return err
+	}
+	serialised := buf.Bytes()
+	if m.Records <= 1 {
+		_, err := conn.Write(serialised)
+		return err
+	}
+	headerEnd := bytes.Index(serialised, []byte("\r\n\r\n")) + 4
+	writes := [][]byte{serialised[:headerEnd]}
+	body := serialised[headerEnd:]
+	parts := m.Records - 1
+	if parts > len(body) {
+		parts = len(body)
+	}
+	for i := 0; i < parts; i++ {
+		writes = append(writes, body[len(body)*i/parts:len(body)*(i+1)/parts])
+	}
+	for i, write := range writes {
+		if i > 0 && m.RecordGap > 0 {
+			time.Sleep(m.RecordGap/2 + time.Duration(mrand.Int63n(int64(m.RecordGap))))
+		}
+		if _, err := conn.Write(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// response is the answer to req
+func (m *MaintenancePage) response(req *http.Request) *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", m.ContentType)
+	header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if m.StatusCode == http.StatusServiceUnavailable {
+		header.Set("Retry-After", "3600")
+	}
+	return &http.Response{
+		StatusCode:    m.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		ContentLength: int64(len(m.Body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(m.Body)),
+		Close:         req.Close,
+	}
+}
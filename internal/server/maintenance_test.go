@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const maintenanceBody = "<html><body><h1>Site under maintenance</h1></body></html>"
+
+func TestSelfSignedCertificate(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	cert, err := selfSignedCertificate([]string{"example.com", "www.example.com"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "example.com", leaf.Subject.CommonName)
+	assert.NoError(t, leaf.VerifyHostname("www.example.com"))
+	assert.True(t, leaf.NotBefore.Before(now))
+	assert.True(t, leaf.NotAfter.After(now.AddDate(0, 11, 0)))
+
+	cert, err = selfSignedCertificate(nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	assert.Equal(t, "localhost", leaf.Subject.CommonName)
+}
+
+func TestDispatchConnection_MaintenancePage(t *testing.T) {
+	cert, err := selfSignedCertificate([]string{"example.com"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	// get sends a GET request on conn and reads the response
+	get := func(t *testing.T, conn interface {
+		Write([]byte) (int, error)
+		Read([]byte) (int, error)
+	}) *http.Response {
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	t.Run("TLS", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.MaintenancePage = MakeMaintenancePage(cert, 0, []byte(maintenanceBody))
+		reasons := make(chan FallbackReason, 1)
+		sta.OnFallback = func(_ net.Conn, reason FallbackReason) { reasons <- reason }
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+
+		tlsConn := tls.Client(local, &tls.Config{ServerName: "example.com", RootCAs: roots})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("TLS handshake with the maintenance page failed: %v", err)
+		}
+		assert.Equal(t, FallbackNotCloak, <-reasons)
+		resp := get(t, tlsConn)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, maintenanceBody, string(body))
+
+		// and again on the same connection
+		resp = get(t, tlsConn)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+
+	t.Run("plain HTTP", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.MaintenancePage = MakeMaintenancePage(cert, http.StatusOK, []byte(maintenanceBody))
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+
+		resp := get(t, local)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, maintenanceBody, string(body))
+	})
+}
+
+// timedWriteConn records when each write to it is made, and how long it is
+type timedWriteConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	times  []time.Time
+	writes [][]byte
+}
+
+func (c *timedWriteConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.times = append(c.times, time.Now())
+	c.writes = append(c.writes, append([]byte{}, b...))
+	c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+// reset forgets the writes so far
+func (c *timedWriteConn) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.times, c.writes = nil, nil
+}
+
+func (c *timedWriteConn) recorded() ([]time.Time, [][]byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.times, c.writes
+}
+
+func TestMaintenancePage_Records(t *testing.T) {
+	cert, err := selfSignedCertificate([]string{"example.com"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	const gap = 20 * time.Millisecond
+	get := func(t *testing.T, conn io.ReadWriter) {
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, maintenanceBody, string(body))
+	}
+	checkGaps := func(t *testing.T, times []time.Time) {
+		for i := 1; i < len(times); i++ {
+			elapsed := times[i].Sub(times[i-1])
+			assert.True(t, elapsed >= gap/2, "write %v only %v after the one before", i, elapsed)
+			assert.True(t, elapsed < 5*gap, "write %v %v after the one before", i, elapsed)
+		}
+	}
+
+	t.Run("TLS", func(t *testing.T) {
+		page := MakeMaintenancePage(cert, 0, []byte(maintenanceBody))
+		// a session ticket could be sent after the client has finished its handshake
+		page.TLSConfig.SessionTicketsDisabled = true
+		page.Records, page.RecordGap = 4, gap
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		recorder := &timedWriteConn{Conn: remote}
+		go page.serve(recorder, TLS{}, nil)
+
+		tlsConn := tls.Client(local, &tls.Config{ServerName: "example.com", RootCAs: roots})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		recorder.reset()
+		get(t, tlsConn)
+
+		times, writes := recorder.recorded()
+		if assert.Len(t, writes, 4) {
+			for _, write := range writes {
+				assert.Equal(t, byte(0x17), write[0], "write isn't an ApplicationData record")
+			}
+		}
+		checkGaps(t, times)
+	})
+
+	t.Run("plain HTTP", func(t *testing.T) {
+		page := MakeMaintenancePage(cert, 0, []byte(maintenanceBody))
+		page.Records, page.RecordGap = 3, gap
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		recorder := &timedWriteConn{Conn: remote}
+		go page.serve(recorder, WebSocket{}, nil)
+		get(t, local)
+
+		times, writes := recorder.recorded()
+		if assert.Len(t, writes, 3) {
+			assert.True(t, bytes.HasSuffix(writes[0], []byte("\r\n\r\n")), "the header isn't written on its own")
+			assert.Equal(t, maintenanceBody, string(append(writes[1], writes[2]...)))
+		}
+		checkGaps(t, times)
+	})
+
+	t.Run("at once", func(t *testing.T) {
+		page := MakeMaintenancePage(cert, 0, []byte(maintenanceBody))
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		recorder := &timedWriteConn{Conn: remote}
+		go page.serve(recorder, WebSocket{}, nil)
+		get(t, local)
+		_, writes := recorder.recorded()
+		assert.Len(t, writes, 1)
+	})
+
+	t.Run("more records than bytes of body", func(t *testing.T) {
+		page := MakeMaintenancePage(cert, 0, []byte("ok"))
+		page.Records = 10
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		recorder := &timedWriteConn{Conn: remote}
+		go page.serve(recorder, WebSocket{}, nil)
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Write(local)
+		resp, err := http.ReadResponse(bufio.NewReader(local), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "ok", string(body))
+		_, writes := recorder.recorded()
+		assert.Len(t, writes, 3)
+	})
+}
+
+func TestInitState_MaintenancePage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ck_maintenance")
+	defer os.RemoveAll(dir)
+	page := filepath.Join(dir, "index.html")
+	ioutil.WriteFile(page, []byte(maintenanceBody), 0644)
+
+	sta, err := InitState(RawConfig{
+		DatabasePath:         filepath.Join(dir, "userinfo.db"),
+		MaintenancePage:      page,
+		MaintenanceRecords:   4,
+		MaintenanceRecordGap: 20,
+		ServerProfile:        &ServerProfile{ServerNames: []string{"example.com"}},
+	}, common.WorldOfTime(time.Unix(1565998966, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, sta.MaintenancePage) {
+		assert.Equal(t, []byte(maintenanceBody), sta.MaintenancePage.Body)
+		assert.Equal(t, http.StatusServiceUnavailable, sta.MaintenancePage.StatusCode)
+		assert.Equal(t, 4, sta.MaintenancePage.Records)
+		assert.Equal(t, 20*time.Millisecond, sta.MaintenancePage.RecordGap)
+		leaf, _ := x509.ParseCertificate(sta.MaintenancePage.TLSConfig.Certificates[0].Certificate[0])
+		assert.Equal(t, []string{"example.com"}, leaf.DNSNames)
+	}
+
+	_, err = InitState(RawConfig{
+		DatabasePath:    filepath.Join(dir, "userinfo2.db"),
+		MaintenancePage: filepath.Join(dir, "missing.html"),
+	}, common.WorldOfTime(time.Unix(1565998966, 0)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,31 @@
+package server
+
+import "time"
+
+// HandshakePhase is a part of the handshake with a Cloak client
+type HandshakePhase string
+
+const (
+	// PhaseParse is parsing the first packet, such as the ClientHello
+	PhaseParse HandshakePhase = "parse"
+	// PhaseAuth is the rest of checking the first packet to be from a Cloak client, which is mostly the key exchange
+	// and decrypting the client's fields
+	PhaseAuth HandshakePhase = "auth"
+	// PhaseReply is composing and writing the handshake reply. It includes a round trip to the client if the server
+	// profile has AwaitClientFinished
+	PhaseReply HandshakePhase = "reply"
+)
+
+// PhaseTimer is told how long each phase of every handshake with a Cloak client took, such as to find out whether the
+// crypto or the I/O takes longer. There's no PhaseReply for a client refused once it's authenticated, such as for an
+// unknown UID. ObservePhase is called from the goroutine of the connection, so it should be quick
+type PhaseTimer interface {
+	ObservePhase(phase HandshakePhase, d time.Duration)
+}
+
+// observePhase tells the PhaseTimer how long phase took, if there is one
+func (sta *State) observePhase(phase HandshakePhase, d time.Duration) {
+	if sta.PhaseTimer != nil {
+		sta.PhaseTimer.ObservePhase(phase, d)
+	}
+}
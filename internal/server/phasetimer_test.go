@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type phaseDuration struct {
+	phase HandshakePhase
+	d     time.Duration
+}
+
+type chanPhaseTimer chan phaseDuration
+
+func (c chanPhaseTimer) ObservePhase(phase HandshakePhase, d time.Duration) {
+	c <- phaseDuration{phase, d}
+}
+
+func TestDispatchConnection_PhaseTimer(t *testing.T) {
+	t.Run("successful handshake", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		timer := make(chanPhaseTimer, 3)
+		sta.PhaseTimer = timer
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		_, err := readServerReply(local)
+		if err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		defer local.Close()
+
+		var phases []HandshakePhase
+		for i := 0; i < 3; i++ {
+			select {
+			case observed := <-timer:
+				phases = append(phases, observed.phase)
+				assert.True(t, observed.d > 0, "%v took %v", observed.phase, observed.d)
+			case <-time.After(timeout):
+				t.Fatalf("only got %v", phases)
+			}
+		}
+		assert.Equal(t, []HandshakePhase{PhaseParse, PhaseAuth, PhaseReply}, phases)
+	})
+
+	t.Run("not from a Cloak client", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		timer := make(chanPhaseTimer, 3)
+		sta.PhaseTimer = timer
+
+		first, _ := hex.DecodeString(chromeClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirConn.Close()
+		local.Close()
+		select {
+		case observed := <-timer:
+			t.Errorf("%v timed for a ClientHello not from a Cloak client", observed.phase)
+		case <-time.After(timeout):
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProbeDecision is what is done with a connection once its ClientHello has been parsed, before it's checked to be
+// from a Cloak client
+type ProbeDecision int
+
+const (
+	// ProbeAccept goes on to check the ClientHello as usual
+	ProbeAccept ProbeDecision = iota
+	// ProbeDivert relays the connection to the redirection server without checking the ClientHello
+	ProbeDivert
+	// ProbeTarpit holds the connection open with Tarpit, or relays it to the redirection server if Tarpit is full
+	ProbeTarpit
+	// ProbeDrop closes the connection
+	ProbeDrop
+)
+
+func (d ProbeDecision) String() string {
+	switch d {
+	case ProbeAccept:
+		return "accept"
+	case ProbeDivert:
+		return "divert"
+	case ProbeTarpit:
+		return "tarpit"
+	case ProbeDrop:
+		return "drop"
+	}
+	return "unknown"
+}
+
+// ProbeClassifier decides whether a connection may be from a Cloak client from its ClientHello and where it's from,
+// for example by the ClientHello's JA3 and AnomalyFlags or the reputation of conn.RemoteAddr(). Classify must not
+// read from or write to conn
+type ProbeClassifier interface {
+	Classify(ch *ClientHello, conn net.Conn) ProbeDecision
+}
+
+// AcceptAllClassifier accepts every connection, which leaves them all to be checked as usual. It's used unless
+// State.ProbeClassifier is set
+type AcceptAllClassifier struct{}
+
+func (AcceptAllClassifier) Classify(*ClientHello, net.Conn) ProbeDecision { return ProbeAccept }
+
+var ErrClassifiedAsProbe = errors.New("classified as a probe")
+
+// classifyProbe consults ProbeClassifier on the ClientHello in data and acts on its decision. divert relays conn to
+// the redirection server. It returns whether conn has been dealt with, which it hasn't if the connection is accepted
+// or data isn't a ClientHello that can be parsed
+func (sta *State) classifyProbe(conn net.Conn, data []byte, divert func()) bool {
+	if sta.ProbeClassifier == nil {
+		return false
+	}
+	ch, err := parseClientHello(data, sta.parseOptions())
+	if err != nil {
+		return false
+	}
+	decision := sta.ProbeClassifier.Classify(ch, conn)
+	if decision == ProbeAccept {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"remoteAddr": conn.RemoteAddr(),
+		"decision":   decision,
+	}).Debug("ClientHello classified as a probe")
+	sta.emitHandshakeEvent(conn, data, ClientInfo{}, ErrClassifiedAsProbe)
+	sta.recordFailedHandshake(conn, data, ErrClassifiedAsProbe)
+
+	switch decision {
+	case ProbeTarpit:
+		cfg := TarpitConfig{Interval: defaultTarpitInterval, MaxDuration: defaultTarpitDuration, MaxConcurrent: defaultMaxTarpits}
+		if sta.Tarpit != nil {
+			cfg = *sta.Tarpit
+		}
+		if !Tarpit(conn, cfg) {
+			divert()
+		}
+	case ProbeDrop:
+		conn.Close()
+	default:
+		divert()
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fixedClassifier makes the same decision for every connection and passes on the ClientHellos it's given
+type fixedClassifier struct {
+	decision ProbeDecision
+	seen     chan *ClientHello
+}
+
+func (c fixedClassifier) Classify(ch *ClientHello, conn net.Conn) ProbeDecision {
+	c.seen <- ch
+	return c.decision
+}
+
+func TestDispatchConnection_ProbeClassifier(t *testing.T) {
+	cloakBytes, _ := hex.DecodeString(cloakClientHello)
+	cloakCh, _ := parseClientHello(cloakBytes, DefaultParseOptions)
+
+	// dispatch sends the Cloak ClientHello to a server whose classifier always makes decision
+	dispatch := func(t *testing.T, decision ProbeDecision) (local net.Conn, redirected chan net.Conn) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		classifier := fixedClassifier{decision: decision, seen: make(chan *ClientHello, 1)}
+		sta.ProbeClassifier = classifier
+		sta.Tarpit = &TarpitConfig{Interval: 10 * time.Millisecond, MaxDuration: 100 * time.Millisecond, MaxConcurrent: 4}
+		redirected = make(chan net.Conn, 1)
+		go func() {
+			conn, err := redirListener.Accept()
+			if err == nil {
+				redirected <- conn
+			}
+		}()
+
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(cloakBytes)
+		select {
+		case ch := <-classifier.seen:
+			assert.Equal(t, cloakCh.JA3(), ch.JA3())
+		case <-time.After(timeout):
+			t.Fatal("classifier not consulted")
+		}
+		return local, redirected
+	}
+	notRedirected := func(t *testing.T, redirected chan net.Conn) {
+		select {
+		case <-redirected:
+			t.Error("relayed to redirection server")
+		default:
+		}
+	}
+
+	t.Run("accept", func(t *testing.T) {
+		local, redirected := dispatch(t, ProbeAccept)
+		defer local.Close()
+		records, err := readServerReply(local)
+		assert.NoError(t, err, "no handshake reply")
+		assert.NotEmpty(t, records)
+		notRedirected(t, redirected)
+	})
+	t.Run("divert", func(t *testing.T) {
+		local, redirected := dispatch(t, ProbeDivert)
+		defer local.Close()
+		select {
+		case conn := <-redirected:
+			buf := make([]byte, len(cloakBytes))
+			_, err := io.ReadFull(conn, buf)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(cloakBytes, buf), "ClientHello not relayed as it was")
+			conn.Close()
+		case <-time.After(timeout):
+			t.Error("not relayed to redirection server")
+		}
+	})
+	t.Run("tarpit", func(t *testing.T) {
+		local, redirected := dispatch(t, ProbeTarpit)
+		buf := make([]byte, 3)
+		_, err := io.ReadFull(local, buf)
+		assert.NoError(t, err, "nothing dripped")
+		notRedirected(t, redirected)
+		local.Close()
+		waitForTarpits(t)
+	})
+	t.Run("drop", func(t *testing.T) {
+		local, redirected := dispatch(t, ProbeDrop)
+		defer local.Close()
+		local.SetReadDeadline(time.Now().Add(timeout))
+		n, err := local.Read(make([]byte, 1))
+		assert.Equal(t, 0, n)
+		assert.Error(t, err, "connection not closed")
+		if netErr, ok := err.(net.Error); ok {
+			assert.False(t, netErr.Timeout(), "connection not closed")
+		}
+		notRedirected(t, redirected)
+	})
+}
+
+func TestAcceptAllClassifier(t *testing.T) {
+	local, _ := net.Pipe()
+	defer local.Close()
+	assert.Equal(t, ProbeAccept, AcceptAllClassifier{}.Classify(&ClientHello{}, local))
+}
@@ -0,0 +1,577 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServerProfile describes the TLS server that the handshake reply to a Cloak client mimics
+type ServerProfile struct {
+	// CipherSuite is the cipher suite selected in the ServerHello
+	CipherSuite uint16
+	// ALPN is the list of application layer protocols supported by the server, in order of preference
+	ALPN []string
+	// ALPNPreference is whose order of preference the protocol is selected from ALPN by
+	ALPNPreference ALPNPreference
+	// FallbackClose is how a connection not from a Cloak client is closed when we are the one closing it
+	FallbackClose CloseStrategy
+	// ServerNames, if not empty, are the names the server serves. A ClientHello not from a Cloak client for a
+	// different name is answered with SNIMismatchAlert instead of being relayed to the redirection server
+	ServerNames      []string
+	SNIMismatchAlert SNIAlert
+	// FlightLengths, if not empty, are the lengths of the encrypted handshake messages the server sends before
+	// Finished, such as EncryptedExtensions, Certificate and CertificateVerify. Each of them, and then Finished, is
+	// sent in an ApplicationData record of its own as a TLS 1.3 server does. Otherwise the whole encrypted flight is
+	// sent in one record of a random length
+	FlightLengths []int
+	// RecordSizeHistogram, if not empty and FlightLengths is, is how often the server's single encrypted flight record
+	// has each length, as captured from the real server. The length of the record in each reply is drawn from it, so
+	// that over many connections the lengths are distributed as the real server's are
+	RecordSizeHistogram []RecordSizeBin
+	// CertCompression, if not nil, is how the server compresses its certificate for a client that offers to
+	// decompress it, as with brotli by servers behind some CDNs
+	CertCompression *CertCompression
+	// DelegatedCredential, if not nil, is the delegated credential the server sends with its certificate to a client
+	// that offers to accept one, as servers behind some CDNs do
+	DelegatedCredential *DelegatedCredential
+	// SessionTickets is whether the server issues TLS 1.2 session tickets. If so, a ClientHello with a session_ticket
+	// extension is answered with an empty session_ticket in the ServerHello and a NewSessionTicket message
+	SessionTickets bool
+	// SCTs is whether the server sends signed certificate timestamps in its ServerHello as a TLS 1.2 server does. If
+	// so, a ClientHello with a signed_certificate_timestamp extension is answered with a list of made-up SCTs
+	SCTs bool
+	// H2Settings is whether the server sends an HTTP/2 SETTINGS frame right after its Finished, as an h2 server does.
+	// If so, the handshake reply to a client for which h2 is selected ends with an ApplicationData record as long as
+	// an encrypted h2SettingsFrame
+	H2Settings bool
+	// AltSvc, if not empty, is the Alt-Svc field value, such as `h3=":443"; ma=86400`, with which the server
+	// advertises HTTP/3 in an HTTP/2 ALTSVC frame after its SETTINGS, as servers that support h3 do. If so, the
+	// handshake reply to a client for which h2 is selected ends with an ApplicationData record as long as an
+	// encrypted h2AltSvcFrame for the origin of the client's server name
+	AltSvc string
+	// SessionIdPolicy is what session id the server puts in its ServerHello
+	SessionIdPolicy SessionIdPolicy
+	// TLS12Flight, if not nil, is the shape of the Certificate and ServerKeyExchange a TLS 1.2 server sends after its
+	// ServerHello. If so, those and a ServerHelloDone follow the ServerHello in Handshake records of their own, so
+	// that a handshake claiming TLS 1.2 doesn't look cut short
+	TLS12Flight *TLS12Flight
+	// TLS12ServerHello is whether the ServerHello is laid out as that of a TLS 1.2 server, with a TLS 1.2 cipher suite,
+	// a fresh session id and only the extensions a TLS 1.2 server answers, instead of with the key_share and
+	// supported_versions of TLS 1.3. The client then reads the rest of the encrypted session key from the session id.
+	// It's only meant for a profile with TLS12Flight
+	TLS12ServerHello bool
+	// AwaitClientFinished is whether the server waits for the client's ClientKeyExchange, ChangeCipherSpec and
+	// Finished before it sends its own ChangeCipherSpec and encrypted flight, as a TLS 1.2 server does
+	AwaitClientFinished bool
+	// TCP, if not nil, are the socket options set on the connection from a Cloak client once its handshake has
+	// succeeded, to make its TCP behaviour more like the server's
+	TCP *TCPTuning
+}
+
+// TLS12Flight is the shape of the plaintext handshake messages of a TLS 1.2 server. Their contents are random
+type TLS12Flight struct {
+	// CertificateLengths are the lengths of the DER certificates in the chain, leaf first
+	CertificateLengths []int
+	// SignatureAlgorithm is that of the signature over the ECDH parameters in ServerKeyExchange, such as 0x0804
+	// (rsa_pss_rsae_sha256)
+	SignatureAlgorithm uint16
+	// SignatureLength is the length of the signature, such as 256 for a 2048 bit RSA key
+	SignatureLength int
+}
+
+// RecordSizeBin is a bin of RecordSizeHistogram
+type RecordSizeBin struct {
+	// Length is the length of the payload of the ApplicationData record
+	Length int
+	// Count is how many times the record has this length among those captured. Only its proportion to the other
+	// Counts in the histogram matters
+	Count int
+}
+
+// ErrRecordSizeHistogram is returned by ComposeReply when the length drawn from RecordSizeHistogram is too short to
+// hold a Finished message
+var ErrRecordSizeHistogram = errors.New("record length in RecordSizeHistogram can't hold Finished")
+
+// CertCompression is how a TLS 1.3 server sends a CompressedCertificate message in place of its Certificate
+type CertCompression struct {
+	// Algorithms are the certificate compression algorithms the server supports, such as 2 for brotli
+	Algorithms []uint16
+	// FlightLengths are used instead of those of the ServerProfile for a client that offers one of Algorithms in its
+	// compress_certificate extension. They should be the same but for the CompressedCertificate, which is shorter
+	// than the Certificate it replaces
+	FlightLengths []int
+}
+
+// DelegatedCredential is the shape of the delegated credential (RFC 9345) a TLS 1.3 server sends in a
+// delegated_credential extension of the leaf CertificateEntry of its Certificate. Like the rest of the Certificate, it's
+// encrypted, so only its length shows
+type DelegatedCredential struct {
+	// SignatureScheme is that of the credential's key, such as 0x0403 (ecdsa_secp256r1_sha256). The credential is only
+	// sent to a client that lists it in its delegated_credential extension
+	SignatureScheme uint16
+	// PublicKeyLength is the length of the DER SubjectPublicKeyInfo of the credential's key. Default is 91, for a
+	// P-256 key
+	PublicKeyLength int
+	// SignatureLength is the length of the certificate's signature over the credential. Default is 72, for ECDSA
+	// with P-256
+	SignatureLength int
+	// FlightLengths, if not empty, are used instead of those of the ServerProfile for a client the credential is sent
+	// to. Otherwise the length of the credential is added to that of the Certificate, which is the second of
+	// FlightLengths, or to that of the single encrypted flight record
+	FlightLengths []int
+}
+
+const (
+	defaultDelegatedCredentialPublicKeyLength = 91
+	defaultDelegatedCredentialSignatureLength = 72
+)
+
+// extensionLength is the length of the delegated_credential extension carrying the credential: its type and length,
+// then the valid_time, expected_cert_verify_algorithm, ASN1_subjectPublicKeyInfo with its 3-byte length, and the
+// algorithm and signature with its 2-byte length
+func (dc DelegatedCredential) extensionLength() int {
+	publicKeyLength, signatureLength := dc.PublicKeyLength, dc.SignatureLength
+	if publicKeyLength <= 0 {
+		publicKeyLength = defaultDelegatedCredentialPublicKeyLength
+	}
+	if signatureLength <= 0 {
+		signatureLength = defaultDelegatedCredentialSignatureLength
+	}
+	return 4 + 4 + 2 + 3 + publicKeyLength + 2 + 2 + signatureLength
+}
+
+// acceptedBy checks if the credential's signature scheme is one of those a client accepts
+func (dc DelegatedCredential) acceptedBy(schemes []uint16) bool {
+	for _, scheme := range schemes {
+		if scheme == dc.SignatureScheme {
+			return true
+		}
+	}
+	return false
+}
+
+// withDelegatedCredential is the profile with the lengths of its encrypted flight lengthened by the delegated
+// credential, and the certLength to pass to flightRecordLengths
+func (p ServerProfile) withDelegatedCredential(certLength int) (ServerProfile, int) {
+	dc := p.DelegatedCredential
+	switch {
+	case len(dc.FlightLengths) > 0:
+		p.FlightLengths = dc.FlightLengths
+	case len(p.FlightLengths) > 1:
+		p.FlightLengths = append([]int{}, p.FlightLengths...)
+		p.FlightLengths[1] += dc.extensionLength()
+	case len(p.FlightLengths) == 0:
+		certLength += dc.extensionLength()
+	}
+	return p, certLength
+}
+
+// SessionIdPolicy is how a server chooses the session id of its ServerHello
+type SessionIdPolicy string
+
+const (
+	// SessionIdEcho echoes the session id of the ClientHello, as a TLS 1.3 server does for middlebox compatibility
+	SessionIdEcho SessionIdPolicy = ""
+	// SessionIdFresh generates a random session id, as a TLS 1.2 server does for a new session
+	SessionIdFresh SessionIdPolicy = "fresh"
+)
+
+// freshSessionIdLength is the length of a session id generated by the server, which is what common servers use
+const freshSessionIdLength = 32
+
+// ALPNPreference is whose order of preference a server selects the application layer protocol by
+type ALPNPreference string
+
+const (
+	// ALPNServerPreference selects the first protocol of the server's that the client offers
+	ALPNServerPreference ALPNPreference = ""
+	// ALPNClientPreference selects the first protocol offered by the client that the server supports
+	ALPNClientPreference ALPNPreference = "client"
+)
+
+// SNIAlert is the alert a server sends when a ClientHello is for a name it doesn't serve
+type SNIAlert string
+
+const (
+	// SNIAlertNone leaves the ClientHello to the redirection server
+	SNIAlertNone             SNIAlert = ""
+	SNIAlertUnrecognizedName SNIAlert = "unrecognized_name"
+	SNIAlertHandshakeFailure SNIAlert = "handshake_failure"
+)
+
+var alertDescriptions = map[SNIAlert]byte{
+	SNIAlertUnrecognizedName: 112,
+	SNIAlertHandshakeFailure: 40,
+}
+
+// servesName checks if the server answers ClientHellos for name
+func (p ServerProfile) servesName(name string) bool {
+	if len(p.ServerNames) == 0 {
+		return true
+	}
+	for _, served := range p.ServerNames {
+		if strings.EqualFold(name, served) {
+			return true
+		}
+	}
+	return false
+}
+
+// CloseStrategy is how a server closes a connection
+type CloseStrategy string
+
+const (
+	// CloseFIN closes the connection normally
+	CloseFIN CloseStrategy = ""
+	// CloseRST resets the connection, as a server does when it gives up on a handshake early
+	CloseRST CloseStrategy = "rst"
+	// CloseNotify sends a close_notify alert before closing the connection normally
+	CloseNotify CloseStrategy = "close_notify"
+)
+
+var closeNotifyAlert = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}
+
+// close closes conn in the way of the strategy. Unknown strategies are treated as CloseFIN
+func (s CloseStrategy) close(conn net.Conn) error {
+	switch s {
+	case CloseRST:
+		// a linger of 0 makes the kernel send RST instead of FIN on close
+		if lingerer, ok := conn.(interface{ SetLinger(int) error }); ok {
+			lingerer.SetLinger(0)
+		}
+	case CloseNotify:
+		conn.Write(closeNotifyAlert)
+	}
+	return conn.Close()
+}
+
+// DefaultServerProfile is used when State.Profile is nil
+var DefaultServerProfile = ServerProfile{
+	CipherSuite: 0x1302, // TLS_AES_256_GCM_SHA384
+}
+
+// cipherSuiteHashLengths maps the cipher suites we know of to the output length of their hash function
+var cipherSuiteHashLengths = map[uint16]int{
+	0x1301: 32, // TLS_AES_128_GCM_SHA256
+	0x1302: 48, // TLS_AES_256_GCM_SHA384
+	0x1303: 32, // TLS_CHACHA20_POLY1305_SHA256
+	0xc02b: 32, // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02f: 32, // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc02c: 48, // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc030: 48, // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0xcca8: 32, // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	0xcca9: 32, // TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+}
+
+// tls13Equivalents maps each cipher suite a TLS 1.3 ServerHello, which the handshake reply always is, can select to
+// itself, and each TLS 1.2 ECDHE suite to the TLS 1.3 suite with the same AEAD and hash
+var tls13Equivalents = map[uint16]uint16{
+	0x1301: 0x1301,
+	0x1302: 0x1302,
+	0x1303: 0x1303,
+	0xc02b: 0x1301,
+	0xc02f: 0x1301,
+	0xc02c: 0x1302,
+	0xc030: 0x1302,
+	0xcca8: 0x1303,
+	0xcca9: 0x1303,
+}
+
+var ErrNoCipherSuite = errors.New("no TLS 1.3 cipher suite offered by the client")
+
+var ErrNoTLS12CipherSuite = errors.New("no TLS 1.2 ECDHE cipher suite offered by the client")
+
+// negotiateCipherSuite picks the cipher suite selected in the ServerHello to ch. A real server only selects a suite
+// offered by the client and of the version it negotiates, so CipherSuite is swapped for its TLS 1.3 equivalent if it's
+// a TLS 1.2 suite, and for the first TLS 1.3 suite offered by the client if the client hasn't offered it
+func (p ServerProfile) negotiateCipherSuite(ch *ClientHello) (uint16, error) {
+	var offered []uint16
+	for i := 0; i+1 < len(ch.cipherSuites); i += 2 {
+		offered = append(offered, u16(ch.cipherSuites[i:i+2]))
+	}
+	if p.TLS12ServerHello {
+		return p.negotiate12CipherSuite(offered)
+	}
+	if equivalent, ok := tls13Equivalents[p.CipherSuite]; ok {
+		for _, suite := range offered {
+			if suite == equivalent {
+				return equivalent, nil
+			}
+		}
+	}
+	for _, suite := range offered {
+		if tls13Equivalents[suite] == suite {
+			return suite, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: profile has %#04x", ErrNoCipherSuite, p.CipherSuite)
+}
+
+// negotiate12CipherSuite picks the cipher suite of a TLS 1.2 ServerHello, which is CipherSuite if it's a TLS 1.2 ECDHE
+// suite the client offered, or else the first one the client offered
+func (p ServerProfile) negotiate12CipherSuite(offered []uint16) (uint16, error) {
+	// the TLS 1.2 suites are those without themselves as their TLS 1.3 equivalent
+	isTLS12 := func(suite uint16) bool {
+		equivalent, ok := tls13Equivalents[suite]
+		return ok && equivalent != suite
+	}
+	for _, suite := range offered {
+		if suite == p.CipherSuite && isTLS12(suite) {
+			return suite, nil
+		}
+	}
+	for _, suite := range offered {
+		if isTLS12(suite) {
+			return suite, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: profile has %#04x", ErrNoTLS12CipherSuite, p.CipherSuite)
+}
+
+const (
+	aeadTagLength    = 16
+	innerContentType = 1 // the real content type at the end of a TLS 1.3 encrypted record
+	handshakeHeader  = 4
+)
+
+// finishedLength is the length of an encrypted Finished message, whose verify_data is as long as the output of
+// the cipher suite's hash function. Unknown cipher suites are assumed to use SHA-256
+func (p ServerProfile) finishedLength() int {
+	hashLen, ok := cipherSuiteHashLengths[p.CipherSuite]
+	if !ok {
+		hashLen = 32
+	}
+	return handshakeHeader + hashLen
+}
+
+// encryptedFlightLength is the length of the payload of the ApplicationData record carrying the server's encrypted
+// handshake messages, which ends with a Finished message. certLength is the length of everything before Finished
+func (p ServerProfile) encryptedFlightLength(certLength int) int {
+	return certLength + p.finishedLength() + innerContentType + aeadTagLength
+}
+
+// flightRecordLengths is the lengths of the payloads of the ApplicationData records carrying the server's encrypted
+// handshake messages. certLength is only used if FlightLengths is empty
+func (p ServerProfile) flightRecordLengths(certLength int) []int {
+	if len(p.FlightLengths) == 0 {
+		return []int{p.encryptedFlightLength(certLength)}
+	}
+	var lengths []int
+	for _, messageLength := range p.FlightLengths {
+		lengths = append(lengths, messageLength+innerContentType+aeadTagLength)
+	}
+	return append(lengths, p.finishedLength()+innerContentType+aeadTagLength)
+}
+
+// sampleCertLength draws the length of everything before Finished in the encrypted flight record from
+// RecordSizeHistogram with rng. It returns certLength as it is if the histogram is empty or has no Count
+func (p ServerProfile) sampleCertLength(rng *rand.Rand, certLength int) (int, error) {
+	total := 0
+	for _, bin := range p.RecordSizeHistogram {
+		if bin.Count > 0 {
+			total += bin.Count
+		}
+	}
+	if total == 0 {
+		return certLength, nil
+	}
+	r := rng.Intn(total)
+	for _, bin := range p.RecordSizeHistogram {
+		if bin.Count <= 0 {
+			continue
+		}
+		if r < bin.Count {
+			certLength = bin.Length - p.encryptedFlightLength(0)
+			if certLength < 0 {
+				return 0, fmt.Errorf("%w: %v", ErrRecordSizeHistogram, bin.Length)
+			}
+			return certLength, nil
+		}
+		r -= bin.Count
+	}
+	return certLength, nil
+}
+
+// h2SettingsFrame is the SETTINGS frame a typical h2 server starts with: SETTINGS_MAX_CONCURRENT_STREAMS 128,
+// SETTINGS_INITIAL_WINDOW_SIZE 65536 and SETTINGS_MAX_FRAME_SIZE 16777215
+var h2SettingsFrame = []byte{
+	0x00, 0x00, 0x12, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, // length 18, type SETTINGS, no flags, stream 0
+	0x00, 0x03, 0x00, 0x00, 0x00, 0x80,
+	0x00, 0x04, 0x00, 0x01, 0x00, 0x00,
+	0x00, 0x05, 0x00, 0xff, 0xff, 0xff,
+}
+
+// h2SettingsRecordLength is the length of the payload of the ApplicationData record carrying h2SettingsFrame
+func (p ServerProfile) h2SettingsRecordLength() int {
+	return len(h2SettingsFrame) + innerContentType + aeadTagLength
+}
+
+// h2AltSvcFrame is an ALTSVC frame on stream 0, which advertises altSvc as an alternative service for origin
+func h2AltSvcFrame(origin, altSvc string) []byte {
+	payloadLength := 2 + len(origin) + len(altSvc)
+	frame := []byte{
+		byte(payloadLength >> 16), byte(payloadLength >> 8), byte(payloadLength),
+		0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, // type ALTSVC, no flags, stream 0
+		byte(len(origin) >> 8), byte(len(origin)),
+	}
+	frame = append(frame, origin...)
+	return append(frame, altSvc...)
+}
+
+// altSvcOrigin is the origin an ALTSVC frame in reply to ch is for. That's the server name the client asked for or,
+// if it didn't send one, the first of ServerNames. It's empty if there's neither
+func (p ServerProfile) altSvcOrigin(ch *ClientHello) string {
+	name, err := ch.serverName()
+	if err != nil || name == "" {
+		if len(p.ServerNames) == 0 {
+			return ""
+		}
+		name = p.ServerNames[0]
+	}
+	return "https://" + name
+}
+
+// altSvcRecordLength is the length of the payload of the ApplicationData record carrying the ALTSVC frame for origin
+func (p ServerProfile) altSvcRecordLength(origin string) int {
+	return len(h2AltSvcFrame(origin, p.AltSvc)) + innerContentType + aeadTagLength
+}
+
+// selectALPN picks the most preferred protocol of the server's that is offered by the client, or with
+// ALPNClientPreference the most preferred of the client's that the server supports. It returns an empty string if
+// there is no such protocol
+func (p ServerProfile) selectALPN(offered []string) string {
+	preferred, other := p.ALPN, offered
+	if p.ALPNPreference == ALPNClientPreference {
+		preferred, other = offered, p.ALPN
+	}
+	for _, proto := range preferred {
+		for _, o := range other {
+			if proto == o {
+				return proto
+			}
+		}
+	}
+	return ""
+}
+
+// replyExtensions are the optional extensions answered in the handshake reply
+type replyExtensions struct {
+	sessionTicket bool
+	sct           bool
+	// certCompression is whether the certificate is compressed with an algorithm both sides support
+	certCompression bool
+	// delegatedCredential is whether the delegated credential is sent with the certificate
+	delegatedCredential bool
+	// alpn is the protocol selected, or empty if there's none
+	alpn string
+}
+
+// replyExtensions intersects the extensions the server answers with those offered in ch. A real server never sends
+// an extension the client didn't offer, so dropped are those of the profile left out because ch doesn't have them
+func (p ServerProfile) replyExtensions(ch *ClientHello) (exts replyExtensions, dropped []string) {
+	// offered notes the extension of typ as dropped unless ok
+	offered := func(ok bool, typ uint16) bool {
+		if !ok {
+			dropped = append(dropped, extensionNames[typ])
+		}
+		return ok
+	}
+	exts.sessionTicket = p.SessionTickets && offered(ch.offersSessionTicket(), 0x0023)
+	exts.sct = p.SCTs && offered(ch.requestsSCT(), 0x0012)
+	if p.CertCompression != nil && offered(ch.CertCompressionAlgs() != nil, 0x001b) {
+		exts.certCompression = p.CertCompression.supportsAny(ch.CertCompressionAlgs())
+	}
+	if p.DelegatedCredential != nil && offered(ch.SupportsDelegatedCreds(), 0x0022) {
+		exts.delegatedCredential = p.DelegatedCredential.acceptedBy(ch.delegatedCredentialSchemes())
+	}
+	_, offersALPN := ch.extensions[[2]byte{0x00, 0x10}]
+	if len(p.ALPN) > 0 && offered(offersALPN, 0x0010) {
+		exts.alpn = p.selectALPN(ch.offeredALPN())
+	}
+	return
+}
+
+// supportsAny checks if the server supports one of the certificate compression algorithms offered by a client
+func (c CertCompression) supportsAny(offered []uint16) bool {
+	for _, alg := range c.Algorithms {
+		for _, o := range offered {
+			if alg == o {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProfileSelector picks one of Profiles for each user. The choice only depends on Seed and the UID, so every
+// connection of a user is answered by the same server while different users see different ones
+type ProfileSelector struct {
+	Profiles []ServerProfile
+	Seed     []byte
+}
+
+// Select returns the profile for the user. Profiles must not be empty
+func (s *ProfileSelector) Select(UID []byte) ServerProfile {
+	h := sha256.New()
+	h.Write(s.Seed)
+	h.Write(UID)
+	sum := h.Sum(nil)
+	return s.Profiles[binary.BigEndian.Uint64(sum[:8])%uint64(len(s.Profiles))]
+}
+
+// serverProfile returns the profile the handshake reply to this user mimics. ProfileSelector takes precedence over
+// Profile
+func (sta *State) serverProfile(UID []byte) ServerProfile {
+	if sta.ProfileSelector != nil && len(sta.ProfileSelector.Profiles) > 0 {
+		return sta.ProfileSelector.Select(UID)
+	}
+	if sta.Profile == nil {
+		return DefaultServerProfile
+	}
+	return *sta.Profile
+}
+
+// serverProfiles returns all the profiles which handshake replies may mimic
+func (sta *State) serverProfiles() []ServerProfile {
+	if sta.ProfileSelector != nil && len(sta.ProfileSelector.Profiles) > 0 {
+		return sta.ProfileSelector.Profiles
+	}
+	return []ServerProfile{sta.serverProfile(nil)}
+}
+
+// closeFallbackConn closes a connection not from a Cloak client in the way of the server we mimic
+func (sta *State) closeFallbackConn(conn net.Conn) {
+	sta.serverProfile(nil).FallbackClose.close(conn)
+}
+
+// answerServerNameMismatch sends the fatal alert of the server we mimic and closes conn if clientHello is for a
+// name the server doesn't serve. It returns whether it has done so
+func (sta *State) answerServerNameMismatch(conn net.Conn, clientHello []byte) bool {
+	profile := sta.serverProfile(nil)
+	description, ok := alertDescriptions[profile.SNIMismatchAlert]
+	if !ok {
+		return false
+	}
+	ch, err := parseClientHello(clientHello, DefaultParseOptions)
+	if err != nil {
+		return false
+	}
+	name, err := ch.serverName()
+	if err != nil || name == "" || profile.servesName(name) {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"remoteAddr": conn.RemoteAddr(),
+		"serverName": name,
+	}).Debug("answering ClientHello for an unserved name with an alert")
+	conn.Write(addRecordLayer([]byte{0x02, description}, []byte{0x15}, []byte{0x03, 0x03}))
+	conn.Close()
+	return true
+}
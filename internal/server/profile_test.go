@@ -0,0 +1,307 @@
+package server
+
+import (
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProfileSelector_Select(t *testing.T) {
+	selector := &ProfileSelector{
+		Profiles: []ServerProfile{{CipherSuite: 0x1301}, {CipherSuite: 0x1302}, {CipherSuite: 0x1303}, {CipherSuite: 0xc030}},
+		Seed:     []byte("seed"),
+	}
+
+	t.Run("same UID same profile", func(t *testing.T) {
+		UID := make([]byte, 16)
+		common.CryptoRandRead(UID)
+		first := selector.Select(UID)
+		for i := 0; i < 10; i++ {
+			if profile := selector.Select(UID); profile.CipherSuite != first.CipherSuite {
+				t.Fatalf("UID got profile %v, then %v", first, profile)
+			}
+		}
+		copied := &ProfileSelector{Profiles: selector.Profiles, Seed: []byte("seed")}
+		if profile := copied.Select(UID); profile.CipherSuite != first.CipherSuite {
+			t.Errorf("selector with the same seed gave profile %v instead of %v", profile, first)
+		}
+	})
+
+	t.Run("different UIDs different profiles", func(t *testing.T) {
+		seen := make(map[uint16]bool)
+		for i := 0; i < 100; i++ {
+			UID := make([]byte, 16)
+			common.CryptoRandRead(UID)
+			seen[selector.Select(UID).CipherSuite] = true
+		}
+		if len(seen) != len(selector.Profiles) {
+			t.Errorf("only %v out of %v profiles are selected for 100 users", len(seen), len(selector.Profiles))
+		}
+	})
+}
+
+func TestState_ServerProfile(t *testing.T) {
+	UID := make([]byte, 16)
+	sta := &State{}
+	if sta.serverProfile(UID).CipherSuite != DefaultServerProfile.CipherSuite {
+		t.Error("DefaultServerProfile isn't used when nothing is set")
+	}
+	sta.Profile = &ServerProfile{CipherSuite: 0x1301}
+	if sta.serverProfile(UID).CipherSuite != 0x1301 {
+		t.Error("Profile isn't used")
+	}
+	sta.ProfileSelector = &ProfileSelector{Profiles: []ServerProfile{{CipherSuite: 0x1302}}}
+	if sta.serverProfile(UID).CipherSuite != 0x1302 {
+		t.Error("ProfileSelector doesn't take precedence over Profile")
+	}
+}
+
+// recordingConn records what is done to it when it's closed
+type recordingConn struct {
+	net.Conn
+	written []byte
+	linger  *int
+	closed  bool
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+func (c *recordingConn) SetLinger(sec int) error {
+	c.linger = &sec
+	return nil
+}
+
+func (c *recordingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCloseStrategy(t *testing.T) {
+	t.Run("FIN", func(t *testing.T) {
+		conn := &recordingConn{}
+		CloseFIN.close(conn)
+		assert.True(t, conn.closed)
+		assert.Nil(t, conn.linger)
+		assert.Empty(t, conn.written)
+	})
+	t.Run("RST", func(t *testing.T) {
+		conn := &recordingConn{}
+		CloseRST.close(conn)
+		assert.True(t, conn.closed)
+		if assert.NotNil(t, conn.linger) {
+			assert.Equal(t, 0, *conn.linger)
+		}
+		assert.Empty(t, conn.written)
+	})
+	t.Run("close_notify", func(t *testing.T) {
+		conn := &recordingConn{}
+		CloseNotify.close(conn)
+		assert.True(t, conn.closed)
+		assert.Nil(t, conn.linger)
+		assert.Equal(t, []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x01, 0x00}, conn.written)
+	})
+	t.Run("from profile", func(t *testing.T) {
+		conn := &recordingConn{}
+		sta := &State{Profile: &ServerProfile{FallbackClose: CloseRST}}
+		sta.closeFallbackConn(conn)
+		assert.True(t, conn.closed)
+		assert.NotNil(t, conn.linger)
+	})
+}
+
+func TestCloseStrategy_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, c := range []struct {
+		name     string
+		strategy CloseStrategy
+		expRead  []byte
+		expReset bool
+	}{
+		{"FIN", CloseFIN, []byte{}, false},
+		{"RST", CloseRST, []byte{}, true},
+		{"close_notify", CloseNotify, closeNotifyAlert, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			server, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.strategy.close(server)
+
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			read, err := ioutil.ReadAll(client)
+			assert.Equal(t, c.expRead, read)
+			if c.expReset {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDispatchConnection_SNIMismatchAlert(t *testing.T) {
+	dispatch := func(t *testing.T, profile *ServerProfile, serverName string) (local net.Conn, redirListener *connutil.PipeListener) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.Profile = profile
+		sni := append([]byte{0x00, byte(len(serverName) + 3), 0x00, 0x00, byte(len(serverName))}, serverName...)
+		first := newTestClientHello().withExtension([2]byte{0x00, 0x00}, sni).marshal()
+		// the alert is written just before the connection is closed, so it must be read synchronously
+		local, remote := net.Pipe()
+		go dispatchConnection(remote, sta)
+		go local.Write(first)
+		return local, redirListener
+	}
+	expectRedirected := func(t *testing.T, redirListener *connutil.PipeListener) {
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirConn.Close()
+	}
+
+	t.Run("mismatching SNI", func(t *testing.T) {
+		for alert, description := range map[SNIAlert]byte{SNIAlertUnrecognizedName: 112, SNIAlertHandshakeFailure: 40} {
+			profile := &ServerProfile{ServerNames: []string{"example.com"}, SNIMismatchAlert: alert}
+			local, _ := dispatch(t, profile, "example.org")
+			local.SetReadDeadline(time.Now().Add(time.Second))
+			reply := make([]byte, 7)
+			_, err := io.ReadFull(local, reply)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, description}, reply, string(alert))
+			_, err = local.Read(make([]byte, 1))
+			assert.Equal(t, io.EOF, err, "connection isn't closed after the alert")
+		}
+	})
+	t.Run("matching SNI", func(t *testing.T) {
+		profile := &ServerProfile{ServerNames: []string{"example.com"}, SNIMismatchAlert: SNIAlertHandshakeFailure}
+		local, redirListener := dispatch(t, profile, "Example.COM")
+		expectRedirected(t, redirListener)
+		local.Close()
+	})
+	t.Run("no alert configured", func(t *testing.T) {
+		profile := &ServerProfile{ServerNames: []string{"example.com"}}
+		local, redirListener := dispatch(t, profile, "example.org")
+		expectRedirected(t, redirListener)
+		local.Close()
+	})
+}
+
+func TestServerProfile_ReplyExtensions(t *testing.T) {
+	profile := ServerProfile{ALPN: []string{"h2", "http/1.1"}, SessionTickets: true, SCTs: true}
+	alpn := append([]byte{0x00, 0x0c, 0x02}, "h2"...)
+	alpn = append(append(alpn, 0x08), "http/1.1"...)
+	offersAll, err := parseClientHello(newTestClientHello().
+		withExtension([2]byte{0x00, 0x10}, alpn).
+		withExtension([2]byte{0x00, 0x23}, nil).
+		withExtension([2]byte{0x00, 0x12}, nil).marshal(), DefaultParseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offersNone, _ := parseClientHello(newTestClientHello().marshal(), DefaultParseOptions)
+
+	t.Run("all offered", func(t *testing.T) {
+		exts, dropped := profile.replyExtensions(offersAll)
+		assert.Equal(t, replyExtensions{sessionTicket: true, sct: true, alpn: "h2"}, exts)
+		assert.Empty(t, dropped)
+	})
+	t.Run("none offered", func(t *testing.T) {
+		exts, dropped := profile.replyExtensions(offersNone)
+		assert.Equal(t, replyExtensions{}, exts)
+		assert.Equal(t, []string{"session_ticket", "signed_certificate_timestamp", "application_layer_protocol_negotiation"}, dropped)
+	})
+	t.Run("not configured", func(t *testing.T) {
+		exts, dropped := DefaultServerProfile.replyExtensions(offersNone)
+		assert.Equal(t, replyExtensions{}, exts)
+		assert.Empty(t, dropped, "extensions the profile doesn't have aren't dropped")
+	})
+	t.Run("certificate compression", func(t *testing.T) {
+		profile := ServerProfile{CertCompression: &CertCompression{Algorithms: []uint16{2}}}
+		brotli, _ := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x1b}, []byte{0x02, 0x00, 0x02}).marshal(), DefaultParseOptions)
+		exts, dropped := profile.replyExtensions(brotli)
+		assert.True(t, exts.certCompression)
+		assert.Empty(t, dropped)
+
+		exts, dropped = profile.replyExtensions(offersNone)
+		assert.False(t, exts.certCompression)
+		assert.Equal(t, []string{"compress_certificate"}, dropped)
+	})
+	t.Run("delegated credential", func(t *testing.T) {
+		profile := ServerProfile{DelegatedCredential: &DelegatedCredential{SignatureScheme: 0x0403}}
+		ecdsa, _ := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x22}, []byte{0x00, 0x02, 0x04, 0x03}).marshal(), DefaultParseOptions)
+		exts, dropped := profile.replyExtensions(ecdsa)
+		assert.True(t, exts.delegatedCredential)
+		assert.Empty(t, dropped)
+
+		ed25519, _ := parseClientHello(newTestClientHello().withExtension([2]byte{0x00, 0x22}, []byte{0x00, 0x02, 0x08, 0x07}).marshal(), DefaultParseOptions)
+		exts, _ = profile.replyExtensions(ed25519)
+		assert.False(t, exts.delegatedCredential, "a credential is sent with a scheme the client doesn't accept")
+
+		exts, dropped = profile.replyExtensions(offersNone)
+		assert.False(t, exts.delegatedCredential)
+		assert.Equal(t, []string{"delegated_credentials"}, dropped)
+	})
+	t.Run("no protocol in common", func(t *testing.T) {
+		exts, dropped := ServerProfile{ALPN: []string{"spdy/3"}}.replyExtensions(offersAll)
+		assert.Equal(t, "", exts.alpn)
+		assert.Empty(t, dropped)
+	})
+}
+
+func TestServerProfile_SelectALPN(t *testing.T) {
+	offered := []string{"http/1.1", "h2"}
+	server := ServerProfile{ALPN: []string{"h2", "http/1.1"}}
+	assert.Equal(t, "h2", server.selectALPN(offered))
+	client := ServerProfile{ALPN: []string{"h2", "http/1.1"}, ALPNPreference: ALPNClientPreference}
+	assert.Equal(t, "http/1.1", client.selectALPN(offered))
+
+	// the client's first choice is skipped if the server doesn't support it
+	client.ALPN = []string{"h2"}
+	assert.Equal(t, "h2", client.selectALPN(offered))
+	for _, profile := range []ServerProfile{server, client} {
+		profile.ALPN = []string{"h3"}
+		assert.Equal(t, "", profile.selectALPN(offered))
+		assert.Equal(t, "", profile.selectALPN(nil))
+	}
+}
+
+func TestServerProfile_WithDelegatedCredential(t *testing.T) {
+	dc := &DelegatedCredential{SignatureScheme: 0x0403}
+	assert.Equal(t, 4+4+2+3+91+2+2+72, dc.extensionLength())
+	assert.Equal(t, 4+4+2+3+44+2+2+64, DelegatedCredential{PublicKeyLength: 44, SignatureLength: 64}.extensionLength())
+
+	t.Run("single record", func(t *testing.T) {
+		profile, certLength := ServerProfile{DelegatedCredential: dc}.withDelegatedCredential(2000)
+		assert.Equal(t, 2000+dc.extensionLength(), certLength)
+		assert.Empty(t, profile.FlightLengths)
+	})
+	t.Run("lengthens the Certificate", func(t *testing.T) {
+		flightLengths := []int{40, 2600, 264}
+		profile, _ := ServerProfile{FlightLengths: flightLengths, DelegatedCredential: dc}.withDelegatedCredential(0)
+		assert.Equal(t, []int{40, 2600 + dc.extensionLength(), 264}, profile.FlightLengths)
+		assert.Equal(t, []int{40, 2600, 264}, flightLengths, "FlightLengths of the profile are changed")
+	})
+	t.Run("own flight lengths", func(t *testing.T) {
+		withLengths := &DelegatedCredential{SignatureScheme: 0x0403, FlightLengths: []int{40, 2800, 80}}
+		profile, _ := ServerProfile{FlightLengths: []int{40, 2600, 264}, DelegatedCredential: withLengths}.withDelegatedCredential(0)
+		assert.Equal(t, []int{40, 2800, 80}, profile.FlightLengths)
+	})
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// connectionCap limits the number of concurrent connections to a proxy server
+type connectionCap struct {
+	max     int32
+	current int32
+}
+
+// acquire takes up one of the connections if the cap hasn't been reached. The returned release function must be
+// called once the connection is closed. It's safe to call it more than once
+func (c *connectionCap) acquire() (release func(), ok bool) {
+	if atomic.AddInt32(&c.current, 1) > c.max {
+		atomic.AddInt32(&c.current, -1)
+		return nil, false
+	}
+	var once sync.Once
+	return func() { once.Do(func() { atomic.AddInt32(&c.current, -1) }) }, true
+}
+
+// acquireProxyConnection takes up one of the connections to the proxy server of proxyMethod for a stream of UID, if
+// it has a cap
+func (sta *State) acquireProxyConnection(proxyMethod string, UID []byte) (release func(), ok bool) {
+	c, capped := sta.proxyCaps[proxyMethod]
+	if !capped {
+		return func() {}, true
+	}
+	release, ok = c.acquire()
+	if !ok {
+		sta.emitSecurityEvent(SecurityEventProxyCapped, nil, UID, proxyMethod)
+	}
+	return
+}
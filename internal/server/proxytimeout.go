@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// parseProxyStreamTimeouts checks that each proxy method is in proxyBook and its timeout, in seconds, is positive
+func parseProxyStreamTimeouts(timeouts map[string]int, proxyBook map[string]net.Addr) (map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration)
+	for name, seconds := range timeouts {
+		name = strings.ToLower(name)
+		if _, ok := proxyBook[name]; !ok {
+			return nil, fmt.Errorf("stream timeout given for %v, which isn't in ProxyBook", name)
+		}
+		if seconds <= 0 {
+			return nil, fmt.Errorf("invalid stream timeout for %v: %v", name, seconds)
+		}
+		parsed[name] = time.Duration(seconds) * time.Second
+	}
+	return parsed, nil
+}
+
+// streamTimeout is how long a stream relayed to the proxy server of proxyMethod may have nothing to send before it's
+// closed. That's its entry in ProxyStreamTimeouts if it has one, or Timeout otherwise
+func (sta *State) streamTimeout(proxyMethod string) time.Duration {
+	if timeout, ok := sta.ProxyStreamTimeouts[proxyMethod]; ok {
+		return timeout
+	}
+	return sta.Timeout
+}
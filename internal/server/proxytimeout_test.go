@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProxyStreamTimeouts(t *testing.T) {
+	proxyBook := map[string]net.Addr{
+		"shadowsocks": &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8388},
+		"openvpn":     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1194},
+	}
+	timeouts, err := parseProxyStreamTimeouts(map[string]int{"Shadowsocks": 60}, proxyBook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]time.Duration{"shadowsocks": time.Minute}, timeouts)
+
+	_, err = parseProxyStreamTimeouts(map[string]int{"tor": 60}, proxyBook)
+	assert.Error(t, err)
+	_, err = parseProxyStreamTimeouts(map[string]int{"openvpn": 0}, proxyBook)
+	assert.Error(t, err)
+}
+
+func TestState_StreamTimeout(t *testing.T) {
+	sta := &State{
+		Timeout:             300 * time.Second,
+		ProxyStreamTimeouts: map[string]time.Duration{"openvpn": 30 * time.Second, "backup": 10 * time.Second},
+		ProxyFallbacks:      map[string]string{"shadowsocks": "backup"},
+		ProxyBook:           testProxyBook("openvpn", "shadowsocks", "backup"),
+	}
+	assert.Equal(t, 30*time.Second, sta.streamTimeout("openvpn"))
+	assert.Equal(t, 300*time.Second, sta.streamTimeout("shadowsocks"), "a proxy method without its own timeout uses Timeout")
+
+	// the timeout is that of the proxy method the stream is relayed to
+	sta.ProxyHealth = MakeProxyHealth(time.Second)
+	sta.ProxyHealth.set(sta.ProxyBook["shadowsocks"].String(), false)
+	assert.Equal(t, 10*time.Second, sta.streamTimeout(sta.resolveProxyMethod("shadowsocks", nil)))
+}
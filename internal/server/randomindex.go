@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRandomIndexWindow = replayCacheAgeLimit
+	defaultRandomIndexSize   = 100000
+)
+
+// ErrCrossUIDReplay is a replay of a random which was first used by a different UID. Only a tampered with or
+// misbehaving client would do this, as the random of a genuine ClientHello is never used again
+var ErrCrossUIDReplay = fmt.Errorf("%w of another UID", ErrReplay)
+
+// RandomIndex remembers which UID each recently seen random was used by, so that a random used again by a different
+// UID can be told apart from a plain replay. Randoms are forgotten after Window, and at most MaxSize are remembered,
+// with the least recently used forgotten to make room for a new one
+type RandomIndex struct {
+	Window  time.Duration
+	MaxSize int
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[[32]byte]*list.Element
+}
+
+type randomIndexEntry struct {
+	random   [32]byte
+	UID      []byte
+	lastSeen time.Time
+}
+
+func MakeRandomIndex(window time.Duration, maxSize int) *RandomIndex {
+	return &RandomIndex{
+		Window:  window,
+		MaxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[[32]byte]*list.Element),
+	}
+}
+
+// Use records that random was used by UID at now. If random was used by a different UID within Window, that UID is
+// returned and the record is left as it was
+func (ri *RandomIndex) Use(random [32]byte, UID []byte, now time.Time) (previousUID []byte, crossUID bool) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+	if elem, ok := ri.entries[random]; ok {
+		entry := elem.Value.(*randomIndexEntry)
+		if now.Sub(entry.lastSeen) < ri.Window {
+			ri.lru.MoveToFront(elem)
+			entry.lastSeen = now
+			if !bytes.Equal(entry.UID, UID) {
+				return entry.UID, true
+			}
+			return nil, false
+		}
+		ri.lru.Remove(elem)
+		delete(ri.entries, random)
+	}
+
+	if ri.lru.Len() >= ri.MaxSize {
+		oldest := ri.lru.Back()
+		ri.lru.Remove(oldest)
+		delete(ri.entries, oldest.Value.(*randomIndexEntry).random)
+	}
+	entry := &randomIndexEntry{
+		random:   random,
+		UID:      append([]byte{}, UID...),
+		lastSeen: now,
+	}
+	ri.entries[random] = ri.lru.PushFront(entry)
+	return nil, false
+}
+
+// checkRandomReuse records the UID a random was used by if RandomIndex is set, and logs it if the random was used by a
+// different UID before. ErrCrossUIDReplay is returned if the random is a replay, which is rejected anyway, or if
+// RejectCrossUIDReplays is set
+func (sta *State) checkRandomReuse(random [32]byte, UID []byte, replayed bool) error {
+	if sta.RandomIndex == nil {
+		return nil
+	}
+	previousUID, crossUID := sta.RandomIndex.Use(random, UID, sta.WorldState.Now())
+	if !crossUID {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"UID":         base64.StdEncoding.EncodeToString(UID),
+		"previousUID": base64.StdEncoding.EncodeToString(previousUID),
+	}).Warn("ClientHello random reused by a different UID")
+	if replayed || sta.RejectCrossUIDReplays {
+		return ErrCrossUIDReplay
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandomIndex(t *testing.T) {
+	start := time.Unix(1000, 0)
+	alice := []byte("alicealiceal")
+	bob := []byte("bobbobbobbob")
+	var random [32]byte
+	random[0] = 1
+
+	t.Run("reuse by a different UID", func(t *testing.T) {
+		ri := MakeRandomIndex(time.Hour, 16)
+		_, crossUID := ri.Use(random, alice, start)
+		assert.False(t, crossUID)
+		_, crossUID = ri.Use(random, alice, start.Add(time.Second))
+		assert.False(t, crossUID, "reuse by the same UID")
+		previousUID, crossUID := ri.Use(random, bob, start.Add(2*time.Second))
+		assert.True(t, crossUID)
+		assert.Equal(t, alice, previousUID)
+		// the first user of the random is kept
+		previousUID, crossUID = ri.Use(random, bob, start.Add(3*time.Second))
+		assert.True(t, crossUID)
+		assert.Equal(t, alice, previousUID)
+	})
+	t.Run("forgotten after window", func(t *testing.T) {
+		ri := MakeRandomIndex(time.Hour, 16)
+		ri.Use(random, alice, start)
+		_, crossUID := ri.Use(random, bob, start.Add(2*time.Hour))
+		assert.False(t, crossUID)
+		previousUID, crossUID := ri.Use(random, alice, start.Add(2*time.Hour+time.Second))
+		assert.True(t, crossUID)
+		assert.Equal(t, bob, previousUID)
+	})
+	t.Run("bounded memory", func(t *testing.T) {
+		ri := MakeRandomIndex(time.Hour, 4)
+		ri.Use(random, alice, start)
+		for i := 0; i < 4; i++ {
+			var other [32]byte
+			other[1] = byte(i)
+			ri.Use(other, alice, start)
+		}
+		assert.Equal(t, 4, ri.lru.Len())
+		assert.Len(t, ri.entries, 4)
+		_, crossUID := ri.Use(random, bob, start)
+		assert.False(t, crossUID, "least recently used random isn't evicted")
+	})
+}
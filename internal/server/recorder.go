@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HandshakeRecord holds what was received from a client whose handshake failed
+type HandshakeRecord struct {
+	Time        time.Time
+	RemoteAddr  string
+	Reason      string
+	FirstPacket []byte
+}
+
+// Recorder records failed handshakes for post-mortem debugging. Record must not block
+type Recorder interface {
+	Record(HandshakeRecord)
+}
+
+const recorderQueueSize = 64
+
+// FileRecorder writes HandshakeRecords as lines of JSON to a file. Once the file has reached maxSize, it is moved
+// to path.old and a new file is started, so at most two files of maxSize are kept on disk. If it can't be moved, it is
+// truncated instead.
+// Records are written asynchronously and are dropped if the write queue is full
+type FileRecorder struct {
+	path    string
+	maxSize int64
+
+	file  *os.File
+	size  int64
+	queue chan HandshakeRecord
+	// done is closed once writeLoop has written every queued record and closed the file
+	done chan struct{}
+}
+
+func MakeFileRecorder(path string, maxSize int64) (*FileRecorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	rec := &FileRecorder{
+		path:    path,
+		maxSize: maxSize,
+		file:    file,
+		size:    info.Size(),
+		queue:   make(chan HandshakeRecord, recorderQueueSize),
+		done:    make(chan struct{}),
+	}
+	go rec.writeLoop()
+	return rec, nil
+}
+
+func (rec *FileRecorder) Record(r HandshakeRecord) {
+	select {
+	case rec.queue <- r:
+	default:
+		log.Debug("handshake recorder queue is full, dropping record")
+	}
+}
+
+func (rec *FileRecorder) writeLoop() {
+	for r := range rec.queue {
+		line, err := json.Marshal(r)
+		if err != nil {
+			log.Errorf("failed to marshal handshake record: %v", err)
+			continue
+		}
+		line = append(line, '\n')
+		if rec.file == nil {
+			if err := rec.reopen(); err != nil {
+				log.Errorf("failed to reopen handshake record file, dropping record: %v", err)
+				continue
+			}
+		}
+		if rec.size+int64(len(line)) > rec.maxSize && rec.size > 0 {
+			if err := rec.rotate(); err != nil {
+				log.Errorf("failed to rotate handshake record file, dropping record: %v", err)
+				continue
+			}
+		}
+		n, err := rec.file.Write(line)
+		rec.size += int64(n)
+		if err != nil {
+			log.Errorf("failed to write handshake record: %v", err)
+		}
+	}
+	if rec.file != nil {
+		rec.file.Close()
+	}
+	close(rec.done)
+}
+
+// rotate moves the file to path.old and starts a new one. If it can't be moved, the file is truncated in place so it
+// never outgrows maxSize. rec.file is nil if the new file can't be opened
+func (rec *FileRecorder) rotate() error {
+	rec.file.Close()
+	if err := os.Rename(rec.path, rec.path+".old"); err != nil {
+		log.Errorf("failed to move handshake record file aside, truncating it instead: %v", err)
+	}
+	var err error
+	rec.file, err = os.OpenFile(rec.path, os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	rec.size = 0
+	return err
+}
+
+// reopen opens the file at path to be appended to, in place of one that rotate failed to open. rec.file is nil if
+// it fails
+func (rec *FileRecorder) reopen() error {
+	rec.file = nil
+	file, err := os.OpenFile(rec.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rec.file = file
+	rec.size = info.Size()
+	return nil
+}
+
+// Close stops the recorder and returns once all the queued records are written. Record must not be called after Close
+func (rec *FileRecorder) Close() {
+	close(rec.queue)
+	<-rec.done
+}
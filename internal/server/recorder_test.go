@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readRecords(t *testing.T, path string) []HandshakeRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []HandshakeRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r HandshakeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestFileRecorder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ck_handshake_record")
+	defer os.RemoveAll(dir)
+
+	t.Run("records are written", func(t *testing.T) {
+		path := filepath.Join(dir, "records")
+		rec, err := MakeFileRecorder(path, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := HandshakeRecord{
+			Time:        time.Unix(1565998966, 0).UTC(),
+			RemoteAddr:  "1.2.3.4:5678",
+			Reason:      ErrBadClientHello.Error(),
+			FirstPacket: []byte{0x16, 0x03, 0x01},
+		}
+		rec.Record(r)
+		rec.Close()
+
+		records := readRecords(t, path)
+		if len(records) != 1 {
+			t.Fatalf("expecting 1 record, got %v", len(records))
+		}
+		if !records[0].Time.Equal(r.Time) || records[0].RemoteAddr != r.RemoteAddr ||
+			records[0].Reason != r.Reason || string(records[0].FirstPacket) != string(r.FirstPacket) {
+			t.Errorf("expecting %v, got %v", r, records[0])
+		}
+	})
+
+	t.Run("file size is bounded", func(t *testing.T) {
+		path := filepath.Join(dir, "bounded")
+		const maxSize = 1024
+		rec, err := MakeFileRecorder(path, maxSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			rec.Record(HandshakeRecord{FirstPacket: make([]byte, 100)})
+		}
+		rec.Close()
+
+		for _, p := range []string{path, path + ".old"} {
+			info, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() > maxSize {
+				t.Errorf("%v has size %v over the limit %v", p, info.Size(), maxSize)
+			}
+		}
+	})
+
+	t.Run("file is truncated if it can't be rotated", func(t *testing.T) {
+		path := filepath.Join(dir, "unrotatable")
+		// a directory can't be replaced by a file, so renaming to path.old fails
+		if err := os.Mkdir(path+".old", 0700); err != nil {
+			t.Fatal(err)
+		}
+		const maxSize = 1024
+		rec, err := MakeFileRecorder(path, maxSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const total = 20
+		for i := 0; i < total; i++ {
+			rec.Record(HandshakeRecord{RemoteAddr: strconv.Itoa(i), FirstPacket: make([]byte, 100)})
+		}
+		rec.Close()
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxSize {
+			t.Errorf("%v has size %v over the limit %v", path, info.Size(), maxSize)
+		}
+		records := readRecords(t, path)
+		if len(records) == 0 || records[len(records)-1].RemoteAddr != strconv.Itoa(total-1) {
+			t.Errorf("expecting the last record to be written after failed rotations, got %v", records)
+		}
+	})
+
+	t.Run("Record doesn't block", func(t *testing.T) {
+		path := filepath.Join(dir, "nonblocking")
+		rec, err := MakeFileRecorder(path, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rec.Close()
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < recorderQueueSize*10; i++ {
+				rec.Record(HandshakeRecord{FirstPacket: make([]byte, 1000)})
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("Record blocked")
+		}
+	})
+}
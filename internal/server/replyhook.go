@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// replyRecordingConn keeps what's written to it while recording is set
+type replyRecordingConn struct {
+	net.Conn
+	recording bool
+	reply     []byte
+}
+
+func (c *replyRecordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.recording {
+		c.reply = append(c.reply, b[:n]...)
+	}
+	return n, err
+}
+
+// sampleReply decides whether the handshake reply about to be sent is to be given to OnReply
+func (sta *State) sampleReply() bool {
+	if sta.OnReply == nil {
+		return false
+	}
+	every := uint64(1)
+	if sta.OnReplySampleEvery > 0 {
+		every = uint64(sta.OnReplySampleEvery)
+	}
+	return atomic.AddUint64(&sta.onReplyCount, 1)%every == 0
+}
+
+// reportReply stops recorder recording and gives the handshake at the start of firstPacket and what was recorded to
+// OnReply on a goroutine of its own, unless the last call to OnReply hasn't returned. recorder is nil if the handshake
+// wasn't sampled. The whole of firstPacket is the handshake if handshakeLength isn't known
+func (sta *State) reportReply(firstPacket []byte, handshakeLength int, recorder *replyRecordingConn) {
+	if recorder == nil {
+		return
+	}
+	recorder.recording = false
+	if !atomic.CompareAndSwapInt32(&sta.onReplyBusy, 0, 1) {
+		return
+	}
+	if handshakeLength > 0 {
+		firstPacket = firstPacket[:handshakeLength]
+	}
+	request := append([]byte{}, firstPacket...)
+	go func() {
+		defer atomic.StoreInt32(&sta.onReplyBusy, 0)
+		sta.OnReply(request, recorder.reply)
+	}()
+}
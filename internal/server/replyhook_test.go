@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type sampledReply struct {
+	request, reply []byte
+}
+
+func TestDispatchConnection_OnReply(t *testing.T) {
+	sta, _, _ := makeDispatchTestState(t)
+	replies := make(chan sampledReply, 1)
+	sta.OnReply = func(request []byte, reply []byte) { replies <- sampledReply{request, reply} }
+
+	first, _ := hex.DecodeString(cloakClientHello)
+	local, remote := connutil.AsyncPipe()
+	go dispatchConnection(remote, sta)
+	local.Write(first)
+	records, err := readServerReply(local)
+	if err != nil {
+		t.Fatalf("failed to read server reply: %v", err)
+	}
+	defer local.Close()
+
+	select {
+	case sampled := <-replies:
+		assert.Equal(t, first, sampled.request)
+		assert.Equal(t, bytes.Join(records, nil), sampled.reply)
+	case <-time.After(timeout):
+		t.Fatal("OnReply isn't called")
+	}
+}
+
+func TestState_SampleReply(t *testing.T) {
+	assert.False(t, (&State{}).sampleReply())
+
+	sta := &State{OnReply: func([]byte, []byte) {}, OnReplySampleEvery: 3}
+	sampled := 0
+	for i := 0; i < 9; i++ {
+		if sta.sampleReply() {
+			sampled++
+		}
+	}
+	assert.Equal(t, 3, sampled)
+
+	t.Run("skipped while busy", func(t *testing.T) {
+		release := make(chan struct{})
+		calls := make(chan []byte, 2)
+		sta := &State{OnReply: func(request []byte, reply []byte) {
+			calls <- request
+			<-release
+		}}
+		sta.reportReply([]byte{0x01, 0x02}, 1, &replyRecordingConn{})
+		<-calls
+		sta.reportReply([]byte{0x03}, 0, &replyRecordingConn{})
+		close(release)
+		select {
+		case request := <-calls:
+			t.Errorf("OnReply called with %x while the last call hasn't returned", request)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
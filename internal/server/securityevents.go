@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SecurityEventKind is which protective limit a SecurityEvent is for
+type SecurityEventKind int
+
+const (
+	// SecurityEventBlocklisted is for a connection closed because Blocklist blocks its source IP
+	SecurityEventBlocklisted SecurityEventKind = iota
+	// SecurityEventFlooding is for a connection closed because FloodTracker blocks its source IP
+	SecurityEventFlooding
+	// SecurityEventReplay is for a first packet that has been seen before, from the same UID or another
+	SecurityEventReplay
+	// SecurityEventTarpitted is for a connection held open by Tarpit as likely from a prober
+	SecurityEventTarpitted
+	// SecurityEventTooManyIPs is for a Cloak client whose UID has connected from too many source IPs
+	SecurityEventTooManyIPs
+	// SecurityEventProxyCapped is for a stream closed because its proxy server has too many connections already
+	SecurityEventProxyCapped
+)
+
+func (k SecurityEventKind) String() string {
+	switch k {
+	case SecurityEventBlocklisted:
+		return "blocklisted"
+	case SecurityEventFlooding:
+		return "flooding"
+	case SecurityEventReplay:
+		return "replay"
+	case SecurityEventTarpitted:
+		return "tarpitted"
+	case SecurityEventTooManyIPs:
+		return "too many IPs"
+	case SecurityEventProxyCapped:
+		return "proxy capped"
+	default:
+		return "unknown"
+	}
+}
+
+// SecurityEvent is a protective limit being triggered by a connection
+type SecurityEvent struct {
+	Time time.Time
+	Kind SecurityEventKind
+	// RemoteIP is the source IP of the connection, or empty for a stream
+	RemoteIP string
+	// UID is that of the Cloak client, or nil if the limit triggered before it was known
+	UID []byte
+	// Detail is what triggered it, such as the error of a replayed first packet
+	Detail string
+}
+
+// SecurityEventSink is given the SecurityEvents of a server for alerting. Emit is called on the goroutine of the
+// connection that triggered the limit, so it must not block. SecurityEventChannel is a sink which never does
+type SecurityEventSink interface {
+	Emit(event SecurityEvent)
+}
+
+// SecurityEventChannel is a SecurityEventSink that sends events to Events, which should be buffered. If it's full, the
+// event is dropped and counted in Dropped
+type SecurityEventChannel struct {
+	Events  chan SecurityEvent
+	dropped uint32
+}
+
+// MakeSecurityEventChannel makes a SecurityEventChannel buffering up to size events
+func MakeSecurityEventChannel(size int) *SecurityEventChannel {
+	return &SecurityEventChannel{Events: make(chan SecurityEvent, size)}
+}
+
+func (c *SecurityEventChannel) Emit(event SecurityEvent) {
+	select {
+	case c.Events <- event:
+	default:
+		atomic.AddUint32(&c.dropped, 1)
+	}
+}
+
+// Dropped is the number of events dropped because Events was full
+func (c *SecurityEventChannel) Dropped() uint32 {
+	return atomic.LoadUint32(&c.dropped)
+}
+
+// emitSecurityEvent gives the event of kind triggered by conn, which is nil for a stream, to SecurityEvents if it's
+// set
+func (sta *State) emitSecurityEvent(kind SecurityEventKind, conn net.Conn, UID []byte, detail string) {
+	if sta.SecurityEvents == nil {
+		return
+	}
+	event := SecurityEvent{
+		Time:   sta.WorldState.Now(),
+		Kind:   kind,
+		UID:    UID,
+		Detail: detail,
+	}
+	if conn != nil {
+		event.RemoteIP = sourceIP(conn)
+	}
+	sta.SecurityEvents.Emit(event)
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// nextSecurityEvent waits for the next event sent to events
+func nextSecurityEvent(t *testing.T, events *SecurityEventChannel) SecurityEvent {
+	select {
+	case event := <-events.Events:
+		return event
+	case <-time.After(timeout):
+		t.Fatal("no security event")
+		return SecurityEvent{}
+	}
+}
+
+func TestSecurityEventChannel_Full(t *testing.T) {
+	events := MakeSecurityEventChannel(1)
+	sta := &State{SecurityEvents: events, WorldState: common.WorldOfTime(cloakClientHelloTime)}
+	sta.emitSecurityEvent(SecurityEventReplay, nil, nil, "")
+	done := make(chan struct{})
+	go func() {
+		sta.emitSecurityEvent(SecurityEventReplay, nil, nil, "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("emitting to a full channel blocks")
+	}
+	assert.Equal(t, uint32(1), events.Dropped())
+	assert.Len(t, events.Events, 1)
+}
+
+func TestDispatchConnection_SecurityEvents(t *testing.T) {
+	cloakBytes, _ := hex.DecodeString(cloakClientHello)
+
+	t.Run("blocklisted", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		events := MakeSecurityEventChannel(4)
+		sta.SecurityEvents = events
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		blocklist := MakeMemoryBlocklist()
+		blocklist.Block(sourceIP(remote), time.Time{})
+		sta.Blocklist = blocklist
+		go dispatchConnection(remote, sta)
+
+		event := nextSecurityEvent(t, events)
+		assert.Equal(t, SecurityEventBlocklisted, event.Kind)
+		assert.Equal(t, sourceIP(remote), event.RemoteIP)
+		assert.Equal(t, sta.WorldState.Now(), event.Time)
+	})
+
+	t.Run("flooding", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		events := MakeSecurityEventChannel(4)
+		sta.SecurityEvents = events
+		sta.FloodTracker = MakeFloodTracker(1, time.Minute, 10*time.Minute, 16)
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		sta.FloodTracker.Failed(sourceIP(remote), sta.WorldState.Now())
+		go dispatchConnection(remote, sta)
+
+		assert.Equal(t, SecurityEventFlooding, nextSecurityEvent(t, events).Kind)
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		events := MakeSecurityEventChannel(4)
+		sta.SecurityEvents = events
+		go func() {
+			for {
+				conn, err := redirListener.Accept()
+				if err != nil {
+					return
+				}
+				go io.Copy(ioutil.Discard, conn)
+			}
+		}()
+		for i := 0; i < 2; i++ {
+			local, remote := connutil.AsyncPipe()
+			defer local.Close()
+			go dispatchConnection(remote, sta)
+			local.Write(cloakBytes)
+			if i == 0 {
+				_, err := readServerReply(local)
+				assert.NoError(t, err)
+				select {
+				case event := <-events.Events:
+					t.Fatalf("security event %v for the first handshake", event.Kind)
+				default:
+				}
+			}
+		}
+
+		event := nextSecurityEvent(t, events)
+		assert.Equal(t, SecurityEventReplay, event.Kind)
+		assert.Equal(t, ErrReplay.Error(), event.Detail)
+	})
+
+	t.Run("tarpitted", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		events := MakeSecurityEventChannel(4)
+		sta.SecurityEvents = events
+		sta.Tarpit = &TarpitConfig{MinProbeScore: probeScoreFailedCheck, Interval: 10 * time.Millisecond, MaxDuration: 100 * time.Millisecond, MaxConcurrent: 4}
+		tch := newTestClientHello()
+		tch.extensions = nil
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(tch.marshal())
+
+		event := nextSecurityEvent(t, events)
+		assert.Equal(t, SecurityEventTarpitted, event.Kind)
+		assert.Contains(t, event.Detail, "probe score")
+		local.Close()
+		waitForTarpits(t)
+	})
+
+	t.Run("too many IPs", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		events := MakeSecurityEventChannel(4)
+		sta.SecurityEvents = events
+		sta.UIDIPTracker = MakeUIDIPTracker(1, 10*time.Minute)
+		sta.UIDIPTracker.Seen(cloakClientHelloUID, "10.0.0.1", sta.WorldState.Now())
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(cloakBytes)
+
+		event := nextSecurityEvent(t, events)
+		assert.Equal(t, SecurityEventTooManyIPs, event.Kind)
+		assert.Equal(t, cloakClientHelloUID, event.UID)
+		assert.Equal(t, "2 IPs", event.Detail)
+	})
+}
+
+func TestAcquireProxyConnection_SecurityEvent(t *testing.T) {
+	events := MakeSecurityEventChannel(4)
+	sta := &State{
+		SecurityEvents: events,
+		WorldState:     common.WorldOfTime(cloakClientHelloTime),
+		proxyCaps:      map[string]*connectionCap{"shadowsocks": {max: 1}},
+	}
+	UID := []byte("0123456789abcdef")
+	if _, ok := sta.acquireProxyConnection("shadowsocks", UID); !ok {
+		t.Fatal("first connection should be allowed")
+	}
+	assert.Len(t, events.Events, 0)
+	if _, ok := sta.acquireProxyConnection("shadowsocks", UID); ok {
+		t.Fatal("second connection should be rejected")
+	}
+	event := nextSecurityEvent(t, events)
+	assert.Equal(t, SecurityEventProxyCapped, event.Kind)
+	assert.Equal(t, UID, event.UID)
+	assert.Equal(t, "shadowsocks", event.Detail)
+	assert.Equal(t, "", event.RemoteIP)
+}
+
+func TestSecurityEventKind_String(t *testing.T) {
+	for kind := SecurityEventBlocklisted; kind <= SecurityEventProxyCapped; kind++ {
+		assert.NotEqual(t, "unknown", kind.String(), "kind %d", kind)
+	}
+	assert.Equal(t, "unknown", SecurityEventKind(-1).String())
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"net"
+	"time"
+)
+
+const maxTLSRecordLength = 1<<14 + 256
+
+var ErrMalformedReply = errors.New("malformed handshake reply")
+
+// SelfTest makes the handshake reply to a representative Cloak ClientHello and checks it with a strict parser.
+// This catches any length field in the reply going out of step with what it describes, which a real TLS client would
+// reject but the more permissive Cloak client would not
+func (sta *State) SelfTest() error {
+	for _, profile := range sta.serverProfiles() {
+		err := selfTest(profile)
+		if err != nil {
+			return fmt.Errorf("profile with cipher suite %#04x: %w", profile.CipherSuite, err)
+		}
+	}
+	return nil
+}
+
+func selfTest(profile ServerProfile) error {
+	sessionId := make([]byte, 32)
+	common.CryptoRandRead(sessionId)
+	var sharedSecret, sessionKey [32]byte
+	common.CryptoRandRead(sharedSecret[:])
+	common.CryptoRandRead(sessionKey[:])
+
+	ch := minimalClientHello(sessionId)
+	cipherSuite, err := profile.negotiateCipherSuite(ch)
+	if err != nil {
+		return err
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	respond := TLS{}.makeResponder(ch, sharedSecret)
+	respondErr := make(chan error, 1)
+	go func() {
+		composer := TLSReplyComposer{Profile: profile, Rand: common.RealWorldState.Rand}
+		_, err := respond(serverSide, sessionKey, common.RealWorldState.Rand, composer)
+		serverSide.Close()
+		respondErr <- err
+	}()
+
+	if profile.AwaitClientFinished {
+		// written as soon as the server reads it, which it does once it has sent ServerHelloDone
+		go clientSide.Write(minimalClientFlight())
+	}
+	clientSide.SetReadDeadline(time.Now().Add(5 * time.Second))
+	negotiated := profile
+	negotiated.CipherSuite = cipherSuite
+	err = checkServerReply(clientSide, sessionId, negotiated)
+	if err != nil {
+		return err
+	}
+	return <-respondErr
+}
+
+// minimalClientHello is a ClientHello with only what a handshake reply needs from it: sessionId, the TLS 1.3 cipher
+// suites followed by the TLS 1.2 ECDHE ones, and a key_share of x25519, as a Cloak client always sends
+func minimalClientHello(sessionId []byte) *ClientHello {
+	keyShare := []byte{0x00, 0x24, x25519Group[0], x25519Group[1], 0x00, 0x20}
+	return &ClientHello{
+		sessionId:    sessionId,
+		cipherSuites: []byte{0x13, 0x01, 0x13, 0x02, 0x13, 0x03, 0xc0, 0x2b, 0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30},
+		extensions:   map[[2]byte][]byte{{0x00, 0x33}: append(keyShare, make([]byte, 32)...)},
+	}
+}
+
+// minimalClientFlight is the ClientKeyExchange, ChangeCipherSpec and Finished of a TLS 1.2 client, with nothing in
+// them but their lengths
+func minimalClientFlight() []byte {
+	TLS12 := []byte{0x03, 0x03}
+	clientKeyExchange := append([]byte{0x10, 0x00, 0x00, 0x21, 0x20}, make([]byte, 32)...)
+	flight := addRecordLayer(clientKeyExchange, []byte{0x16}, TLS12)
+	flight = append(flight, addRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)...)
+	return append(flight, addRecordLayer(make([]byte, 40), []byte{0x16}, TLS12)...)
+}
+
+// readRecord reads one TLS record of type typ and returns its payload
+func readRecord(r io.Reader, typ byte) ([]byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record header: %v", err)
+	}
+	if header[0] != typ {
+		return nil, fmt.Errorf("%w: record type %#x, expecting %#x", ErrMalformedReply, header[0], typ)
+	}
+	if !bytes.Equal(header[1:3], []byte{0x03, 0x03}) {
+		return nil, fmt.Errorf("%w: record version %x", ErrMalformedReply, header[1:3])
+	}
+	length := int(u16(header[3:5]))
+	if length == 0 || length > maxTLSRecordLength {
+		return nil, fmt.Errorf("%w: record length %v", ErrMalformedReply, length)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record payload: %v", err)
+	}
+	return payload, nil
+}
+
+// checkServerHello checks that every length field in a ServerHello handshake message matches what follows it, and
+// that the fields a TLS 1.3 client would check are what they should be
+func checkServerHello(sh []byte, clientSessionId []byte, profile ServerProfile) error {
+	malformed := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%w: ServerHello %v", ErrMalformedReply, fmt.Sprintf(format, a...))
+	}
+
+	if len(sh) < 4 || sh[0] != 0x02 {
+		return malformed("has the wrong handshake type")
+	}
+	if length := int(sh[1])<<16 | int(sh[2])<<8 | int(sh[3]); length != len(sh)-4 {
+		return malformed("length %v, but %v bytes follow", length, len(sh)-4)
+	}
+	if profile.TLS12ServerHello {
+		return check12ServerHello(sh[4:], profile)
+	}
+	body := sh[4:]
+	// version 2, random 32, session id length 1
+	if len(body) < 35 {
+		return malformed("is too short")
+	}
+	if !bytes.Equal(body[0:2], []byte{0x03, 0x03}) {
+		return malformed("legacy_version %x", body[0:2])
+	}
+	body = body[34:]
+	sessionIdLen := int(body[0])
+	body = body[1:]
+	// session id, cipher suite 2, compression method 1, extensions length 2
+	if len(body) < sessionIdLen+5 {
+		return malformed("is too short for a session id of length %v", sessionIdLen)
+	}
+	switch profile.SessionIdPolicy {
+	case SessionIdFresh:
+		if sessionIdLen != freshSessionIdLength {
+			return malformed("has a fresh session id of length %v", sessionIdLen)
+		}
+	default:
+		if !bytes.Equal(body[:sessionIdLen], clientSessionId) {
+			return malformed("doesn't echo the session id")
+		}
+	}
+	body = body[sessionIdLen:]
+	if cipherSuite := u16(body[0:2]); cipherSuite != profile.CipherSuite {
+		return malformed("cipher suite %#04x, expecting %#04x", cipherSuite, profile.CipherSuite)
+	}
+	if body[2] != 0x00 {
+		return malformed("compression method %v", body[2])
+	}
+	extensionsLen := int(u16(body[3:5]))
+	body = body[5:]
+	if extensionsLen != len(body) {
+		return malformed("extensions length %v, but %v bytes follow", extensionsLen, len(body))
+	}
+
+	extensions := make(map[[2]byte][]byte)
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return malformed("has a truncated extension")
+		}
+		var typ [2]byte
+		copy(typ[:], body[0:2])
+		length := int(u16(body[2:4]))
+		if length > len(body)-4 {
+			return malformed("extension %x length %v, but %v bytes follow", typ, length, len(body)-4)
+		}
+		if _, ok := extensions[typ]; ok {
+			return malformed("has duplicate extension %x", typ)
+		}
+		extensions[typ] = body[4 : 4+length]
+		body = body[4+length:]
+	}
+
+	if sv := extensions[[2]byte{0x00, 0x2b}]; !bytes.Equal(sv, []byte{0x03, 0x04}) {
+		return malformed("supported_versions %x", sv)
+	}
+	keyShare := extensions[[2]byte{0x00, 0x33}]
+	if len(keyShare) < 4 {
+		return malformed("key_share %x", keyShare)
+	}
+	var group [2]byte
+	copy(group[:], keyShare[0:2])
+	keyExchangeLength, ok := keyExchangeLengths[group]
+	if !ok || int(u16(keyShare[2:4])) != keyExchangeLength || len(keyShare) != 4+keyExchangeLength {
+		return malformed("key_share %x", keyShare)
+	}
+	return nil
+}
+
+// check12ServerHello checks the body of a TLS 1.2 ServerHello in the same way, and that none of the extensions only a
+// TLS 1.3 ServerHello has are in it
+func check12ServerHello(body []byte, profile ServerProfile) error {
+	malformed := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%w: TLS 1.2 ServerHello %v", ErrMalformedReply, fmt.Sprintf(format, a...))
+	}
+
+	// version 2, random 32, session id 1 + 32, cipher suite 2, compression method 1
+	if len(body) < 70 {
+		return malformed("is too short")
+	}
+	if !bytes.Equal(body[0:2], []byte{0x03, 0x03}) {
+		return malformed("server_version %x", body[0:2])
+	}
+	if sessionIdLen := int(body[34]); sessionIdLen != freshSessionIdLength {
+		return malformed("has a session id of length %v", sessionIdLen)
+	}
+	body = body[35+freshSessionIdLength:]
+	if cipherSuite := u16(body[0:2]); cipherSuite != profile.CipherSuite {
+		return malformed("cipher suite %#04x, expecting %#04x", cipherSuite, profile.CipherSuite)
+	}
+	if equivalent, ok := tls13Equivalents[profile.CipherSuite]; !ok || equivalent == profile.CipherSuite {
+		return malformed("has cipher suite %#04x, which isn't a TLS 1.2 ECDHE one", profile.CipherSuite)
+	}
+	if body[2] != 0x00 {
+		return malformed("compression method %v", body[2])
+	}
+	body = body[3:]
+	// the extensions block may be left out altogether
+	if len(body) == 0 {
+		return nil
+	}
+	if len(body) < 2 || int(u16(body[0:2])) != len(body)-2 {
+		return malformed("has an extensions block of length %v", len(body))
+	}
+	body = body[2:]
+	seen := make(map[[2]byte]bool)
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return malformed("has a truncated extension")
+		}
+		var typ [2]byte
+		copy(typ[:], body[0:2])
+		length := int(u16(body[2:4]))
+		if length > len(body)-4 {
+			return malformed("extension %x length %v, but %v bytes follow", typ, length, len(body)-4)
+		}
+		if seen[typ] {
+			return malformed("has duplicate extension %x", typ)
+		}
+		if typ == [2]byte{0x00, 0x2b} || typ == [2]byte{0x00, 0x33} {
+			return malformed("has TLS 1.3 extension %x", typ)
+		}
+		seen[typ] = true
+		body = body[4+length:]
+	}
+	return nil
+}
+
+// checkServerReply reads and checks the ServerHello, the TLS12Flight of profile if any, ChangeCipherSpec if the client
+// sent a session id, and ApplicationData records of a reply
+func checkServerReply(r io.Reader, clientSessionId []byte, profile ServerProfile) error {
+	sh, err := readRecord(r, 0x16)
+	if err != nil {
+		return err
+	}
+	err = checkServerHello(sh, clientSessionId, profile)
+	if err != nil {
+		return err
+	}
+
+	if profile.TLS12Flight != nil {
+		// Certificate, ServerKeyExchange and ServerHelloDone
+		for _, msgType := range []byte{0x0b, 0x0c, 0x0e} {
+			message, err := readRecord(r, 0x16)
+			if err != nil {
+				return err
+			}
+			if len(message) < handshakeHeader || message[0] != msgType ||
+				int(message[1])<<16|int(message[2])<<8|int(message[3]) != len(message)-handshakeHeader {
+				return fmt.Errorf("%w: expecting a handshake message of type %v, got %x", ErrMalformedReply, msgType, message)
+			}
+		}
+	}
+
+	// only a client in middlebox compatibility mode, which sends a session id, is sent ChangeCipherSpec
+	if len(clientSessionId) > 0 {
+		ccs, err := readRecord(r, 0x14)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(ccs, []byte{0x01}) {
+			return fmt.Errorf("%w: ChangeCipherSpec %x", ErrMalformedReply, ccs)
+		}
+	}
+
+	if len(profile.FlightLengths) > 0 {
+		for i, length := range profile.flightRecordLengths(0) {
+			record, err := readRecord(r, 0x17)
+			if err != nil {
+				return err
+			}
+			if len(record) != length {
+				return fmt.Errorf("%w: encrypted flight record %v has length %v, expecting %v", ErrMalformedReply, i, len(record), length)
+			}
+		}
+		return nil
+	}
+
+	flight, err := readRecord(r, 0x17)
+	if err != nil {
+		return err
+	}
+	for _, certLength := range possibleCertLengths {
+		if len(flight) == profile.encryptedFlightLength(certLength) {
+			return nil
+		}
+	}
+	for _, bin := range profile.RecordSizeHistogram {
+		if bin.Count > 0 && len(flight) == bin.Length {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: encrypted flight length %v doesn't end with a Finished message", ErrMalformedReply, len(flight))
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"github.com/cbeuw/Cloak/internal/common"
+	"testing"
+)
+
+func TestState_SelfTest(t *testing.T) {
+	for _, profile := range []*ServerProfile{nil, {CipherSuite: 0x1301}, {CipherSuite: 0x1302}, {CipherSuite: 0x1301, FlightLengths: []int{40, 2600, 264}}} {
+		sta := &State{Profile: profile}
+		err := sta.SelfTest()
+		if err != nil {
+			t.Errorf("self test failed for profile %v: %v", profile, err)
+		}
+	}
+}
+
+func TestCheckServerReply(t *testing.T) {
+	sessionId := make([]byte, 32)
+	common.CryptoRandRead(sessionId)
+	cert := make([]byte, DefaultServerProfile.encryptedFlightLength(possibleCertLengths[0]))
+	makeReply := func() []byte {
+		reply, _ := composeReply(serverHelloFields{sessionId: sessionId, keyShareGroup: x25519Group}, nil, true, [][]byte{cert}, DefaultServerProfile, rand.Reader)
+		return reply
+	}
+
+	t.Run("correct", func(t *testing.T) {
+		err := checkServerReply(bytes.NewReader(makeReply()), sessionId, DefaultServerProfile)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	// offsets into the reply: record header 5, handshake header 4, version 2, random 32, session id 1+32,
+	// cipher suite 2, compression 1
+	const extensionsLenOffset = 5 + 4 + 2 + 32 + 1 + 32 + 2 + 1
+	corruptions := []struct {
+		name   string
+		offset int
+	}{
+		{"record length", 4},
+		{"handshake length", 8},
+		{"session id length", 5 + 4 + 2 + 32},
+		{"extensions length", extensionsLenOffset + 1},
+		{"key_share length", extensionsLenOffset + 2 + 3},
+	}
+	for _, c := range corruptions {
+		t.Run(c.name, func(t *testing.T) {
+			reply := makeReply()
+			reply[c.offset]++
+			err := checkServerReply(bytes.NewReader(reply), sessionId, DefaultServerProfile)
+			if err == nil {
+				t.Error("corrupted reply passed")
+			}
+		})
+	}
+
+	t.Run("wrong cipher suite", func(t *testing.T) {
+		err := checkServerReply(bytes.NewReader(makeReply()), sessionId, ServerProfile{CipherSuite: 0x1301})
+		if !errors.Is(err, ErrMalformedReply) {
+			t.Errorf("expecting ErrMalformedReply, got %v", err)
+		}
+	})
+}
+
+func TestState_SelfTest_ProfileSelector(t *testing.T) {
+	sta := &State{ProfileSelector: &ProfileSelector{
+		Profiles: []ServerProfile{{CipherSuite: 0x1301}, {CipherSuite: 0xcca8}},
+	}}
+	err := sta.SelfTest()
+	if err != nil {
+		t.Errorf("self test failed: %v", err)
+	}
+}
@@ -2,15 +2,19 @@ package server
 
 import (
 	"crypto"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"io"
 	"io/ioutil"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,12 +29,99 @@ type RawConfig struct {
 	StreamTimeout int
 	KeepAlive     int
 	CncMode       bool
+
+	HandshakeRecordPath    string
+	HandshakeRecordMaxSize int64
+
+	ServerProfile  *ServerProfile
+	ServerProfiles []ServerProfile
+
+	MinCipherSuites           int
+	CountGREASECipherSuites   bool
+	MinExtensions             int
+	CountGREASEExtensions     bool
+	MaxExtensions             int
+	MaxKeyShares              int
+	RejectDuplicateExtensions bool
+	StrictExtensionsLength    bool
+	RejectSmallOrderKeyShares bool
+	HandshakeBudget           int
+	KeyShareGroups            []uint16
+	DivertOnlySCSV            bool
+	PreferredKeyShareGroups   []uint16
+
+	ReadAhead int
+
+	AcceptWindows []string
+
+	CloakServerNames []string
+
+	ClockSkewTolerance int
+
+	FloodThreshold int
+	FloodWindow    int
+	FloodCooldown  int
+	FloodMaxIPs    int
+
+	Blocklist []string
+
+	ProxyFallbacks           map[string]string
+	ProxyHealthCheckInterval int
+	ProxyUpstreams           map[string][]string
+	ProxyStreamTimeouts      map[string]int
+	ProxyBreakerThreshold    int
+	ProxyBreakerWindow       int
+	ProxyBreakerCooldown     int
+
+	UIDOverrides map[string]UIDPolicy
+
+	UIDIPThreshold int
+	UIDIPWindow    int
+	UIDIPAction    string
+	UIDIPThrottle  int
+
+	TarpitProbeScore int
+	TarpitInterval   int
+	TarpitDuration   int
+	MaxTarpits       int
+
+	CrossUIDReplayCacheSize int
+	CrossUIDReplayWindow    int
+	RejectCrossUIDReplays   bool
+
+	SelfTest bool
+
+	AlwaysHelloRetryRequest bool
+
+	MaintenancePage      string
+	MaintenanceCert      string
+	MaintenanceKey       string
+	MaintenanceStatus    int
+	MaintenanceRecords   int
+	MaintenanceRecordGap int
 }
 
 // State type stores the global state of the program
 type State struct {
 	ProxyBook   map[string]net.Addr
 	ProxyDialer common.Dialer
+	// ProxyHealth, if not nil, is consulted before a stream is relayed to a proxy server. The streams of a proxy
+	// method whose proxy server is unhealthy are relayed to the first healthy one down its chain of ProxyFallbacks
+	ProxyHealth    *ProxyHealth
+	ProxyFallbacks map[string]string
+	// ProxyBreaker, if not nil, fails streams of a proxy method whose proxy server keeps refusing connections instead
+	// of connecting to it, until it's tried again after a cooldown. Like with ProxyHealth, they go to a fallback if
+	// there's one available
+	ProxyBreaker *CircuitBreaker
+	// ProxyUpstreams spreads the streams of some proxy methods over several proxy servers, keeping each user on the
+	// same one. The address in ProxyBook is only health checked
+	ProxyUpstreams map[string]*HashRing
+	// ProxyStreamTimeouts override Timeout for the streams relayed to the proxy servers of some proxy methods
+	ProxyStreamTimeouts map[string]time.Duration
+	// UIDOverrides are the policies of UIDs whose clients don't get what they ask for, by UID in base64
+	UIDOverrides map[string]UIDPolicy
+	// proxyCaps limits the number of concurrent connections to some of the proxy servers in ProxyBook
+	proxyCaps map[string]*connectionCap
 
 	WorldState common.WorldState
 	AdminUID   []byte
@@ -49,6 +140,142 @@ type State struct {
 	UsedRandom  map[[32]byte]int64
 
 	Panel *userPanel
+
+	// Recorder, if not nil, is given the first packet of every failed handshake
+	Recorder Recorder
+
+	// Profile is the TLS server mimicked in the handshake reply. DefaultServerProfile is used if it's nil
+	Profile *ServerProfile
+	// ProfileSelector, if not nil, picks the TLS server mimicked in the handshake reply to each user instead of Profile
+	ProfileSelector *ProfileSelector
+	// ReplyComposer, if not nil, composes the handshake reply on the TLS transport instead of a TLSReplyComposer of
+	// the server profile
+	ReplyComposer ReplyComposer
+	// FillerRand, if not nil, provides the bytes of the handshake reply that only have to look random. See
+	// TLSReplyComposer.FillerRand. InitState sets it to ChaCha20 keystreams seeded from WorldState.Rand
+	FillerRand io.Reader
+	// Authenticate, if not nil, checks the first packet of each connection instead of AuthFirstPacket, such as to try
+	// out a different authentication scheme. Any error it returns has the connection relayed to the redirection server
+	Authenticate func(firstPacket []byte, transport Transport, sta *State) (ClientInfo, Responder, error)
+
+	// ConfigureConn, if not nil, is called with the connection from a Cloak client once the handshake has succeeded.
+	// It can be used to tune socket options, in which case it should type assert the net.Conn to *net.TCPConn
+	ConfigureConn func(net.Conn)
+	// TuneConn, if not nil, sets the TCP of the server profile on the connection from a Cloak client instead of the
+	// options being set on its *net.TCPConn, before ConfigureConn is called. It's only called if TCP is set
+	TuneConn func(net.Conn, TCPTuning) error
+	// ConfigureFallbackConn, if not nil, is called with the connection that is about to be relayed to RedirAddr
+	ConfigureFallbackConn func(net.Conn)
+	// OnFallback, if not nil, is called with the connection that is about to be relayed to RedirAddr and why, before
+	// ConfigureFallbackConn
+	OnFallback func(net.Conn, FallbackReason)
+
+	// MinCipherSuites, if positive, is the least number of cipher suites a ClientHello must offer for it to be
+	// considered coming from a Cloak client. GREASE values are only counted if CountGREASECipherSuites is set
+	MinCipherSuites         int
+	CountGREASECipherSuites bool
+	// MinExtensions, if positive, is the least number of distinct extensions a ClientHello must have for it to be
+	// considered coming from a Cloak client. GREASE values are only counted if CountGREASEExtensions is set
+	MinExtensions         int
+	CountGREASEExtensions bool
+	// MaxExtensions, MaxKeyShares, RejectDuplicateExtensions, StrictExtensionsLength and RejectSmallOrderKeyShares are
+	// the ParseOptions of ClientHellos from supposed Cloak clients. DefaultMaxExtensions and DefaultMaxKeyShares are
+	// used if MaxExtensions and MaxKeyShares aren't positive
+	MaxExtensions             int
+	MaxKeyShares              int
+	RejectDuplicateExtensions bool
+	StrictExtensionsLength    bool
+	RejectSmallOrderKeyShares bool
+	// HandshakeBudget, if positive, is how long a ClientHello may take to be parsed and checked for authentication
+	// before it's given up on and the connection relayed to the redirection server. It guards against ClientHellos
+	// made to be costly to handle
+	HandshakeBudget time.Duration
+	// ReplyWriteTimeout, if positive, is how long the handshake reply may take to be written instead of
+	// replyWriteTimeout. A client that doesn't read its reply, such as by advertising a zero window, has its
+	// connection closed once it's passed
+	ReplyWriteTimeout time.Duration
+	// KeyShareGroups, if not empty, are the named groups one of which must be in the key_share of a ClientHello
+	// for it to be considered coming from a Cloak client
+	KeyShareGroups []uint16
+	// DivertOnlySCSV makes ClientHellos which offer nothing but signalling cipher suite values, such as
+	// TLS_EMPTY_RENEGOTIATION_INFO_SCSV, considered not coming from a Cloak client
+	DivertOnlySCSV bool
+
+	// PreferredKeyShareGroups are the named groups the key_share in the handshake reply may be in, most preferred
+	// first. See TLSReplyComposer.PreferredKeyShareGroups
+	PreferredKeyShareGroups [][2]byte
+
+	// ReadAhead, if positive, is the most bytes sent by a client right after its first packet that are read along
+	// with it. See ClientInfo.EarlyData
+	ReadAhead int
+
+	// ClockSkewTolerance, if positive, is how far the timestamp of a Cloak client may be from our time, instead of
+	// timestampTolerance. The randoms in UsedRandom are kept for at least twice this long, so a larger value holds
+	// more of them in memory. A ClientHello can still be replayed within this long after it's sent if the server
+	// restarts, as the randoms in UsedRandom are lost
+	ClockSkewTolerance time.Duration
+	// AcceptWindows, if not empty, are the only times of day when Cloak handshakes are accepted. At any other time
+	// every connection is relayed to the redirection server
+	AcceptWindows []AcceptWindow
+	// CloakServerNames, if not empty, are the only server names, in lower case, of ClientHellos that are checked for
+	// being from a Cloak client. A ClientHello for any other name, or for none, is relayed to the redirection server
+	// straight away
+	CloakServerNames map[string]struct{}
+
+	// FloodTracker, if not nil, drops connections from source IPs which have sent too many malformed first packets
+	FloodTracker *FloodTracker
+	// Blocklist, if not nil, has connections from the source IPs it blocks closed before anything is read from them
+	Blocklist Blocklist
+	// ProbeClassifier, if not nil, decides what to do with each connection once its ClientHello has been parsed,
+	// before it's checked to be from a Cloak client
+	ProbeClassifier ProbeClassifier
+	// RandomIndex, if not nil, tells apart randoms reused by a different UID from plain replays. Such a reuse is
+	// always logged, and is rejected if it isn't already a replay only when RejectCrossUIDReplays is set
+	RandomIndex           *RandomIndex
+	RejectCrossUIDReplays bool
+
+	// AlwaysHelloRetryRequest is for testing clients only. It has the first ClientHello of every connection answered
+	// with a HelloRetryRequest for x25519, and the ClientHello the client retries with handled as if it were the first
+	// packet. It shows whether a client handles a HelloRetryRequest like the browser it mimics, but a Cloak client
+	// can't, and neither is it how the redirection server would answer
+	AlwaysHelloRetryRequest bool
+
+	// SecurityEvents, if not nil, is given a SecurityEvent whenever a protective limit is triggered, such as a blocked
+	// source IP or a replayed first packet, for alerting
+	SecurityEvents SecurityEventSink
+
+	// HandshakeEvents, if not nil, is sent a HandshakeEvent for every first packet. It should be buffered, as events
+	// are dropped rather than waited on if it's full
+	HandshakeEvents        chan HandshakeEvent
+	droppedHandshakeEvents uint32
+	// PhaseTimer, if not nil, is told how long the parse, authentication and reply phases of every handshake with a
+	// Cloak client took
+	PhaseTimer PhaseTimer
+	// latency is how long the recent successful handshakes took, as given by LatencySnapshot
+	latency latencyTracker
+	// OnReply, if not nil, is called with the handshake of a Cloak client and the exact bytes of the handshake reply
+	// sent to it, such as to compare the reply with captures of the server mimicked. One in every OnReplySampleEvery
+	// successful handshakes is given to it, or every one if that isn't positive. It's called on a goroutine of its
+	// own, and a sampled handshake is skipped if the last call hasn't returned yet
+	OnReply            func(request []byte, reply []byte)
+	OnReplySampleEvery int
+	onReplyCount       uint64
+	onReplyBusy        int32
+
+	// Tarpit, if not nil, makes connections likely from probers held open instead of relayed to the redirection server
+	Tarpit *TarpitConfig
+
+	// UIDIPTracker, if not nil, warns of UIDs connecting from too many source IPs, whose connections are then dealt
+	// with by UIDIPAction. UIDIPThrottle is how long each is held if that's UIDIPThrottle
+	UIDIPTracker  *UIDIPTracker
+	UIDIPAction   UIDIPAction
+	UIDIPThrottle time.Duration
+
+	// MaintenancePage, if not nil, answers connections not from a Cloak client itself instead of them being relayed
+	// to the redirection server
+	MaintenancePage *MaintenancePage
+
+	draining int32
 }
 
 func parseRedirAddr(redirAddr string) (net.Addr, string, error) {
@@ -83,32 +310,76 @@ func parseRedirAddr(redirAddr string) (net.Addr, string, error) {
 	return redirHost, port, nil
 }
 
-func parseProxyBook(bookEntries map[string][]string) (map[string]net.Addr, error) {
+// parseProxyBook parses the network and address of each proxy method, as well as the optional third item in an entry,
+// which is the maximum number of concurrent connections to that proxy server
+func parseProxyBook(bookEntries map[string][]string) (map[string]net.Addr, map[string]*connectionCap, error) {
 	proxyBook := map[string]net.Addr{}
+	proxyCaps := map[string]*connectionCap{}
 	for name, pair := range bookEntries {
 		name = strings.ToLower(name)
-		if len(pair) != 2 {
-			return nil, fmt.Errorf("invalid proxy endpoint and address pair for %v: %v", name, pair)
+		if len(pair) != 2 && len(pair) != 3 {
+			return nil, nil, fmt.Errorf("invalid proxy endpoint and address pair for %v: %v", name, pair)
+		}
+		if len(pair) == 3 {
+			max, err := strconv.Atoi(pair[2])
+			if err != nil || max <= 0 {
+				return nil, nil, fmt.Errorf("invalid maximum number of connections for %v: %v", name, pair[2])
+			}
+			proxyCaps[name] = &connectionCap{max: int32(max)}
 		}
 		network := strings.ToLower(pair[0])
 		switch network {
-		case "tcp":
-			addr, err := net.ResolveTCPAddr("tcp", pair[1])
-			if err != nil {
-				return nil, err
-			}
-			proxyBook[name] = addr
-			continue
-		case "udp":
-			addr, err := net.ResolveUDPAddr("udp", pair[1])
+		case "tcp", "udp", "unix":
+			addr, err := parseProxyAddr(network, pair[1])
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			proxyBook[name] = addr
 			continue
 		}
 	}
-	return proxyBook, nil
+	return proxyBook, proxyCaps, nil
+}
+
+// unixScheme is the prefix of an address in ProxyBook which is the path of a Unix domain socket
+const unixScheme = "unix://"
+
+// parseProxyAddr resolves the address of a proxy server on network. An address of the form unix:///path/to.sock is
+// a Unix domain socket whichever of tcp or unix network is, as is any address on the unix network
+func parseProxyAddr(network string, address string) (net.Addr, error) {
+	if strings.HasPrefix(address, unixScheme) {
+		if network == "udp" {
+			return nil, fmt.Errorf("%v is a Unix domain socket, which can't be used for udp", address)
+		}
+		network, address = "unix", strings.TrimPrefix(address, unixScheme)
+	}
+	switch network {
+	case "udp":
+		return net.ResolveUDPAddr("udp", address)
+	case "unix":
+		if address == "" {
+			return nil, errors.New("empty path of Unix domain socket")
+		}
+		return net.ResolveUnixAddr("unix", address)
+	default:
+		return net.ResolveTCPAddr("tcp", address)
+	}
+}
+
+// parseProxyFallbacks checks that both the proxy method and its fallback in each entry are in proxyBook
+func parseProxyFallbacks(fallbacks map[string]string, proxyBook map[string]net.Addr) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for name, fallback := range fallbacks {
+		name, fallback = strings.ToLower(name), strings.ToLower(fallback)
+		if _, ok := proxyBook[name]; !ok {
+			return nil, fmt.Errorf("fallback given for %v, which isn't in ProxyBook", name)
+		}
+		if _, ok := proxyBook[fallback]; !ok {
+			return nil, fmt.Errorf("fallback %v of %v isn't in ProxyBook", fallback, name)
+		}
+		parsed[name] = fallback
+	}
+	return parsed, nil
 }
 
 // ParseConfig reads the config file or semicolon-separated options and parse them into a RawConfig
@@ -141,6 +412,7 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 		UsedRandom:  map[[32]byte]int64{},
 		RedirDialer: &net.Dialer{},
 		WorldState:  worldState,
+		FillerRand:  makeFillerRandom(worldState.Rand),
 	}
 	if preParse.CncMode {
 		err = errors.New("command & control mode not implemented")
@@ -171,17 +443,163 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 		return
 	}
 
-	sta.ProxyBook, err = parseProxyBook(preParse.ProxyBook)
+	sta.ProxyBook, sta.proxyCaps, err = parseProxyBook(preParse.ProxyBook)
 	if err != nil {
 		err = fmt.Errorf("unable to parse ProxyBook: %v", err)
 		return
 	}
+	sta.ProxyFallbacks, err = parseProxyFallbacks(preParse.ProxyFallbacks, sta.ProxyBook)
+	if err != nil {
+		return
+	}
+	sta.ProxyUpstreams, err = parseProxyUpstreams(preParse.ProxyUpstreams, sta.ProxyBook)
+	if err != nil {
+		return
+	}
+	sta.ProxyStreamTimeouts, err = parseProxyStreamTimeouts(preParse.ProxyStreamTimeouts, sta.ProxyBook)
+	if err != nil {
+		return
+	}
+	sta.UIDOverrides, err = parseUIDOverrides(preParse.UIDOverrides, sta.ProxyBook)
+	if err != nil {
+		return
+	}
 
 	var pv [32]byte
 	copy(pv[:], preParse.PrivateKey)
 	sta.StaticPv = &pv
 
 	sta.AdminUID = preParse.AdminUID
+	sta.Profile = preParse.ServerProfile
+	if len(preParse.ServerProfiles) > 0 {
+		// the private key is a secret which stays the same across restarts, so users can't work out which profile
+		// another user gets, and each user keeps getting the same one
+		seed := sha256.Sum256(preParse.PrivateKey)
+		sta.ProfileSelector = &ProfileSelector{Profiles: preParse.ServerProfiles, Seed: seed[:]}
+	}
+	sta.MinCipherSuites = preParse.MinCipherSuites
+	sta.CountGREASECipherSuites = preParse.CountGREASECipherSuites
+	sta.MinExtensions = preParse.MinExtensions
+	sta.CountGREASEExtensions = preParse.CountGREASEExtensions
+	sta.MaxExtensions = preParse.MaxExtensions
+	sta.MaxKeyShares = preParse.MaxKeyShares
+	sta.RejectDuplicateExtensions = preParse.RejectDuplicateExtensions
+	sta.RejectSmallOrderKeyShares = preParse.RejectSmallOrderKeyShares
+	sta.StrictExtensionsLength = preParse.StrictExtensionsLength
+	sta.HandshakeBudget = time.Duration(preParse.HandshakeBudget) * time.Millisecond
+	sta.KeyShareGroups = preParse.KeyShareGroups
+	sta.DivertOnlySCSV = preParse.DivertOnlySCSV
+	sta.PreferredKeyShareGroups = DefaultPreferredKeyShareGroups
+	if len(preParse.PreferredKeyShareGroups) > 0 {
+		sta.PreferredKeyShareGroups = nil
+		for _, group := range preParse.PreferredKeyShareGroups {
+			if _, ok := keyExchangeLengths[[2]byte{byte(group >> 8), byte(group)}]; !ok {
+				err = fmt.Errorf("unable to answer key_share in group %v", group)
+				return
+			}
+			sta.PreferredKeyShareGroups = append(sta.PreferredKeyShareGroups, [2]byte{byte(group >> 8), byte(group)})
+		}
+	}
+	sta.ReadAhead = preParse.ReadAhead
+	if preParse.ClockSkewTolerance > 0 {
+		sta.ClockSkewTolerance = time.Duration(preParse.ClockSkewTolerance) * time.Second
+		if sta.ClockSkewTolerance >= replayCacheAgeLimit {
+			err = fmt.Errorf("ClockSkewTolerance must be shorter than %v, which is how long randoms are kept to detect replays", replayCacheAgeLimit)
+			return
+		}
+	}
+	for _, window := range preParse.AcceptWindows {
+		var acceptWindow AcceptWindow
+		acceptWindow, err = parseAcceptWindow(window)
+		if err != nil {
+			err = fmt.Errorf("unable to parse AcceptWindows: %v", err)
+			return
+		}
+		sta.AcceptWindows = append(sta.AcceptWindows, acceptWindow)
+	}
+	sta.CloakServerNames = parseCloakServerNames(preParse.CloakServerNames)
+	if preParse.FloodThreshold > 0 {
+		window, cooldown, maxIPs := defaultFloodWindow, defaultFloodCooldown, defaultFloodMaxIPs
+		if preParse.FloodWindow > 0 {
+			window = time.Duration(preParse.FloodWindow) * time.Second
+		}
+		if preParse.FloodCooldown > 0 {
+			cooldown = time.Duration(preParse.FloodCooldown) * time.Second
+		}
+		if preParse.FloodMaxIPs > 0 {
+			maxIPs = preParse.FloodMaxIPs
+		}
+		sta.FloodTracker = MakeFloodTracker(preParse.FloodThreshold, window, cooldown, maxIPs)
+	}
+	if len(preParse.Blocklist) > 0 {
+		var blocklist *MemoryBlocklist
+		blocklist, err = ParseMemoryBlocklist(preParse.Blocklist)
+		if err != nil {
+			return
+		}
+		sta.Blocklist = blocklist
+	}
+	if preParse.CrossUIDReplayCacheSize > 0 {
+		window := defaultRandomIndexWindow
+		if preParse.CrossUIDReplayWindow > 0 {
+			window = time.Duration(preParse.CrossUIDReplayWindow) * time.Second
+		}
+		sta.RandomIndex = MakeRandomIndex(window, preParse.CrossUIDReplayCacheSize)
+		sta.RejectCrossUIDReplays = preParse.RejectCrossUIDReplays
+	}
+	if preParse.UIDIPThreshold > 0 {
+		window := defaultUIDIPWindow
+		if preParse.UIDIPWindow > 0 {
+			window = time.Duration(preParse.UIDIPWindow) * time.Second
+		}
+		sta.UIDIPTracker = MakeUIDIPTracker(preParse.UIDIPThreshold, window)
+		sta.UIDIPAction, err = parseUIDIPAction(preParse.UIDIPAction)
+		if err != nil {
+			return
+		}
+		sta.UIDIPThrottle = defaultUIDIPThrottle
+		if preParse.UIDIPThrottle > 0 {
+			sta.UIDIPThrottle = time.Duration(preParse.UIDIPThrottle) * time.Second
+		}
+	}
+	if preParse.TarpitProbeScore > 0 {
+		sta.Tarpit = &TarpitConfig{
+			MinProbeScore: preParse.TarpitProbeScore,
+			Interval:      defaultTarpitInterval,
+			MaxDuration:   defaultTarpitDuration,
+			MaxConcurrent: defaultMaxTarpits,
+		}
+		if preParse.TarpitInterval > 0 {
+			sta.Tarpit.Interval = time.Duration(preParse.TarpitInterval) * time.Millisecond
+		}
+		if preParse.TarpitDuration > 0 {
+			sta.Tarpit.MaxDuration = time.Duration(preParse.TarpitDuration) * time.Second
+		}
+		if preParse.MaxTarpits > 0 {
+			sta.Tarpit.MaxConcurrent = preParse.MaxTarpits
+		}
+	}
+	sta.AlwaysHelloRetryRequest = preParse.AlwaysHelloRetryRequest
+
+	if preParse.HandshakeRecordPath != "" {
+		maxSize := preParse.HandshakeRecordMaxSize
+		if maxSize <= 0 {
+			maxSize = defaultHandshakeRecordMaxSize
+		}
+		sta.Recorder, err = MakeFileRecorder(preParse.HandshakeRecordPath, maxSize)
+		if err != nil {
+			err = fmt.Errorf("unable to open handshake record file: %v", err)
+			return
+		}
+	}
+
+	if preParse.MaintenancePage != "" {
+		sta.MaintenancePage, err = sta.loadMaintenancePage(preParse)
+		if err != nil {
+			err = fmt.Errorf("unable to load MaintenancePage: %v", err)
+			return
+		}
+	}
 
 	var arrUID [16]byte
 	for _, UID := range preParse.BypassUID {
@@ -192,9 +610,39 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 	sta.BypassUID[arrUID] = struct{}{}
 
 	go sta.UsedRandomCleaner()
+	if preParse.ProxyBreakerThreshold > 0 {
+		window, cooldown := defaultBreakerWindow, defaultBreakerCooldown
+		if preParse.ProxyBreakerWindow > 0 {
+			window = time.Duration(preParse.ProxyBreakerWindow) * time.Second
+		}
+		if preParse.ProxyBreakerCooldown > 0 {
+			cooldown = time.Duration(preParse.ProxyBreakerCooldown) * time.Second
+		}
+		sta.ProxyBreaker = MakeCircuitBreaker(preParse.ProxyBreakerThreshold, window, cooldown)
+	}
+	if preParse.ProxyHealthCheckInterval > 0 {
+		sta.ProxyHealth = MakeProxyHealth(defaultProxyHealthCheckTimeout)
+		go sta.ProxyHealthChecker(time.Duration(preParse.ProxyHealthCheckInterval) * time.Second)
+	}
 	return sta, nil
 }
 
+// SetDraining turns the draining mode on or off. In draining mode, Cloak clients trying to start a new session are
+// redirected to RedirAddr, as if they were not Cloak clients. Connections belonging to existing sessions are still
+// accepted
+func (sta *State) SetDraining(draining bool) {
+	if draining {
+		atomic.StoreInt32(&sta.draining, 1)
+	} else {
+		atomic.StoreInt32(&sta.draining, 0)
+	}
+}
+
+// Draining checks if the server is in draining mode
+func (sta *State) Draining() bool {
+	return atomic.LoadInt32(&sta.draining) == 1
+}
+
 // IsBypass checks if a UID is a bypass user
 func (sta *State) IsBypass(UID []byte) bool {
 	var arrUID [16]byte
@@ -203,22 +651,64 @@ func (sta *State) IsBypass(UID []byte) bool {
 	return exist
 }
 
+// timestampTolerance is how far the clock of a client may be from ours if ClockSkewTolerance isn't set
 const timestampTolerance = 180 * time.Second
 
+// replyTimeout is how long the handshake reply may take to be written
+func (sta *State) replyTimeout() time.Duration {
+	if sta.ReplyWriteTimeout > 0 {
+		return sta.ReplyWriteTimeout
+	}
+	return replyWriteTimeout
+}
+
+// clockSkewTolerance is how far the timestamp of a Cloak client may be from our time
+func (sta *State) clockSkewTolerance() time.Duration {
+	if sta.ClockSkewTolerance > 0 {
+		return sta.ClockSkewTolerance
+	}
+	return timestampTolerance
+}
+
+const defaultHandshakeRecordMaxSize = 10 * 1024 * 1024
+
 const replayCacheAgeLimit = 12 * time.Hour
 
 // UsedRandomCleaner clears the cache of used random fields every replayCacheAgeLimit
 func (sta *State) UsedRandomCleaner() {
 	for {
 		time.Sleep(replayCacheAgeLimit)
-		sta.usedRandomM.Lock()
-		for key, t := range sta.UsedRandom {
-			if time.Unix(t, 0).Before(sta.WorldState.Now().Add(timestampTolerance)) {
-				delete(sta.UsedRandom, key)
-			}
+		sta.cleanUsedRandom()
+	}
+}
+
+// cleanUsedRandom deletes the used random fields registered longer than twice clockSkewTolerance ago. A ClientHello's
+// timestamp can be up to clockSkewTolerance ahead of when it was registered, and it's accepted until our time is
+// clockSkewTolerance past that, so any younger random must be kept to stop the ClientHello from being replayed
+func (sta *State) cleanUsedRandom() {
+	expiry := sta.WorldState.Now().Add(-2 * sta.clockSkewTolerance())
+	sta.usedRandomM.Lock()
+	for key, t := range sta.UsedRandom {
+		if time.Unix(t, 0).Before(expiry) {
+			delete(sta.UsedRandom, key)
 		}
-		sta.usedRandomM.Unlock()
 	}
+	sta.usedRandomM.Unlock()
+}
+
+// recordFailedHandshake passes a failed handshake to the Recorder, if there is one
+func (sta *State) recordFailedHandshake(conn net.Conn, firstPacket []byte, reason error) {
+	if sta.Recorder == nil {
+		return
+	}
+	packet := make([]byte, len(firstPacket))
+	copy(packet, firstPacket)
+	sta.Recorder.Record(HandshakeRecord{
+		Time:        sta.WorldState.Now(),
+		RemoteAddr:  conn.RemoteAddr().String(),
+		Reason:      reason.Error(),
+		FirstPacket: packet,
+	})
 }
 
 func (sta *State) registerRandom(r [32]byte) bool {
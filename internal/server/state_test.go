@@ -1,8 +1,14 @@
 package server
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
 )
 
 func TestParseRedirAddr(t *testing.T) {
@@ -106,3 +112,178 @@ func TestParseRedirAddr(t *testing.T) {
 		}
 	})
 }
+
+func TestParseProxyBook(t *testing.T) {
+	t.Run("without cap", func(t *testing.T) {
+		book, caps, err := parseProxyBook(map[string][]string{"shadowsocks": {"tcp", "127.0.0.1:8388"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if book["shadowsocks"].String() != "127.0.0.1:8388" {
+			t.Errorf("expected %v got %v", "127.0.0.1:8388", book["shadowsocks"])
+		}
+		if len(caps) != 0 {
+			t.Errorf("expected no caps, got %v", caps)
+		}
+	})
+	t.Run("with cap", func(t *testing.T) {
+		_, caps, err := parseProxyBook(map[string][]string{"shadowsocks": {"tcp", "127.0.0.1:8388", "100"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if caps["shadowsocks"] == nil || caps["shadowsocks"].max != 100 {
+			t.Errorf("expected a cap of 100, got %v", caps["shadowsocks"])
+		}
+	})
+	t.Run("bad cap", func(t *testing.T) {
+		for _, bad := range []string{"0", "-1", "many"} {
+			_, _, err := parseProxyBook(map[string][]string{"shadowsocks": {"tcp", "127.0.0.1:8388", bad}})
+			if err == nil {
+				t.Errorf("cap %v should fail", bad)
+			}
+		}
+	})
+	t.Run("too many items", func(t *testing.T) {
+		_, _, err := parseProxyBook(map[string][]string{"shadowsocks": {"tcp", "127.0.0.1:8388", "1", "2"}})
+		if err == nil {
+			t.Error("should fail")
+		}
+	})
+	t.Run("unix domain socket", func(t *testing.T) {
+		book, _, err := parseProxyBook(map[string][]string{
+			"shadowsocks": {"tcp", "unix:///run/shadowsocks.sock"},
+			"openvpn":     {"unix", "/run/openvpn.sock"},
+			"v2ray":       {"tcp", "127.0.0.1:10086"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, path := range map[string]string{"shadowsocks": "/run/shadowsocks.sock", "openvpn": "/run/openvpn.sock"} {
+			if book[name].Network() != "unix" || book[name].String() != path {
+				t.Errorf("expected %v to dial unix %v, got %v %v", name, path, book[name].Network(), book[name])
+			}
+		}
+		if book["v2ray"].Network() != "tcp" {
+			t.Errorf("expected v2ray to dial tcp, got %v", book["v2ray"].Network())
+		}
+	})
+	t.Run("bad unix domain socket", func(t *testing.T) {
+		for _, bad := range [][]string{{"udp", "unix:///run/openvpn.sock"}, {"unix", ""}, {"tcp", "unix://"}} {
+			_, _, err := parseProxyBook(map[string][]string{"openvpn": bad})
+			if err == nil {
+				t.Errorf("%v should fail", bad)
+			}
+		}
+	})
+}
+
+func TestProxyAddr_UnixDial(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ck_proxy")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	book, _, err := parseProxyBook(map[string][]string{"shadowsocks": {"tcp", "unix://" + path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rings, err := parseProxyUpstreams(map[string][]string{"shadowsocks": {filepath.Join(dir, "other.sock")}}, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta := &State{ProxyBook: book}
+	addr := sta.proxyAddr("shadowsocks", nil)
+	conn, err := (&net.Dialer{}).Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("failed to dial %v %v: %v", addr.Network(), addr, err)
+	}
+	defer conn.Close()
+	(<-accepted).Close()
+
+	for _, upstream := range rings["shadowsocks"].upstreams {
+		if upstream.Network() != "unix" {
+			t.Errorf("expected upstreams of a unix proxy server to be unix too, got %v %v", upstream.Network(), upstream)
+		}
+	}
+}
+
+func TestConnectionCap(t *testing.T) {
+	c := &connectionCap{max: 2}
+	release1, ok := c.acquire()
+	if !ok {
+		t.Fatal("first connection should be allowed")
+	}
+	_, ok = c.acquire()
+	if !ok {
+		t.Fatal("second connection should be allowed")
+	}
+	_, ok = c.acquire()
+	if ok {
+		t.Fatal("third connection should be rejected")
+	}
+	release1()
+	release1()
+	_, ok = c.acquire()
+	if !ok {
+		t.Fatal("connection should be allowed after a release")
+	}
+	_, ok = c.acquire()
+	if ok {
+		t.Fatal("releasing twice should only free one connection")
+	}
+}
+
+func TestAcquireProxyConnection_Uncapped(t *testing.T) {
+	sta := &State{}
+	for i := 0; i < 10; i++ {
+		if _, ok := sta.acquireProxyConnection("shadowsocks", nil); !ok {
+			t.Fatal("uncapped proxy method should always be allowed")
+		}
+	}
+}
+
+func TestCleanUsedRandom(t *testing.T) {
+	start := time.Unix(1565998966, 0)
+	now := start
+	sta := &State{
+		WorldState:         common.WorldOfTime(start),
+		ClockSkewTolerance: time.Hour,
+		UsedRandom:         map[[32]byte]int64{},
+	}
+	sta.WorldState.Now = func() time.Time { return now }
+
+	old := [32]byte{1}
+	// registered just over a tolerance before the sweep, so its ClientHello may have a timestamp ahead of our time
+	// then which is still accepted at the sweep
+	skewed := [32]byte{2}
+	recent := [32]byte{3}
+	sta.registerRandom(old)
+	now = start.Add(119 * time.Minute)
+	sta.registerRandom(skewed)
+	now = start.Add(150 * time.Minute)
+	sta.registerRandom(recent)
+
+	now = start.Add(3 * time.Hour)
+	sta.cleanUsedRandom()
+
+	if _, ok := sta.UsedRandom[old]; ok {
+		t.Error("random registered over twice the clock skew tolerance ago should have been deleted")
+	}
+	if !sta.registerRandom(skewed) {
+		t.Error("random whose ClientHello can still be accepted should have survived the sweep")
+	}
+	if !sta.registerRandom(recent) {
+		t.Error("random registered within the clock skew tolerance should have survived the sweep")
+	}
+}
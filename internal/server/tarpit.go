@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// TarpitConfig describes how connections from probes are held open
+type TarpitConfig struct {
+	// MinProbeScore is the lowest ProbeScore of a connection that is tarpitted
+	MinProbeScore int
+	// Interval is the time between each byte sent
+	Interval time.Duration
+	// MaxDuration is the longest a connection is held before being closed
+	MaxDuration time.Duration
+	// MaxConcurrent is the most connections held at the same time. Connections beyond this are not tarpitted
+	MaxConcurrent int
+}
+
+const (
+	defaultTarpitInterval = 5 * time.Second
+	defaultTarpitDuration = 5 * time.Minute
+	defaultMaxTarpits     = 64
+)
+
+// activeTarpits is the number of connections being held by Tarpit across the process
+var activeTarpits int32
+
+// Tarpit holds conn open and slowly sends it meaningless bytes until the client goes away or cfg.MaxDuration has
+// passed, then closes it. This costs a scanner time instead of telling it straight away that it is unwelcome.
+// It blocks for as long as it holds conn. If cfg.MaxConcurrent connections are already held, it returns false
+// straight away and conn is left untouched
+func Tarpit(conn net.Conn, cfg TarpitConfig) bool {
+	return holdInTarpit(conn, cfg, nil)
+}
+
+// holdInTarpit is Tarpit, which calls held, if not nil, once it has taken conn
+func holdInTarpit(conn net.Conn, cfg TarpitConfig, held func()) bool {
+	if atomic.AddInt32(&activeTarpits, 1) > int32(cfg.MaxConcurrent) {
+		atomic.AddInt32(&activeTarpits, -1)
+		return false
+	}
+	defer atomic.AddInt32(&activeTarpits, -1)
+	if held != nil {
+		held()
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(cfg.MaxDuration)
+	conn.SetWriteDeadline(deadline)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	timer := time.NewTimer(cfg.MaxDuration)
+	defer timer.Stop()
+
+	b := make([]byte, 1)
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-ticker.C:
+			common.CryptoRandRead(b)
+			if _, err := conn.Write(b); err != nil {
+				return true
+			}
+		}
+	}
+}
+
+const (
+	// probeScoreMalformed is the ProbeScore of a first packet that isn't a ClientHello at all
+	probeScoreMalformed = 4
+	// probeScoreFailedCheck is added to the ProbeScore of a ClientHello that fails the sanity checks of checkClientHello
+	probeScoreFailedCheck = 2
+)
+
+var failedCheckErrors = []error{
+	ErrNoExtensions,
+	ErrImplausibleVersions,
+	ErrTooFewCipherSuites,
+	ErrTooFewExtensions,
+	ErrOnlySCSV,
+	ErrKeyShareGroupNotAllowed,
+}
+
+// ProbeScore rates how likely a connection whose first packet is data is from an active prober rather than from a
+// browser. reason is why the connection isn't treated as from a Cloak client. Each of the ClientHello's anomaly flags
+// adds one to the score, and failing a sanity check adds more
+func ProbeScore(data []byte, reason error) int {
+	ch, err := parseClientHello(data, DefaultParseOptions)
+	if err != nil {
+		return probeScoreMalformed
+	}
+	score := len(ch.AnomalyFlags())
+	for _, checkErr := range failedCheckErrors {
+		if errors.Is(reason, checkErr) {
+			score += probeScoreFailedCheck
+			break
+		}
+	}
+	return score
+}
+
+// tarpitProbe tarpits conn if it's likely from a prober and returns whether it has done so. The first packets of
+// transports other than TLS are left alone, since an ordinary HTTP request isn't a ClientHello
+func (sta *State) tarpitProbe(conn net.Conn, transport Transport, data []byte, reason error) bool {
+	if sta.Tarpit == nil {
+		return false
+	}
+	if _, ok := transport.(WebSocket); ok {
+		return false
+	}
+	score := ProbeScore(data, reason)
+	if score < sta.Tarpit.MinProbeScore {
+		return false
+	}
+	log.WithFields(log.Fields{
+		"remoteAddr": conn.RemoteAddr(),
+		"probeScore": score,
+	}).Debug("tarpitting probe")
+	return holdInTarpit(conn, *sta.Tarpit, func() {
+		sta.emitSecurityEvent(SecurityEventTarpitted, conn, nil, fmt.Sprintf("probe score %v", score))
+	})
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/hex"
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// drain reads from conn until it's closed and sends the time each byte arrived
+func drain(conn net.Conn) chan time.Time {
+	arrivals := make(chan time.Time, 1024)
+	go func() {
+		b := make([]byte, 1)
+		for {
+			_, err := conn.Read(b)
+			if err != nil {
+				close(arrivals)
+				return
+			}
+			arrivals <- time.Now()
+		}
+	}()
+	return arrivals
+}
+
+// waitForTarpits waits until no connection is held by Tarpit, so that tests don't share activeTarpits
+func waitForTarpits(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&activeTarpits) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connections are still held by Tarpit")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTarpit_Drip(t *testing.T) {
+	cfg := TarpitConfig{Interval: 20 * time.Millisecond, MaxDuration: 150 * time.Millisecond, MaxConcurrent: 1}
+	local, remote := net.Pipe()
+	start := time.Now()
+	done := make(chan bool)
+	go func() { done <- Tarpit(remote, cfg) }()
+
+	var arrivals []time.Time
+	for arrival := range drain(local) {
+		arrivals = append(arrivals, arrival)
+	}
+	assert.True(t, <-done)
+	elapsed := time.Since(start)
+
+	assert.True(t, elapsed >= cfg.MaxDuration, "closed after %v, before MaxDuration", elapsed)
+	assert.True(t, elapsed < cfg.MaxDuration+100*time.Millisecond, "closed %v after MaxDuration", elapsed-cfg.MaxDuration)
+	// a byte per interval, give or take scheduling
+	assert.True(t, len(arrivals) >= 5 && len(arrivals) <= 7, "%v bytes sent", len(arrivals))
+	last := start
+	for _, arrival := range arrivals {
+		assert.True(t, arrival.Sub(last) >= cfg.Interval/2, "bytes sent %v apart", arrival.Sub(last))
+		last = arrival
+	}
+}
+
+func TestTarpit_ClientGone(t *testing.T) {
+	cfg := TarpitConfig{Interval: 10 * time.Millisecond, MaxDuration: 10 * time.Second, MaxConcurrent: 1}
+	local, remote := net.Pipe()
+	done := make(chan bool)
+	go func() { done <- Tarpit(remote, cfg) }()
+	local.Read(make([]byte, 1))
+	local.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tarpit goes on after the client has gone")
+	}
+}
+
+func TestTarpit_MaxConcurrent(t *testing.T) {
+	cfg := TarpitConfig{Interval: 10 * time.Millisecond, MaxDuration: 10 * time.Second, MaxConcurrent: 1}
+	heldLocal, heldRemote := net.Pipe()
+	heldDone := make(chan bool)
+	go func() { heldDone <- Tarpit(heldRemote, cfg) }()
+	// the first byte means the connection is being held
+	heldLocal.Read(make([]byte, 1))
+
+	_, remote := net.Pipe()
+	rejected := make(chan bool)
+	go func() { rejected <- Tarpit(remote, cfg) }()
+	select {
+	case held := <-rejected:
+		assert.False(t, held, "more connections held than MaxConcurrent")
+	case <-time.After(time.Second):
+		t.Fatal("connection beyond MaxConcurrent is held")
+	}
+
+	heldLocal.Close()
+	assert.True(t, <-heldDone)
+
+	cfg.MaxDuration = 20 * time.Millisecond
+	local, remote := net.Pipe()
+	go drain(local)
+	assert.True(t, Tarpit(remote, cfg), "slot isn't freed")
+}
+
+func TestProbeScore(t *testing.T) {
+	cloakBytes, _ := hex.DecodeString(cloakClientHello)
+	assert.Equal(t, 0, ProbeScore(cloakBytes, ErrBadDecryption))
+	assert.Equal(t, probeScoreMalformed, ProbeScore([]byte("SSH-2.0-OpenSSH_8.2\r\n"), ErrUnrecognisedProtocol))
+
+	tch := newTestClientHello().withExtension([2]byte{0x00, 0x15}, make([]byte, 4000))
+	tch.sessionId = tch.sessionId[:8]
+	assert.Equal(t, 2, ProbeScore(tch.marshal(), ErrBadDecryption))
+	assert.Equal(t, 2+probeScoreFailedCheck, ProbeScore(tch.marshal(), ErrTooFewCipherSuites))
+}
+
+func TestDispatchConnection_Tarpit(t *testing.T) {
+	sta, _, redirListener := makeDispatchTestState(t)
+	sta.Tarpit = &TarpitConfig{MinProbeScore: probeScoreFailedCheck, Interval: 10 * time.Millisecond, MaxDuration: 100 * time.Millisecond, MaxConcurrent: 4}
+	redirected := make(chan net.Conn, 1)
+	go func() {
+		conn, err := redirListener.Accept()
+		if err == nil {
+			redirected <- conn
+		}
+	}()
+
+	t.Run("probe", func(t *testing.T) {
+		tch := newTestClientHello()
+		tch.extensions = nil
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(tch.marshal())
+
+		buf := make([]byte, 3)
+		_, err := io.ReadFull(local, buf)
+		assert.NoError(t, err, "nothing dripped")
+		select {
+		case <-redirected:
+			t.Error("probe relayed to redirection server")
+		default:
+		}
+		local.Close()
+		waitForTarpits(t)
+	})
+
+	t.Run("browser", func(t *testing.T) {
+		chromeBytes, _ := hex.DecodeString(chromeClientHello)
+		local, remote := connutil.AsyncPipe()
+		go dispatchConnection(remote, sta)
+		local.Write(chromeBytes)
+		select {
+		case conn := <-redirected:
+			conn.Close()
+		case <-time.After(timeout):
+			t.Error("browser not relayed to redirection server")
+		}
+		local.Close()
+	})
+}
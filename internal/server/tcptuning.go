@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TCPTuning are the socket options of a connection from a Cloak client, set so that its TCP behaviour is closer to
+// that of the server mimicked. Options left zero are left as the OS sets them. Those fixed in the TCP handshake, such
+// as the MSS and window scale, can't be changed by the time the connection reaches us
+type TCPTuning struct {
+	// NoDelay, if not nil, is whether Nagle's algorithm is disabled. Go disables it by default
+	NoDelay *bool
+	// SendBuffer, if positive, is the size in bytes of the socket's send buffer (SO_SNDBUF)
+	SendBuffer int
+	// ReceiveBuffer, if positive, is the size in bytes of the socket's receive buffer (SO_RCVBUF)
+	ReceiveBuffer int
+	// KeepAlive, if positive, is the seconds between TCP keep-alive probes
+	KeepAlive int
+}
+
+// applyTCPTuning sets the socket options of tuning on conn, if it's a *net.TCPConn
+func applyTCPTuning(conn net.Conn, tuning TCPTuning) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if tuning.NoDelay != nil {
+		if err := tcpConn.SetNoDelay(*tuning.NoDelay); err != nil {
+			return err
+		}
+	}
+	if tuning.SendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(tuning.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if tuning.ReceiveBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(tuning.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if tuning.KeepAlive > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcpConn.SetKeepAlivePeriod(time.Duration(tuning.KeepAlive) * time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureConn tunes conn, the connection from a Cloak client of UID whose handshake has succeeded, with the TCP of
+// the server profile UID is answered with, then calls ConfigureConn with it
+func (sta *State) configureConn(conn net.Conn, UID []byte) {
+	if tuning := sta.serverProfile(UID).TCP; tuning != nil {
+		tune := sta.TuneConn
+		if tune == nil {
+			tune = applyTCPTuning
+		}
+		if err := tune(conn, *tuning); err != nil {
+			log.WithField("remoteAddr", conn.RemoteAddr()).Warnf("failed to tune TCP connection: %v", err)
+		}
+	}
+	if sta.ConfigureConn != nil {
+		sta.ConfigureConn(conn)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyTCPTuning(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	noDelay := false
+	tuning := TCPTuning{NoDelay: &noDelay, SendBuffer: 65536, ReceiveBuffer: 65536, KeepAlive: 15}
+	assert.NoError(t, applyTCPTuning(conn, tuning))
+	assert.NoError(t, applyTCPTuning(conn, TCPTuning{}))
+
+	local, remote := connutil.AsyncPipe()
+	defer local.Close()
+	assert.NoError(t, applyTCPTuning(remote, tuning), "a connection that isn't TCP is tuned")
+}
+
+func TestDispatchConnection_TuneConn(t *testing.T) {
+	noDelay := false
+	tuning := &TCPTuning{NoDelay: &noDelay, SendBuffer: 262144}
+
+	t.Run("successful handshake", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.Profile = &ServerProfile{CipherSuite: 0x1301, TCP: tuning}
+		tuned := make(chan TCPTuning, 2)
+		sta.TuneConn = func(conn net.Conn, tuning TCPTuning) error {
+			tuned <- tuning
+			return nil
+		}
+		// how many times TuneConn had been called when ConfigureConn is
+		configured := make(chan int, 1)
+		sta.ConfigureConn = func(conn net.Conn) { configured <- len(tuned) }
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		if _, err := readServerReply(local); err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+
+		select {
+		case n := <-configured:
+			assert.Equal(t, 1, n, "ConfigureConn called before TuneConn")
+		case <-time.After(timeout):
+			t.Fatal("ConfigureConn not called")
+		}
+		select {
+		case got := <-tuned:
+			assert.Equal(t, *tuning, got)
+		case <-time.After(timeout):
+			t.Fatal("TuneConn not called")
+		}
+	})
+
+	t.Run("profile without TCP", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		configured := make(chan struct{}, 1)
+		sta.TuneConn = func(conn net.Conn, tuning TCPTuning) error {
+			t.Error("TuneConn called without TCP in the profile")
+			return nil
+		}
+		sta.ConfigureConn = func(conn net.Conn) { configured <- struct{}{} }
+
+		first, _ := hex.DecodeString(cloakClientHello)
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		if _, err := readServerReply(local); err != nil {
+			t.Fatalf("failed to read server reply: %v", err)
+		}
+		select {
+		case <-configured:
+		case <-time.After(timeout):
+			t.Fatal("ConfigureConn not called")
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		sta.Profile = &ServerProfile{CipherSuite: 0x1301, TCP: tuning}
+		sta.TuneConn = func(conn net.Conn, tuning TCPTuning) error {
+			t.Error("TuneConn called on fallback")
+			return nil
+		}
+
+		first, _ := hex.DecodeString(chromeClientHello)
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(first)
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirConn.Close()
+	})
+}
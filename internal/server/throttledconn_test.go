@@ -0,0 +1,205 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// throttleOptions are how a throttledConn holds up the net.Conn it wraps. The zero value passes everything through
+type throttleOptions struct {
+	// ReadDelay and WriteDelay are slept before each Read and Write
+	ReadDelay  time.Duration
+	WriteDelay time.Duration
+	// MaxChunk, if positive, is the most bytes each Read and Write passes on, so a Write may be short
+	MaxChunk int
+	// StallReads and StallWrites have Read and Write block once StallReadsAfter and StallWritesAfter bytes have been
+	// passed on, until the deadline passes or the conn is closed
+	StallReads       bool
+	StallReadsAfter  int
+	StallWrites      bool
+	StallWritesAfter int
+}
+
+// throttleTimeout is returned by a stalled Read or Write once its deadline has passed, as by a net.Conn of the os
+type throttleTimeout struct{}
+
+func (throttleTimeout) Error() string   { return "i/o timeout" }
+func (throttleTimeout) Timeout() bool   { return true }
+func (throttleTimeout) Temporary() bool { return true }
+
+// throttledConn is a net.Conn which delays, chunks and stalls reads and writes of another as its throttleOptions say
+type throttledConn struct {
+	net.Conn
+	opts throttleOptions
+
+	mutex         sync.Mutex
+	read, written int
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// deadlineSet is closed and replaced whenever a deadline is set, to wake up stalled calls
+	deadlineSet chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newThrottledConn(inner net.Conn, opts throttleOptions) *throttledConn {
+	return &throttledConn{
+		Conn:        inner,
+		opts:        opts,
+		deadlineSet: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// allowed is how much of wanted bytes may be passed on after done bytes have been. It's 0 if the call is to stall
+func (c *throttledConn) allowed(wanted, done int, stall bool, stallAfter int) int {
+	if c.opts.MaxChunk > 0 && wanted > c.opts.MaxChunk {
+		wanted = c.opts.MaxChunk
+	}
+	if stall && done+wanted > stallAfter {
+		wanted = stallAfter - done
+	}
+	return wanted
+}
+
+// stall blocks until the deadline given by deadline has passed or the conn is closed. The deadline is looked up again
+// whenever one is set
+func (c *throttledConn) stall(deadline func() time.Time) error {
+	for {
+		c.mutex.Lock()
+		d, deadlineSet := deadline(), c.deadlineSet
+		c.mutex.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !d.IsZero() {
+			remaining := time.Until(d)
+			if remaining <= 0 {
+				return throttleTimeout{}
+			}
+			timer = time.NewTimer(remaining)
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+			return throttleTimeout{}
+		case <-deadlineSet:
+		case <-c.closed:
+			return io.ErrClosedPipe
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	time.Sleep(c.opts.ReadDelay)
+	c.mutex.Lock()
+	n := c.allowed(len(b), c.read, c.opts.StallReads, c.opts.StallReadsAfter)
+	c.mutex.Unlock()
+	if n <= 0 && len(b) > 0 {
+		return 0, c.stall(func() time.Time { return c.readDeadline })
+	}
+	n, err := c.Conn.Read(b[:n])
+	c.mutex.Lock()
+	c.read += n
+	c.mutex.Unlock()
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	time.Sleep(c.opts.WriteDelay)
+	c.mutex.Lock()
+	n := c.allowed(len(b), c.written, c.opts.StallWrites, c.opts.StallWritesAfter)
+	c.mutex.Unlock()
+	if n <= 0 && len(b) > 0 {
+		return 0, c.stall(func() time.Time { return c.writeDeadline })
+	}
+	n, err := c.Conn.Write(b[:n])
+	c.mutex.Lock()
+	c.written += n
+	c.mutex.Unlock()
+	return n, err
+}
+
+func (c *throttledConn) setDeadlines(read, write bool, t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if read {
+		c.readDeadline = t
+	}
+	if write {
+		c.writeDeadline = t
+	}
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+}
+
+func (c *throttledConn) SetDeadline(t time.Time) error {
+	c.setDeadlines(true, true, t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *throttledConn) SetReadDeadline(t time.Time) error {
+	c.setDeadlines(true, false, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *throttledConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadlines(false, true, t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *throttledConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestThrottledConn(t *testing.T) {
+	t.Run("chunks", func(t *testing.T) {
+		local, remote := connutil.AsyncPipe()
+		conn := newThrottledConn(remote, throttleOptions{MaxChunk: 3})
+		n, err := conn.Write([]byte("abcdef"))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		local.Write([]byte("ghijkl"))
+		buf := make([]byte, 6)
+		n, _ = conn.Read(buf)
+		assert.Equal(t, "ghi", string(buf[:n]))
+	})
+
+	t.Run("stalls until deadline", func(t *testing.T) {
+		_, remote := connutil.AsyncPipe()
+		conn := newThrottledConn(remote, throttleOptions{StallWrites: true, StallWritesAfter: 4})
+		n, err := conn.Write([]byte("abcdef"))
+		assert.NoError(t, err)
+		assert.Equal(t, 4, n)
+
+		start := time.Now()
+		conn.SetWriteDeadline(start.Add(50 * time.Millisecond))
+		_, err = conn.Write([]byte("ef"))
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Errorf("expecting a timeout, got %v", err)
+		}
+		assert.True(t, time.Since(start) >= 50*time.Millisecond, "returned before the deadline")
+	})
+
+	t.Run("stalls until closed", func(t *testing.T) {
+		_, remote := connutil.AsyncPipe()
+		conn := newThrottledConn(remote, throttleOptions{StallReads: true})
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := conn.Read(make([]byte, 1))
+			readErr <- err
+		}()
+		conn.Close()
+		assert.Equal(t, io.ErrClosedPipe, <-readErr)
+	})
+}
@@ -7,7 +7,7 @@ import (
 	"net"
 )
 
-type Responder = func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error)
+type Responder = func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader, composer ReplyComposer) (preparedConn net.Conn, err error)
 type Transport interface {
 	processFirstPacket(reqPacket []byte, privateKey crypto.PrivateKey) (authFragments, Responder, error)
 }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUIDIPWindow   = 10 * time.Minute
+	defaultUIDIPThrottle = 5 * time.Second
+)
+
+// UIDIPAction is what is done with the connections of a UID which has connected from too many source IPs
+type UIDIPAction int
+
+const (
+	// UIDIPLog only logs a warning, and serves the connection as usual
+	UIDIPLog UIDIPAction = iota
+	// UIDIPThrottle holds the connection for UIDIPThrottle before serving it
+	UIDIPThrottle
+	// UIDIPDivert relays the connection to the redirection server as if it weren't from a Cloak client
+	UIDIPDivert
+)
+
+func (a UIDIPAction) String() string {
+	switch a {
+	case UIDIPLog:
+		return "log"
+	case UIDIPThrottle:
+		return "throttle"
+	case UIDIPDivert:
+		return "divert"
+	default:
+		return "unknown"
+	}
+}
+
+func parseUIDIPAction(action string) (UIDIPAction, error) {
+	switch strings.ToLower(action) {
+	case "", "log":
+		return UIDIPLog, nil
+	case "throttle":
+		return UIDIPThrottle, nil
+	case "divert":
+		return UIDIPDivert, nil
+	default:
+		return UIDIPLog, fmt.Errorf("unknown UIDIPAction %v", action)
+	}
+}
+
+// UIDIPTracker keeps track of the distinct source IPs each UID has connected from within Window, which are more than
+// Threshold if its credentials are shared or stolen. Only the Threshold+1 most recently seen IPs of a UID are kept,
+// which is all it takes to tell if there are too many, and only authenticated UIDs are counted, so memory is bounded by
+// the number of users
+type UIDIPTracker struct {
+	Threshold int
+	Window    time.Duration
+
+	mutex sync.Mutex
+	uids  map[string]map[string]time.Time
+}
+
+func MakeUIDIPTracker(threshold int, window time.Duration) *UIDIPTracker {
+	return &UIDIPTracker{
+		Threshold: threshold,
+		Window:    window,
+		uids:      make(map[string]map[string]time.Time),
+	}
+}
+
+// Seen counts a connection of UID from ip at now, and returns how many distinct IPs, up to Threshold+1, UID has
+// connected from within Window, and whether they are more than Threshold
+func (t *UIDIPTracker) Seen(UID []byte, ip string, now time.Time) (int, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ips, ok := t.uids[string(UID)]
+	if !ok {
+		ips = make(map[string]time.Time)
+		t.uids[string(UID)] = ips
+	}
+	// forget the IPs that have slid out of the window
+	windowStart := now.Add(-t.Window)
+	for seenIP, seen := range ips {
+		if !seen.After(windowStart) {
+			delete(ips, seenIP)
+		}
+	}
+	if _, ok := ips[ip]; !ok && len(ips) > t.Threshold {
+		// the least recently seen IP makes room for the new one
+		var oldest string
+		for seenIP, seen := range ips {
+			if oldest == "" || seen.Before(ips[oldest]) {
+				oldest = seenIP
+			}
+		}
+		delete(ips, oldest)
+	}
+	ips[ip] = now
+	return len(ips), len(ips) > t.Threshold
+}
+
+// checkUIDIPs counts the connection conn of a client of UID if UIDIPTracker is set. If UID has connected from too many
+// source IPs, a warning is logged, and the connection is held for UIDIPThrottle first if that's the UIDIPAction. It
+// returns false if the connection should be diverted to the redirection server instead of being served
+func (sta *State) checkUIDIPs(conn net.Conn, UID []byte) bool {
+	if sta.UIDIPTracker == nil {
+		return true
+	}
+	ips, exceeded := sta.UIDIPTracker.Seen(UID, sourceIP(conn), sta.WorldState.Now())
+	if !exceeded {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"UID":        b64(UID),
+		"remoteAddr": conn.RemoteAddr(),
+		"IPs":        ips,
+		"window":     sta.UIDIPTracker.Window,
+		"action":     sta.UIDIPAction,
+	}).Warn("UID is connecting from too many IPs")
+	sta.emitSecurityEvent(SecurityEventTooManyIPs, conn, UID, fmt.Sprintf("%v IPs", ips))
+	switch sta.UIDIPAction {
+	case UIDIPThrottle:
+		time.Sleep(sta.UIDIPThrottle)
+	case UIDIPDivert:
+		return false
+	}
+	return true
+}
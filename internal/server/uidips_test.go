@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/connutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUIDIPTracker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	UID := []byte("alice")
+	t.Run("threshold", func(t *testing.T) {
+		tracker := MakeUIDIPTracker(3, 10*time.Minute)
+		for i := 0; i < 3; i++ {
+			ips, exceeded := tracker.Seen(UID, fmt.Sprintf("10.0.0.%v", i), start)
+			assert.Equal(t, i+1, ips)
+			assert.False(t, exceeded)
+		}
+		_, exceeded := tracker.Seen(UID, "10.0.0.0", start.Add(time.Second))
+		assert.False(t, exceeded, "an IP seen before is counted again")
+		_, exceeded = tracker.Seen([]byte("bob"), "10.0.0.9", start)
+		assert.False(t, exceeded, "another UID is counted with alice")
+		ips, exceeded := tracker.Seen(UID, "10.0.0.3", start.Add(time.Second))
+		assert.Equal(t, 4, ips)
+		assert.True(t, exceeded)
+	})
+	t.Run("sliding window", func(t *testing.T) {
+		tracker := MakeUIDIPTracker(2, time.Minute)
+		tracker.Seen(UID, "10.0.0.0", start)
+		tracker.Seen(UID, "10.0.0.1", start.Add(50*time.Second))
+		// the first IP has slid out of the window
+		_, exceeded := tracker.Seen(UID, "10.0.0.2", start.Add(70*time.Second))
+		assert.False(t, exceeded)
+		_, exceeded = tracker.Seen(UID, "10.0.0.3", start.Add(80*time.Second))
+		assert.True(t, exceeded)
+	})
+	t.Run("bounded memory", func(t *testing.T) {
+		tracker := MakeUIDIPTracker(2, time.Minute)
+		for i := 0; i < 100; i++ {
+			ips, exceeded := tracker.Seen(UID, fmt.Sprintf("10.0.0.%v", i), start.Add(time.Duration(i)*time.Millisecond))
+			assert.True(t, ips <= 3)
+			assert.Equal(t, i >= 2, exceeded)
+		}
+		assert.Len(t, tracker.uids[string(UID)], 3)
+	})
+}
+
+func TestParseUIDIPAction(t *testing.T) {
+	for action, expected := range map[string]UIDIPAction{"": UIDIPLog, "log": UIDIPLog, "Throttle": UIDIPThrottle, "divert": UIDIPDivert} {
+		parsed, err := parseUIDIPAction(action)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, parsed, action)
+	}
+	_, err := parseUIDIPAction("block")
+	assert.Error(t, err)
+}
+
+func TestDispatchConnection_UIDIPs(t *testing.T) {
+	cloakBytes, _ := hex.DecodeString(cloakClientHello)
+	// others has the UID of cloakClientHello seen from as many other IPs as the threshold allows
+	others := func(sta *State) {
+		sta.UIDIPTracker = MakeUIDIPTracker(3, 10*time.Minute)
+		for i := 0; i < 3; i++ {
+			sta.UIDIPTracker.Seen(cloakClientHelloUID, fmt.Sprintf("10.0.0.%v", i), sta.WorldState.Now())
+		}
+	}
+
+	t.Run("log", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		others(sta)
+		sta.UIDIPAction = UIDIPLog
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(cloakBytes)
+		_, err := readServerReply(local)
+		assert.NoError(t, err, "a connection is served as usual")
+	})
+	t.Run("throttle", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		others(sta)
+		sta.UIDIPAction = UIDIPThrottle
+		sta.UIDIPThrottle = timeout
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		start := time.Now()
+		local.Write(cloakBytes)
+		_, err := readServerReply(local)
+		assert.NoError(t, err)
+		assert.True(t, time.Since(start) >= timeout, "a connection is served without being held")
+	})
+	t.Run("divert", func(t *testing.T) {
+		sta, _, redirListener := makeDispatchTestState(t)
+		others(sta)
+		sta.UIDIPAction = UIDIPDivert
+		reasons := make(chan FallbackReason, 1)
+		sta.OnFallback = func(_ net.Conn, reason FallbackReason) { reasons <- reason }
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(cloakBytes)
+		redirConn, err := redirListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirConn.Close()
+		assert.Equal(t, FallbackTooManyIPs, <-reasons)
+	})
+	t.Run("within the threshold", func(t *testing.T) {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.UIDIPTracker = MakeUIDIPTracker(3, 10*time.Minute)
+		sta.UIDIPAction = UIDIPDivert
+		local, remote := connutil.AsyncPipe()
+		defer local.Close()
+		go dispatchConnection(remote, sta)
+		local.Write(cloakBytes)
+		_, err := readServerReply(local)
+		assert.NoError(t, err)
+	})
+}
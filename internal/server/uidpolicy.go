@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// encryptionMethodNames are the names of the encryption methods as they are given in a client's config
+var encryptionMethodNames = map[string]byte{
+	"plain":             mux.EncryptionMethodPlain,
+	"aes-gcm":           mux.EncryptionMethodAESGCM,
+	"chacha20-poly1305": mux.EncryptionMethodChaha20Poly1305,
+}
+
+var ErrEncryptionMethodNotAllowed = errors.New("encryption method not allowed for UID")
+
+// UIDPolicy overrides what a client of a UID asks for, such as to move the UID over to a new proxy server without
+// its clients being updated
+type UIDPolicy struct {
+	// ProxyMethod, if not empty, is the proxy method the streams of the UID are relayed to, whichever one its clients
+	// ask for
+	ProxyMethod string
+	// EncryptionMethod, if not empty, is the only encryption method, by name as in a client's config, that clients of
+	// the UID may use. A client encrypts its session with the method it chose, so this can't override it, and clients
+	// using any other are refused instead
+	EncryptionMethod string
+}
+
+// applyUIDPolicy overrides the proxy method of info with the one in the UIDOverrides entry of its UID, and checks
+// its encryption method against the entry
+func (sta *State) applyUIDPolicy(info *ClientInfo) error {
+	policy, ok := sta.UIDOverrides[b64(info.UID)]
+	if !ok {
+		return nil
+	}
+	if policy.EncryptionMethod != "" {
+		if method, ok := encryptionMethodNames[policy.EncryptionMethod]; !ok || method != info.EncryptionMethod {
+			return fmt.Errorf("%w: client uses %v, %v required", ErrEncryptionMethodNotAllowed, info.EncryptionMethod, policy.EncryptionMethod)
+		}
+	}
+	if policy.ProxyMethod != "" && policy.ProxyMethod != info.ProxyMethod {
+		log.WithFields(log.Fields{
+			"UID":         b64(info.UID),
+			"proxyMethod": info.ProxyMethod,
+			"override":    policy.ProxyMethod,
+		}).Debug("overriding proxy method of UID")
+		info.ProxyMethod = policy.ProxyMethod
+	}
+	return nil
+}
+
+// parseUIDOverrides checks that each UID is valid base64, and that the proxy and encryption methods of its policy
+// exist
+func parseUIDOverrides(overrides map[string]UIDPolicy, proxyBook map[string]net.Addr) (map[string]UIDPolicy, error) {
+	parsed := make(map[string]UIDPolicy)
+	for UID, policy := range overrides {
+		UIDBytes, err := base64.StdEncoding.DecodeString(UID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID %v: %v", UID, err)
+		}
+		policy.ProxyMethod = strings.ToLower(policy.ProxyMethod)
+		if _, ok := proxyBook[policy.ProxyMethod]; policy.ProxyMethod != "" && !ok {
+			return nil, fmt.Errorf("proxy method %v of UID %v isn't in ProxyBook", policy.ProxyMethod, UID)
+		}
+		policy.EncryptionMethod = strings.ToLower(policy.EncryptionMethod)
+		if _, ok := encryptionMethodNames[policy.EncryptionMethod]; policy.EncryptionMethod != "" && !ok {
+			return nil, fmt.Errorf("unknown encryption method %v of UID %v", policy.EncryptionMethod, UID)
+		}
+		parsed[b64(UIDBytes)] = policy
+	}
+	return parsed, nil
+}
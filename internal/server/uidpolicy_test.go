@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthFirstPacket_UIDOverrides(t *testing.T) {
+	first, _ := hex.DecodeString(cloakClientHello)
+	makeState := func(t *testing.T, overrides map[string]UIDPolicy) *State {
+		sta, _, _ := makeDispatchTestState(t)
+		sta.ProxyBook["openvpn"] = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1194}
+		sta.UIDOverrides = overrides
+		return sta
+	}
+
+	t.Run("no override", func(t *testing.T) {
+		sta := makeState(t, map[string]UIDPolicy{b64(make([]byte, 16)): {ProxyMethod: "openvpn"}})
+		info, _, err := AuthFirstPacket(first, TLS{}, sta)
+		assert.NoError(t, err)
+		assert.Equal(t, "shadowsocks", info.ProxyMethod)
+	})
+
+	t.Run("proxy method", func(t *testing.T) {
+		sta := makeState(t, map[string]UIDPolicy{b64(cloakClientHelloUID): {ProxyMethod: "openvpn"}})
+		info, _, err := AuthFirstPacket(first, TLS{}, sta)
+		assert.NoError(t, err)
+		assert.Equal(t, "openvpn", info.ProxyMethod)
+	})
+
+	t.Run("proxy method asked for has been removed", func(t *testing.T) {
+		sta := makeState(t, map[string]UIDPolicy{b64(cloakClientHelloUID): {ProxyMethod: "openvpn"}})
+		delete(sta.ProxyBook, "shadowsocks")
+		info, _, err := AuthFirstPacket(first, TLS{}, sta)
+		assert.NoError(t, err)
+		assert.Equal(t, "openvpn", info.ProxyMethod)
+	})
+
+	t.Run("encryption method", func(t *testing.T) {
+		sta := makeState(t, nil)
+		info, _, err := AuthFirstPacket(first, TLS{}, sta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var used, other string
+		for name, method := range encryptionMethodNames {
+			if method == info.EncryptionMethod {
+				used = name
+			} else {
+				other = name
+			}
+		}
+
+		sta = makeState(t, map[string]UIDPolicy{b64(cloakClientHelloUID): {EncryptionMethod: used}})
+		_, _, err = AuthFirstPacket(first, TLS{}, sta)
+		assert.NoError(t, err)
+
+		sta = makeState(t, map[string]UIDPolicy{b64(cloakClientHelloUID): {EncryptionMethod: other}})
+		_, _, err = AuthFirstPacket(first, TLS{}, sta)
+		assert.True(t, errors.Is(err, ErrEncryptionMethodNotAllowed), "got %v", err)
+	})
+}
+
+func TestParseUIDOverrides(t *testing.T) {
+	proxyBook := map[string]net.Addr{"shadowsocks": &net.TCPAddr{}}
+	UID := b64(make([]byte, 16))
+	parsed, err := parseUIDOverrides(map[string]UIDPolicy{UID: {ProxyMethod: "Shadowsocks", EncryptionMethod: "AES-GCM"}}, proxyBook)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]UIDPolicy{UID: {ProxyMethod: "shadowsocks", EncryptionMethod: "aes-gcm"}}, parsed)
+
+	for _, overrides := range []map[string]UIDPolicy{
+		{"not base64!": {ProxyMethod: "shadowsocks"}},
+		{UID: {ProxyMethod: "tor"}},
+		{UID: {EncryptionMethod: "rot13"}},
+	} {
+		_, err := parseUIDOverrides(overrides, proxyBook)
+		assert.Error(t, err, "%v", overrides)
+	}
+}
@@ -99,6 +99,22 @@ func (panel *userPanel) TerminateActiveUser(user *ActiveUser, reason string) {
 	panel.activeUsersM.Unlock()
 }
 
+// hasSession checks if the active user of UID has a session of sessionID
+func (panel *userPanel) hasSession(UID []byte, sessionID uint32) bool {
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	panel.activeUsersM.RLock()
+	user, ok := panel.activeUsers[arrUID]
+	panel.activeUsersM.RUnlock()
+	if !ok {
+		return false
+	}
+	user.sessionsM.RLock()
+	_, ok = user.sessions[sessionID]
+	user.sessionsM.RUnlock()
+	return ok
+}
+
 func (panel *userPanel) isActive(UID []byte) bool {
 	var arrUID [16]byte
 	copy(arrUID[:], UID)
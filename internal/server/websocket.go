@@ -12,6 +12,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"time"
 )
 
 type WebSocket struct{}
@@ -20,11 +21,13 @@ func (WebSocket) String() string { return "WebSocket" }
 
 func (WebSocket) processFirstPacket(reqPacket []byte, privateKey crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
 	var req *http.Request
+	start := time.Now()
 	req, err = http.ReadRequest(bufio.NewReader(bytes.NewBuffer(reqPacket)))
 	if err != nil {
 		err = fmt.Errorf("failed to parse first HTTP GET: %v", err)
 		return
 	}
+	parseDuration := time.Since(start)
 	var hiddenData []byte
 	hiddenData, err = base64.StdEncoding.DecodeString(req.Header.Get("hidden"))
 
@@ -34,13 +37,14 @@ func (WebSocket) processFirstPacket(reqPacket []byte, privateKey crypto.PrivateK
 		return
 	}
 
+	fragments.parseDuration = parseDuration
 	respond = WebSocket{}.makeResponder(reqPacket, fragments.sharedSecret)
 
 	return
 }
 
 func (WebSocket) makeResponder(reqPacket []byte, sharedSecret [32]byte) Responder {
-	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
+	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader, _ ReplyComposer) (preparedConn net.Conn, err error) {
 		handler := newWsHandshakeHandler()
 
 		// For an explanation of the following 3 lines, see the comments in websocketAux.go
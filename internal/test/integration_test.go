@@ -382,6 +382,41 @@ retry:
 
 }
 
+func TestTCPServerProfiles(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	profiles := map[string]*server.ServerProfile{
+		"flight lengths":  {CipherSuite: 0x1301, FlightLengths: []int{40, 2600, 264}},
+		"session tickets": {CipherSuite: 0xc030, SessionTickets: true},
+		"await client finished": {
+			CipherSuite:         0xc030,
+			TLS12Flight:         &server.TLS12Flight{CertificateLengths: []int{1300, 1100}, SignatureAlgorithm: 0x0804, SignatureLength: 256},
+			AwaitClientFinished: true,
+		},
+	}
+	for name, profile := range profiles {
+		t.Run(name, func(t *testing.T) {
+			worldState := common.WorldOfTime(time.Unix(10, 0))
+			lcc, rcc, ai := generateClientConfigs(singleplexTCPConfig, worldState)
+			var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+			defer os.Remove(tmpDB.Name())
+			sta := basicServerState(worldState, tmpDB)
+			sta.Profile = profile
+			proxyToCkClientD, proxyFromCkServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go serveTCPEcho(proxyFromCkServerL)
+
+			proxyConn, err := proxyToCkClientD.Dial("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			runEchoTest(t, []net.Conn{proxyConn}, 65536)
+		})
+	}
+}
+
 func TestTCPMultiplex(t *testing.T) {
 	log.SetLevel(log.ErrorLevel)
 	worldState := common.WorldOfTime(time.Unix(10, 0))